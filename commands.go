@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"mxsms/sqlog"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	historyLimit = 10            // messages listed by /history
+	chatTime     = "Jan 2 15:04" // time format of the chat command responses
+)
+
+var commandRE = regexp.MustCompile(`(?s)\A/(\w+)\s*(.*)`) // /command [argument]
+
+// chatHelp lists the chat commands.
+const chatHelp = `<phone> <text> - send the message to the phone
+<phone>,<phone>,@<group> <text> - send the message to each of the phones and group members
+/to <phone> - send the messages without a phone number to the phone; /to alone clears it
+/from <number> - send from the outgoing number; /from alone selects it automatically
+/r <text> - reply to the sender of the last incoming message
+/status - delivery status of the last message sent
+/history <phone> - recent messages with the phone, the /to one if not set
+/help - this help`
+
+// command executes the chat command of the MX user and responds with its
+// result. The session state is kept by the gateway history.
+func (mh *MessageHandle) command(gate *SMSGate, mx *MX, data *incommingMessage, logEntry *logrus.Entry, name, arg string) error {
+	jid := data.From
+	reply := func(format string, items ...interface{}) error {
+		return mh.client.Send(gate.getMessage(jid, "%s", fmt.Sprintf(format, items...)))
+	}
+	session := gate.history.Session(mx.name, jid)
+	logEntry = logEntry.WithField("command", name)
+	if name == "r" { // sent as the message to the phone
+		if session.ReplyTo == "" {
+			gate.Metrics.Handled(mx.name, outcomeNoPhone)
+			return reply("No incoming message to reply to")
+		}
+		if arg == "" {
+			return reply("Usage: /r <text>")
+		}
+		return mh.send(gate, mx, data, logEntry, session.ReplyTo, arg, nil)
+	}
+	gate.Metrics.Handled(mx.name, outcomeCommand)
+	switch name {
+	case "help":
+		return reply(chatHelp)
+	case "to":
+		if arg == "" {
+			gate.history.SetRecipient(mx.name, jid, "")
+			logEntry.Info("Chat recipient cleared")
+			return reply("Recipient cleared: messages must start with a phone number")
+		}
+		number, err := mx.parse(arg)
+		if err != nil {
+			return reply("Invalid phone number: %q", arg)
+		}
+		gate.history.SetRecipient(mx.name, jid, number.String())
+		logEntry.WithField("phone", number.String()).Info("Chat recipient set")
+		return reply("Messages without a phone number will be sent to %s", number)
+	case "from":
+		if arg == "" {
+			gate.history.SetSender(mx.name, jid, "")
+			logEntry.Info("Chat sender cleared")
+			return reply("The outgoing number will be selected automatically")
+		}
+		from := strings.TrimPrefix(arg, "+")
+		if number, err := mx.parse(arg); err == nil && !hasKey(mx.From, from) {
+			from = number.String()
+		}
+		if !hasKey(mx.From, from) {
+			return reply("Unknown outgoing number %q: one of %s expected", arg, strings.Join(sortedKeys(mx.From), ", "))
+		}
+		gate.history.SetSender(mx.name, jid, from)
+		logEntry.WithField("from", from).Info("Chat sender set")
+		return reply("Messages will be sent from %s", from)
+	case "status":
+		last := session.last()
+		if last == nil {
+			return reply("No messages sent")
+		}
+		return reply("Message to %s at %s: %s", last.Phone, last.Time.Format(chatTime), last.Status)
+	case "history":
+		phone := session.To
+		if arg != "" {
+			number, err := mx.parse(arg)
+			if err != nil {
+				return reply("Invalid phone number: %q", arg)
+			}
+			phone = number.String()
+		}
+		if phone == "" {
+			return reply("Usage: /history <phone>")
+		}
+		messages := conversation(session, mx.name, jid, phone)
+		if len(messages) == 0 {
+			return reply("No recent messages with %s", phone)
+		}
+		lines := make([]string, len(messages))
+		for i, msg := range messages {
+			if msg.Incoming {
+				lines[i] = fmt.Sprintf("%s < %s", msg.Time.Format(chatTime), msg.Text)
+			} else {
+				lines[i] = fmt.Sprintf("%s > %s (%s)", msg.Time.Format(chatTime), msg.Text, msg.Status)
+			}
+		}
+		return reply("Messages with %s:\n%s", phone, strings.Join(lines, "\n"))
+	}
+	return reply("Unknown command /%s: send /help for the list", name)
+}
+
+// conversation returns the last messages of the MX user with the phone number,
+// oldest first: from the message log if it's configured, so they survive the
+// restarts, or from the session.
+func conversation(session Session, mxName, jid, phone string) []chatMessage {
+	if sglogDB == nil {
+		return session.conversation(phone, historyLimit)
+	}
+	logged, err := sglogDB.Find(sqlog.Query{Number: phone, JID: jid, MX: mxName, Limit: historyLimit})
+	if err != nil {
+		llog.WithError(err).Error("Message log search error")
+		return session.conversation(phone, historyLimit)
+	}
+	messages := make([]chatMessage, len(logged))
+	for i, msg := range logged { // newest first
+		messages[len(logged)-1-i] = chatMessage{
+			ID:       msg.ID,
+			Incoming: msg.Direction == sqlog.Inbound,
+			Phone:    phone,
+			Text:     msg.Text,
+			Status:   msg.Status,
+			Time:     msg.Created,
+		}
+	}
+	return messages
+}
@@ -0,0 +1,221 @@
+// Package conf reads the gateway configuration written in YAML or JSON. String
+// values may reference the secrets kept outside of the file:
+//
+//	password: ${SMPP_PASSWORD}        the environment variable
+//	password: file:/run/secrets/smpp  the file content without the final newline
+//
+// The variables are replaced anywhere in the value; the file reference must be
+// the whole value.
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration formats.
+const (
+	YAML = "yaml"
+	JSON = "json"
+)
+
+// filePrefix starts the reference to the file with the value.
+const filePrefix = "file:"
+
+// envVar matches the reference to the environment variable.
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Format returns the format of the configuration file by the name extension or,
+// if it's unknown, by the content: JSON starts with a brace.
+func Format(name string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return YAML
+	case ".json":
+		return JSON
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return JSON
+	}
+	return YAML
+}
+
+// Unmarshal decodes the configuration in the format into the value, expanding
+// the references in the string values.
+func Unmarshal(format string, data []byte, v interface{}) error {
+	switch format {
+	case YAML:
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return err
+		}
+		if err := expandNode(&node, ""); err != nil {
+			return err
+		}
+		if node.Kind == 0 { // empty document
+			return nil
+		}
+		return node.Decode(v)
+	case JSON:
+		var doc interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber() // as written
+		if err := decoder.Decode(&doc); err != nil {
+			return err
+		}
+		doc, err := expandJSON(doc, "")
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	}
+	return fmt.Errorf("unknown configuration format %q", format)
+}
+
+// Marshal encodes the configuration in the format.
+func Marshal(format string, v interface{}) ([]byte, error) {
+	switch format {
+	case YAML:
+		return yaml.Marshal(v)
+	case JSON:
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return nil, fmt.Errorf("unknown configuration format %q", format)
+}
+
+// Expand returns the value with the environment variables replaced, or the
+// content of the referenced file.
+func Expand(value string) (string, error) {
+	if strings.HasPrefix(value, filePrefix) {
+		name := strings.TrimPrefix(value, filePrefix)
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	var err error
+	value = envVar.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envVar.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+	return value, err
+}
+
+// expandNode expands the string values of the YAML node. The tag of the
+// expanded plain value is resolved again, so numbers can be referenced too.
+func expandNode(node *yaml.Node, path string) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPath := path
+			if node.Kind == yaml.SequenceNode {
+				childPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+			if err := expandNode(child, childPath); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := expandNode(node.Content[i+1], joinPath(path, node.Content[i].Value)); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if node.ShortTag() != "!!str" {
+			return nil
+		}
+		value, err := Expand(node.Value)
+		if err != nil {
+			return fmt.Errorf("%s: line %d: %w", path, node.Line, err)
+		}
+		if value != node.Value {
+			node.Value = value
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+	return nil
+}
+
+// expandJSON expands the string values of the decoded JSON document.
+func expandJSON(doc interface{}, path string) (interface{}, error) {
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range doc {
+			expanded, err := expandJSON(value, joinPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			doc[key] = expanded
+		}
+	case []interface{}:
+		for i, value := range doc {
+			expanded, err := expandJSON(value, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			doc[i] = expanded
+		}
+	case string:
+		value, err := Expand(doc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return value, nil
+	}
+	return doc, nil
+}
+
+// joinPath returns the path of the key in the mapping.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Duration is the time.Duration written as a string, such as "30s" or "1h30m".
+type Duration time.Duration
+
+// String returns the duration as a string.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface. The empty
+// string is zero.
+func (d *Duration) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = 0
+		return nil
+	}
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
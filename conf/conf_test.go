@@ -0,0 +1,79 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig is the configuration decoded in the tests.
+type testConfig struct {
+	Server struct {
+		Host  string   `yaml:"host" json:"host"`
+		Port  int      `yaml:"port" json:"port"`
+		Delay Duration `yaml:"delay,omitempty" json:"delay,omitempty"`
+	} `yaml:"server" json:"server"`
+	Password string   `yaml:"password" json:"password"`
+	Keys     []string `yaml:"keys" json:"keys"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MXSMS_HOST", "10.0.0.1")
+	t.Setenv("MXSMS_PORT", "2775")
+	for _, test := range []struct {
+		name string
+		data string
+	}{
+		{"config.yaml", "server:\n  host: ${MXSMS_HOST}\n  port: ${MXSMS_PORT}\n  delay: 1m30s\n" +
+			"password: file:" + secret + "\nkeys: [\"a-${MXSMS_PORT}\"]\n"},
+		{"config", `{"server": {"host": "${MXSMS_HOST}", "port": 2775, "delay": "1m30s"},
+			"password": "file:` + secret + `", "keys": ["a-${MXSMS_PORT}"]}`},
+	} {
+		var config testConfig
+		if err := Unmarshal(Format(test.name, []byte(test.data)), []byte(test.data), &config); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if config.Server.Host != "10.0.0.1" || config.Server.Port != 2775 || config.Password != "s3cret" ||
+			config.Server.Delay != Duration(time.Second*90) || len(config.Keys) != 1 || config.Keys[0] != "a-2775" {
+			t.Errorf("%s: %+v", test.name, config)
+		}
+		// round trip
+		format := Format(test.name, []byte(test.data))
+		data, err := Marshal(format, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded testConfig
+		if err := Unmarshal(format, data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Server != config.Server || decoded.Password != config.Password {
+			t.Errorf("%s round trip: %+v", test.name, decoded)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var config testConfig
+	for data, want := range map[string]string{
+		"password: ${MXSMS_UNSET}\n":       "password: line 1: environment variable MXSMS_UNSET is not set",
+		"password: file:/nonexistent\n":    "password: line 1: open /nonexistent",
+		`{"keys": ["${MXSMS_UNSET}"]}`:     "keys[0]: environment variable MXSMS_UNSET is not set",
+		"server:\n  delay: 30\n":           "time: missing unit in duration",
+		`{"server": {"delay": "forever"}}`: "invalid duration",
+	} {
+		err := Unmarshal(Format("", []byte(data)), []byte(data), &config)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: %v", data, err)
+		}
+	}
+	if value, err := Expand("pa$$word"); err != nil || value != "pa$$word" {
+		t.Errorf("expanded %q: %v", value, err)
+	}
+}
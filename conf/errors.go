@@ -0,0 +1,48 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError describes the invalid configuration value.
+type FieldError struct {
+	Path string // path of the value, such as smsgate.smpp.address[0]
+	Err  error
+}
+
+func (e *FieldError) Error() string { return e.Path + ": " + e.Err.Error() }
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// Errors collects the errors of the configuration validation, so all of them
+// are reported at once.
+type Errors []*FieldError
+
+// Add adds the error of the value, if any.
+func (e *Errors) Add(path string, err error) {
+	if err != nil {
+		*e = append(*e, &FieldError{Path: path, Err: err})
+	}
+}
+
+// Addf adds the error of the value with the formatted message.
+func (e *Errors) Addf(path, format string, args ...interface{}) {
+	e.Add(path, fmt.Errorf(format, args...))
+}
+
+// Error returns the errors one per line.
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Err returns the errors or nil if there are none.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
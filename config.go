@@ -1,25 +1,52 @@
 package main
 
 import (
-	"encoding/json"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
-	"net"
+	"mxsms/conf"
+	"mxsms/supervisor"
+	"sync"
 	"time"
 )
 
 type Config struct {
-	MX      map[string]*MX `json:"mx,omitempty"`      // MX servers
-	SMSGate *SMSGate       `json:"smsgate,omitempty"` // SMS handling settings
+	MX      map[string]*MX `yaml:"mx,omitempty" json:"mx,omitempty"`           // MX servers
+	SMSGate *SMSGate       `yaml:"smsgate,omitempty" json:"smsgate,omitempty"` // SMS handling settings
+
+	mu sync.RWMutex // guards MX replaced by the reload
 }
 
-// ParseConfig parses the configuration and initializes initial values.
+// ParseConfig parses the configuration in YAML or JSON, detected by the
+// content, and initializes initial values.
 func ParseConfig(data []byte) (*Config, error) {
-	config := new(Config)
-	err := json.Unmarshal(data, config)
+	return parseConfig(conf.Format("", data), data)
+}
+
+// LoadConfig loads, parses and validates the configuration from a file. The
+// format is selected by the file extension: .yaml, .yml or .json, or detected
+// by the content.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	config, err := parseConfig(conf.Format(filename, data), data)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// parseConfig parses the configuration in the format and initializes initial
+// values. The ${ENV} and file: references in the values are expanded.
+func parseConfig(format string, data []byte) (*Config, error) {
+	config := new(Config)
+	if err := conf.Unmarshal(format, data, config); err != nil {
+		return nil, err
+	}
 	for name, mx := range config.MX {
 		if mx.Disabled {
 			delete(config.MX, name) // immediately remove blocked MX servers
@@ -27,56 +54,106 @@ func ParseConfig(data []byte) (*Config, error) {
 		}
 		mx.name = name                                            // save the server configuration name
 		mx.Logger = logrus.StandardLogger().WithField("mx", name) // assign log handler
+		mx.conn = new(mxConn)
 	}
 	return config, nil
 }
 
-// LoadConfig loads and parses the configuration from a file.
-func LoadConfig(filename string) (*Config, error) {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, err
+// MXConnect starts the connections to the MX servers. They are reconnected by
+// the supervisors with the reconnect settings of the gateway.
+func (c *Config) MXConnect() {
+	for _, mx := range c.MX {
+		c.mxConnect(mx)
 	}
-	return ParseConfig(data)
 }
 
-func (c *Config) MXConnect() {
-	for _, mx := range c.MX {
-		go func(mx *MX) {
-			maxErrors := MaxErrors // set the maximum number of allowable errors
-			if mx.Addr.MaxError > 0 {
-				maxErrors = mx.Addr.MaxError
-			}
-			var lastErrorTime time.Time      // time when the last temporary error occurred
-			for i := 0; i < maxErrors; i++ { // restart the service automatically in case of connection errors
-				err := mx.Connect() // establish connection with the server
-				//zabbixLog.Send("mx.sms.link.lost", mx.name)
-				switch err := err.(type) { // check the error type
-				// case *csta.ErrorCode, *csta.LoginResponse, syscall.Errno:
-				case *net.OpError:
-					if !(err.Temporary() || err.Timeout()) {
-						break // this is not a temporary error
-					}
-					if time.Since(lastErrorTime) > time.Minute*30 {
-						i = 0 // reset error counter if they were long ago
-					}
-					reconnectDelay, _ := time.ParseDuration(mx.Addr.ReconnectDelay)
-					time.Sleep(reconnectDelay) // delay before next attempt
-					lastErrorTime = time.Now() // remember error time
-					continue                   // non-critical errors - re-establish connection
-				case nil:
-					return // planned service stop
-				}
-				break
-			}
-			mx.Logger.Warning("MX connection stopped")
-			return // service stop
-		}(mx) // isolate the service as a parameter, otherwise only the last one will be launched
+// mxConnect starts the connection to the MX server.
+func (c *Config) mxConnect(mx *MX) {
+	var alert func(supervisor.Alert)
+	if c.SMSGate != nil {
+		alert = c.SMSGate.alert
 	}
+	mx.conn.supervisor = &supervisor.Supervisor{
+		Name:   "mx/" + mx.name,
+		Policy: c.mxPolicy(mx),
+		State:  &mx.conn.state,
+		Logger: mx.Logger,
+		Alert:  alert,
+	}
+	go mx.conn.supervisor.Run(mx.Connect)
+}
+
+// mxPolicy returns the reconnect policy of the MX server.
+func (c *Config) mxPolicy(mx *MX) supervisor.Policy {
+	var reconnect *supervisor.Config
+	if c.SMSGate != nil {
+		reconnect = c.SMSGate.reconnect()
+	}
+	delay, _ := time.ParseDuration(mx.Addr.ReconnectDelay)
+	return reconnect.Policy(delay, mx.Addr.MaxError)
 }
 
 func (c *Config) MXClose() {
-	for _, mx := range c.MX { // stop all running connections to MX
+	for _, mx := range c.servers() { // stop all running connections to MX
 		mx.Close()
 	}
 }
+
+// servers returns the MX servers by name. The map is replaced by the reload,
+// not changed.
+func (c *Config) servers() map[string]*MX {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.MX
+}
+
+// server returns the settings of the MX server or nil if there is no such one.
+func (c *Config) server(name string) *MX {
+	return c.servers()[name]
+}
+
+// Reload applies the reloaded configuration to the running gateway. Only the MX
+// servers and SMPP links with the changed connection settings are reconnected;
+// the templates, the phone settings and the carriers are replaced in place, and
+// the history and the queued messages are kept. It returns false if other
+// gateway settings are changed and the gateway must be restarted.
+func (c *Config) Reload(next *Config) bool {
+	if !c.SMSGate.reload(next.SMSGate) {
+		return false
+	}
+	servers := make(map[string]*MX, len(next.MX))
+	var closed, started []*MX
+	for name, mx := range next.MX {
+		servers[name] = mx
+		running := c.MX[name]
+		switch {
+		case running == nil:
+			started = append(started, mx)
+		case running.sameConnection(mx):
+			mx.conn = running.conn // only the phone settings are changed
+			mx.conn.supervisor.SetPolicy(c.mxPolicy(mx))
+		default:
+			closed, started = append(closed, running), append(started, mx)
+		}
+	}
+	for name, mx := range c.MX {
+		if servers[name] == nil {
+			closed = append(closed, mx)
+		}
+	}
+	c.mu.Lock()
+	c.MX = servers
+	c.mu.Unlock()
+	for _, mx := range closed {
+		mx.Close()
+	}
+	for _, mx := range started {
+		c.mxConnect(mx)
+	}
+	llog.WithFields(logrus.Fields{
+		"mx":      len(servers),
+		"closed":  len(closed),
+		"started": len(started),
+	}).Info("Config reloaded")
+	return true
+}
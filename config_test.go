@@ -1,11 +1,11 @@
 package main
 
 import (
-	"fmt"
-	"gopkg.in/yaml.v3"
-	"io/ioutil"
+	"bytes"
+	"mxsms/conf"
 	"mxsms/csta_old"
 	"mxsms/sms"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,8 +21,8 @@ func TestConfigGenerate(t *testing.T) {
 					Port:           7778,
 					Secure:         true,
 					SkipVerify:     true,
-					Timeout:        time.Second * 20,
-					ReconnectDelay: time.Second * 30,
+					Timeout:        "20s",
+					ReconnectDelay: "30s",
 					MaxError:       5,
 				},
 				Login: csta_old.Login{
@@ -33,6 +33,7 @@ func TestConfigGenerate(t *testing.T) {
 					Short:  0,
 					Prefix: "1",
 					From:   map[string]string{"14086751455": "twilio", "14086751475": "twilio"},
+					Pool:   NumberPool{Sticky: conf.Duration(time.Hour * 168)},
 				},
 				DefaultJID: "44086340573989457",
 			},
@@ -43,8 +44,8 @@ func TestConfigGenerate(t *testing.T) {
 				SystemID:        "Zultys",
 				Password:        "unmQF932",
 				MaxParts:        8,
-				EnquireDuration: time.Second * 30,
-				ReconnectDelay:  time.Second * 30,
+				EnquireDuration: conf.Duration(time.Second * 30),
+				ReconnectDelay:  conf.Duration(time.Second * 30),
 				MaxError:        5,
 			},
 			Responses: SMSTemplates{
@@ -57,21 +58,114 @@ func TestConfigGenerate(t *testing.T) {
 			},
 		},
 	}
-	data, err := yaml.Marshal(config)
+	for _, format := range []string{conf.YAML, conf.JSON} {
+		data, err := conf.Marshal(format, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseConfig(data)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", format, err, data)
+		}
+		if smpp := parsed.SMSGate.SMPP; smpp.EnquireDuration != conf.Duration(time.Second*30) || smpp.SystemID != "Zultys" {
+			t.Errorf("%s: %# v", format, pretty.Formatter(smpp))
+		}
+		if mx := parsed.MX["xyzrd-test"]; mx == nil || mx.name != "xyzrd-test" || mx.Prefix != "1" || len(mx.From) != 2 {
+			t.Errorf("%s: %# v", format, pretty.Formatter(mx))
+		}
+		again, err := conf.Marshal(format, parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, again) {
+			t.Errorf("%s round trip:\n%s\n%s", format, data, again)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	for _, name := range []string{"config.yaml", "config.json"} {
+		config, err := LoadConfig(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(config.MX) == 0 || config.SMSGate == nil || config.SMSGate.SMPP == nil ||
+			config.SMSGate.SMPP.ReconnectDelay != conf.Duration(time.Second*30) {
+			t.Errorf("%s: %# v", name, pretty.Formatter(config))
+		}
+	}
+}
+
+func TestConfigSecrets(t *testing.T) {
+	t.Setenv("MXSMS_SMPP_PASSWORD", "s3cret")
+	config, err := ParseConfig([]byte("smsgate:\n  smpp:\n    systemId: gw\n    password: ${MXSMS_SMPP_PASSWORD}\n"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Println(string(data))
-	err = ioutil.WriteFile("config.yaml", data, 0666)
+	if config.SMSGate.SMPP.Password != "s3cret" {
+		t.Errorf("password %q", config.SMSGate.SMPP.Password)
+	}
+	if _, err := ParseConfig([]byte(`{"smsgate": {"smpp": {"password": "${MXSMS_UNSET}"}}}`)); err == nil {
+		t.Error("unset variable accepted")
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	const data = `mx:
+  kept:
+    server: {host: 127.0.0.1, port: 1}
+    phones: {from: {"14085550001": ""}}
+  moved:
+    server: {host: 127.0.0.1, port: 2}
+    phones: {from: {"14085550002": ""}}
+  removed:
+    server: {host: 127.0.0.1, port: 3}
+    phones: {from: {"14085550003": ""}}
+smsgate:
+  smpp: {systemId: gw}
+  messageTemplates: {accepted: "sent to %s"}
+`
+	running, err := ParseConfig([]byte(data))
 	if err != nil {
 		t.Fatal(err)
 	}
-}
+	running.MXConnect()
+	running.SMSGate.Connect()
+	defer running.SMSGate.Close()
+	defer running.MXClose()
+	kept, moved := running.server("kept").conn, running.server("moved").conn
 
-func TestConfigFile(t *testing.T) {
-	config, err := LoadConfig("config.yaml")
+	next, err := ParseConfig([]byte(strings.NewReplacer(
+		`"14085550001": ""`, `"14085550001": "", "14085550004": ""`,
+		"port: 2", "port: 4",
+		"removed:", "added:",
+		"sent to", "accepted by",
+	).Replace(data)))
 	if err != nil {
 		t.Fatal(err)
 	}
-	pretty.Println(config)
+	if !running.Reload(next) {
+		t.Fatal("restart required")
+	}
+	if mx := running.server("kept"); mx.conn != kept || len(mx.From) != 2 {
+		t.Errorf("kept server %# v", pretty.Formatter(mx))
+	}
+	if mx := running.server("moved"); mx.conn == moved || mx.Port != 4 {
+		t.Errorf("moved server not restarted")
+	}
+	if running.server("removed") != nil || running.server("added") == nil {
+		t.Errorf("servers %v", sortedKeys(running.servers()))
+	}
+	if accepted := running.SMSGate.templates().Accepted; accepted != "accepted by %s" {
+		t.Errorf("template %q", accepted)
+	}
+
+	// the settings of the running services require the restart
+	restart, err := ParseConfig([]byte(data + "  mySqlLog: sqlite:///tmp/mxsms.db\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running.Reload(restart) || running.server("added") == nil {
+		t.Error("reloaded in place")
+	}
 }
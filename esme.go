@@ -0,0 +1,189 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"mxsms/smpp"
+	"mxsms/sms"
+)
+
+const receiptTTL = time.Hour * 72 // how long to wait for carrier receipts
+
+// finalStates lists the receipt states after which the message state doesn't change.
+var finalStates = map[string]bool{
+	"DELIVRD": true,
+	"EXPIRED": true,
+	"DELETED": true,
+	"UNDELIV": true,
+	"UNKNOWN": true,
+	"REJECTD": true,
+}
+
+// receipt tracks the delivery of a message submitted by an ESME client, so the
+// carrier receipts can be relayed back to it.
+type receipt struct {
+	msg       *sms.Submitted // submitted message
+	parts     int            // number of parts sent to the carrier
+	responses int            // number of received submit responses
+	final     int            // number of parts in a final state
+	status    sms.Status     // status to relay, the first failure wins
+	relayed   bool           // the receipt was already sent to the client
+	created   time.Time
+}
+
+// submitting passes messages from ESME clients to the sending pipeline.
+func (s *SMSGate) submitting() {
+	server := s.Server.SMPP()
+	for {
+		select {
+		case msg := <-s.Server.Receive:
+			s.Submit(msg)
+		case <-server.Done():
+			return
+		}
+	}
+}
+
+// Submit sends a message submitted by an ESME client through the same path
+// as messages from MX users. The source address must be one of the configured
+// outgoing phone numbers.
+func (s *SMSGate) Submit(msg sms.Submitted) {
+	logEntry := llog.WithFields(logrus.Fields{
+		"client": msg.Client,
+		"from":   msg.From,
+		"to":     msg.To,
+	})
+	mxName := mxByPhone(msg.From)
+	if mxName == "" {
+		logEntry.Warning("SMS submit ignore: unknown source number")
+		s.relayReceipt(&msg, sms.Status{Stat: "REJECTD", Err: int(smpp.ESME_RINVSRCADR)})
+		return
+	}
+	smsMessage := &sms.SendMessage{
+		MXName: mxName,
+		From:   msg.From,
+		To:     msg.To,
+		Text:   msg.Text,
+		Origin: &msg,
+	}
+	if err := s.send(smsMessage, 0); err != nil {
+		logEntry.WithError(err).Error("SMS submit error")
+		s.relayReceipt(&msg, sms.Status{Stat: "UNDELIV", Err: int(smpp.ESME_RSUBMITFAIL)})
+		return
+	}
+	logEntry.WithField("mx", mxName).Info("SMS submit")
+}
+
+// sendResponse links the message id assigned by the SMPP server to the receipt
+// of the ESME message the part belongs to.
+func (s *SMSGate) sendResponse(resp sms.SendResponse) {
+	if resp.Message == nil || resp.Message.Origin == nil || !resp.Message.Origin.Receipt {
+		return // not an ESME message or no receipt requested
+	}
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	if s.receipts == nil {
+		s.receipts = make(map[string]*receipt)
+		s.pending = make(map[*sms.SendMessage]*receipt)
+	}
+	s.purgeReceipts()
+	r := s.pending[resp.Message]
+	if r == nil {
+		r = &receipt{
+			msg:     resp.Message.Origin,
+			parts:   len(resp.Message.Seq),
+			created: time.Now(),
+		}
+		s.pending[resp.Message] = r
+	}
+	if r.responses++; r.responses >= r.parts {
+		delete(s.pending, resp.Message) // all parts are known
+	}
+	if resp.Status != smpp.ESME_ROK { // the part was rejected by the SMPP server
+		r.update(sms.Status{Stat: "REJECTD", Err: int(resp.Status)})
+	} else {
+		s.receipts[resp.ID] = r
+	}
+	if r.done() {
+		go s.relayReceipt(r.msg, r.status)
+	}
+}
+
+// status relays carrier receipts for ESME messages.
+func (s *SMSGate) status(status sms.Status) {
+	if !finalStates[status.Stat] {
+		return // wait for the final state
+	}
+	s.receiptsMu.Lock()
+	r := s.receipts[status.ID]
+	if r == nil {
+		s.receiptsMu.Unlock()
+		return // not an ESME message
+	}
+	delete(s.receipts, status.ID)
+	r.update(status)
+	done := r.done()
+	s.receiptsMu.Unlock()
+	if done {
+		s.relayReceipt(r.msg, r.status)
+	}
+}
+
+// update accounts a part in a final state.
+func (r *receipt) update(status sms.Status) {
+	r.final++
+	if r.status.Stat == "" || (r.status.Stat == "DELIVRD" && status.Stat != "DELIVRD") {
+		r.status = status
+	}
+	if status.Stat == "DELIVRD" {
+		r.status.Dlvrd = 1
+	}
+}
+
+// done reports whether the receipt should be relayed now. It is relayed once,
+// after all parts reached a final state.
+func (r *receipt) done() bool {
+	if r.relayed || r.responses < r.parts || r.final < r.parts {
+		return false
+	}
+	r.relayed = true
+	return true
+}
+
+// purgeReceipts removes receipts the carrier never confirmed. It must be called
+// with the lock held.
+func (s *SMSGate) purgeReceipts() {
+	if time.Since(s.purged) < time.Minute {
+		return
+	}
+	s.purged = time.Now()
+	for id, r := range s.receipts {
+		if time.Since(r.created) > receiptTTL {
+			delete(s.receipts, id)
+		}
+	}
+	for msg, r := range s.pending {
+		if time.Since(r.created) > receiptTTL {
+			delete(s.pending, msg)
+		}
+	}
+	for id, sent := range s.sent {
+		if time.Since(sent.created) > receiptTTL {
+			delete(s.sent, id)
+		}
+	}
+}
+
+// relayReceipt sends the delivery receipt to the ESME client if it requested one.
+func (s *SMSGate) relayReceipt(msg *sms.Submitted, status sms.Status) {
+	if !msg.Receipt || s.Server == nil {
+		return
+	}
+	if status.Stat == "DELIVRD" {
+		status.Dlvrd = 1
+	}
+	if err := s.Server.SendReceipt(*msg, status); err != nil {
+		llog.WithError(err).WithField("client", msg.Client).Error("SMS receipt error")
+	}
+}
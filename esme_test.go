@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"mxsms/sms"
+)
+
+func TestReceipt(t *testing.T) {
+	r := &receipt{msg: &sms.Submitted{Receipt: true}, parts: 2, responses: 2}
+	r.update(sms.Status{Stat: "DELIVRD"})
+	if r.done() {
+		t.Fatal("relayed before all parts are final")
+	}
+	r.update(sms.Status{Stat: "UNDELIV", Err: 1})
+	if !r.done() {
+		t.Fatal("not relayed after all parts are final")
+	}
+	if r.status.Stat != "UNDELIV" {
+		t.Errorf("status %q, the failure should win", r.status.Stat)
+	}
+	if r.done() {
+		t.Error("relayed twice")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"mxsms/smpp"
+	"mxsms/sms"
+	"mxsms/supervisor"
+)
+
+// sentMessage links the message id assigned by the SMPP server to the sent
+// message, so delivery receipts can be published with the phone numbers.
+type sentMessage struct {
+	msg     *sms.SendMessage
+	created time.Time
+}
+
+// receivedEvent describes the data of the incoming message event.
+type receivedEvent struct {
+	From  string      `json:"from"`
+	To    string      `json:"to"`
+	Text  string      `json:"text"`
+	Media []sms.Media `json:"media,omitempty"` // MMS attachments
+}
+
+// statusEvent describes the data of the delivery receipt event.
+type statusEvent struct {
+	ID     string    `json:"id"` // message identifier assigned by the SMPP server
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Stat   string    `json:"stat"` // message state from the receipt
+	Err    int       `json:"err,omitempty"`
+	Submit time.Time `json:"submit,omitempty"`
+	Done   time.Time `json:"done,omitempty"`
+}
+
+// trackSent remembers the sent message the SMPP server response belongs to.
+func (s *SMSGate) trackSent(resp sms.SendResponse) {
+	if s.Webhooks == nil || resp.Message == nil || resp.Status != smpp.ESME_ROK {
+		return
+	}
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	if s.sent == nil {
+		s.sent = make(map[string]sentMessage)
+	}
+	s.purgeReceipts()
+	s.sent[resp.ID] = sentMessage{msg: resp.Message, created: time.Now()}
+}
+
+// publishReceived publishes the incoming message event.
+func (s *SMSGate) publishReceived(msg sms.Received) {
+	s.Webhooks.Publish(sms.EventReceived, msg.To, mxByPhone(msg.To),
+		receivedEvent{From: msg.From, To: msg.To, Text: msg.Text, Media: msg.Media})
+}
+
+// publishStatus publishes the delivery receipt event for a message sent by the
+// gateway. Receipts for unknown messages are ignored.
+func (s *SMSGate) publishStatus(status sms.Status) {
+	if s.Webhooks == nil {
+		return
+	}
+	s.receiptsMu.Lock()
+	sent, ok := s.sent[status.ID]
+	if ok && finalStates[status.Stat] {
+		delete(s.sent, status.ID)
+	}
+	s.receiptsMu.Unlock()
+	if !ok {
+		return
+	}
+	s.Webhooks.Publish(sms.EventStatus, sent.msg.From, sent.msg.MXName, statusEvent{
+		ID:     status.ID,
+		From:   sent.msg.From,
+		To:     sent.msg.To,
+		Stat:   status.Stat,
+		Err:    status.Err,
+		Submit: status.Submit,
+		Done:   status.Done,
+	})
+}
+
+// publishLink publishes the SMPP connection state change.
+func (s *SMSGate) publishLink(link sms.Link) {
+	event := sms.EventLinkDown
+	if link.Up {
+		event = sms.EventLinkUp
+	}
+	s.Webhooks.Publish(event, "", "", link)
+}
+
+// alert reports the circuit breaker change of the MX or SMPP connection: it's
+// logged, published to the webhooks and sent to Zabbix as the breaker state.
+func (s *SMSGate) alert(a supervisor.Alert) {
+	logEntry := llog.WithFields(logrus.Fields{
+		"connection": a.Name,
+		"breaker":    a.Breaker,
+		"failures":   a.Failures,
+	})
+	if a.Breaker == supervisor.Open {
+		logEntry.WithField("auth", a.Auth).Error("Connection alert: " + a.Error)
+	} else {
+		logEntry.Info("Connection alert cleared")
+	}
+	s.Webhooks.Publish(sms.EventAlert, "", "", a)
+	s.Zabbix.Set(fmt.Sprintf("sms.breaker[%s]", a.Name), a.Breaker)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"mxsms/health"
+)
+
+// HealthConfig describes the health check endpoints: GET /healthz and
+// GET /readyz. They are served on the own address or, if it's not set, with the
+// metrics.
+type HealthConfig struct {
+	Address string        `yaml:"address,omitempty" json:"address,omitempty"` // address and port to listen on
+	Ready   health.Policy `yaml:"ready,omitempty" json:"ready,omitempty"`     // connections required for readiness
+
+	server *http.Server
+}
+
+// Start starts serving the health checks on the own address.
+func (h *HealthConfig) Start(handler http.Handler) error {
+	if !health.ValidPolicy(h.Ready.SMPP) || !health.ValidPolicy(h.Ready.MX) {
+		return errors.New("unknown readiness policy: use any, all or none")
+	}
+	listener, err := net.Listen("tcp", h.Address)
+	if err != nil {
+		return err
+	}
+	h.server = &http.Server{Handler: handler, ReadHeaderTimeout: time.Second * 10}
+	go func() {
+		if err := h.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			llog.WithError(err).Error("Health server error")
+		}
+	}()
+	llog.WithField("address", listener.Addr().String()).Info("Health server started")
+	return nil
+}
+
+// Close stops serving the health checks.
+func (h *HealthConfig) Close() error {
+	if h == nil || h.server == nil {
+		return nil
+	}
+	return h.server.Close()
+}
+
+// healthReport returns the state of the MX and SMPP connections checked with
+// the readiness policy.
+func (s *SMSGate) healthReport() health.Report {
+	report := health.Report{
+		MX:    make(map[string]health.Status, len(config.servers())),
+		Links: s.SMPP.LinkStates(),
+	}
+	for name, mx := range config.servers() {
+		report.MX[name] = mx.conn.state.Status()
+	}
+	var policy health.Policy
+	if s.Health != nil {
+		policy = s.Health.Ready
+	}
+	policy.Check(&report)
+	return report
+}
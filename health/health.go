@@ -0,0 +1,219 @@
+// Package health tracks the state of the gateway connections and serves the
+// liveness and readiness checks for orchestrators:
+//
+//	GET /healthz  200 while the process is serving, with the connection states
+//	GET /readyz   200 if the readiness policy is met, 503 otherwise
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Connection states.
+const (
+	Connecting = "connecting" // connecting, binding or logging in
+	Up         = "up"         // bound or logged in
+	Down       = "down"       // lost, reconnecting after the delay
+	Stopped    = "stopped"    // stopped after the errors or closed
+)
+
+// Report statuses.
+const (
+	StatusOK       = "ok"       // all connections are up
+	StatusDegraded = "degraded" // some connections are not up
+)
+
+// Readiness policies: the connections that must be up.
+const (
+	RequireAny  = "any"  // at least one, the default
+	RequireAll  = "all"  // every configured one
+	RequireNone = "none" // not required
+)
+
+// State tracks the state of a connection. It's safe for concurrent use; the
+// nil State ignores the changes.
+type State struct {
+	state     string
+	since     time.Time // time of the last state change
+	upSince   time.Time
+	lastError error
+	errorTime time.Time
+	keepalive time.Time // last keepalive response
+	mu        sync.Mutex
+}
+
+// Set changes the state. The error, if any, is remembered as the last error;
+// it's kept after the connection is restored.
+func (s *State) Set(state string, err error) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.lastError, s.errorTime = err, now
+	}
+	if state == s.state {
+		return
+	}
+	s.state, s.since = state, now
+	if state == Up {
+		s.upSince = now
+	}
+	s.keepalive = time.Time{}
+}
+
+// Keepalive remembers the time of the keepalive response, such as
+// enquire_link_resp.
+func (s *State) Keepalive() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.keepalive = time.Now()
+	s.mu.Unlock()
+}
+
+// Status returns the current state.
+func (s *State) Status() Status {
+	status := Status{State: Down}
+	if s == nil {
+		return status
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != "" {
+		status.State, status.Since = s.state, timeRef(s.since)
+	}
+	if s.state == Up {
+		status.UpSince = timeRef(s.upSince)
+		status.Keepalive = timeRef(s.keepalive)
+	}
+	if s.lastError != nil {
+		status.LastError, status.ErrorTime = s.lastError.Error(), timeRef(s.errorTime)
+	}
+	return status
+}
+
+// timeRef returns the pointer to the time, nil for the zero time.
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Status describes the state of a connection. For SMPP links UpSince is the
+// bind time and Keepalive the last enquire_link_resp; for MX servers UpSince is
+// the login time.
+type Status struct {
+	State     string     `json:"state"`
+	Since     *time.Time `json:"since,omitempty"`     // time of the last state change
+	UpSince   *time.Time `json:"upSince,omitempty"`   // while up
+	Keepalive *time.Time `json:"keepalive,omitempty"` // last keepalive response while up
+	LastError string     `json:"lastError,omitempty"`
+	ErrorTime *time.Time `json:"errorTime,omitempty"`
+}
+
+// Link describes the state of the link to the SMPP server.
+type Link struct {
+	Address string `json:"address"`        // address and port of the SMPP server
+	Name    string `json:"name,omitempty"` // link name used in the metrics
+	Status
+}
+
+// Report describes the state of the gateway connections.
+type Report struct {
+	Status  string            `json:"status"`            // ok or degraded
+	Ready   bool              `json:"ready"`             // the readiness policy is met
+	Reasons []string          `json:"reasons,omitempty"` // why the gateway is not ready
+	MX      map[string]Status `json:"mx"`                // MX servers by name
+	Links   []Link            `json:"links"`             // SMPP links
+}
+
+// Policy describes which connections must be up for the gateway to be ready:
+// any (the default), all or none of them.
+type Policy struct {
+	SMPP string `yaml:"smpp,omitempty" json:"smpp,omitempty"` // bound SMPP links
+	MX   string `yaml:"mx,omitempty" json:"mx,omitempty"`     // logged in MX servers
+}
+
+// Check sets the status, readiness and reasons of the report.
+func (p Policy) Check(r *Report) {
+	var linksUp, mxUp int
+	for _, link := range r.Links {
+		if link.State == Up {
+			linksUp++
+		}
+	}
+	for _, status := range r.MX {
+		if status.State == Up {
+			mxUp++
+		}
+	}
+	r.Status = StatusOK
+	if linksUp < len(r.Links) || mxUp < len(r.MX) {
+		r.Status = StatusDegraded
+	}
+	r.Reasons = nil
+	if !requires(p.SMPP, linksUp, len(r.Links)) {
+		r.Reasons = append(r.Reasons, fmt.Sprintf("%d of %d SMPP links bound", linksUp, len(r.Links)))
+	}
+	if !requires(p.MX, mxUp, len(r.MX)) {
+		r.Reasons = append(r.Reasons, fmt.Sprintf("%d of %d MX servers logged in", mxUp, len(r.MX)))
+	}
+	r.Ready = len(r.Reasons) == 0
+}
+
+// requires reports whether the number of up connections meets the policy.
+// Nothing is required if none is configured.
+func requires(policy string, up, total int) bool {
+	switch {
+	case total == 0 || policy == RequireNone:
+		return true
+	case policy == RequireAll:
+		return up == total
+	default:
+		return up > 0
+	}
+}
+
+// ValidPolicy reports whether the policy name is known; empty means any.
+func ValidPolicy(policy string) bool {
+	switch policy {
+	case "", RequireAny, RequireAll, RequireNone:
+		return true
+	}
+	return false
+}
+
+// Handler serves /healthz and /readyz with the report returned by the function.
+func Handler(report func() Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rep := report()
+		code := http.StatusOK
+		switch r.URL.Path {
+		case "/healthz":
+		case "/readyz":
+			if !rep.Ready {
+				code = http.StatusServiceUnavailable
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(rep)
+	})
+}
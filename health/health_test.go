@@ -0,0 +1,103 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	var state State
+	if status := state.Status(); status.State != Down || status.Since != nil {
+		t.Errorf("initial status %+v", status)
+	}
+	state.Set(Connecting, nil)
+	state.Set(Down, errors.New("connection refused"))
+	state.Set(Up, nil)
+	state.Keepalive()
+	status := state.Status()
+	if status.State != Up || status.UpSince == nil || status.Keepalive == nil ||
+		status.LastError != "connection refused" || status.ErrorTime == nil {
+		t.Errorf("up status %+v", status)
+	}
+	state.Set(Stopped, nil)
+	if status := state.Status(); status.State != Stopped || status.UpSince != nil || status.Keepalive != nil ||
+		status.LastError != "connection refused" {
+		t.Errorf("stopped status %+v", status)
+	}
+	var nilState *State
+	nilState.Set(Up, nil)
+	nilState.Keepalive()
+	if status := nilState.Status(); status.State != Down {
+		t.Errorf("nil status %+v", status)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	report := func(links []string, mx ...string) *Report {
+		r := &Report{MX: make(map[string]Status)}
+		for _, state := range links {
+			r.Links = append(r.Links, Link{Status: Status{State: state}})
+		}
+		for i, state := range mx {
+			r.MX[string(rune('a'+i))] = Status{State: state}
+		}
+		return r
+	}
+	tests := []struct {
+		policy  Policy
+		report  *Report
+		status  string
+		reasons int
+	}{
+		{Policy{}, report([]string{Up, Down}, Up), StatusDegraded, 0},
+		{Policy{}, report([]string{Down, Stopped}, Up), StatusDegraded, 1},
+		{Policy{}, report([]string{Up}, Down), StatusDegraded, 1},
+		{Policy{SMPP: RequireAll}, report([]string{Up, Down}, Up), StatusDegraded, 1},
+		{Policy{SMPP: RequireNone, MX: RequireNone}, report([]string{Down}, Down), StatusDegraded, 0},
+		{Policy{MX: RequireAll}, report([]string{Up}, Up, Up), StatusOK, 0},
+		{Policy{}, report(nil), StatusOK, 0}, // nothing configured
+	}
+	for i, test := range tests {
+		test.policy.Check(test.report)
+		if test.report.Status != test.status || len(test.report.Reasons) != test.reasons ||
+			test.report.Ready != (test.reasons == 0) {
+			t.Errorf("%d: %+v", i, test.report)
+		}
+	}
+	if ValidPolicy("some") || !ValidPolicy("") || !ValidPolicy(RequireAll) {
+		t.Error("unexpected policy validation")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ready := false
+	handler := Handler(func() Report {
+		r := Report{Links: []Link{{Address: "10.0.0.1:2775", Status: Status{State: Down, LastError: "EOF"}}}}
+		if ready {
+			r.Links[0].State = Up
+		}
+		Policy{}.Check(&r)
+		return r
+	})
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, w.Body.String()
+	}
+	if code, body := get("/healthz"); code != 200 || !strings.Contains(body, `"lastError":"EOF"`) {
+		t.Errorf("healthz: %d %s", code, body)
+	}
+	if code, body := get("/readyz"); code != 503 || !strings.Contains(body, `"0 of 1 SMPP links bound"`) {
+		t.Errorf("readyz: %d %s", code, body)
+	}
+	ready = true
+	if code, body := get("/readyz"); code != 200 || !strings.Contains(body, `"status":"ok"`) {
+		t.Errorf("readyz: %d %s", code, body)
+	}
+	if code, _ := get("/other"); code != 404 {
+		t.Errorf("other: %d", code)
+	}
+}
@@ -1,79 +1,530 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"mxsms/conf"
+	"mxsms/sqlog"
 )
 
+const defaultHistoryTTL = time.Hour * 24 * 30 // how long pairings are kept by default
+
+// HistoryConfig describes where the history of sent messages is stored.
+type HistoryConfig struct {
+	Store string        `yaml:"store,omitempty" json:"store,omitempty"` // memory, file or sql; memory by default
+	File  string        `yaml:"file,omitempty" json:"file,omitempty"`   // file name for the file store
+	DSN   string        `yaml:"dsn,omitempty" json:"dsn,omitempty"`     // database of the sql store, the log one if empty
+	TTL   conf.Duration `yaml:"ttl,omitempty" json:"ttl,omitempty"`     // how long pairings are kept, 720h by default
+}
+
 type historyItem struct {
-	MXName string    // MX server name
-	JID    string    // unique user identifier
-	Sended time.Time // record addition time
+	MXName string    `json:"mx"`   // MX server name
+	JID    string    `json:"jid"`  // unique user identifier
+	Sended time.Time `json:"sent"` // record addition time
 }
 
+// HistoryStore keeps the pairings of the outgoing numbers with recipients and
+// the MX users that texted them, and the chat choices of the MX users.
+type HistoryStore interface {
+	// Add saves the pairing, replacing the previous one for the numbers.
+	Add(from, to string, item historyItem) error
+	// List returns the pairings of the recipient by outgoing number.
+	List(to string) (map[string]historyItem, error)
+	// All returns all pairings by recipient and outgoing number.
+	All() (map[string]map[string]historyItem, error)
+	// Purge removes the pairings added before the time.
+	Purge(before time.Time) error
+	// SaveSession saves the chat choices of the MX user; empty ones are removed.
+	SaveSession(mxName, jid string, item sessionItem) error
+	// Sessions returns the chat choices by MX server name and user.
+	Sessions() (map[string]map[string]sessionItem, error)
+	// Close releases the store.
+	Close() error
+}
+
+// History remembers the outgoing numbers used for recipients and routes the
+// replies back to the MX users that texted them. Pairings older than TTL are ignored and
+// removed. The zero value keeps the history in memory. The store keeps the
+// pairings and the chat choices of the sessions; the recent messages of the
+// sessions are kept in memory.
 type History struct {
-	list map[string]map[string]historyItem // to|from map
-	mu   sync.RWMutex
+	Store  HistoryStore  // storage, in memory if nil
+	TTL    time.Duration // how long pairings are kept, 30 days if zero
+	purged time.Time     // last time expired pairings were removed
+	mu     sync.Mutex
+	saving sync.Mutex // serializes the session saves
+
+	sessions map[sessionKey]*Session // chat sessions of the MX users
+	parts    map[string]sessionKey   // SMPP message part id -> session of the chat message
 }
 
-func (h *History) Add(mxName, jid, from, to string) {
+// OpenHistory returns the history with the store from the configuration and
+// the chat choices saved in it. The sql store uses the log connection if the
+// DSN is empty.
+func OpenHistory(cfg *HistoryConfig, logDSN string) (*History, error) {
+	history := new(History)
+	if cfg == nil {
+		return history, nil
+	}
+	history.TTL = time.Duration(cfg.TTL)
+	var err error
+	switch cfg.Store {
+	case "", "memory":
+	case "file":
+		history.Store, err = openFileHistory(cfg.File)
+	case "sql":
+		dsn := cfg.DSN
+		if dsn == "" {
+			dsn = logDSN
+		}
+		history.Store, err = openSQLHistory(dsn)
+	default:
+		err = fmt.Errorf("unsupported history store %q", cfg.Store)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := history.loadSessions(); err != nil {
+		history.Close()
+		return nil, err
+	}
+	return history, nil
+}
+
+// store returns the history store, creating the memory one if not set.
+func (h *History) store() HistoryStore {
 	h.mu.Lock()
-	if h.list == nil {
-		h.list = make(map[string]map[string]historyItem)
+	defer h.mu.Unlock()
+	if h.Store == nil {
+		h.Store = new(memoryHistory)
 	}
-	items := h.list[to]
-	if items == nil {
-		items = make(map[string]historyItem)
-		h.list[to] = items
+	return h.Store
+}
+
+// ttl returns how long pairings are kept.
+func (h *History) ttl() time.Duration {
+	if h.TTL > 0 {
+		return h.TTL
+	}
+	return defaultHistoryTTL
+}
+
+// list returns the pairings of the recipient that have not expired.
+func (h *History) list(to string) map[string]historyItem {
+	items, err := h.store().List(to)
+	if err != nil {
+		llog.WithError(err).Error("History read error")
+		return nil
+	}
+	expired := time.Now().Add(-h.ttl())
+	for from, item := range items {
+		if item.Sended.Before(expired) {
+			delete(items, from)
+		}
 	}
-	items[from] = historyItem{
+	return items
+}
+
+func (h *History) Add(mxName, jid, from, to string) {
+	store := h.store()
+	err := store.Add(from, to, historyItem{
 		MXName: mxName,
 		JID:    jid,
 		Sended: time.Now(),
+	})
+	if err != nil {
+		llog.WithError(err).Error("History write error")
+	}
+	h.mu.Lock()
+	purge := time.Since(h.purged) > h.ttl()/100
+	if purge {
+		h.purged = time.Now()
 	}
 	h.mu.Unlock()
+	if purge { // remove stale pairings from time to time
+		if err := store.Purge(time.Now().Add(-h.ttl())); err != nil {
+			llog.WithError(err).Error("History purge error")
+		}
+	}
 }
 
 func (h *History) Get(from, to string) (mxName, jid string) {
-	h.mu.RLock()
-	items := h.list[to]
+	item := h.list(to)[from]
+	return item.MXName, item.JID
+}
+
+// Migrate copies the pairings that have not expired and the chat sessions from
+// the history used before the configuration reload and closes its store. A
+// store shared by both histories is kept as is.
+func (h *History) Migrate(old *History) error {
+	h.migrateSessions(old)
+	oldStore, store := old.store(), h.store()
+	if oldStore == store {
+		return nil
+	}
+	all, err := oldStore.All()
+	if err != nil {
+		return err
+	}
+	expired := time.Now().Add(-h.ttl())
+	for to, items := range all {
+		for from, item := range items {
+			if item.Sended.Before(expired) {
+				continue
+			}
+			if err := store.Add(from, to, item); err != nil {
+				return err
+			}
+		}
+	}
+	sessions, err := oldStore.Sessions()
+	if err != nil {
+		return err
+	}
+	for mxName, items := range sessions {
+		for jid, item := range items {
+			if err := store.SaveSession(mxName, jid, item); err != nil {
+				return err
+			}
+		}
+	}
+	return oldStore.Close()
+}
+
+// Close closes the history store.
+func (h *History) Close() error {
+	return h.store().Close()
+}
+
+// memoryHistory keeps the history in memory.
+type memoryHistory struct {
+	list     map[string]map[string]historyItem // to|from map
+	sessions map[string]map[string]sessionItem // mx|jid map
+	mu       sync.RWMutex
+}
+
+func (m *memoryHistory) Add(from, to string, item historyItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.list == nil {
+		m.list = make(map[string]map[string]historyItem)
+	}
+	items := m.list[to]
 	if items == nil {
-		h.mu.RUnlock()
-		return
+		items = make(map[string]historyItem)
+		m.list[to] = items
 	}
-	item := items[from]
-	h.mu.RUnlock()
-	return item.MXName, item.JID
+	items[from] = item
+	return nil
 }
 
-func (h *History) GetFrom(froms map[string]string, to, jid string) (from string) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	items := h.list[to]
+func (m *memoryHistory) List(to string) (map[string]historyItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	items := m.list[to]
 	if items == nil {
-		// Return the first phone number from the map if no history
-		for number := range froms {
-			return number
-		}
+		return nil, nil
 	}
+	list := make(map[string]historyItem, len(items))
 	for from, item := range items {
-		if item.JID == jid {
-			return from
+		list[from] = item
+	}
+	return list, nil
+}
+
+func (m *memoryHistory) All() (map[string]map[string]historyItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	all := make(map[string]map[string]historyItem, len(m.list))
+	for to, items := range m.list {
+		all[to] = make(map[string]historyItem, len(items))
+		for from, item := range items {
+			all[to][from] = item
+		}
+	}
+	return all, nil
+}
+
+func (m *memoryHistory) Purge(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for to, items := range m.list {
+		for from, item := range items {
+			if item.Sended.Before(before) {
+				delete(items, from)
+			}
+		}
+		if len(items) == 0 {
+			delete(m.list, to)
+		}
+	}
+	return nil
+}
+
+func (m *memoryHistory) SaveSession(mxName, jid string, item sessionItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if item == (sessionItem{}) {
+		if items := m.sessions[mxName]; items != nil {
+			delete(items, jid)
+			if len(items) == 0 {
+				delete(m.sessions, mxName)
+			}
+		}
+		return nil
+	}
+	if m.sessions == nil {
+		m.sessions = make(map[string]map[string]sessionItem)
+	}
+	items := m.sessions[mxName]
+	if items == nil {
+		items = make(map[string]sessionItem)
+		m.sessions[mxName] = items
+	}
+	items[jid] = item
+	return nil
+}
+
+func (m *memoryHistory) Sessions() (map[string]map[string]sessionItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	all := make(map[string]map[string]sessionItem, len(m.sessions))
+	for mxName, items := range m.sessions {
+		all[mxName] = make(map[string]sessionItem, len(items))
+		for jid, item := range items {
+			all[mxName][jid] = item
 		}
 	}
-	var (
-		sended   time.Time
-		sendFrom string
-	)
-	for number := range froms {
-		item, ok := items[number]
-		if !ok {
-			return number
+	return all, nil
+}
+
+func (m *memoryHistory) Close() error { return nil }
+
+// fileHistory keeps the history in memory and saves it to a JSON file after
+// every change.
+type fileHistory struct {
+	memoryHistory
+	filename string
+	save     sync.Mutex // serializes file writes
+}
+
+// historyFile is the content of the history file.
+type historyFile struct {
+	Pairings map[string]map[string]historyItem `json:"pairings,omitempty"` // to|from map
+	Sessions map[string]map[string]sessionItem `json:"sessions,omitempty"` // mx|jid map
+}
+
+// openFileHistory loads the history from the file, if it exists.
+func openFileHistory(filename string) (*fileHistory, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("history file not set")
+	}
+	f := &fileHistory{filename: filename}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var content historyFile
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("history file %s: %w", filename, err)
+	}
+	f.list, f.sessions = content.Pairings, content.Sessions
+	return f, nil
+}
+
+func (f *fileHistory) Add(from, to string, item historyItem) error {
+	f.memoryHistory.Add(from, to, item)
+	return f.write()
+}
+
+func (f *fileHistory) Purge(before time.Time) error {
+	f.memoryHistory.Purge(before)
+	return f.write()
+}
+
+func (f *fileHistory) SaveSession(mxName, jid string, item sessionItem) error {
+	f.memoryHistory.SaveSession(mxName, jid, item)
+	return f.write()
+}
+
+// write saves the history to a temporary file and renames it, so the file is
+// never left half written.
+func (f *fileHistory) write() error {
+	f.save.Lock()
+	defer f.save.Unlock()
+	var content historyFile
+	content.Pairings, _ = f.memoryHistory.All()
+	content.Sessions, _ = f.memoryHistory.Sessions()
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.filename), filepath.Base(f.filename)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.filename)
+}
+
+// sqlHistory keeps the history in a database table.
+type sqlHistory struct {
+	db      *sql.DB
+	dialect sqlog.Dialect
+}
+
+// openSQLHistory connects to the database selected by the DSN scheme, as the
+// message log does, and creates the history tables.
+func openSQLHistory(dsn string) (*sqlHistory, error) {
+	db, dialect, err := sqlog.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS history (
+		recipient VARCHAR(32) NOT NULL,
+		sender VARCHAR(32) NOT NULL,
+		mx VARCHAR(64) NOT NULL,
+		jid VARCHAR(64) NOT NULL,
+		sent BIGINT NOT NULL,
+		PRIMARY KEY (recipient, sender)
+	)`)
+	if err == nil {
+		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS history_sessions (
+			mx VARCHAR(64) NOT NULL,
+			jid VARCHAR(64) NOT NULL,
+			recipient VARCHAR(32) NOT NULL,
+			sender VARCHAR(32) NOT NULL,
+			reply_to VARCHAR(32) NOT NULL,
+			PRIMARY KEY (mx, jid)
+		)`)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlHistory{db: db, dialect: dialect}, nil
+}
+
+func (s *sqlHistory) Add(from, to string, item historyItem) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.dialect.Rebind(`DELETE FROM history WHERE recipient = ? AND sender = ?`), to, from); err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.dialect.Rebind(`INSERT INTO history (recipient, sender, mx, jid, sent) VALUES (?, ?, ?, ?, ?)`),
+		to, from, item.MXName, item.JID, item.Sended.Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlHistory) List(to string) (map[string]historyItem, error) {
+	rows, err := s.db.Query(s.dialect.Rebind(`SELECT recipient, sender, mx, jid, sent FROM history WHERE recipient = ?`), to)
+	if err != nil {
+		return nil, err
+	}
+	all, err := scanHistory(rows)
+	return all[to], err
+}
+
+func (s *sqlHistory) All() (map[string]map[string]historyItem, error) {
+	rows, err := s.db.Query(`SELECT recipient, sender, mx, jid, sent FROM history`)
+	if err != nil {
+		return nil, err
+	}
+	return scanHistory(rows)
+}
+
+func (s *sqlHistory) Purge(before time.Time) error {
+	_, err := s.db.Exec(s.dialect.Rebind(`DELETE FROM history WHERE sent < ?`), before.Unix())
+	return err
+}
+
+func (s *sqlHistory) SaveSession(mxName, jid string, item sessionItem) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.dialect.Rebind(`DELETE FROM history_sessions WHERE mx = ? AND jid = ?`), mxName, jid); err != nil {
+		return err
+	}
+	if item != (sessionItem{}) {
+		_, err = tx.Exec(s.dialect.Rebind(`INSERT INTO history_sessions (mx, jid, recipient, sender, reply_to) VALUES (?, ?, ?, ?, ?)`),
+			mxName, jid, item.To, item.From, item.ReplyTo)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlHistory) Sessions() (map[string]map[string]sessionItem, error) {
+	rows, err := s.db.Query(`SELECT mx, jid, recipient, sender, reply_to FROM history_sessions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make(map[string]map[string]sessionItem)
+	for rows.Next() {
+		var (
+			mxName, jid string
+			item        sessionItem
+		)
+		if err := rows.Scan(&mxName, &jid, &item.To, &item.From, &item.ReplyTo); err != nil {
+			return nil, err
+		}
+		if all[mxName] == nil {
+			all[mxName] = make(map[string]sessionItem)
+		}
+		all[mxName][jid] = item
+	}
+	return all, rows.Err()
+}
+
+func (s *sqlHistory) Close() error {
+	return s.db.Close()
+}
+
+// scanHistory reads the history rows and closes them.
+func scanHistory(rows *sql.Rows) (map[string]map[string]historyItem, error) {
+	defer rows.Close()
+	all := make(map[string]map[string]historyItem)
+	for rows.Next() {
+		var (
+			to, from string
+			item     historyItem
+			sent     int64
+		)
+		if err := rows.Scan(&to, &from, &item.MXName, &item.JID, &sent); err != nil {
+			return nil, err
 		}
-		if sended.IsZero() || item.Sended.Before(sended) {
-			sended = item.Sended
-			sendFrom = number
+		item.Sended = time.Unix(sent, 0)
+		if all[to] == nil {
+			all[to] = make(map[string]historyItem)
 		}
+		all[to][from] = item
 	}
-	return sendFrom
+	return all, rows.Err()
 }
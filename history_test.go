@@ -3,18 +3,147 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"mxsms/conf"
+	"mxsms/sms"
 )
 
 func TestHistory(t *testing.T) {
 	jids := []string{"jid1", "jid2"}
 	froms := map[string]string{"100": "twilio", "200": "twilio"}
 	tos := []string{"01", "02", "03", "02", "01", "03", "03", "03", "01"}
-	var history History
+	var (
+		history History
+		numbers NumberAllocator
+	)
+	mx := &MX{name: "mxName", PhoneInfo: PhoneInfo{From: froms}}
 	for _, to := range tos {
 		jid := jids[rand.Intn(len(jids))]
-		from := history.GetFrom(froms, to, jid)
-		history.Add("mxName", jid, from, to)
-		fmt.Println(jid, from, to)
+		allocation, err := numbers.Allocate(mx, &history, to, jid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		history.Add("mxName", jid, allocation.From, to)
+		numbers.Sent(allocation.From)
+		fmt.Println(jid, allocation.From, to)
+	}
+}
+
+func TestHistoryExpire(t *testing.T) {
+	history := &History{TTL: time.Hour}
+	history.Add("mx", "jid1", "100", "01")
+	history.Store.Add("200", "01", historyItem{MXName: "mx", JID: "jid2", Sended: time.Now().Add(-time.Hour * 2)})
+	if mxName, jid := history.Get("100", "01"); mxName != "mx" || jid != "jid1" {
+		t.Errorf("unexpected pairing %q %q", mxName, jid)
+	}
+	if _, jid := history.Get("200", "01"); jid != "" {
+		t.Errorf("expired pairing returned: %q", jid)
+	}
+	if err := history.Store.Purge(time.Now().Add(-history.TTL)); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := history.Store.All(); len(all["01"]) != 1 {
+		t.Errorf("expired pairing not purged: %v", all)
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history.json")
+	cfg := &HistoryConfig{Store: "file", File: filename}
+	history, err := OpenHistory(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history.Add("mx", "jid1", "100", "01")
+	history.SetRecipient("mx", "jid1", "14085551234")
+	history.SetSender("mx", "jid1", "100")
+	history.SetRecipient("mx", "jid2", "01")
+	history.SetRecipient("mx", "jid2", "") // nothing left to save
+	history.Close()
+	// the pairings and the chat choices are loaded after the restart
+	history, err = OpenHistory(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mxName, jid := history.Get("100", "01"); mxName != "mx" || jid != "jid1" {
+		t.Errorf("unexpected pairing %q %q", mxName, jid)
+	}
+	if session := history.Session("mx", "jid1"); session.To != "14085551234" || session.From != "100" {
+		t.Errorf("session %+v", session)
+	}
+	if sessions, _ := history.Store.Sessions(); len(sessions["mx"]) != 1 {
+		t.Errorf("sessions %v", sessions)
+	}
+	if _, err := OpenHistory(&HistoryConfig{Store: "unknown"}, ""); err == nil {
+		t.Error("unknown store accepted")
+	}
+}
+
+func TestHistoryMigrate(t *testing.T) {
+	old := &SMSGate{}
+	if err := old.OpenHistory(nil); err != nil {
+		t.Fatal(err)
+	}
+	old.history.Add("mx", "jid1", "100", "01")
+	old.history.SetRecipient("mx", "jid1", "01")
+	// the same configuration keeps the store
+	gate := &SMSGate{}
+	if err := gate.OpenHistory(old); err != nil {
+		t.Fatal(err)
+	}
+	if gate.history != old.history {
+		t.Error("history not kept")
+	}
+	// another store gets the pairings copied
+	gate = &SMSGate{History: &HistoryConfig{Store: "file", File: filepath.Join(t.TempDir(), "history.json")}}
+	if err := gate.OpenHistory(old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gate.history.Store.(*fileHistory); !ok {
+		t.Errorf("unexpected store %T", gate.history.Store)
+	}
+	if mxName, jid := gate.history.Get("100", "01"); mxName != "mx" || jid != "jid1" {
+		t.Errorf("pairing not migrated: %q %q", mxName, jid)
+	}
+	if sessions, _ := gate.history.Store.Sessions(); sessions["mx"]["jid1"].To != "01" {
+		t.Errorf("session not migrated: %v", sessions)
+	}
+}
+
+func TestHistorySQL(t *testing.T) {
+	dsn := "sqlite://" + filepath.Join(t.TempDir(), "history.db")
+	history, err := OpenHistory(&HistoryConfig{Store: "sql", TTL: conf.Duration(time.Hour)}, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	history.Add("mx", "jid1", "100", "01")
+	history.Add("mx", "jid2", "100", "01") // replaces the pairing
+	history.Store.Add("200", "01", historyItem{MXName: "mx", JID: "jid3", Sended: time.Now().Add(-time.Hour * 2)})
+	if mxName, jid := history.Get("100", "01"); mxName != "mx" || jid != "jid2" {
+		t.Errorf("unexpected pairing %q %q", mxName, jid)
+	}
+	if _, jid := history.Get("200", "01"); jid != "" {
+		t.Errorf("expired pairing returned: %q", jid)
+	}
+	if err := history.Store.Purge(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if all, err := history.Store.All(); err != nil || len(all["01"]) != 1 {
+		t.Errorf("all: %v %v", err, all)
+	}
+	history.chatReceived("mx", "jid1", sms.Received{From: "14085551234", To: "100", Text: "hello"})
+	history.SetSender("mx", "jid1", "100")
+	history.Close()
+	history, err = OpenHistory(&HistoryConfig{Store: "sql"}, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	if session := history.Session("mx", "jid1"); session.ReplyTo != "14085551234" || session.From != "100" {
+		t.Errorf("session %+v", session)
 	}
 }
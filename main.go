@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"mxsms/sqlog"
@@ -22,14 +27,36 @@ var (
 	//zabbixLog      *zabbix.Log
 )
 
-const MaxErrors = 10 // maximum allowed number of connection errors
-
 func main() {
-	var debugLevel = uint(logrus.InfoLevel)
-	flag.StringVar(&configFileName, "config", configFileName, "configuration `fileName`")
+	var (
+		debugLevel = uint(logrus.InfoLevel)
+		search     string
+		check      bool
+		watch      time.Duration
+	)
+	flag.StringVar(&configFileName, "config", configFileName, "configuration `fileName`, YAML or JSON")
 	flag.UintVar(&debugLevel, "level", debugLevel, "log `level` [0-5]")
+	flag.StringVar(&search, "search", "", "print the logged messages matching the `query`: number=&jid=&since=...")
+	flag.BoolVar(&check, "check-config", false, "validate the configuration and exit")
+	flag.DurationVar(&watch, "watch", 0, "reload the configuration when the file is changed, checked at the `interval`")
 	flag.Parse() // parse application launch parameters
 
+	if check { // report all configuration errors and exit
+		if _, err := LoadConfig(configFileName); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:\n%v\n", configFileName, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", configFileName)
+		return
+	}
+
+	if search != "" { // search the message log and exit
+		if err := searchLog(search); err != nil {
+			llog.WithError(err).Fatal("Log search error")
+		}
+		return
+	}
+
 	logrus.SetLevel(logrus.Level(debugLevel)) // debug level
 	// logrus.SetFormatter(new(logrus.JSONFormatter))
 	// hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO, "")
@@ -47,44 +74,156 @@ func main() {
 	}
 	logEntry.Info(appName)
 
-	// start an infinite loop of reading configuration and establishing connection
+	// load and parse configuration file
+	logEntry = llog.WithField("filename", configFileName)
+	var err error
+	config, err = LoadConfig(configFileName) // load configuration file
+	if err != nil {
+		logEntry.WithError(err).Fatal("Error loading config")
+	}
+	if err := start(nil); err != nil {
+		logEntry.WithError(err).Fatal("Error starting")
+	}
+	// initialize support for system signals and configuration changes
+	signals := monitorSignals(os.Interrupt, os.Kill, syscall.SIGUSR1)
+	changes := watchFile(configFileName, watch)
 	for {
-		// load and parse configuration file
-		logEntry := llog.WithField("filename", configFileName)
-		var err error
-		config, err = LoadConfig(configFileName) // load configuration file
-		if err != nil {
-			logEntry.WithError(err).Fatal("Error loading config")
+		select {
+		case signal := <-signals:
+			if signal != syscall.SIGUSR1 { // not a signal to reread the config
+				stop()
+				config.SMSGate.history.Close() // save the history
+				llog.Info("The end")
+				return // end our work
+			}
+		case <-changes:
+		}
+		llog.Info("Reload")
+		next, err := LoadConfig(configFileName)
+		if err != nil { // keep working with the running configuration
+			logEntry.WithError(err).Error("Error reloading config")
+			continue
+		}
+		if config.Reload(next) { // changed in place
+			continue
+		}
+		// the changed services are started again with the new configuration
+		llog.Info("Restart")
+		stop()
+		previous := config
+		config = next
+		if err := start(previous); err != nil {
+			logEntry.WithError(err).Fatal("Error restarting")
 		}
-		logEntry.WithField("mx", len(config.MX)).Info("Config loaded")
+	}
+}
 
-		/*sglogDB, err = sqlog.Connect(config.SMSGate.MYSQL)
+// start starts the gateway with the loaded configuration. The history and the
+// number usage of the configuration used before the restart are kept.
+func start(previous *Config) error {
+	logEntry := llog.WithField("filename", configFileName)
+	logEntry.WithField("mx", len(config.MX)).Info("Config loaded")
+	var gate *SMSGate
+	if previous != nil {
+		gate = previous.SMSGate
+	}
+	// keep the history of sent messages across reloads
+	if err := config.SMSGate.OpenHistory(gate); err != nil {
+		return fmt.Errorf("opening history: %w", err)
+	}
+	if config.SMSGate.MYSQL != "" {
+		db, err := sqlog.Connect(config.SMSGate.MYSQL)
 		if err != nil {
-			logEntry.WithError(err).Fatal("Error connecting to MySQL")
-		}*/
-		// //zabbixLog = zabbix.New(config.SMSGate.ZabbixHost)
-		config.SMSGate.SMPP.Zabbix = config.SMSGate.Zabbix
+			return fmt.Errorf("connecting to the message log: %w", err)
+		}
+		sglogDB = db
+	}
+	// //zabbixLog = zabbix.New(config.SMSGate.ZabbixHost)
+	config.SMSGate.SMPP.Zabbix = config.SMSGate.Zabbix
 
-		config.MXConnect()       // start asynchronous connection to MX
-		config.SMSGate.Connect() // establish connection to SMPP servers
-		// initialize support for system signals and wait for it to happen...
-		signal := monitorSignals(os.Interrupt, os.Kill, syscall.SIGUSR1)
-		config.SMSGate.Close() // stop connection to SMPP
-		config.MXClose()       // stop connection to MX servers
-		sglogDB.Close()        // close connection to the log
-		// check if the signal is not a signal to reread the config
-		if signal != syscall.SIGUSR1 {
-			llog.Info("The end")
-			return // end our work
+	config.MXConnect()       // start asynchronous connection to MX
+	config.SMSGate.Connect() // establish connection to SMPP servers
+	return nil
+}
+
+// stop stops the running gateway. The history stays open for the restart.
+func stop() {
+	config.SMSGate.Close() // stop connection to SMPP
+	config.MXClose()       // stop connection to MX servers
+	sglogDB.Close()        // close connection to the log
+	sglogDB = nil
+	config.SMSGate.Zabbix.Close() // send the queued metrics
+}
+
+// searchLog prints the logged messages matching the query as JSON lines.
+func searchLog(search string) error {
+	values, err := url.ParseQuery(search)
+	if err != nil {
+		return err
+	}
+	query, err := sqlog.ParseQuery(values)
+	if err != nil {
+		return err
+	}
+	cfg, err := LoadConfig(configFileName)
+	if err != nil {
+		return err
+	}
+	if cfg.SMSGate.MYSQL == "" {
+		return errors.New("message log is not configured")
+	}
+	db, err := sqlog.Connect(cfg.SMSGate.MYSQL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	messages, err := db.Find(query)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			return err
 		}
-		llog.Info("Reload") // reread config and start all over again
 	}
+	return nil
 }
 
-// monitorSignals starts monitoring signals and returns a value when it receives a signal.
+// monitorSignals starts monitoring signals and returns the channel receiving them.
 // The parameters are a list of signals to be tracked.
-func monitorSignals(signals ...os.Signal) os.Signal {
+func monitorSignals(signals ...os.Signal) <-chan os.Signal {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, signals...)
-	return <-signalChan
+	return signalChan
+}
+
+// watchFile checks the modification time of the file at the interval and returns
+// the channel receiving a value when it's changed. The file is not watched if
+// the interval is zero.
+func watchFile(filename string, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	if interval <= 0 {
+		return changes
+	}
+	var modTime time.Time
+	if info, err := os.Stat(filename); err == nil {
+		modTime = info.ModTime()
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(filename)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue // reloaded when it's written again
+			}
+			modTime = info.ModTime()
+			select {
+			case changes <- struct{}{}:
+			default: // the reload is pending
+			}
+		}
+	}()
+	return changes
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"mxsms/smpp"
+	"mxsms/sms"
+)
+
+// Outcomes of the MX chat messages.
+const (
+	outcomeNoPhone   = "noPhone"
+	outcomeIncorrect = "incorrect"
+	outcomeAccepted  = "accepted"
+	outcomeError     = "error"
+	outcomeCommand   = "command" // chat command other than /r
+)
+
+// Metrics describes the Prometheus metrics of the gateway, served at
+// GET /metrics. SMPP links are labeled with the names from smpp.names, REST
+// carriers with the carrier name. Counters start from zero after the
+// configuration reload.
+type Metrics struct {
+	Address string            `yaml:"address" json:"address"`                   // address and port to listen on
+	Labels  map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"` // labels added to all metrics, such as the gateway name
+
+	smpp       *sms.SMPP
+	submits    *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	parts      prometheus.Histogram
+	receipts   *prometheus.CounterVec
+	received   *prometheus.CounterVec
+	handled    *prometheus.CounterVec
+	reconnects *prometheus.CounterVec
+	bound      *prometheus.GaugeVec
+	registry   *prometheus.Registry
+	server     *http.Server
+	mux        *http.ServeMux
+	listener   net.Listener
+	links      map[string]bool // links bound at least once
+	mu         sync.Mutex
+}
+
+// Start registers the metrics of the SMPP connection and starts serving them.
+func (m *Metrics) Start(s *sms.SMPP) error {
+	m.smpp = s
+	m.submits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mxsms_smpp_submits_total",
+		Help: "Message parts submitted, by link and response status.",
+	}, []string{"link", "status"})
+	m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mxsms_smpp_submit_duration_seconds",
+		Help:    "Time from submitting a message part to the response.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"link"})
+	m.parts = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mxsms_message_parts",
+		Help:    "Parts of the sent messages.",
+		Buckets: prometheus.LinearBuckets(1, 1, sms.MaxParts),
+	})
+	m.receipts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mxsms_smpp_receipts_total",
+		Help: "Delivery receipts, by link and message state.",
+	}, []string{"link", "state"})
+	m.received = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mxsms_sms_received_total",
+		Help: "Incoming messages, by link.",
+	}, []string{"link"})
+	m.handled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mxsms_mx_messages_total",
+		Help: "MX chat messages, by MX server and outcome: noPhone, incorrect, accepted or error.",
+	}, []string{"mx", "outcome"})
+	m.reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mxsms_smpp_reconnects_total",
+		Help: "Binds of the SMPP links after the first one.",
+	}, []string{"link"})
+	m.bound = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mxsms_smpp_link_up",
+		Help: "Whether the SMPP link is bound.",
+	}, []string{"link"})
+	queue := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mxsms_smpp_send_queue",
+		Help: "Messages waiting for a bound SMPP link.",
+	}, func() float64 { return float64(s.Queued()) })
+	m.links = make(map[string]bool)
+	for _, addr := range s.Address { // links are down until bound
+		m.bound.WithLabelValues(s.LinkName(addr)).Set(0)
+	}
+
+	m.registry = prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(m.Labels, m.registry)
+	registerer.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.submits, m.latency, m.parts, m.receipts, m.received, m.handled,
+		m.reconnects, m.bound, queue,
+	)
+	if m.Address == "" {
+		return nil // collected, but not served
+	}
+	listener, err := net.Listen("tcp", m.Address)
+	if err != nil {
+		return err
+	}
+	m.mux = http.NewServeMux()
+	m.mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.listener = listener
+	m.server = &http.Server{Handler: m.mux, ReadHeaderTimeout: time.Second * 10}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			llog.WithError(err).Error("Metrics server error")
+		}
+	}()
+	llog.WithField("address", listener.Addr().String()).Info("Metrics server started")
+	return nil
+}
+
+// Handle serves the handler with the metrics, if they are served.
+func (m *Metrics) Handle(pattern string, handler http.Handler) {
+	if m == nil || m.mux == nil {
+		return
+	}
+	m.mux.Handle(pattern, handler)
+}
+
+// Close stops serving the metrics.
+func (m *Metrics) Close() error {
+	if m == nil || m.server == nil {
+		return nil
+	}
+	return m.server.Close()
+}
+
+// started reports whether the metrics are collected.
+func (m *Metrics) started() bool {
+	return m != nil && m.registry != nil
+}
+
+// link returns the label of the SMPP server address or carrier name.
+func (m *Metrics) link(addr string) string {
+	return m.smpp.LinkName(addr)
+}
+
+// Submitted counts the response to the submitted message part.
+func (m *Metrics) Submitted(resp sms.SendResponse) {
+	if !m.started() {
+		return
+	}
+	link := m.link(resp.Addr)
+	status := "ok"
+	if resp.Status != smpp.ESME_ROK {
+		status = strconv.FormatUint(uint64(resp.Status), 10)
+	}
+	m.submits.WithLabelValues(link, status).Inc()
+	if !resp.Submitted.IsZero() {
+		m.latency.WithLabelValues(link).Observe(time.Since(resp.Submitted).Seconds())
+	}
+}
+
+// Sent counts the parts of the sent message.
+func (m *Metrics) Sent(msg *sms.SendMessage) {
+	if !m.started() {
+		return
+	}
+	m.parts.Observe(float64(len(msg.Seq)))
+}
+
+// Receipt counts the delivery receipt.
+func (m *Metrics) Receipt(status sms.Status) {
+	if !m.started() {
+		return
+	}
+	m.receipts.WithLabelValues(m.link(status.Addr), status.Stat).Inc()
+}
+
+// Received counts the incoming message.
+func (m *Metrics) Received(msg sms.Received) {
+	if !m.started() {
+		return
+	}
+	m.received.WithLabelValues(m.link(msg.Addr)).Inc()
+}
+
+// Handled counts the outcome of the MX chat message.
+func (m *Metrics) Handled(mx, outcome string) {
+	if !m.started() {
+		return
+	}
+	m.handled.WithLabelValues(mx, outcome).Inc()
+}
+
+// Link sets the bind state of the SMPP link and counts the reconnects.
+func (m *Metrics) Link(link sms.Link) {
+	if !m.started() {
+		return
+	}
+	name := m.link(link.Address)
+	if !link.Up {
+		m.bound.WithLabelValues(name).Set(0)
+		return
+	}
+	m.bound.WithLabelValues(name).Set(1)
+	m.mu.Lock()
+	if m.links[name] {
+		m.reconnects.WithLabelValues(name).Inc()
+	}
+	m.links[name] = true
+	m.mu.Unlock()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"mxsms/smpp"
+	"mxsms/sms"
+)
+
+func TestMetrics(t *testing.T) {
+	s := &sms.SMPP{
+		Address: []string{"10.0.0.1:2775", "10.0.0.2:2775"},
+		Names:   map[string]string{"10.0.0.1:2775": "east"},
+	}
+	m := &Metrics{Address: "127.0.0.1:0", Labels: map[string]string{"gateway": "gw1"}}
+	if err := m.Start(s); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.Link(sms.Link{Address: "10.0.0.1:2775", Up: true})
+	m.Link(sms.Link{Address: "10.0.0.1:2775", Up: false})
+	m.Link(sms.Link{Address: "10.0.0.1:2775", Up: true})
+	m.Submitted(sms.SendResponse{Addr: "10.0.0.1:2775", Submitted: time.Now()})
+	m.Submitted(sms.SendResponse{Addr: "10.0.0.2:2775", Status: smpp.ESME_RTHROTTLED})
+	m.Sent(&sms.SendMessage{Seq: []uint32{1, 2}})
+	m.Receipt(sms.Status{Addr: "twilio", Stat: "DELIVRD"})
+	m.Received(sms.Received{Addr: "10.0.0.1:2775"})
+	m.Handled("mx1", outcomeAccepted)
+
+	resp, err := http.Get("http://" + m.listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	body := string(data)
+	for _, line := range []string{
+		`mxsms_smpp_link_up{gateway="gw1",link="east"} 1`,
+		`mxsms_smpp_link_up{gateway="gw1",link="10.0.0.2:2775"} 0`,
+		`mxsms_smpp_reconnects_total{gateway="gw1",link="east"} 1`,
+		`mxsms_smpp_submits_total{gateway="gw1",link="east",status="ok"} 1`,
+		`mxsms_smpp_submits_total{gateway="gw1",link="10.0.0.2:2775",status="88"} 1`,
+		`mxsms_smpp_submit_duration_seconds_count{gateway="gw1",link="east"} 1`,
+		`mxsms_message_parts_bucket{gateway="gw1",le="2"} 1`,
+		`mxsms_smpp_receipts_total{gateway="gw1",link="twilio",state="DELIVRD"} 1`,
+		`mxsms_sms_received_total{gateway="gw1",link="east"} 1`,
+		`mxsms_mx_messages_total{gateway="gw1",mx="mx1",outcome="accepted"} 1`,
+		`mxsms_smpp_send_queue{gateway="gw1"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	var nilMetrics *Metrics // not configured
+	nilMetrics.Handled("mx1", outcomeError)
+	nilMetrics.Close()
+}
@@ -3,37 +3,58 @@ package main
 import (
 	"fmt"
 	"mxsms/csta_old"
+	"mxsms/sms"
+	"net/url"
 	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
-// MessageHandle describes the handler for incoming messages.
-type MessageHandle struct {
-	*SMSGate                  // message templates
-	*MX                       // rules for parsing phone numbers
-	phoneRE  *regexp.Regexp   // regular expression for parsing the message
-	client   *csta_old.Client // client for connection to MX
+// recipients is the pattern of the comma-separated phone numbers and @group names.
+const recipients = `((?:\+?\d{3,15}|@[\w.-]+)(?:\s*,\s*(?:\+?\d{3,15}|@[\w.-]+))*)`
+
+var (
+	// MMS <phone[,...]> <http(s) URL> [text]
+	mmsRE = regexp.MustCompile(`(?is)\AMMS\s+` + recipients + `\s+(https?://\S+)\s*(.*)`)
+	// comma-separated phone numbers and @group names and the text after them
+	recipientsRE = regexp.MustCompile(`(?s)\A` + recipients + `\s+(.+)`)
+)
+
+// parsedMessage is the chat message split for sending.
+type parsedMessage struct {
+	recipients string // phone numbers and @groups the message starts with
+	text       string // text after the recipients
+	media      string // media URL of the MMS
 }
 
-// NewMessageHandler initializes and returns a new handler for incoming messages.
-func NewMessageHandler(sms *SMSGate, mx *MX) *MessageHandle {
-	min := 11 - len(mx.Prefix) // by default, it will be the minimum phone number without prefix
-	if min < 7 {
-		min = 11 // if the prefix is too long, we don't consider it
-	}
-	if mx.Short >= 3 && mx.Short <= 6 {
-		min = mx.Short
+// parseMessage splits the chat message into the recipients, the media URL and
+// the text. Only the messages of the full MMS <phone[,...]> <http(s) URL> shape
+// are MMS; the other ones starting with the word, like "MMS is down again",
+// are the ordinary text.
+func parseMessage(body string) parsedMessage {
+	if mms := mmsRE.FindStringSubmatch(body); mms != nil {
+		return parsedMessage{recipients: mms[1], media: mms[2], text: mms[3]}
 	}
-	re := fmt.Sprintf("(?s)\\A\\+?(\\d{%d,11})\\s+(.+)", min)
-	// initialize the message handler
-	handler := &MessageHandle{
-		SMSGate: sms,
-		MX:      mx,
-		phoneRE: regexp.MustCompile(re),
+	if submatch := recipientsRE.FindStringSubmatch(body); submatch != nil {
+		return parsedMessage{recipients: submatch[1], text: submatch[2]}
 	}
-	return handler
+	return parsedMessage{text: body}
+}
+
+// MessageHandle describes the handler for incoming messages. The templates and
+// the phone rules are looked up for each message, so the reloaded ones are used.
+type MessageHandle struct {
+	name   string           // MX server name
+	client *csta_old.Client // client for connection to MX
+}
+
+// NewMessageHandler initializes and returns a new handler for incoming messages
+// of the MX server.
+func NewMessageHandler(name string) *MessageHandle {
+	return &MessageHandle{name: name}
 }
 
 // Register returns information for registering the incoming message handler.
@@ -44,7 +65,8 @@ func (mh *MessageHandle) Register(client *csta_old.Client) csta_old.EventMap {
 	}
 }
 
-// Handle is called to process the parsed data of an incoming message.
+// Handle is called to process the parsed data of an incoming message: a chat
+// command or a message to send to the phone it starts with.
 func (mh *MessageHandle) Handle(eventData interface{}) (err error) {
 	data, ok := eventData.(*incommingMessage)
 	if !ok {
@@ -54,44 +76,103 @@ func (mh *MessageHandle) Handle(eventData interface{}) (err error) {
 	if err = mh.client.Send(messageAck{data.From, data.MsgID, data.ReqID}); err != nil {
 		return
 	}
-	logEntry := mh.MX.Logger.WithFields(logrus.Fields{
+	gate, mx := config.SMSGate, config.server(mh.name)
+	if mx == nil {
+		return // removed by the reload
+	}
+	responses := gate.templates()
+	logEntry := mx.Logger.WithFields(logrus.Fields{
 		"id":   data.MsgID,
 		"jid":  data.From,
 		"name": data.Name,
 	})
-	// parse the message and check if it starts with a phone number
-	submatch := mh.phoneRE.FindStringSubmatch(data.Body)
-	if submatch == nil { // phone number not found
+	body := data.Body
+	if command := commandRE.FindStringSubmatch(body); command != nil {
+		return mh.command(gate, mx, data, logEntry, strings.ToLower(command[1]), strings.TrimSpace(command[2]))
+	}
+	// parse the message and check if it starts with the phone numbers; messages
+	// without them go to the recipient chosen with /to
+	msg := parseMessage(body)
+	var to []string
+	if recipient := gate.history.Session(mx.name, data.From).To; recipient != "" {
+		to = []string{recipient}
+	}
+	text := body
+	if msg.recipients != "" {
+		// bring the phone numbers found in the message to the international format
+		phones, invalid := mx.recipients(msg.recipients)
+		switch {
+		case invalid == "":
+			to, text = phones, msg.text
+		case len(to) == 0 || msg.media != "": // invalid number in the region or unknown group
+			logEntry.WithField("phone", invalid).Info("SMS send ignore bad phone")
+			gate.Metrics.Handled(mx.name, outcomeIncorrect)
+			return mh.client.Send(gate.getMessage(data.From, responses.Incorrect, invalid))
+		}
+	}
+	if len(to) == 0 { // phone number not found
 		logEntry.Info("SMS send ignore: no phone")
-		//zabbixLog.Send("gw.sms.unknown.destination", "no phone")
-		return mh.client.Send(mh.getMessage(data.From, mh.Responses.NoPhone))
+		gate.Metrics.Handled(mx.name, outcomeNoPhone)
+		return mh.client.Send(gate.getMessage(data.From, responses.NoPhone))
 	}
-	phone := submatch[1] // phone number found in the message
-	// analyze the length of the phone number and bring the number to the standard
-	switch l := len(phone); {
-	case l >= 3 && l <= 6 && l == mh.Short: // this is a short number - leave as is
-	case l >= 7 && l == 11-len(mh.Prefix): // not full number - without prefix
-		phone = fmt.Sprintf("%s%s", mh.Prefix, phone)
-	case l == 11 && phone[1] != '0': // full phone number
-		phone = fmt.Sprintf("%s", phone)
-	default: // unclear phone number length or invalid number
-		logEntry.WithField("phone", phone).Info("SMS send ignore bad phone")
-		//zabbixLog.Send("gw.sms.unknown.destination", phone)
-		return mh.client.Send(mh.getMessage(data.From, mh.Responses.Incorrect, phone))
+	var media []sms.Media
+	if msg.media != "" {
+		mediaURL, err := url.Parse(msg.media)
+		if err != nil || mediaURL.Host == "" {
+			logEntry.WithField("url", msg.media).Info("MMS send ignore bad media URL")
+			gate.Metrics.Handled(mx.name, outcomeIncorrect)
+			return mh.client.Send(gate.getMessage(data.From, responses.Error, "invalid media URL"))
+		}
+		media = []sms.Media{{URL: mediaURL.String()}}
 	}
+	if len(to) > 1 {
+		return mh.sendGroup(gate, mx, data, logEntry, to, text, media)
+	}
+	return mh.send(gate, mx, data, logEntry, to[0], text, media)
+}
+
+// send sends the message of the MX user to the phone and confirms it in the chat.
+func (mh *MessageHandle) send(gate *SMSGate, mx *MX, data *incommingMessage, logEntry *logrus.Entry,
+	phone, text string, media []sms.Media) error {
+	responses := gate.templates()
 	logEntry = logEntry.WithField("phone", phone)
 	// now let's deal with the message text: send SMS message
-	err = mh.SMSGate.Send(mh.name, data.From, data.MsgID, phone, submatch[2])
+	err := gate.SendMMS(mx.name, data.From, data.MsgID, phone, text, media)
 	if err != nil { // message not sent
 		logEntry.WithError(err).Info("SMS send error")
-		//zabbixLog.Send("gw.sms.delivery.error", err.Error())
-		return mh.client.Send(mh.getMessage(data.From, mh.Responses.Error, err.Error()))
+		gate.Metrics.Handled(mx.name, outcomeError)
+		return mh.client.Send(gate.getMessage(data.From, responses.Error, err.Error()))
 	}
 	logEntry.Info("SMS send to phone") // message successfully sent
-	if err = mh.client.Send(mh.getMessage(data.From, mh.Responses.Accepted, phone)); err != nil {
-		return
+	gate.Metrics.Handled(mx.name, outcomeAccepted)
+	return mh.client.Send(gate.getMessage(data.From, responses.Accepted, phone))
+}
+
+// sendGroup sends the message of the MX user to each of the phones and confirms
+// it in the chat with the results by recipient. Replies of the recipients are
+// routed back to the user as for the single messages.
+func (mh *MessageHandle) sendGroup(gate *SMSGate, mx *MX, data *incommingMessage, logEntry *logrus.Entry,
+	phones []string, text string, media []sms.Media) error {
+	group := gate.templates().Group
+	if group == "" {
+		group = "SMS sent to %s of %s recipients:\n%s"
+	}
+	results := make([]string, len(phones))
+	var sent int
+	for i, phone := range phones {
+		logEntry := logEntry.WithField("phone", phone)
+		if err := gate.SendMMS(mx.name, data.From, data.MsgID, phone, text, media); err != nil {
+			logEntry.WithError(err).Info("SMS send error")
+			gate.Metrics.Handled(mx.name, outcomeError)
+			results[i] = fmt.Sprintf("%s: %s", phone, err)
+			continue
+		}
+		logEntry.Info("SMS send to phone")
+		gate.Metrics.Handled(mx.name, outcomeAccepted)
+		results[i] = phone + ": accepted"
+		sent++
 	}
-	return
+	return mh.client.Send(gate.getMessage(data.From, group, strconv.Itoa(sent), strconv.Itoa(len(phones)), strings.Join(results, "\n")))
 }
 
 // incommingMessage describes an incoming message.
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestParseMessage(t *testing.T) {
+	for body, want := range map[string]parsedMessage{
+		"4085555678 see you at 5":                               {recipients: "4085555678", text: "see you at 5"},
+		"MMS 4085555678, @sales https://example.com/a.jpg look": {recipients: "4085555678, @sales", media: "https://example.com/a.jpg", text: "look"},
+		"mms +14085555678 http://example.com/a.jpg":             {recipients: "+14085555678", media: "http://example.com/a.jpg"},
+		"MMS is down again":                                     {text: "MMS is down again"}, // goes to the /to recipient
+		"MMS 4085555678 is down again":                          {text: "MMS 4085555678 is down again"},
+		"MMS 4085555678 ftp://example.com/a.jpg":                {text: "MMS 4085555678 ftp://example.com/a.jpg"},
+		"see you at 5":                                          {text: "see you at 5"},
+	} {
+		if got := parseMessage(body); got != want {
+			t.Errorf("%q: %+v, want %+v", body, got, want)
+		}
+	}
+}
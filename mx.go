@@ -1,14 +1,28 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
 	"github.com/sirupsen/logrus"
+	"mxsms/health"
+	"mxsms/phone"
+	"mxsms/supervisor"
 )
 
 // PhoneInfo describes rules for parsing phone numbers
 type PhoneInfo struct {
-	Short  int               `yaml:",omitempty"`              // length of short phone number
-	Prefix string            `yaml:"defaultPrefix,omitempty"` // prefix for incomplete phone number
-	From   map[string]string // list of outgoing phone numbers
+	Region string                `yaml:"region,omitempty" json:"region,omitempty"`               // default region of the national numbers, such as US
+	Short  int                   `yaml:"short,omitempty" json:"short,omitempty"`                 // length of short phone number
+	Prefix string                `yaml:"defaultPrefix,omitempty" json:"defaultPrefix,omitempty"` // prefix for incomplete phone number
+	From   map[string]string     `yaml:"from" json:"from"`                                       // outgoing phone numbers and their carriers
+	Types  map[string]phone.Type `yaml:"types,omitempty" json:"types,omitempty"`                 // kinds of the From numbers, classified by the number if not set
+	Pool   NumberPool            `yaml:"pool,omitempty" json:"pool,omitempty"`                   // allocation of the outgoing numbers
+	Groups map[string][]string   `yaml:"groups,omitempty" json:"groups,omitempty"`               // contact groups texted as @name
 }
 
 // MX describes the service configuration, including necessary data for connecting to the server
@@ -20,13 +34,139 @@ type MX struct {
 	PhoneInfo      `yaml:"phones" json:"phones"` // information for parsing phone numbers
 	DefaultJID     string                        `yaml:"defaultJID,omitempty" json:"defaultJID,omitempty"` // where to deliver unknown messages
 	Disabled       bool                          `yaml:",omitempty" json:"disabled,omitempty"`             // flag for ignored service
-	Logger         *logrus.Entry                 `yaml:"-"`                                                // log for outputting service information
-	handler        *MessageHandle                // chat message handler
-	client         *csta_old.Client              // client for connection to MX-server
+	Logger         *logrus.Entry                 `yaml:"-" json:"-"`                                       // log for outputting service information
+	conn           *mxConn                       // connection kept by the reload if the server is unchanged
+}
+
+const maxPending = 1000 // incoming messages kept for the MX users until the login
+
+// mxConn describes the running connection to the MX server. It's shared by the
+// reloaded MX settings when only the phone settings are changed.
+type mxConn struct {
+	handler    *MessageHandle         // chat message handler
+	client     *csta_old.Client       // client for connection to MX-server, nil until the login
+	state      health.State           // connection state, for the health checks
+	supervisor *supervisor.Supervisor // reconnects after the failures
+	pending    []*sendMessage         // messages to the MX users sent after the login
+	mu         sync.Mutex             // guards the client and the pending messages
+}
+
+// deliver sends the message to the MX user or, while the connection is not
+// logged in, keeps it to send after the login, dropping the oldest kept one if
+// there are too many. It reports whether the message was sent.
+func (c *mxConn) deliver(msg *sendMessage) (sent bool, err error) {
+	if msg == nil {
+		return false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		if len(c.pending) >= maxPending {
+			c.pending = c.pending[1:]
+		}
+		c.pending = append(c.pending, msg)
+		return false, nil
+	}
+	return true, c.client.Send(msg)
+}
+
+// login sets the client of the logged in connection and sends it the pending
+// messages; nil clears it after the connection is lost.
+func (c *mxConn) login(client *csta_old.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = client
+	for client != nil && len(c.pending) > 0 {
+		if err := client.Send(c.pending[0]); err != nil {
+			return err
+		}
+		c.pending = c.pending[1:]
+	}
+	return nil
 }
 
-// Connect establishes a connection and starts the service.
-func (mx *MX) Connect() error {
+// loggedIn returns the client of the logged in connection or nil.
+func (c *mxConn) loggedIn() *csta_old.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// region returns the default region of the national numbers: the configured
+// one or the region of the calling code in the default prefix; the North
+// American numbering plan if neither is set.
+func (p PhoneInfo) region() string {
+	if p.Region != "" {
+		return p.Region
+	}
+	if r := phone.ByCallingCode(p.Prefix); r != nil {
+		return r.Code
+	}
+	return "US"
+}
+
+// senderType returns the kind of the outgoing number: the configured one or the
+// one classified by the number.
+func (p PhoneInfo) senderType(from string) phone.Type {
+	if kind := p.Types[from]; kind != "" {
+		return kind
+	}
+	return phone.Classify(from)
+}
+
+// parse parses the phone number written by the MX user. Numbers of the short
+// length are kept as short codes; incomplete ones are completed with the
+// default prefix.
+func (p PhoneInfo) parse(number string) (phone.Number, error) {
+	if p.Short > 0 && len(number) == p.Short && digitsRE.MatchString(number) {
+		return phone.Number{Digits: number, Region: p.region(), Type: phone.ShortCode}, nil
+	}
+	parsed, err := phone.Parse(number, p.region())
+	if err != nil && p.Prefix != "" && digitsRE.MatchString(number) {
+		if parsed, err := phone.Parse("+"+p.Prefix+number, ""); err == nil && !parsed.OutOfPlan() {
+			return parsed, nil
+		}
+	}
+	return parsed, err
+}
+
+// recipients returns the phone numbers of the comma-separated list of numbers
+// and @group names, without duplicates. The invalid number or the unknown group
+// is returned if there is one.
+func (p PhoneInfo) recipients(list string) (phones []string, invalid string) {
+	var numbers []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if !strings.HasPrefix(item, "@") {
+			numbers = append(numbers, item)
+		} else if group, ok := p.Groups[item[1:]]; ok {
+			numbers = append(numbers, group...)
+		} else {
+			return nil, item
+		}
+	}
+	for _, number := range numbers {
+		parsed, err := p.parse(number)
+		if err != nil {
+			return nil, number
+		}
+		if !includes(phones, parsed.String()) {
+			phones = append(phones, parsed.String())
+		}
+	}
+	return phones, ""
+}
+
+// sameConnection reports whether the server address and the login are the same,
+// so the running connection can be kept by the reload.
+func (mx *MX) sameConnection(other *MX) bool {
+	return reflect.DeepEqual(mx.Addr, other.Addr) && reflect.DeepEqual(mx.Login, other.Login)
+}
+
+// Connect establishes a connection and starts the service. The up function is
+// called after the login; rejected logins are reported as authorization
+// failures.
+func (mx *MX) Connect(up func()) error {
 	if mx.Logger == nil { // initialize log support
 		mx.Logger = logrus.NewEntry(logrus.StandardLogger())
 	}
@@ -48,14 +188,21 @@ func (mx *MX) Connect() error {
 	defer client.Close()
 	client.Logger = mx.Logger
 	// initialize message handler
-	mx.handler = NewMessageHandler(config.SMSGate, mx)
-	client.AddHandler(mx.handler)
+	mx.conn.handler = NewMessageHandler(mx.name)
+	client.AddHandler(mx.conn.handler)
 	if err := client.Login(mx.Login); err != nil {
 		mx.Logger.WithError(err).Error("Authorizing error")
-		return err // error sending authorization command to the server
+		return loginError(err) // error sending authorization command to the server
 	}
 	mx.Logger.WithField("login", mx.Login.User).Info("MX Authorized")
-	mx.client = client
+	defer mx.conn.login(nil)
+	if err := mx.conn.login(client); err != nil {
+		mx.Logger.WithError(err).Error("MX pending messages error")
+		return err
+	}
+	if up != nil {
+		up()
+	}
 	// start the process of reading responses from the server
 	err = client.Reading()
 	if err != nil {
@@ -64,11 +211,23 @@ func (mx *MX) Connect() error {
 	return err
 }
 
-// Close stops the running service.
+// loginError marks the login error as an authorization failure unless the
+// connection is lost.
+func loginError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return supervisor.AuthError(err)
+}
+
+// Close stops reconnecting and the running service.
 func (mx *MX) Close() error {
-	if mx.client == nil {
+	mx.conn.supervisor.Stop()
+	client := mx.conn.loggedIn()
+	if client == nil {
 		return nil // client connection to the server is not initialized
 	}
 	mx.Logger.Info("MX Close")
-	return mx.client.Close() // stop connection to the server
+	return client.Close() // stop connection to the server
 }
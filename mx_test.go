@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"mxsms/phone"
+)
+
+func TestPhoneInfoParse(t *testing.T) {
+	for _, test := range []struct {
+		phones PhoneInfo
+		number string
+		want   string
+	}{
+		{PhoneInfo{Prefix: "1"}, "4085551234", "14085551234"},
+		{PhoneInfo{}, "+447400123456", "447400123456"},
+		{PhoneInfo{Region: "GB"}, "07400123456", "447400123456"},
+		{PhoneInfo{Region: "GB", Short: 4}, "1234", "1234"},
+		{PhoneInfo{Prefix: "7495"}, "1234567", "74951234567"}, // local number of the city
+		{PhoneInfo{Prefix: "1"}, "0405551234", ""},
+	} {
+		number, err := test.phones.parse(test.number)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q accepted as %s", test.number, number)
+			}
+			continue
+		}
+		if err != nil || number.String() != test.want {
+			t.Errorf("%q: %s %v", test.number, number, err)
+		}
+	}
+	if region := (PhoneInfo{Prefix: "44"}).region(); region != "GB" || phone.Lookup(region) == nil {
+		t.Errorf("region %q", region)
+	}
+}
+
+func TestPhoneInfoRecipients(t *testing.T) {
+	phones := PhoneInfo{Region: "US", Groups: map[string][]string{
+		"sales": {"408 555 1234", "+447400123456"},
+	}}
+	list, invalid := phones.recipients("4085555678, @sales,14085551234")
+	if invalid != "" || strings.Join(list, ",") != "14085555678,14085551234,447400123456" {
+		t.Errorf("recipients %v %q", list, invalid)
+	}
+	if _, invalid := phones.recipients("4085555678,@support"); invalid != "@support" {
+		t.Errorf("unknown group %q", invalid)
+	}
+	if _, invalid := phones.recipients("4085555678,0405551234"); invalid != "0405551234" {
+		t.Errorf("invalid number %q", invalid)
+	}
+	if match := recipientsRE.FindStringSubmatch("4085555678, @sales see you at 5"); match == nil ||
+		match[1] != "4085555678, @sales" || match[2] != "see you at 5" {
+		t.Errorf("recipients match %q", match)
+	}
+}
+
+func TestMXConnPending(t *testing.T) {
+	conn := new(mxConn)
+	for i := 0; i < maxPending+1; i++ { // not logged in: kept without blocking
+		if sent, err := conn.deliver(&sendMessage{To: "jid1", Body: strconv.Itoa(i)}); sent || err != nil {
+			t.Fatalf("sent %v: %v", sent, err)
+		}
+	}
+	if len(conn.pending) != maxPending || conn.pending[0].Body != "1" {
+		t.Errorf("%d pending, the oldest %q", len(conn.pending), conn.pending[0].Body)
+	}
+	if sent, err := conn.deliver(nil); sent || err != nil || len(conn.pending) != maxPending {
+		t.Errorf("no message: %v %v", sent, err)
+	}
+	if conn.loggedIn() != nil {
+		t.Error("logged in without the client")
+	}
+}
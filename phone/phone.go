@@ -0,0 +1,250 @@
+// Package phone parses the phone numbers written in the national or the
+// international format with the numbering plans of the libphonenumber metadata,
+// normalizes them to E.164 and classifies them. The gateway keeps the numbers
+// as the international digits without the plus, and the short codes as they
+// are dialed.
+package phone
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Type is the kind of the phone number.
+type Type string
+
+// Types of the phone numbers.
+const (
+	Unknown       Type = "unknown"       // international number out of the numbering plans
+	FixedLine     Type = "fixedLine"     // geographic number
+	Mobile        Type = "mobile"        // mobile number
+	FixedOrMobile Type = "fixedOrMobile" // the numbering plan doesn't tell them apart
+	TollFree      Type = "tollFree"      // toll-free number
+	Service       Type = "service"       // premium-rate, shared-cost, VoIP, personal and other services
+	ShortCode     Type = "shortCode"     // short code dialed within the region
+	International Type = "international" // any international number, for the sender kinds
+	Alphanumeric  Type = "alphanumeric"  // sender ID made of letters and digits
+)
+
+// SMPP type of number (TON) and numbering plan indicator (NPI) values.
+const (
+	TONUnknown       = 0
+	TONInternational = 1
+	TONNational      = 2
+	TONNetwork       = 3 // network specific, used for the short codes
+	TONAlphanumeric  = 5
+	NPIUnknown       = 0
+	NPIISDN          = 1 // E.164
+)
+
+const (
+	maxDigits       = 15 // E.164 numbers without the plus
+	minDigits       = 8  // international numbers out of the numbering plans
+	maxShortCode    = 6  // longest short code
+	maxAlphanumeric = 11 // longest alphanumeric sender ID
+)
+
+// senderChars lists the characters of the alphanumeric sender IDs: the ones
+// the GSM 7-bit default alphabet encodes as ASCII.
+const senderChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789 !\"#%&'()*+,-./:;<=>?"
+
+// ErrInvalid is returned for the numbers not valid in their region.
+var ErrInvalid = errors.New("invalid phone number")
+
+// Number is the parsed phone number.
+type Number struct {
+	Digits      string // international digits without the plus, or the short code
+	CallingCode string // country calling code, empty if it's unknown or the short code
+	Region      string // ISO 3166-1 code of the region, empty if it's unknown
+	Type        Type
+}
+
+// Parse parses the number written in the international format, with the plus
+// or the international prefix of the region, or in the national format of the
+// region. The digits may be separated with spaces, dashes, dots and brackets.
+// The national numbers of the region are preferred to the international ones
+// written without the plus. Unknown or empty regions parse only the
+// international numbers.
+func Parse(number, region string) (Number, error) {
+	digits, international := clean(number)
+	if digits == "" {
+		return Number{}, fmt.Errorf("%w: %q", ErrInvalid, number)
+	}
+	if !international && Lookup(region) != nil {
+		if len(digits) <= maxShortCode {
+			if n, err := phonenumbers.Parse(digits, region); err == nil &&
+				phonenumbers.IsPossibleShortNumberForRegion(n, region) {
+				return Number{Digits: digits, Region: region, Type: ShortCode}, nil
+			}
+		}
+		// also the numbers with the international prefix of the region
+		if n, err := phonenumbers.Parse(digits, region); err == nil && phonenumbers.IsValidNumber(n) {
+			return parsed(n), nil
+		}
+	}
+	if n, ok := parseInternational(digits, international); ok {
+		return n, nil
+	}
+	return Number{}, fmt.Errorf("%w: %q", ErrInvalid, number)
+}
+
+// clean returns the digits of the number and whether it starts with the plus.
+// It returns no digits if there are other characters.
+func clean(number string) (digits string, plus bool) {
+	number = strings.TrimSpace(number)
+	if strings.HasPrefix(number, "+") {
+		number, plus = number[1:], true
+	}
+	var b strings.Builder
+	for _, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", plus
+		}
+	}
+	return b.String(), plus
+}
+
+// parseInternational parses the international number without the plus. The
+// numbers the numbering plans don't describe are accepted as Unknown only if
+// the plus was written: the plans may be behind the numbers in use.
+func parseInternational(digits string, plus bool) (Number, bool) {
+	if len(digits) > maxDigits {
+		return Number{}, false
+	}
+	n, err := phonenumbers.Parse("+"+digits, phonenumbers.UNKNOWN_REGION)
+	if err == nil && phonenumbers.IsValidNumber(n) {
+		return parsed(n), true
+	}
+	if !plus || len(digits) < minDigits {
+		return Number{}, false
+	}
+	var callingCode string
+	if err == nil && n.GetCountryCode() != 0 {
+		callingCode = strconv.Itoa(int(n.GetCountryCode()))
+	}
+	return Number{Digits: digits, CallingCode: callingCode, Type: Unknown}, true
+}
+
+// parsed returns the valid number parsed with the metadata.
+func parsed(n *phonenumbers.PhoneNumber) Number {
+	callingCode := strconv.Itoa(int(n.GetCountryCode()))
+	number := Number{
+		Digits:      callingCode + phonenumbers.GetNationalSignificantNumber(n),
+		CallingCode: callingCode,
+		Type:        Service,
+	}
+	if region := phonenumbers.GetRegionCodeForNumber(n); Lookup(region) != nil {
+		number.Region = region
+	}
+	switch phonenumbers.GetNumberType(n) {
+	case phonenumbers.FIXED_LINE:
+		number.Type = FixedLine
+	case phonenumbers.MOBILE:
+		number.Type = Mobile
+	case phonenumbers.FIXED_LINE_OR_MOBILE:
+		number.Type = FixedOrMobile
+	case phonenumbers.TOLL_FREE:
+		number.Type = TollFree
+	}
+	return number
+}
+
+// String returns the number as the gateway keeps it: the international digits
+// without the plus or the short code.
+func (n Number) String() string {
+	return n.Digits
+}
+
+// E164 returns the number in the E.164 format with the plus, or the short code.
+func (n Number) E164() string {
+	if n.Type == ShortCode {
+		return n.Digits
+	}
+	return "+" + n.Digits
+}
+
+// National returns the national significant number, or the short code.
+func (n Number) National() string {
+	return strings.TrimPrefix(n.Digits, n.CallingCode)
+}
+
+// OutOfPlan reports whether the number has a known calling code but doesn't
+// fit its numbering plan: it's accepted only as written with
+// the plus.
+func (n Number) OutOfPlan() bool {
+	return n.Type == Unknown && n.CallingCode != ""
+}
+
+// SMPP returns the type of number and the numbering plan indicator of the
+// number used as the SMPP address.
+func (n Number) SMPP() (ton, npi int) {
+	return n.Type.SMPP()
+}
+
+// SMPP returns the type of number and the numbering plan indicator of the
+// address of the kind. Addresses of no kind are unknown.
+func (t Type) SMPP() (ton, npi int) {
+	switch t {
+	case "":
+		return TONUnknown, NPIUnknown
+	case ShortCode:
+		return TONNetwork, NPIUnknown
+	case Alphanumeric:
+		return TONAlphanumeric, NPIUnknown
+	}
+	return TONInternational, NPIISDN
+}
+
+// Classify returns the kind of the address kept by the gateway: ShortCode for
+// the digits up to the length of the short codes, International for the longer
+// ones, Alphanumeric for the sender IDs, and no kind for other addresses.
+func Classify(addr string) Type {
+	digits := strings.TrimPrefix(addr, "+")
+	switch {
+	case digits == "":
+		return ""
+	case strings.Trim(digits, "0123456789") == "":
+		if len(digits) <= maxShortCode {
+			return ShortCode
+		}
+		return International
+	case IsAlphanumeric(addr):
+		return Alphanumeric
+	}
+	return ""
+}
+
+// IsAlphanumeric reports whether the address is a valid alphanumeric sender ID:
+// up to 11 characters of the GSM 7-bit default alphabet with a letter.
+func IsAlphanumeric(addr string) bool {
+	if addr == "" || len(addr) > maxAlphanumeric || strings.Trim(addr, senderChars) != "" {
+		return false
+	}
+	return strings.IndexFunc(addr, func(r rune) bool {
+		return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z'
+	}) >= 0
+}
+
+// Normalize returns the number as the gateway keeps it, parsed with the region.
+// Numbers that can't be parsed, such as the alphanumeric senders, are returned
+// without the plus.
+func Normalize(number, region string) string {
+	if n, err := Parse(number, region); err == nil {
+		return n.String()
+	}
+	return strings.TrimPrefix(number, "+")
+}
+
+// Address returns the type of number and the numbering plan indicator of the
+// address kept by the gateway, classified with Classify.
+func Address(addr string) (ton, npi int) {
+	return Classify(addr).SMPP()
+}
@@ -0,0 +1,116 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		number, region string
+		digits         string
+		typ            Type
+		numberRegion   string
+	}{
+		{"4085551234", "US", "14085551234", FixedOrMobile, "US"},
+		{"1 (408) 555-1234", "US", "14085551234", FixedOrMobile, "US"},
+		{"+14085551234", "", "14085551234", FixedOrMobile, "US"},
+		{"14085551234", "", "14085551234", FixedOrMobile, "US"},
+		{"011 44 7400 123456", "US", "447400123456", Mobile, "GB"},
+		{"8005551234", "US", "18005551234", TollFree, "US"},
+		{"22395", "US", "22395", ShortCode, "US"},
+		{"447400123456", "US", "447400123456", Mobile, "GB"},
+		{"07400 123456", "GB", "447400123456", Mobile, "GB"},
+		{"020 7946 0018", "GB", "442079460018", FixedLine, "GB"},
+		{"0800 123 4567", "GB", "448001234567", TollFree, "GB"},
+		{"8 916 123-45-67", "RU", "79161234567", Mobile, "RU"},
+		{"+7 495 123-45-67", "US", "74951234567", FixedLine, "RU"},
+		{"06 12345678", "NL", "31612345678", Mobile, "NL"},
+		{"0412 345 678", "AU", "61412345678", Mobile, "AU"},
+		{"98765 43210", "IN", "919876543210", Mobile, "IN"},
+		{"11 91234-5678", "BR", "5511912345678", Mobile, "BR"},
+		{"+2348012345678", "US", "2348012345678", Mobile, "NG"},
+		{"+7 701 123 4567", "US", "77011234567", Mobile, "KZ"}, // Kazakhstan shares +7 with RU
+		{"(514) 555-0199", "CA", "15145550199", FixedOrMobile, "CA"},
+		{"070-123 45 67", "SE", "46701234567", Mobile, "SE"},
+		{"090-1234-5678", "JP", "819012345678", Mobile, "JP"},
+		{"+1 999 555 1234", "US", "19995551234", Unknown, ""}, // out of the plan with the plus
+		{"+99912345678", "US", "99912345678", Unknown, ""},    // unassigned calling code
+		{"+447400123456", "XX", "447400123456", Mobile, "GB"}, // unknown region
+	} {
+		n, err := Parse(test.number, test.region)
+		if err != nil {
+			t.Errorf("%q in %s: %v", test.number, test.region, err)
+			continue
+		}
+		if n.Digits != test.digits || n.Type != test.typ || n.Region != test.numberRegion {
+			t.Errorf("%q in %s: %+v", test.number, test.region, n)
+		}
+	}
+	if n, _ := Parse("+7 000 123 4567", ""); !n.OutOfPlan() || n.CallingCode != "7" {
+		t.Errorf("+7 number out of the plan: %+v", n)
+	}
+	for _, test := range []struct{ number, region string }{
+		{"0405551234", "US"},      // area codes don't start with 0
+		{"40855512", "US"},        // too short
+		{"19995551234", ""},       // out of the plan without the plus
+		{"+1408555123456789", ""}, // too long for E.164
+		{"4085551234", "XX"},      // national number of the unknown region
+		{"408-CALL-NOW", "US"},
+		{"", "US"},
+	} {
+		if n, err := Parse(test.number, test.region); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q in %s: %+v %v", test.number, test.region, n, err)
+		}
+	}
+}
+
+func TestNumberFormat(t *testing.T) {
+	n, err := Parse("07400 123456", "GB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.E164() != "+447400123456" || n.National() != "7400123456" || n.String() != "447400123456" {
+		t.Errorf("formats %q %q %q", n.E164(), n.National(), n.String())
+	}
+	if ton, npi := n.SMPP(); ton != TONInternational || npi != NPIISDN {
+		t.Errorf("international TON/NPI %d/%d", ton, npi)
+	}
+	short, _ := Parse("22395", "US")
+	if ton, npi := short.SMPP(); ton != TONNetwork || npi != NPIUnknown || short.E164() != "22395" {
+		t.Errorf("short code TON/NPI %d/%d", ton, npi)
+	}
+	for addr, want := range map[string]int{
+		"14085551234":  TONInternational,
+		"+14085551234": TONInternational,
+		"12345":        TONNetwork,
+		"Example":      TONAlphanumeric,
+		"Example@Home": TONUnknown,
+	} {
+		if ton, _ := Address(addr); ton != want {
+			t.Errorf("%q TON %d", addr, ton)
+		}
+	}
+	if normalized := Normalize("+Example", "US"); normalized != "Example" {
+		t.Errorf("normalized %q", normalized)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for addr, want := range map[string]Type{
+		"14085551234":   International,
+		"+447400123456": International,
+		"22395":         ShortCode,
+		"ACME Bank":     Alphanumeric,
+		"Shop-24":       Alphanumeric,
+		"123456789012":  International,
+		"ACME Bank Ltd": "", // too long
+		"Café":          "", // not in the GSM alphabet as ASCII
+		"ACME@":         "",
+		"":              "",
+	} {
+		if kind := Classify(addr); kind != want {
+			t.Errorf("%q: %q", addr, kind)
+		}
+	}
+}
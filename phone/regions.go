@@ -0,0 +1,32 @@
+package phone
+
+import (
+	"strconv"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Region is the country or territory of the numbering plan.
+type Region struct {
+	Code        string // ISO 3166-1 alpha-2 code, such as US
+	CallingCode string // country calling code without the plus
+}
+
+// Lookup returns the region by the ISO 3166-1 code or nil if it's unknown.
+func Lookup(code string) *Region {
+	callingCode := phonenumbers.GetCountryCodeForRegion(code)
+	if callingCode == 0 {
+		return nil
+	}
+	return &Region{Code: code, CallingCode: strconv.Itoa(callingCode)}
+}
+
+// ByCallingCode returns the main region of the country calling code or nil if
+// it's unknown or not geographic.
+func ByCallingCode(callingCode string) *Region {
+	code, err := strconv.Atoi(callingCode)
+	if err != nil {
+		return nil
+	}
+	return Lookup(phonenumbers.GetRegionCodeForCountryCode(code))
+}
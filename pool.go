@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"mxsms/conf"
+)
+
+// Number pool policies selecting the outgoing number for a new conversation.
+const (
+	PolicyLeastRecent = "leastRecent" // the number used least recently, the default
+	PolicyRoundRobin  = "roundRobin"  // the numbers in turn
+	PolicyHash        = "hash"        // the number by the hash of the recipient
+	PolicyDedicated   = "dedicated"   // the number assigned to the user
+	PolicyChosen      = "chosen"      // the number chosen by the user with /from, not configurable
+)
+
+// ErrPoolExhausted is returned when all numbers of the pool reached the daily cap.
+var ErrPoolExhausted = errors.New("daily limit reached for all phone numbers")
+
+// NumberPool describes how the outgoing numbers of the MX server are allocated.
+// The number used for the user and recipient is kept while the conversation
+// goes on, then a new one is selected with the policy.
+type NumberPool struct {
+	Policy    string            `yaml:"policy,omitempty" json:"policy,omitempty"`       // leastRecent, roundRobin, hash or dedicated
+	Sticky    conf.Duration     `yaml:"sticky,omitempty" json:"sticky,omitempty"`       // how long the number is kept, as long as the history if empty
+	DailyCap  int               `yaml:"dailyCap,omitempty" json:"dailyCap,omitempty"`   // messages per number and day, unlimited if zero
+	Caps      map[string]int    `yaml:"caps,omitempty" json:"caps,omitempty"`           // daily caps of the numbers, if differ
+	Dedicated map[string]string `yaml:"dedicated,omitempty" json:"dedicated,omitempty"` // JID -> number for the dedicated policy
+}
+
+// Allocation describes the pool member selected for a message.
+type Allocation struct {
+	From   string // outgoing number
+	Policy string // policy that selected the number
+	Sticky bool   // the number was kept from the conversation
+}
+
+// NumberAllocator selects the outgoing numbers and counts the messages sent
+// from them. It is kept across configuration reloads, so the daily caps hold.
+type NumberAllocator struct {
+	usage map[string]*numberUsage // usage by number
+	next  map[string]int          // round-robin position by MX server name
+	mu    sync.Mutex
+}
+
+// numberUsage describes the use of a number.
+type numberUsage struct {
+	day   string    // day the count belongs to
+	count int       // messages sent during the day
+	last  time.Time // last time a message was sent
+}
+
+// Allocate selects the outgoing number of the MX server for the message from the
+// user to the recipient.
+func (a *NumberAllocator) Allocate(mx *MX, history *History, to, jid string) (Allocation, error) {
+	pool := mx.Pool
+	numbers := make([]string, 0, len(mx.From))
+	for number := range mx.From {
+		numbers = append(numbers, number)
+	}
+	if len(numbers) == 0 {
+		return Allocation{}, errors.New("from phone is empty")
+	}
+	sort.Strings(numbers) // the same order every time
+	sticky := time.Duration(pool.Sticky)
+	policy := pool.Policy
+	if policy == "" {
+		policy = PolicyLeastRecent
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.usage == nil {
+		a.usage = make(map[string]*numberUsage)
+		a.next = make(map[string]int)
+	}
+	// keep the number of the conversation
+	var (
+		stickyFrom string
+		sended     time.Time
+	)
+	for from, item := range history.list(to) {
+		if item.JID != jid || !hasKey(mx.From, from) {
+			continue
+		}
+		if sticky > 0 && time.Since(item.Sended) > sticky {
+			continue
+		}
+		if item.Sended.After(sended) && a.available(pool, from) {
+			stickyFrom, sended = from, item.Sended
+		}
+	}
+	if stickyFrom != "" {
+		return Allocation{From: stickyFrom, Policy: policy, Sticky: true}, nil
+	}
+	var from string
+	switch policy {
+	case PolicyLeastRecent:
+		var last time.Time
+		for _, number := range numbers {
+			if !a.available(pool, number) {
+				continue
+			}
+			if used := a.used(number); from == "" || used.Before(last) {
+				from, last = number, used
+			}
+		}
+	case PolicyRoundRobin:
+		start := a.next[mx.name]
+		for i := range numbers {
+			number := numbers[(start+i)%len(numbers)]
+			if a.available(pool, number) {
+				from = number
+				a.next[mx.name] = (start + i + 1) % len(numbers)
+				break
+			}
+		}
+	case PolicyHash:
+		from = a.hashed(pool, numbers, to)
+	case PolicyDedicated:
+		if number := pool.Dedicated[jid]; hasKey(mx.From, number) && a.available(pool, number) {
+			from = number
+		} else { // users without a number get one by the hash
+			from = a.hashed(pool, numbers, jid)
+		}
+	default:
+		return Allocation{}, fmt.Errorf("unsupported pool policy %q", policy)
+	}
+	if from == "" {
+		return Allocation{}, ErrPoolExhausted
+	}
+	return Allocation{From: from, Policy: policy}, nil
+}
+
+// Choose returns the outgoing number chosen by the user if it's below its daily
+// cap.
+func (a *NumberAllocator) Choose(mx *MX, from string) (Allocation, error) {
+	if !hasKey(mx.From, from) {
+		return Allocation{}, fmt.Errorf("unknown phone number %s", from)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.available(mx.Pool, from) {
+		return Allocation{}, fmt.Errorf("daily limit reached for %s", from)
+	}
+	return Allocation{From: from, Policy: PolicyChosen}, nil
+}
+
+// Sent counts the message sent from the number.
+func (a *NumberAllocator) Sent(from string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.usage == nil {
+		a.usage = make(map[string]*numberUsage)
+		a.next = make(map[string]int)
+	}
+	usage := a.usage[from]
+	if usage == nil {
+		usage = new(numberUsage)
+		a.usage[from] = usage
+	}
+	now := time.Now()
+	if day := now.Format("2006-01-02"); usage.day != day {
+		usage.day, usage.count = day, 0
+	}
+	usage.count++
+	usage.last = now
+}
+
+// Usage returns the number of messages sent from the numbers today.
+func (a *NumberAllocator) Usage() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	today := time.Now().Format("2006-01-02")
+	usage := make(map[string]int, len(a.usage))
+	for number, u := range a.usage {
+		if u.day == today {
+			usage[number] = u.count
+		}
+	}
+	return usage
+}
+
+// available reports whether the number is below its daily cap.
+func (a *NumberAllocator) available(pool NumberPool, number string) bool {
+	limit, ok := pool.Caps[number]
+	if !ok {
+		limit = pool.DailyCap
+	}
+	if limit <= 0 {
+		return true
+	}
+	usage := a.usage[number]
+	if usage == nil || usage.day != time.Now().Format("2006-01-02") {
+		return true
+	}
+	return usage.count < limit
+}
+
+// used returns the last time a message was sent from the number.
+func (a *NumberAllocator) used(number string) time.Time {
+	if usage := a.usage[number]; usage != nil {
+		return usage.last
+	}
+	return time.Time{}
+}
+
+// hashed returns the available number selected by the hash of the key. Numbers
+// over the cap are skipped in order.
+func (a *NumberAllocator) hashed(pool NumberPool, numbers []string, key string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	start := int(hash.Sum32() % uint32(len(numbers)))
+	for i := range numbers {
+		if number := numbers[(start+i)%len(numbers)]; a.available(pool, number) {
+			return number
+		}
+	}
+	return ""
+}
+
+// hasKey reports whether the map has the key.
+func hasKey(m map[string]string, key string) bool {
+	_, ok := m[key]
+	return ok
+}
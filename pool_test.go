@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"mxsms/conf"
+)
+
+func TestNumberAllocator(t *testing.T) {
+	froms := map[string]string{"100": "twilio", "200": "twilio", "300": "twilio"}
+	tests := []struct {
+		pool  NumberPool
+		sends [][2]string // jid and recipient
+		want  []string    // allocated numbers
+	}{
+		{
+			pool:  NumberPool{},
+			sends: [][2]string{{"jid1", "01"}, {"jid1", "02"}, {"jid2", "01"}, {"jid1", "01"}},
+			want:  []string{"100", "200", "300", "100"},
+		},
+		{
+			pool:  NumberPool{Policy: PolicyRoundRobin},
+			sends: [][2]string{{"jid1", "01"}, {"jid2", "01"}, {"jid2", "02"}, {"jid3", "02"}, {"jid2", "01"}},
+			want:  []string{"100", "200", "300", "100", "200"},
+		},
+		{
+			pool:  NumberPool{Policy: PolicyHash},
+			sends: [][2]string{{"jid1", "01"}, {"jid2", "01"}, {"jid3", "02"}, {"jid1", "03"}},
+			want:  []string{"100", "100", "200", "300"},
+		},
+		{
+			pool:  NumberPool{Policy: PolicyDedicated, Dedicated: map[string]string{"jid1": "200"}},
+			sends: [][2]string{{"jid1", "01"}, {"jid1", "02"}, {"jid2", "01"}, {"jid2", "02"}},
+			want:  []string{"200", "200", "300", "300"},
+		},
+		{ // the daily cap ends the conversation on the number
+			pool:  NumberPool{DailyCap: 1, Caps: map[string]int{"100": 2}},
+			sends: [][2]string{{"jid1", "01"}, {"jid1", "01"}, {"jid1", "01"}, {"jid1", "01"}},
+			want:  []string{"100", "100", "200", "300"},
+		},
+	}
+	for i, test := range tests {
+		var (
+			history History
+			numbers NumberAllocator
+		)
+		mx := &MX{name: "mx", PhoneInfo: PhoneInfo{From: froms, Pool: test.pool}}
+		for j, send := range test.sends {
+			allocation, err := numbers.Allocate(mx, &history, send[1], send[0])
+			if err != nil {
+				t.Fatalf("%d/%d: %v", i, j, err)
+			}
+			if allocation.From != test.want[j] {
+				t.Errorf("%d/%d: %+v, want %s", i, j, allocation, test.want[j])
+			}
+			history.Add("mx", send[0], allocation.From, send[1])
+			numbers.Sent(allocation.From)
+			time.Sleep(time.Millisecond) // distinct send times
+		}
+	}
+}
+
+func TestNumberAllocatorLimits(t *testing.T) {
+	var (
+		history History
+		numbers NumberAllocator
+	)
+	mx := &MX{name: "mx", PhoneInfo: PhoneInfo{
+		From: map[string]string{"100": "twilio"},
+		Pool: NumberPool{DailyCap: 1, Sticky: conf.Duration(time.Hour)},
+	}}
+	history.Add("mx", "jid1", "100", "01")
+	allocation, err := numbers.Allocate(mx, &history, "01", "jid1")
+	if err != nil || !allocation.Sticky {
+		t.Errorf("conversation number not kept: %+v %v", allocation, err)
+	}
+	numbers.Sent("100")
+	if _, err := numbers.Allocate(mx, &history, "02", "jid1"); err != ErrPoolExhausted {
+		t.Errorf("cap not applied: %v", err)
+	}
+	if usage := numbers.Usage(); usage["100"] != 1 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+	// pairings older than the sticky period select the number again
+	mx.Pool = NumberPool{Sticky: conf.Duration(time.Hour)}
+	history.Store.Add("100", "03", historyItem{MXName: "mx", JID: "jid1", Sended: time.Now().Add(-time.Hour * 2)})
+	if allocation, err := numbers.Allocate(mx, &history, "03", "jid1"); err != nil || allocation.Sticky {
+		t.Errorf("stale conversation kept: %+v %v", allocation, err)
+	}
+}
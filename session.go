@@ -0,0 +1,275 @@
+package main
+
+import (
+	"time"
+
+	"mxsms/smpp"
+	"mxsms/sms"
+	"mxsms/sqlog"
+)
+
+const maxRecent = 50 // messages kept in the session for the history command
+
+// Session describes the chat state of the MX user: the recipient and the
+// outgoing number chosen with the chat commands, the sender to reply to and the
+// recent messages. The choices are saved in the History store, so they survive
+// the gateway restarts; the recent messages are kept in memory.
+type Session struct {
+	To      string        // sticky recipient chosen with /to
+	From    string        // outgoing number chosen with /from
+	ReplyTo string        // sender of the last incoming message, for /r
+	Recent  []chatMessage // recent messages, oldest first
+}
+
+// chatMessage describes a message sent or received by the MX user.
+type chatMessage struct {
+	ID       string    // gateway identifier of the outgoing message
+	Incoming bool      // received from the phone
+	Phone    string    // recipient or sender phone number
+	Text     string    // message text
+	Status   string    // state of the outgoing message, see sqlog statuses
+	Time     time.Time // sending or receiving time
+	parts    []string  // SMPP identifiers of the message parts
+}
+
+// sessionItem is the chat choices of the MX user saved in the history store.
+type sessionItem struct {
+	To      string `json:"to,omitempty"`      // sticky recipient
+	From    string `json:"from,omitempty"`    // outgoing number
+	ReplyTo string `json:"replyTo,omitempty"` // sender of the last incoming message
+}
+
+// choices returns the chat choices of the session to save.
+func (s *Session) choices() sessionItem {
+	if s == nil {
+		return sessionItem{}
+	}
+	return sessionItem{To: s.To, From: s.From, ReplyTo: s.ReplyTo}
+}
+
+// sessionKey identifies the session of the MX user.
+type sessionKey struct {
+	mx, jid string // MX server name and user identifier
+}
+
+// Session returns a copy of the chat session of the MX user.
+func (h *History) Session(mxName, jid string) Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	session := h.sessions[sessionKey{mxName, jid}]
+	if session == nil {
+		return Session{}
+	}
+	copied := *session
+	copied.Recent = append([]chatMessage(nil), session.Recent...)
+	return copied
+}
+
+// SetRecipient sets the sticky recipient of the MX user; empty clears it.
+func (h *History) SetRecipient(mxName, jid, to string) {
+	h.update(mxName, jid, func(session *Session) { session.To = to })
+}
+
+// SetSender sets the outgoing number chosen by the MX user; empty returns the
+// choice to the number pool.
+func (h *History) SetSender(mxName, jid, from string) {
+	h.update(mxName, jid, func(session *Session) { session.From = from })
+}
+
+// update changes the session of the MX user, creating it if necessary, and
+// saves its changed choices in the store. It must be called without the lock
+// held.
+func (h *History) update(mxName, jid string, change func(*Session)) {
+	key := sessionKey{mxName, jid}
+	if h.change(key, change) {
+		h.saveSession(key)
+	}
+}
+
+// change changes the session and reports whether its choices were changed.
+func (h *History) change(key sessionKey, change func(*Session)) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions == nil {
+		h.sessions = make(map[sessionKey]*Session)
+		h.parts = make(map[string]sessionKey)
+	}
+	session := h.sessions[key]
+	if session == nil {
+		session = new(Session)
+		h.sessions[key] = session
+	}
+	choices := session.choices()
+	change(session)
+	if extra := len(session.Recent) - maxRecent; extra > 0 { // forget the oldest messages
+		for _, msg := range session.Recent[:extra] {
+			for _, id := range msg.parts {
+				delete(h.parts, id)
+			}
+		}
+		session.Recent = append([]chatMessage(nil), session.Recent[extra:]...)
+	}
+	return session.choices() != choices
+}
+
+// saveSession saves the current choices of the session in the store.
+func (h *History) saveSession(key sessionKey) {
+	store := h.store()
+	h.saving.Lock()
+	defer h.saving.Unlock()
+	h.mu.Lock()
+	choices := h.sessions[key].choices()
+	h.mu.Unlock()
+	if err := store.SaveSession(key.mx, key.jid, choices); err != nil {
+		llog.WithError(err).Error("History session write error")
+	}
+}
+
+// loadSessions restores the chat choices saved in the store.
+func (h *History) loadSessions() error {
+	all, err := h.store().Sessions()
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for mxName, items := range all {
+		for jid, item := range items {
+			if h.sessions == nil {
+				h.sessions = make(map[sessionKey]*Session)
+				h.parts = make(map[string]sessionKey)
+			}
+			h.sessions[sessionKey{mxName, jid}] = &Session{To: item.To, From: item.From, ReplyTo: item.ReplyTo}
+		}
+	}
+	return nil
+}
+
+// chatSent adds the outgoing message of the MX user to the session.
+func (h *History) chatSent(msg *sms.SendMessage) {
+	h.update(msg.MXName, msg.JID, func(session *Session) {
+		session.Recent = append(session.Recent, chatMessage{
+			ID:     msg.ID,
+			Phone:  msg.To,
+			Text:   msg.Text,
+			Status: sqlog.StatusAccepted,
+			Time:   time.Now(),
+		})
+	})
+}
+
+// chatReceived adds the incoming message routed to the MX user to the session,
+// so /r replies to its sender.
+func (h *History) chatReceived(mxName, jid string, msg sms.Received) {
+	h.update(mxName, jid, func(session *Session) {
+		session.ReplyTo = msg.From
+		session.Recent = append(session.Recent, chatMessage{
+			Incoming: true,
+			Phone:    msg.From,
+			Text:     msg.Text,
+			Time:     time.Now(),
+		})
+	})
+}
+
+// chatFailed marks the outgoing message of the MX user as failed.
+func (h *History) chatFailed(msg *sms.SendMessage) {
+	h.update(msg.MXName, msg.JID, func(session *Session) {
+		if sent := session.message(msg.ID); sent != nil {
+			sent.Status = sqlog.StatusFailed
+		}
+	})
+}
+
+// chatResponse links the message part accepted by the carrier to the message of
+// the MX user, so its receipts update the status.
+func (h *History) chatResponse(resp sms.SendResponse) {
+	if resp.Message == nil || resp.Message.JID == "" {
+		return // not a chat message
+	}
+	h.update(resp.Message.MXName, resp.Message.JID, func(session *Session) {
+		sent := session.message(resp.Message.ID)
+		switch {
+		case sent == nil:
+		case resp.Status != smpp.ESME_ROK: // rejected by the carrier
+			sent.Status = sqlog.StatusFailed
+		default:
+			sent.parts = append(sent.parts, resp.ID)
+			h.parts[resp.ID] = sessionKey{resp.Message.MXName, resp.Message.JID}
+			if sent.Status == sqlog.StatusAccepted {
+				sent.Status = sqlog.StatusSent
+			}
+		}
+	})
+}
+
+// chatStatus updates the status of the message of the MX user with the
+// delivery receipt. The first failed part fails the message.
+func (h *History) chatStatus(status sms.Status) {
+	h.mu.Lock()
+	key, ok := h.parts[status.ID]
+	if ok && finalStates[status.Stat] {
+		delete(h.parts, status.ID)
+	}
+	h.mu.Unlock()
+	if !ok {
+		return // not a chat message
+	}
+	h.update(key.mx, key.jid, func(session *Session) {
+		for i := range session.Recent {
+			sent := &session.Recent[i]
+			if !includes(sent.parts, status.ID) || sent.Status == sqlog.StatusFailed {
+				continue
+			}
+			switch {
+			case status.Stat == "DELIVRD":
+				sent.Status = sqlog.StatusDelivered
+			case finalStates[status.Stat]:
+				sent.Status = sqlog.StatusFailed
+			}
+		}
+	})
+}
+
+// message returns the outgoing message with the gateway identifier or nil.
+func (s *Session) message(id string) *chatMessage {
+	for i := len(s.Recent) - 1; i >= 0; i-- {
+		if msg := &s.Recent[i]; !msg.Incoming && msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// last returns the last outgoing message or nil.
+func (s Session) last() *chatMessage {
+	for i := len(s.Recent) - 1; i >= 0; i-- {
+		if msg := &s.Recent[i]; !msg.Incoming {
+			return msg
+		}
+	}
+	return nil
+}
+
+// conversation returns up to the limit of the last messages sent to or
+// received from the phone number, oldest first.
+func (s Session) conversation(phone string, limit int) []chatMessage {
+	var list []chatMessage
+	for i := len(s.Recent) - 1; i >= 0 && len(list) < limit; i-- {
+		if s.Recent[i].Phone == phone {
+			list = append([]chatMessage{s.Recent[i]}, list...)
+		}
+	}
+	return list
+}
+
+// migrateSessions takes the chat sessions of the history used before the
+// configuration reload.
+func (h *History) migrateSessions(old *History) {
+	old.mu.Lock()
+	sessions, parts := old.sessions, old.parts
+	old.mu.Unlock()
+	h.mu.Lock()
+	h.sessions, h.parts = sessions, parts
+	h.mu.Unlock()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mxsms/smpp"
+	"mxsms/sms"
+	"mxsms/sqlog"
+)
+
+func TestSession(t *testing.T) {
+	history := new(History)
+	history.SetRecipient("mx", "jid1", "14085551234")
+	history.SetSender("mx", "jid1", "100")
+	msg := &sms.SendMessage{ID: "m1", MXName: "mx", JID: "jid1", From: "100", To: "14085551234", Text: "hi"}
+	history.chatSent(msg)
+	history.chatResponse(sms.SendResponse{ID: "s1", Message: msg, Status: smpp.ESME_ROK})
+	history.chatResponse(sms.SendResponse{ID: "s2", Message: msg, Status: smpp.ESME_ROK})
+	if last := history.Session("mx", "jid1").last(); last == nil || last.Status != sqlog.StatusSent {
+		t.Fatalf("last message %+v", last)
+	}
+	history.chatStatus(sms.Status{ID: "s1", Stat: "DELIVRD"})
+	history.chatStatus(sms.Status{ID: "s2", Stat: "UNDELIV"})
+	history.chatStatus(sms.Status{ID: "s1", Stat: "DELIVRD"}) // the failed message stays failed
+	history.chatReceived("mx", "jid1", sms.Received{From: "14085551234", To: "100", Text: "hello"})
+	session := history.Session("mx", "jid1")
+	if session.To != "14085551234" || session.From != "100" || session.ReplyTo != "14085551234" {
+		t.Errorf("session %+v", session)
+	}
+	if last := session.last(); last.ID != "m1" || last.Status != sqlog.StatusFailed {
+		t.Errorf("last message %+v", last)
+	}
+	if list := session.conversation("14085551234", 10); len(list) != 2 || !list[1].Incoming {
+		t.Errorf("conversation %+v", list)
+	}
+	if other := history.Session("mx", "jid2"); other.To != "" || len(other.Recent) != 0 {
+		t.Errorf("session of another user %+v", other)
+	}
+	for i := 0; i < maxRecent; i++ { // the oldest messages are forgotten with their parts
+		history.chatSent(&sms.SendMessage{ID: fmt.Sprint(i), MXName: "mx", JID: "jid1", To: "01"})
+	}
+	if session := history.Session("mx", "jid1"); len(session.Recent) != maxRecent || session.message("m1") != nil {
+		t.Errorf("%d recent messages", len(session.Recent))
+	}
+	if len(history.parts) != 0 {
+		t.Errorf("parts kept: %v", history.parts)
+	}
+	migrated := new(History)
+	if err := migrated.Migrate(history); err != nil {
+		t.Fatal(err)
+	}
+	if session := migrated.Session("mx", "jid1"); session.To != "14085551234" {
+		t.Errorf("migrated session %+v", session)
+	}
+}
+
+func TestConversationLog(t *testing.T) {
+	session := Session{Recent: []chatMessage{{Phone: "14085551234", Text: "in memory"}}}
+	if list := conversation(session, "mx", "jid1", "14085551234"); len(list) != 1 {
+		t.Errorf("session conversation %+v", list)
+	}
+	db, err := sqlog.Connect("sqlite://" + filepath.Join(t.TempDir(), "log.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sglogDB = db
+	defer func() {
+		sglogDB = nil
+		db.Close()
+	}()
+	start := time.Now()
+	db.Insert(&sqlog.Message{ID: "m1", Direction: sqlog.Outbound, MX: "mx", JID: "jid1", From: "100",
+		To: "14085551234", Text: "hi", Status: sqlog.StatusDelivered, Created: start})
+	db.Insert(&sqlog.Message{ID: "m2", Direction: sqlog.Inbound, MX: "mx", JID: "jid1", From: "14085551234",
+		To: "100", Text: "hello", Status: sqlog.StatusDelivered, Created: start.Add(time.Second)})
+	db.Insert(&sqlog.Message{ID: "m3", Direction: sqlog.Outbound, MX: "mx", JID: "jid2", From: "100",
+		To: "14085551234", Text: "other user", Created: start})
+	db.Flush()
+	// the log is read instead of the session, so the messages survive the restarts
+	list := conversation(session, "mx", "jid1", "14085551234")
+	if len(list) != 2 || list[0].Text != "hi" || list[0].Incoming || list[0].Status != sqlog.StatusDelivered ||
+		list[1].Text != "hello" || !list[1].Incoming {
+		t.Errorf("log conversation %+v", list)
+	}
+}
+
+func TestCommandRE(t *testing.T) {
+	for body, want := range map[string][]string{
+		"/to 4085551234":     {"to", "4085551234"},
+		"/r see you\nsoon":   {"r", "see you\nsoon"},
+		"/status":            {"status", ""},
+		"4085551234 /to":     nil,
+		"MMS 4085551234 url": nil,
+	} {
+		match := commandRE.FindStringSubmatch(body)
+		if want == nil {
+			if match != nil {
+				t.Errorf("%q: %q", body, match)
+			}
+			continue
+		}
+		if match == nil || match[1] != want[0] || match[2] != want[1] {
+			t.Errorf("%q: %q", body, match)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+-- ESME accounts of the SQL authenticator. The statements work with MySQL,
+-- PostgreSQL and SQLite.
+CREATE TABLE smpp_accounts (
+    system_id VARCHAR(16) NOT NULL,
+    password VARCHAR(64) NOT NULL,
+    system_type VARCHAR(13) NOT NULL DEFAULT '',
+    throughput INT NOT NULL DEFAULT 0,
+    max_binds INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (system_id)
+);
+
+-- Lists of the accounts, a row per value. The kind is one of bindType,
+-- allowedIP, sourceAddr and number.
+CREATE TABLE smpp_account_values (
+    system_id VARCHAR(16) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    value VARCHAR(64) NOT NULL,
+    PRIMARY KEY (system_id, kind, value)
+);
+CREATE INDEX smpp_account_values_value ON smpp_account_values (kind, value);
@@ -0,0 +1,149 @@
+package smpp
+
+import (
+	"crypto/subtle"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bind types used in the account configuration.
+const (
+	BindTransmitter = "transmitter"
+	BindReceiver    = "receiver"
+	BindTransceiver = "transceiver"
+)
+
+// bindTypes maps bind requests to the bind type names of the account configuration.
+var bindTypes = map[CMDId]string{
+	BIND_TRANSMITTER: BindTransmitter,
+	BIND_RECEIVER:    BindReceiver,
+	BIND_TRANSCEIVER: BindTransceiver,
+}
+
+// Authenticator checks ESME credentials and returns the account with the policies
+// applied to its sessions. The returned error should be ESME_RINVSYSID for an
+// unknown system_id and ESME_RINVPASWD for a wrong password; any other error is
+// reported to the ESME as ESME_RSYSERR.
+type Authenticator interface {
+	Authenticate(systemID, password string) (*Account, error)
+}
+
+// NumberOwner is implemented by authenticators that know which account owns a
+// phone number, so messages to it can be delivered to the ESME.
+type NumberOwner interface {
+	// Owner returns the system_id of the account owning the number or an empty string.
+	Owner(number string) (string, error)
+}
+
+// AuthFunc adapts a plain credentials check to the Authenticator interface.
+// Accounts returned by it have no restrictions.
+type AuthFunc func(systemID, password string) bool
+
+// Authenticate implements the Authenticator interface.
+func (f AuthFunc) Authenticate(systemID, password string) (*Account, error) {
+	if !f(systemID, password) {
+		return nil, ESME_RINVPASWD
+	}
+	return &Account{SystemID: systemID}, nil
+}
+
+// Account describes an ESME account and the policies applied to its sessions.
+// Empty lists and zero values mean no restriction.
+type Account struct {
+	SystemID    string   `yaml:"systemId" json:"systemId"`
+	Password    string   `yaml:"password" json:"password"`
+	SystemType  string   `yaml:"systemType,omitempty" json:"systemType,omitempty"`   // required system_type
+	BindTypes   []string `yaml:"bindTypes,omitempty" json:"bindTypes,omitempty"`     // allowed bind types
+	AllowedIPs  []string `yaml:"allowedIPs,omitempty" json:"allowedIPs,omitempty"`   // allowed client networks in CIDR notation
+	Throughput  int      `yaml:"throughput,omitempty" json:"throughput,omitempty"`   // maximum submits per second
+	SourceAddrs []string `yaml:"sourceAddrs,omitempty" json:"sourceAddrs,omitempty"` // allowed source addresses
+	MaxBinds    int      `yaml:"maxBinds,omitempty" json:"maxBinds,omitempty"`       // maximum concurrent sessions
+	Numbers     []string `yaml:"numbers,omitempty" json:"numbers,omitempty"`         // phone numbers delivered to the account
+}
+
+// checkPassword compares the password in constant time.
+func (a *Account) checkPassword(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(a.Password), []byte(password)) == 1
+}
+
+// CheckBind returns the status of the bind request with the system_type from the
+// remote address against the account policies.
+func (a *Account) CheckBind(id CMDId, systemType string, addr net.Addr) CMDStatus {
+	if a.SystemType != "" && a.SystemType != systemType {
+		return ESME_RINVSYSTYP
+	}
+	if len(a.BindTypes) > 0 && !included_check(a.BindTypes, bindTypes[id]) {
+		return ESME_RBINDFAIL
+	}
+	if len(a.AllowedIPs) > 0 && !a.allowsIP(addr) {
+		return ESME_RBINDFAIL
+	}
+	return ESME_ROK
+}
+
+// allowsIP reports whether the address belongs to one of the allowed networks.
+// Plain IP addresses are accepted as single host networks.
+func (a *Account) allowsIP(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range a.AllowedIPs {
+		if !strings.Contains(allowed, "/") {
+			if net.ParseIP(allowed).Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(allowed); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSource reports whether the account may submit messages from the address.
+func (a *Account) AllowsSource(sourceAddr string) bool {
+	return len(a.SourceAddrs) == 0 || included_check(a.SourceAddrs, sourceAddr)
+}
+
+// limiter is a token bucket limiting the number of submits per second.
+type limiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate int) *limiter {
+	return &limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// Allow takes a token from the bucket and reports whether it was available.
+func (l *limiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
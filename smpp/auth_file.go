@@ -0,0 +1,164 @@
+package smpp
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// placeholderPassword is the password of the sample accounts file, refused so
+// the sample can't be used with a known password.
+const placeholderPassword = "CHANGE_ME"
+
+// FileAuthenticator authenticates ESME accounts listed in a YAML or JSON file:
+//
+//	accounts:
+//	  - systemId: pbx
+//	    password: secret
+//	    bindTypes: [transceiver]
+//	    allowedIPs: [10.0.0.0/8]
+//	    throughput: 10
+//
+// The file can be reloaded while the server is running.
+type FileAuthenticator struct {
+	filename string
+	accounts map[string]*Account
+	numbers  map[string]string // phone number -> system_id
+	modTime  time.Time
+	mu       sync.RWMutex
+	done     chan struct{}
+}
+
+// accountsFile describes the format of the accounts file.
+type accountsFile struct {
+	Accounts []*Account `yaml:"accounts" json:"accounts"`
+}
+
+// NewFileAuthenticator loads the accounts from the file.
+func NewFileAuthenticator(filename string) (*FileAuthenticator, error) {
+	a := &FileAuthenticator{filename: filename}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the accounts file again. The previously loaded accounts are kept
+// if the file can't be parsed.
+func (a *FileAuthenticator) Reload() error {
+	info, err := os.Stat(a.filename)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.filename)
+	if err != nil {
+		return err
+	}
+	// JSON is a subset of YAML, so both formats are parsed the same way
+	var file accountsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	accounts := make(map[string]*Account, len(file.Accounts))
+	numbers := make(map[string]string)
+	for _, account := range file.Accounts {
+		if account.SystemID == "" {
+			return fmt.Errorf("%s: account without systemId", a.filename)
+		}
+		if account.Password == placeholderPassword {
+			return fmt.Errorf("%s: account %s has the placeholder password %s", a.filename,
+				account.SystemID, placeholderPassword)
+		}
+		accounts[account.SystemID] = account
+		for _, number := range account.Numbers {
+			if owner, ok := numbers[number]; ok && owner != account.SystemID {
+				return fmt.Errorf("%s: number %s belongs to %s and %s",
+					a.filename, number, owner, account.SystemID)
+			}
+			numbers[number] = account.SystemID
+		}
+	}
+	a.mu.Lock()
+	a.accounts = accounts
+	a.numbers = numbers
+	a.modTime = info.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+// Watch checks the file for changes with the interval and reloads it when it was
+// modified, until Close is called.
+func (a *FileAuthenticator) Watch(interval time.Duration) {
+	a.mu.Lock()
+	if a.done != nil {
+		a.mu.Unlock()
+		return // already watching
+	}
+	a.done = make(chan struct{})
+	done := a.done
+	a.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(a.filename)
+			if err != nil {
+				continue
+			}
+			a.mu.RLock()
+			modified := !info.ModTime().Equal(a.modTime)
+			a.mu.RUnlock()
+			if !modified {
+				continue
+			}
+			logEntry := logrus.WithField("filename", a.filename)
+			if err := a.Reload(); err != nil {
+				logEntry.WithError(err).Error("SMPP accounts reload error")
+				continue
+			}
+			logEntry.Info("SMPP accounts reloaded")
+		}
+	}()
+}
+
+// Close stops watching the file.
+func (a *FileAuthenticator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.done != nil {
+		close(a.done)
+		a.done = nil
+	}
+	return nil
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *FileAuthenticator) Authenticate(systemID, password string) (*Account, error) {
+	a.mu.RLock()
+	account := a.accounts[systemID]
+	a.mu.RUnlock()
+	if account == nil {
+		return nil, ESME_RINVSYSID
+	}
+	if !account.checkPassword(password) {
+		return nil, ESME_RINVPASWD
+	}
+	return account, nil
+}
+
+// Owner implements the NumberOwner interface.
+func (a *FileAuthenticator) Owner(number string) (string, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.numbers[number], nil
+}
@@ -0,0 +1,88 @@
+package smpp
+
+import (
+	"database/sql"
+
+	"mxsms/sqlog"
+)
+
+// SQLAuthenticator authenticates ESME accounts stored in the smpp_accounts table
+// of a MySQL, PostgreSQL or SQLite database (see accounts.sql). The lists of the
+// account are kept in the smpp_account_values table, a row per value. Changes
+// of the tables apply to the next bind.
+type SQLAuthenticator struct {
+	db      *sql.DB
+	dialect sqlog.Dialect
+}
+
+// OpenSQLAuthenticator connects to the database selected by the DSN scheme, see
+// sqlog.Open for the formats.
+func OpenSQLAuthenticator(dsn string) (*SQLAuthenticator, error) {
+	db, dialect, err := sqlog.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLAuthenticator(db, dialect), nil
+}
+
+// NewSQLAuthenticator returns the authenticator reading the accounts from the
+// database.
+func NewSQLAuthenticator(db *sql.DB, dialect sqlog.Dialect) *SQLAuthenticator {
+	return &SQLAuthenticator{db: db, dialect: dialect}
+}
+
+// Close closes the database.
+func (a *SQLAuthenticator) Close() error {
+	return a.db.Close()
+}
+
+// Owner implements the NumberOwner interface.
+func (a *SQLAuthenticator) Owner(number string) (string, error) {
+	var systemID string
+	err := a.db.QueryRow(a.dialect.Rebind(`SELECT system_id FROM smpp_account_values
+		WHERE kind = 'number' AND value = ? ORDER BY system_id LIMIT 1`), number).Scan(&systemID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return systemID, err
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *SQLAuthenticator) Authenticate(systemID, password string) (*Account, error) {
+	account := &Account{SystemID: systemID}
+	err := a.db.QueryRow(a.dialect.Rebind(`SELECT password, system_type, throughput, max_binds
+		FROM smpp_accounts WHERE system_id = ?`), systemID).Scan(
+		&account.Password, &account.SystemType, &account.Throughput, &account.MaxBinds)
+	if err == sql.ErrNoRows {
+		return nil, ESME_RINVSYSID
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !account.checkPassword(password) {
+		return nil, ESME_RINVPASWD
+	}
+	rows, err := a.db.Query(a.dialect.Rebind(`SELECT kind, value FROM smpp_account_values
+		WHERE system_id = ? ORDER BY kind, value`), systemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, value string
+		if err := rows.Scan(&kind, &value); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "bindType":
+			account.BindTypes = append(account.BindTypes, value)
+		case "allowedIP":
+			account.AllowedIPs = append(account.AllowedIPs, value)
+		case "sourceAddr":
+			account.SourceAddrs = append(account.SourceAddrs, value)
+		case "number":
+			account.Numbers = append(account.Numbers, value)
+		}
+	}
+	return account, rows.Err()
+}
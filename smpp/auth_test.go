@@ -0,0 +1,216 @@
+package smpp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAccounts = `
+accounts:
+  - systemId: pbx
+    password: secret
+    systemType: PBX
+    bindTypes: [transmitter]
+    allowedIPs: [10.0.0.0/8, 192.168.1.10]
+    throughput: 2
+    sourceAddrs: ["14085551234"]
+  - systemId: app
+    password: app
+`
+
+func testAuthFile(t *testing.T, name, data string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	auth, err := NewFileAuthenticator(testAuthFile(t, "accounts.yaml", testAccounts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate("unknown", "secret"); err != ESME_RINVSYSID {
+		t.Errorf("unknown system id: %v", err)
+	}
+	if _, err := auth.Authenticate("pbx", "wrong"); err != ESME_RINVPASWD {
+		t.Errorf("wrong password: %v", err)
+	}
+	account, err := auth.Authenticate("pbx", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Throughput != 2 || len(account.AllowedIPs) != 2 {
+		t.Errorf("unexpected account %+v", account)
+	}
+}
+
+func TestFileAuthenticatorPlaceholder(t *testing.T) {
+	sample, err := os.ReadFile("../accounts.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileAuthenticator(testAuthFile(t, "accounts.yaml", string(sample))); err == nil ||
+		!strings.Contains(err.Error(), "placeholder password") {
+		t.Errorf("sample accounts accepted: %v", err)
+	}
+}
+
+func TestSQLAuthenticator(t *testing.T) {
+	auth, err := OpenSQLAuthenticator("sqlite://" + filepath.Join(t.TempDir(), "accounts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Close()
+	schema, err := os.ReadFile("accounts.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := strings.Split(string(schema), ";")
+	statements = append(statements[:len(statements)-1], // the text after the last statement
+		`INSERT INTO smpp_accounts (system_id, password, system_type, throughput) VALUES ('pbx', 'secret', 'PBX', 2)`,
+		`INSERT INTO smpp_accounts (system_id, password) VALUES ('app', 'app')`,
+		`INSERT INTO smpp_account_values (system_id, kind, value) VALUES
+			('pbx', 'bindType', 'transmitter'), ('pbx', 'allowedIP', '10.0.0.0/8'),
+			('pbx', 'allowedIP', '192.168.1.10'), ('pbx', 'sourceAddr', '14085551234'),
+			('pbx', 'number', '74995551234')`)
+	for _, statement := range statements {
+		if _, err := auth.db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	if _, err := auth.Authenticate("unknown", "secret"); err != ESME_RINVSYSID {
+		t.Errorf("unknown system id: %v", err)
+	}
+	if _, err := auth.Authenticate("pbx", "wrong"); err != ESME_RINVPASWD {
+		t.Errorf("wrong password: %v", err)
+	}
+	account, err := auth.Authenticate("pbx", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.SystemType != "PBX" || account.Throughput != 2 || len(account.AllowedIPs) != 2 ||
+		len(account.BindTypes) != 1 || account.BindTypes[0] != BindTransmitter || !account.AllowsSource("14085551234") {
+		t.Errorf("unexpected account %+v", account)
+	}
+	if account, err := auth.Authenticate("app", "app"); err != nil || len(account.BindTypes) != 0 {
+		t.Errorf("unrestricted account %+v: %v", account, err)
+	}
+	if owner, err := auth.Owner("74995551234"); err != nil || owner != "pbx" {
+		t.Errorf("owner %q: %v", owner, err)
+	}
+	if owner, err := auth.Owner("14085551234"); err != nil || owner != "" {
+		t.Errorf("owner of the source address %q: %v", owner, err)
+	}
+}
+
+func TestFileAuthenticatorJSON(t *testing.T) {
+	auth, err := NewFileAuthenticator(testAuthFile(t, "accounts.json",
+		`{"accounts": [{"systemId": "app", "password": "app", "bindTypes": ["receiver"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := auth.Authenticate("app", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(account.BindTypes) != 1 || account.BindTypes[0] != BindReceiver {
+		t.Errorf("unexpected bind types %v", account.BindTypes)
+	}
+}
+
+func TestFileAuthenticatorWatch(t *testing.T) {
+	filename := testAuthFile(t, "accounts.yaml", testAccounts)
+	auth, err := NewFileAuthenticator(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Watch(10 * time.Millisecond)
+	defer auth.Close()
+	data := "accounts:\n  - systemId: app\n    password: changed\n"
+	if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time differs on file systems with a coarse resolution
+	os.Chtimes(filename, time.Now(), time.Now().Add(time.Second))
+	for i := 0; i < 100; i++ {
+		if _, err = auth.Authenticate("app", "changed"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("accounts were not reloaded: %v", err)
+	}
+	if _, err := auth.Authenticate("pbx", "secret"); err != ESME_RINVSYSID {
+		t.Errorf("removed account: %v", err)
+	}
+}
+
+func TestAccountCheckBind(t *testing.T) {
+	account := &Account{
+		SystemType: "PBX",
+		BindTypes:  []string{BindTransmitter},
+		AllowedIPs: []string{"10.0.0.0/8", "192.168.1.10"},
+	}
+	for _, test := range []struct {
+		id         CMDId
+		systemType string
+		ip         string
+		status     CMDStatus
+	}{
+		{BIND_TRANSMITTER, "PBX", "10.1.2.3", ESME_ROK},
+		{BIND_TRANSMITTER, "PBX", "192.168.1.10", ESME_ROK},
+		{BIND_TRANSMITTER, "PBX", "192.168.1.11", ESME_RBINDFAIL},
+		{BIND_TRANSMITTER, "SMPP", "10.1.2.3", ESME_RINVSYSTYP},
+		{BIND_RECEIVER, "PBX", "10.1.2.3", ESME_RBINDFAIL},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 2775}
+		if status := account.CheckBind(test.id, test.systemType, addr); status != test.status {
+			t.Errorf("%s %s %s: %v", test.id.Error(), test.systemType, test.ip, status)
+		}
+	}
+}
+
+func TestServerAccountPolicies(t *testing.T) {
+	auth, err := NewFileAuthenticator(testAuthFile(t, "accounts.yaml", `
+accounts:
+  - systemId: client1
+    password: pass1
+    bindTypes: [transmitter]
+    throughput: 1
+    sourceAddrs: ["100"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("", auth)
+	esme := testSession(t, s)
+	p, _ := esme.Bind(BIND_TRANSMITTER, "client2", "pass1", &Params{})
+	if resp := testRequest(t, esme, p); resp.GetHeader().Status != ESME_RINVSYSID {
+		t.Errorf("unknown system id: %v", resp.GetHeader().Status)
+	}
+	if resp := testBind(t, esme, BIND_RECEIVER, "pass1"); resp.GetHeader().Status != ESME_RBINDFAIL {
+		t.Errorf("bind type not allowed: %v", resp.GetHeader().Status)
+	}
+	if resp := testBind(t, esme, BIND_TRANSMITTER, "pass1"); !resp.Ok() {
+		t.Fatalf("bind: %v", resp.GetHeader().Status)
+	}
+	p, _ = esme.SubmitSm("200", "300", "text", Params{})
+	if resp := testRequest(t, esme, p); resp.GetHeader().Status != ESME_RINVSRCADR {
+		t.Errorf("source address not allowed: %v", resp.GetHeader().Status)
+	}
+	p, _ = esme.SubmitSm("100", "300", "text", Params{})
+	if resp := testRequest(t, esme, p); !resp.Ok() {
+		t.Errorf("submit: %v", resp.GetHeader().Status)
+	}
+	p, _ = esme.SubmitSm("100", "300", "text", Params{})
+	if resp := testRequest(t, esme, p); resp.GetHeader().Status != ESME_RTHROTTLED {
+		t.Errorf("submit over throughput: %v", resp.GetHeader().Status)
+	}
+}
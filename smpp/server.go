@@ -10,52 +10,171 @@ import (
 	"time"
 )
 
+// SMS describes a message submitted by an ESME.
 type SMS struct {
-	From    string
-	To      string
-	Message string
-	Client  string
+	From               string
+	To                 string
+	Message            string         // raw short_message, including UDH if any
+	Client             string         // system_id of the submitting ESME
+	MessageID          string         // message id returned in submit_sm_resp
+	DataCoding         uint8          // data_coding of the short message
+	EsmClass           uint8          // esm_class, 0x40 is set when the message starts with UDH
+	RegisteredDelivery uint8          // registered_delivery, 0x01 requests a delivery receipt
+	Session            *ClientSession // session the message was submitted with
+}
+
+// DefaultBindTimeout is the time a new connection is given to bind before it is closed.
+const DefaultBindTimeout = 30 * time.Second
+
+// SessionState describes the state of an ESME session in the SMPP state machine.
+type SessionState int
+
+const (
+	StateOpen     SessionState = iota // connected, but not bound yet
+	StateBoundTx                      // bound as transmitter
+	StateBoundRx                      // bound as receiver
+	StateBoundTrx                     // bound as transceiver
+	StateUnbound                      // unbind requested, session is closing
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case StateOpen:
+		return "OPEN"
+	case StateBoundTx:
+		return "BOUND_TX"
+	case StateBoundRx:
+		return "BOUND_RX"
+	case StateBoundTrx:
+		return "BOUND_TRX"
+	case StateUnbound:
+		return "UNBOUND"
+	default:
+		return fmt.Sprint("Unknown State:", int(s))
+	}
+}
+
+// Bound reports whether the session has successfully bound.
+func (s SessionState) Bound() bool {
+	return s == StateBoundTx || s == StateBoundRx || s == StateBoundTrx
+}
+
+// CanTransmit reports whether the ESME may submit messages in this state.
+func (s SessionState) CanTransmit() bool {
+	return s == StateBoundTx || s == StateBoundTrx
+}
+
+// CanReceive reports whether messages may be delivered to the ESME in this state.
+func (s SessionState) CanReceive() bool {
+	return s == StateBoundRx || s == StateBoundTrx
+}
+
+// bindStates maps bind requests to the session state they lead to.
+var bindStates = map[CMDId]SessionState{
+	BIND_TRANSMITTER: StateBoundTx,
+	BIND_RECEIVER:    StateBoundRx,
+	BIND_TRANSCEIVER: StateBoundTrx,
+}
+
+// respID returns the command id of the response to the request id.
+func respID(id CMDId) CMDId {
+	return id | GENERIC_NACK
 }
 
 type Server struct {
 	addr            string
 	tlsConfig       *tls.Config
-	Clients         map[string]*ClientSession
-	clientAddresses map[string]string // address -> clientId/systemId
+	BindTimeout     time.Duration               // time allowed for a new connection to bind, 0 to wait forever
+	MaxBinds        int                         // maximum concurrent sessions per system_id, 0 for unlimited
+	Clients         map[string][]*ClientSession // systemId -> bound sessions
+	clientAddresses map[string]string           // address -> clientId/systemId
+	nextSession     map[string]int              // systemId -> round robin position for delivery
+	limiters        map[string]*limiter         // systemId -> submit throughput limiter
 	clientsMu       sync.RWMutex
 	listener        net.Listener
-	authHandler     func(systemID, password string) bool
+	auth            Authenticator
 	IncomingChannel chan SMS
 	OutgoingChannel chan SMS
-	pendingReceipts map[string]string
-	receiptsMutex   sync.Mutex
+	// DeliverSmRespHandler is called for every deliver_sm_resp received from an ESME.
+	DeliverSmRespHandler func(session *ClientSession, seq uint32, status CMDStatus)
+	done                 chan struct{} // closed when the server is stopped
 }
 
 type ClientSession struct {
 	*Smpp
 	systemID string
-	bound    bool
+	account  *Account
+	state    SessionState
+	stateMu  sync.RWMutex
+	writeMu  sync.Mutex // sessions are written from reading and delivery goroutines
+}
+
+// Write sends the PDU to the ESME. Concurrent writes are serialized.
+func (c *ClientSession) Write(p Pdu) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Smpp.Write(p)
+}
+
+// logger returns the log entry of the session with the client address and the
+// system_id it is bound with.
+func (c *ClientSession) logger() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"client": c.SystemID(),
+		"remote": c.conn.RemoteAddr().String(),
+	})
+}
+
+// SystemID returns the system_id the session is bound with.
+func (c *ClientSession) SystemID() string {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.systemID
+}
+
+// Account returns the account the session is bound with.
+func (c *ClientSession) Account() *Account {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.account
 }
 
-func NewServer(addr string, authHandler func(systemID, password string) bool) *Server {
+// State returns the current state of the session.
+func (c *ClientSession) State() SessionState {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.state
+}
+
+func (c *ClientSession) setState(state SessionState) {
+	c.stateMu.Lock()
+	c.state = state
+	c.stateMu.Unlock()
+}
+
+func NewServer(addr string, auth Authenticator) *Server {
 	return &Server{
 		addr:            addr,
-		Clients:         make(map[string]*ClientSession),
+		Clients:         make(map[string][]*ClientSession),
 		clientAddresses: make(map[string]string),
-		authHandler:     authHandler,
+		nextSession:     make(map[string]int),
+		limiters:        make(map[string]*limiter),
+		BindTimeout:     DefaultBindTimeout,
+		auth:            auth,
 		IncomingChannel: make(chan SMS, 100),
 		OutgoingChannel: make(chan SMS, 100),
-		pendingReceipts: make(map[string]string),
+		done:            make(chan struct{}),
 	}
 }
 
-func NewServerTLS(addr string, config *tls.Config, authHandler func(systemID, password string) bool) *Server {
-	server := NewServer(addr, authHandler)
+func NewServerTLS(addr string, config *tls.Config, auth Authenticator) *Server {
+	server := NewServer(addr, auth)
 	server.tlsConfig = config
 	return server
 }
 
-func (s *Server) Start() {
+// Start starts listening and accepting ESME connections.
+func (s *Server) Start() error {
 	var err error
 
 	if s.tlsConfig != nil {
@@ -64,17 +183,37 @@ func (s *Server) Start() {
 		s.listener, err = net.Listen("tcp", s.addr)
 	}
 	if err != nil {
-		fmt.Printf("failed to start server: %v", err)
+		return fmt.Errorf("failed to start server: %w", err)
 	}
 
 	go s.acceptConnections()
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Done returns a channel that is closed when the server is stopped.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
 }
 
 func (s *Server) acceptConnections() {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			logrus.Error("unable to accept connection")
+			select {
+			case <-s.done:
+				return // server stopped
+			default:
+			}
+			logrus.WithError(err).Error("unable to accept connection")
+			time.Sleep(100 * time.Millisecond)
 			continue
 		}
 		go s.handleConnection(conn)
@@ -83,162 +222,230 @@ func (s *Server) acceptConnections() {
 
 func (s *Server) handleConnection(conn net.Conn) {
 	smpp := &Smpp{conn: conn}
-	session := &ClientSession{Smpp: smpp}
+	session := &ClientSession{Smpp: smpp, state: StateOpen}
 
 	defer func() {
+		session.setState(StateUnbound)
 		session.Close()
 		s.removeClient(session)
 	}()
 
-	if err := s.bindClient(session); err != nil {
-		return
+	// connections that never bind are dropped after the bind timeout
+	if s.BindTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.BindTimeout))
 	}
 
 	for {
 		pdu, err := session.Read()
 		if err != nil {
-			break
+			if err, ok := err.(net.Error); ok && err.Timeout() && !session.State().Bound() {
+				logrus.Warnf("bind timeout for %s", conn.RemoteAddr().String())
+			}
+			return
+		}
+		if !s.handlePDU(session, pdu) {
+			return
 		}
-		s.handlePDU(session, pdu)
 	}
 }
 
-func (s *Server) bindClient(session *ClientSession) error {
-	pdu, err := session.Read()
+// bindClient authenticates a bind request and moves the session to the bound state
+// requested by the ESME.
+func (s *Server) bindClient(session *ClientSession, pdu Pdu) error {
+	header := pdu.GetHeader()
+	systemID := pdu.GetField(SYSTEM_ID).String()
+	password := pdu.GetField(PASSWORD).String()
+
+	account, err := s.auth.Authenticate(systemID, password)
 	if err != nil {
-		return err
+		status, ok := err.(CMDStatus)
+		if !ok {
+			status = ESME_RSYSERR // authenticator failure, not the client's fault
+		}
+		s.rejectPDU(session, header, status)
+		return fmt.Errorf("authentication failed for %s: %w", systemID, err)
 	}
-
-	bindPdu, ok := pdu.(*Bind)
-	if !ok {
-		return fmt.Errorf("expected Bind PDU, got %T", pdu)
+	systemType := pdu.GetField(SYSTEM_TYPE).String()
+	if status := account.CheckBind(header.Id, systemType, session.conn.RemoteAddr()); status != ESME_ROK {
+		s.rejectPDU(session, header, status)
+		return fmt.Errorf("bind not allowed for %s: %w", systemID, status)
 	}
 
-	systemID := bindPdu.GetField(SYSTEM_ID).String()
-	password := bindPdu.GetField(PASSWORD).String()
-
-	if !s.authHandler(systemID, password) {
-		resp, _ := session.BindResp(BIND_TRANSCEIVER_RESP, bindPdu.GetHeader().Sequence, ESME_RINVPASWD, "")
+	if err := s.addClient(account, session); err != nil {
+		resp, _ := session.BindResp(respID(header.Id), header.Sequence, ESME_RBINDFAIL, "")
 		session.Write(resp)
-		return fmt.Errorf("authentication failed")
-	}
-
-	resp, _ := session.BindResp(BIND_TRANSCEIVER_RESP, bindPdu.GetHeader().Sequence, ESME_ROK, systemID)
-	if err := session.Write(resp); err != nil {
 		return err
 	}
-
+	session.stateMu.Lock()
 	session.systemID = systemID
-	session.bound = true
-	s.addClient(systemID, session)
-	return nil
+	session.account = account
+	session.state = bindStates[header.Id]
+	session.stateMu.Unlock()
+	session.conn.SetReadDeadline(time.Time{}) // bound sessions are kept alive by enquire_link
+
+	resp, _ := session.BindResp(respID(header.Id), header.Sequence, ESME_ROK, systemID)
+	return session.Write(resp)
 }
 
-func (s *Server) handlePDU(session *ClientSession, pdu Pdu) {
-	switch pdu.GetHeader().Id {
+// handlePDU processes a PDU received from the ESME according to the session state.
+// It returns false when the connection should be closed.
+func (s *Server) handlePDU(session *ClientSession, pdu Pdu) bool {
+	header := pdu.GetHeader()
+	state := session.State()
+
+	switch header.Id {
+	case BIND_TRANSMITTER, BIND_RECEIVER, BIND_TRANSCEIVER:
+		if state != StateOpen {
+			s.rejectPDU(session, header, ESME_RALYBND)
+			return true
+		}
+		if err := s.bindClient(session, pdu); err != nil {
+			logrus.WithError(err).Warnf("bind failed for %s", session.conn.RemoteAddr().String())
+		}
 	case SUBMIT_SM:
-		s.isAuthenticated(session)
+		if !state.CanTransmit() {
+			s.rejectPDU(session, header, ESME_RINVBNDSTS)
+			return true
+		}
 		s.handleSubmitSM(session, pdu)
 	case DELIVER_SM_RESP:
-		s.isAuthenticated(session)
+		if !state.CanReceive() {
+			return true // responses are never answered, just drop it
+		}
 		s.handleDeliverSmResp(session, pdu)
 	case ENQUIRE_LINK:
-		s.isAuthenticated(session)
 		s.handleEnquireLink(session, pdu)
 	case UNBIND:
+		if !state.Bound() {
+			s.rejectPDU(session, header, ESME_RINVBNDSTS)
+			return true
+		}
 		s.handleUnbind(session, pdu)
+		return false
+	case ENQUIRE_LINK_RESP, UNBIND_RESP, GENERIC_NACK:
+		// responses to our own requests, nothing to do
 	default:
+		if !state.Bound() {
+			s.rejectPDU(session, header, ESME_RINVBNDSTS)
+			return true
+		}
 		s.handleUnknownPDU(session, pdu)
 	}
+	return true
+}
+
+// rejectPDU answers a request with the error status using the matching response PDU.
+func (s *Server) rejectPDU(session *ClientSession, header *Header, status CMDStatus) {
+	var resp Pdu
+	switch header.Id {
+	case BIND_TRANSMITTER, BIND_RECEIVER, BIND_TRANSCEIVER:
+		resp, _ = session.BindResp(respID(header.Id), header.Sequence, status, "")
+	case SUBMIT_SM:
+		resp, _ = session.SubmitSmResp(header.Sequence, status, "")
+	default:
+		resp, _ = session.GenericNack(header.Sequence, status)
+	}
+	if err := session.Write(resp); err != nil {
+		logrus.WithError(err).Errorf("unable to reject %s", header.Id.Error())
+	}
 }
 
 func (s *Server) handleSubmitSM(session *ClientSession, pdu Pdu) {
 	submitSM, ok := pdu.(*SubmitSm)
 	if !ok {
-		fmt.Printf("Error: Expected SubmitSm, got %T\n", pdu)
+		session.logger().Errorf("expected submit_sm, got %T", pdu)
 		return
 	}
 
-	messageID := generateMessageID()
+	sourceAddr := submitSM.GetField(SOURCE_ADDR).String()
+	if !session.Account().AllowsSource(sourceAddr) {
+		s.rejectPDU(session, submitSM.GetHeader(), ESME_RINVSRCADR)
+		return
+	}
+	if !s.allowSubmit(session.SystemID()) {
+		s.rejectPDU(session, submitSM.GetHeader(), ESME_RTHROTTLED)
+		return
+	}
 
-	registeredDelivery := submitSM.GetField(REGISTERED_DELIVERY).Value().(uint8)
-	if registeredDelivery&0x01 != 0 {
-		s.receiptsMutex.Lock()
-		s.pendingReceipts[messageID] = session.systemID
-		s.receiptsMutex.Unlock()
+	// the fields are checked so a malformed PDU is rejected instead of a panic
+	dataCoding, ok := uint8Field(submitSM, DATA_CODING)
+	if !ok {
+		s.rejectPDU(session, submitSM.GetHeader(), ESME_RSUBMITFAIL)
+		return
+	}
+	esmClass, ok := uint8Field(submitSM, ESM_CLASS)
+	if !ok {
+		s.rejectPDU(session, submitSM.GetHeader(), ESME_RINVESMCLASS)
+		return
+	}
+	registeredDelivery, ok := uint8Field(submitSM, REGISTERED_DELIVERY)
+	if !ok {
+		s.rejectPDU(session, submitSM.GetHeader(), ESME_RINVREGDLVFLG)
+		return
 	}
 
-	s.IncomingChannel <- SMS{
-		From:    submitSM.GetField(SOURCE_ADDR).String(),
-		To:      submitSM.GetField(DESTINATION_ADDR).String(),
-		Message: submitSM.GetField(SHORT_MESSAGE).String(),
+	messageID := generateMessageID()
+	sms := SMS{
+		From:               sourceAddr,
+		To:                 submitSM.GetField(DESTINATION_ADDR).String(),
+		Message:            submitSM.GetField(SHORT_MESSAGE).String(),
+		Client:             session.SystemID(),
+		MessageID:          messageID,
+		DataCoding:         dataCoding,
+		EsmClass:           esmClass,
+		RegisteredDelivery: registeredDelivery,
+		Session:            session,
+	}
+	select {
+	case s.IncomingChannel <- sms:
+	case <-s.done:
+		s.rejectPDU(session, submitSM.GetHeader(), ESME_RSYSERR)
+		return
 	}
 
 	resp, _ := session.SubmitSmResp(submitSM.GetHeader().Sequence, ESME_ROK, messageID)
 	session.Write(resp)
-
-	if registeredDelivery&0x01 != 0 {
-		go s.simulateDeliveryAndSendReceipt(submitSM, messageID)
-	}
 }
 
-func (s *Server) simulateDeliveryAndSendReceipt(submitSM *SubmitSm, messageID string) {
-	time.Sleep(5 * time.Second)
-
-	s.receiptsMutex.Lock()
-	systemID, exists := s.pendingReceipts[messageID]
-	delete(s.pendingReceipts, messageID)
-	s.receiptsMutex.Unlock()
-
-	if !exists {
-		return
+// uint8Field returns the value of the one-octet field of the PDU; false if the
+// field is missing or of another type.
+func uint8Field(pdu Pdu, name string) (uint8, bool) {
+	field := pdu.GetField(name)
+	if field == nil {
+		return 0, false
 	}
+	v, ok := field.Value().(uint8)
+	return v, ok
+}
 
-	s.clientsMu.RLock()
-	session, exists := s.Clients[systemID]
-	s.clientsMu.RUnlock()
-
-	if !exists {
-		return
+// DeliverSm sends a message to the ESME and returns its sequence number.
+func (c *ClientSession) DeliverSm(source_addr, destination_addr, short_message string, params Params) (uint32, error) {
+	if !c.State().CanReceive() {
+		return 0, ESME_RINVBNDSTS
 	}
-	/*	receiptMsg := fmt.Sprintf("id:%s submit date:%s done date:%s stat:DELIVRD err:000 text:%s",
-		messageID,
-		time.Now().Add(-5*time.Second).Format("0601021504"),
-		time.Now().Format("0601021504"),
-		submitSM.GetField(SHORT_MESSAGE).String()[:20])*/
-
-	// Respond back to Deliver SM with Deliver SM Resp
-	resp, err := session.DeliverSmResp(submitSM.Sequence+1, ESME_ROK)
-	session.Write(resp)
+	p, err := c.Smpp.DeliverSm(source_addr, destination_addr, short_message, params)
 	if err != nil {
-		fmt.Println("DeliverSmResp err:", err)
+		return 0, err
+	}
+	if err := c.Write(p); err != nil {
+		return 0, err
 	}
+	return p.GetHeader().Sequence, nil
 }
 
 func (s *Server) handleDeliverSmResp(session *ClientSession, pdu Pdu) {
 	deliverSmResp, ok := pdu.(*DeliverSmResp)
 	if !ok {
-		fmt.Printf("Error: Expected DeliverSmResp, got %T\n", pdu)
+		session.logger().Errorf("expected deliver_sm_resp, got %T", pdu)
 		return
 	}
 
-	if deliverSmResp.Ok() {
-		fmt.Printf("Delivery receipt acknowledged by client %s\n", session.systemID)
-	} else {
-		fmt.Printf("Delivery receipt failed for client %s with status %d\n", session.systemID, deliverSmResp.Header.Status)
+	if !deliverSmResp.Ok() {
+		logrus.Warnf("deliver_sm failed for client %s with status %d", session.SystemID(), deliverSmResp.Header.Status)
 	}
-}
-
-func (s *Server) isAuthenticated(session *ClientSession) (string, bool) {
-	s.clientsMu.RLock()
-	defer s.clientsMu.RUnlock()
-
-	for systemID, clientSession := range s.Clients {
-		if clientSession == session {
-			return systemID, true
-		}
+	if s.DeliverSmRespHandler != nil {
+		s.DeliverSmRespHandler(session, deliverSmResp.Header.Sequence, deliverSmResp.Header.Status)
 	}
-	return "", false
 }
 
 func (s *Server) handleEnquireLink(session *ClientSession, pdu Pdu) {
@@ -253,11 +460,10 @@ func (s *Server) handleEnquireLink(session *ClientSession, pdu Pdu) {
 func (s *Server) handleUnbind(session *ClientSession, pdu Pdu) {
 	unbind := pdu.(*Unbind)
 	resp, _ := session.UnbindResp(unbind.GetHeader().Sequence)
-	err := session.Write(resp)
-	if err != nil {
+	session.setState(StateUnbound)
+	if err := session.Write(resp); err != nil {
 		return
 	}
-	session.bound = false
 }
 
 func (s *Server) handleUnknownPDU(session *ClientSession, pdu Pdu) {
@@ -268,33 +474,112 @@ func (s *Server) handleUnknownPDU(session *ClientSession, pdu Pdu) {
 	}
 }
 
-func (s *Server) addClient(systemID string, session *ClientSession) {
-	logrus.Infof("adding client %s %s", systemID, session.conn.RemoteAddr().String())
+// addClient registers a new session for the account, respecting the MaxBinds limit
+// of the account or of the server.
+func (s *Server) addClient(account *Account, session *ClientSession) error {
+	systemID := account.SystemID
+	maxBinds := s.MaxBinds
+	if account.MaxBinds > 0 {
+		maxBinds = account.MaxBinds
+	}
 
 	s.clientsMu.Lock()
 	defer s.clientsMu.Unlock()
-	s.Clients[systemID] = session
+	if maxBinds > 0 && len(s.Clients[systemID]) >= maxBinds {
+		return fmt.Errorf("maximum number of binds (%d) reached for %s", maxBinds, systemID)
+	}
+	// the throughput limit is shared by all sessions of the account
+	if limiter := s.limiters[systemID]; account.Throughput <= 0 {
+		delete(s.limiters, systemID)
+	} else if limiter == nil || limiter.rate != account.Throughput {
+		s.limiters[systemID] = newLimiter(account.Throughput)
+	}
+
+	logrus.Infof("adding client %s %s", systemID, session.conn.RemoteAddr().String())
+	s.Clients[systemID] = append(s.Clients[systemID], session)
 	s.clientAddresses[session.conn.RemoteAddr().String()] = systemID
+	return nil
 }
 
+// removeClient removes the session from the list of sessions of its systemID.
 func (s *Server) removeClient(session *ClientSession) {
-	logrus.Infof("removing client %s %s", session.systemID, session.conn.RemoteAddr().String())
+	systemID := session.SystemID()
+	if systemID == "" {
+		return // the session never bound
+	}
 
 	s.clientsMu.Lock()
 	defer s.clientsMu.Unlock()
-	delete(s.Clients, session.systemID)
-	delete(s.clientAddresses, session.systemID)
+	sessions := s.Clients[systemID]
+	for i, clientSession := range sessions {
+		if clientSession != session {
+			continue
+		}
+		logrus.Infof("removing client %s %s", systemID, session.conn.RemoteAddr().String())
+		sessions = append(sessions[:i:i], sessions[i+1:]...)
+		delete(s.clientAddresses, session.conn.RemoteAddr().String())
+		break
+	}
+	if len(sessions) == 0 {
+		delete(s.Clients, systemID)
+		delete(s.nextSession, systemID)
+		delete(s.limiters, systemID)
+		return
+	}
+	s.Clients[systemID] = sessions
+}
+
+// allowSubmit checks the throughput limit of the systemID.
+func (s *Server) allowSubmit(systemID string) bool {
+	s.clientsMu.RLock()
+	limiter := s.limiters[systemID]
+	s.clientsMu.RUnlock()
+	return limiter == nil || limiter.Allow()
 }
 
+// Sessions returns all sessions currently bound with the systemID.
+func (s *Server) Sessions(systemID string) []*ClientSession {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	return append([]*ClientSession(nil), s.Clients[systemID]...)
+}
+
+// ReceiverSession returns the next receiver capable session of the systemID,
+// balancing deliveries across all of them. It returns nil if none is bound.
+func (s *Server) ReceiverSession(systemID string) *ClientSession {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	sessions := s.Clients[systemID]
+	for i := 0; i < len(sessions); i++ {
+		next := (s.nextSession[systemID] + i) % len(sessions)
+		if sessions[next].State().CanReceive() {
+			s.nextSession[systemID] = next + 1
+			return sessions[next]
+		}
+	}
+	return nil
+}
+
+// Stop closes the listener and all client sessions. The channels are left open,
+// use Done to find out that the server was stopped.
 func (s *Server) Stop() error {
 	s.clientsMu.Lock()
 	defer s.clientsMu.Unlock()
 
-	for _, session := range s.Clients {
-		session.Close()
+	select {
+	case <-s.done:
+		return nil // already stopped
+	default:
+		close(s.done)
+	}
+	for _, sessions := range s.Clients {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}
+	if s.listener == nil {
+		return nil
 	}
-	close(s.IncomingChannel)
-	close(s.OutgoingChannel)
 	return s.listener.Close()
 }
 
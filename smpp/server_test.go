@@ -0,0 +1,206 @@
+package smpp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testSession starts serving one end of a pipe and returns an ESME bound to the other.
+func testSession(t *testing.T, s *Server) *Smpp {
+	serverConn, clientConn := net.Pipe()
+	go s.handleConnection(serverConn)
+	esme := &Smpp{conn: clientConn}
+	t.Cleanup(func() { esme.Close() })
+	return esme
+}
+
+func testServer() *Server {
+	return NewServer("", AuthFunc(func(systemID, password string) bool {
+		return systemID == "client1" && password == "pass1"
+	}))
+}
+
+func testRequest(t *testing.T, esme *Smpp, p Pdu) Pdu {
+	if err := esme.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := esme.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetHeader().Sequence != p.GetHeader().Sequence {
+		t.Fatalf("sequence %d, expected %d", resp.GetHeader().Sequence, p.GetHeader().Sequence)
+	}
+	return resp
+}
+
+func testBind(t *testing.T, esme *Smpp, cmdId CMDId, password string) Pdu {
+	p, err := esme.Bind(cmdId, "client1", password, &Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testRequest(t, esme, p)
+}
+
+func TestServerBindResp(t *testing.T) {
+	for cmdId, state := range bindStates {
+		s := testServer()
+		esme := testSession(t, s)
+		resp := testBind(t, esme, cmdId, "pass1")
+		if resp.GetHeader().Id != respID(cmdId) {
+			t.Errorf("%s: got %s", cmdId.Error(), resp.GetHeader().Id.Error())
+		}
+		if !resp.Ok() {
+			t.Errorf("%s: %v", cmdId.Error(), resp.GetHeader().Status)
+		}
+		s.clientsMu.RLock()
+		sessions := s.Clients["client1"]
+		s.clientsMu.RUnlock()
+		if len(sessions) != 1 || sessions[0].State() != state {
+			t.Errorf("%s: session not in %s", cmdId.Error(), state)
+		}
+	}
+}
+
+func TestServerBindState(t *testing.T) {
+	s := testServer()
+	esme := testSession(t, s)
+
+	// submit before bind
+	p, _ := esme.SubmitSm("100", "200", "text", Params{})
+	if resp := testRequest(t, esme, p); resp.GetHeader().Status != ESME_RINVBNDSTS {
+		t.Errorf("submit while open: %v", resp.GetHeader().Status)
+	}
+	// unbind before bind
+	p, _ = esme.Unbind()
+	if resp := testRequest(t, esme, p); resp.GetHeader().Status != ESME_RINVBNDSTS {
+		t.Errorf("unbind while open: %v", resp.GetHeader().Status)
+	}
+	// wrong password keeps the session open
+	if resp := testBind(t, esme, BIND_RECEIVER, "wrong"); resp.GetHeader().Status != ESME_RINVPASWD {
+		t.Errorf("bind with wrong password: %v", resp.GetHeader().Status)
+	}
+	if resp := testBind(t, esme, BIND_RECEIVER, "pass1"); !resp.Ok() {
+		t.Errorf("bind: %v", resp.GetHeader().Status)
+	}
+	// already bound
+	if resp := testBind(t, esme, BIND_TRANSCEIVER, "pass1"); resp.GetHeader().Status != ESME_RALYBND {
+		t.Errorf("second bind: %v", resp.GetHeader().Status)
+	}
+	// receivers are not allowed to submit
+	p, _ = esme.SubmitSm("100", "200", "text", Params{})
+	if resp := testRequest(t, esme, p); resp.GetHeader().Status != ESME_RINVBNDSTS {
+		t.Errorf("submit by receiver: %v", resp.GetHeader().Status)
+	}
+	p, _ = esme.EnquireLink()
+	if resp := testRequest(t, esme, p); resp.GetHeader().Id != ENQUIRE_LINK_RESP {
+		t.Errorf("enquire link: got %s", resp.GetHeader().Id.Error())
+	}
+	p, _ = esme.Unbind()
+	if resp := testRequest(t, esme, p); resp.GetHeader().Id != UNBIND_RESP {
+		t.Errorf("unbind: got %s", resp.GetHeader().Id.Error())
+	}
+	// the connection is closed after unbind
+	if _, err := esme.Read(); err == nil {
+		t.Error("connection is still open after unbind")
+	}
+}
+
+func TestServerSubmit(t *testing.T) {
+	s := testServer()
+	esme := testSession(t, s)
+	if resp := testBind(t, esme, BIND_TRANSMITTER, "pass1"); !resp.Ok() {
+		t.Fatalf("bind: %v", resp.GetHeader().Status)
+	}
+	p, _ := esme.SubmitSm("100", "200", "text", Params{})
+	resp := testRequest(t, esme, p)
+	if !resp.Ok() || resp.GetField(MESSAGE_ID).String() == "" {
+		t.Errorf("submit: %v", resp.GetHeader().Status)
+	}
+	if sms := <-s.IncomingChannel; sms.Message != "text" {
+		t.Errorf("unexpected message %q", sms.Message)
+	}
+}
+
+func TestServerSubmitInvalid(t *testing.T) {
+	s := testServer()
+	serverConn, clientConn := net.Pipe()
+	session := &ClientSession{Smpp: &Smpp{conn: serverConn}, account: &Account{SystemID: "client1"}}
+	esme := &Smpp{conn: clientConn}
+	t.Cleanup(func() { esme.Close(); session.Close() })
+	p, _ := esme.SubmitSm("100", "200", "text", Params{})
+	delete(p.(*SubmitSm).mandatoryFields, ESM_CLASS) // malformed PDU must not panic
+	go s.handleSubmitSM(session, p)
+	resp, err := esme.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetHeader().Status != ESME_RINVESMCLASS {
+		t.Errorf("submit: %v", resp.GetHeader().Status)
+	}
+}
+
+func TestServerBindTimeout(t *testing.T) {
+	s := testServer()
+	s.BindTimeout = 50 * time.Millisecond
+	esme := testSession(t, s)
+	done := make(chan error)
+	go func() {
+		_, err := esme.Read()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected connection to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("connection was not closed after bind timeout")
+	}
+}
+
+func TestServerMultiSession(t *testing.T) {
+	s := testServer()
+	s.MaxBinds = 3
+	rx1, rx2 := testSession(t, s), testSession(t, s)
+	tx := testSession(t, s)
+	testBind(t, rx1, BIND_RECEIVER, "pass1")
+	testBind(t, rx2, BIND_TRANSCEIVER, "pass1")
+	testBind(t, tx, BIND_TRANSMITTER, "pass1")
+	if resp := testBind(t, testSession(t, s), BIND_RECEIVER, "pass1"); resp.GetHeader().Status != ESME_RBINDFAIL {
+		t.Errorf("bind over the limit: %v", resp.GetHeader().Status)
+	}
+	sessions := s.Sessions("client1")
+	if len(sessions) != 3 {
+		t.Fatalf("%d sessions, expected 3", len(sessions))
+	}
+	// deliveries alternate between receiver sessions and skip the transmitter
+	used := make(map[*ClientSession]int)
+	for i := 0; i < 4; i++ {
+		session := s.ReceiverSession("client1")
+		if session == nil || !session.State().CanReceive() {
+			t.Fatal("no receiver session")
+		}
+		used[session]++
+	}
+	if len(used) != 2 || used[sessions[0]] != 2 || used[sessions[1]] != 2 {
+		t.Errorf("deliveries are not balanced: %v", used)
+	}
+	// disconnect removes only the closed session
+	p, _ := rx1.Unbind()
+	testRequest(t, rx1, p)
+	rx1.Read()
+	for i := 0; i < 100 && len(s.Sessions("client1")) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sessions = s.Sessions("client1")
+	if len(sessions) != 2 {
+		t.Fatalf("%d sessions after disconnect, expected 2", len(sessions))
+	}
+	for i := 0; i < 2; i++ {
+		if session := s.ReceiverSession("client1"); session == nil || session.State() != StateBoundTrx {
+			t.Error("expected the remaining transceiver session")
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 )
@@ -152,6 +153,27 @@ func (s *Smpp) SubmitSm(source_addr, destination_addr, short_message string, par
 	return p, nil
 }
 
+func (s *Smpp) DeliverSm(source_addr, destination_addr, short_message string, params Params) (Pdu, error) {
+	p, _ := NewDeliverSm(
+		&Header{
+			Id:       DELIVER_SM,
+			Sequence: s.NewSeqNum(),
+		},
+		[]byte{},
+	)
+	p.SetField(SOURCE_ADDR, source_addr)
+	p.SetField(DESTINATION_ADDR, destination_addr)
+	p.SetField(SHORT_MESSAGE, short_message)
+	for f, v := range params {
+		err := p.SetField(f, v)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
 func (s *Smpp) SubmitSmResp(seq uint32, status CMDStatus, messageId string) (Pdu, error) {
 	p, _ := NewSubmitSmResp(
 		&Header{
@@ -229,7 +251,7 @@ func (s *Smpp) GenericNack(seq uint32, status CMDStatus) (Pdu, error) {
 
 func (s *Smpp) Read() (Pdu, error) {
 	l := make([]byte, 4)
-	_, err := s.conn.Read(l)
+	_, err := io.ReadFull(s.conn, l)
 	if err != nil {
 		return nil, err
 	}
@@ -238,7 +260,7 @@ func (s *Smpp) Read() (Pdu, error) {
 		return nil, SmppPduSizeErr
 	}
 	data := make([]byte, pduLength)
-	i, err := s.conn.Read(data)
+	i, err := io.ReadFull(s.conn, data)
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +49,10 @@ func newTransceiver(addr string, eli time.Duration, bindParams Params, config *t
 		eli = time.Second * 10
 	}
 	trx.eLDuration = eli
+	// timers are created before the goroutine starts, so Close can always see them
+	trx.eLTicker = time.NewTicker(eli)
+	trx.eLCheckTimer = time.NewTimer(eli / 2)
+	trx.eLCheckTimer.Stop()
 	go trx.startEnquireLink(eli)
 	return trx, nil
 }
@@ -124,11 +128,8 @@ func (t *Transceiver) bindCheck() {
 }
 
 func (t *Transceiver) startEnquireLink(eli time.Duration) {
-	t.eLTicker = time.NewTicker(eli)
 	// check delay is half the time of enquire link intervel
 	d := time.Duration(eli / 2)
-	t.eLCheckTimer = time.NewTimer(d)
-	t.eLCheckTimer.Stop()
 	for {
 		select {
 		case <-t.eLTicker.C:
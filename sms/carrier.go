@@ -0,0 +1,352 @@
+package sms
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"mxsms/phone"
+	"mxsms/smpp"
+)
+
+// Carrier APIs supported by HTTPCarrier.
+const (
+	APITwilio    = "twilio"
+	APITelnyx    = "telnyx"
+	APIBandwidth = "bandwidth"
+)
+
+const carrierTimeout = time.Second * 30 // time allowed for the carrier API request
+
+// ErrNotHTTP is returned by carriers that don't receive messages over HTTP.
+var ErrNotHTTP = errors.New("carrier doesn't use HTTP callbacks")
+
+// Carrier sends messages through a carrier and parses the messages and delivery
+// receipts the carrier posts back. Responses to the sent messages are passed to
+// the receive channel of the carrier as SendResponse, the same way as for SMPP.
+type Carrier interface {
+	// Send sends the message.
+	Send(msg *SendMessage) error
+	// ParseInbound returns the incoming messages posted by the carrier. Requests
+	// with other events return no messages.
+	ParseInbound(r *http.Request) ([]Received, error)
+	// ParseStatus returns the delivery receipts posted by the carrier. Requests
+	// with other events return no receipts.
+	ParseStatus(r *http.Request) ([]Status, error)
+}
+
+// SMPPCarrier sends messages over the SMPP connections. Incoming messages and
+// receipts arrive with DELIVER_SM, so it doesn't parse HTTP requests.
+type SMPPCarrier struct {
+	*SMPP
+}
+
+// Send implements the Carrier interface. Messages with media are rejected: SMPP
+// carries only text.
+func (c SMPPCarrier) Send(msg *SendMessage) error {
+	if len(msg.Media) > 0 {
+		return ErrMMSNotSupported
+	}
+	return c.SMPP.Send(msg)
+}
+
+// ParseInbound implements the Carrier interface.
+func (SMPPCarrier) ParseInbound(r *http.Request) ([]Received, error) {
+	return nil, ErrNotHTTP
+}
+
+// ParseStatus implements the Carrier interface.
+func (SMPPCarrier) ParseStatus(r *http.Request) ([]Status, error) {
+	return nil, ErrNotHTTP
+}
+
+// HTTPCarrier sends messages with the REST API of a carrier. Each message is sent
+// as one request; the carrier splits long messages itself.
+type HTTPCarrier struct {
+	Name        string             // carrier name from the configuration
+	API         string             // twilio, telnyx or bandwidth
+	Username    string             // API user name
+	Password    string             // API password, auth token or key
+	Account     string             // account identifier, the user name if empty
+	Endpoint    string             // base URL of the API, the public one if empty
+	Application string             // Bandwidth application or Telnyx messaging profile
+	Secret      string             // Telnyx public key or Bandwidth callback user:password
+	CallbackURL string             // public base URL of the callbacks, used in Twilio signatures
+	Logger      *logrus.Entry      // log output
+	Receive     chan<- interface{} // responses, incoming messages and receipts
+	Media       *MediaStore        // stores the media of incoming MMS, if set
+	Client      *http.Client       // HTTP client, with the default timeout if nil
+	api         carrierAPI         // request and callback formats
+	seq         uint32             // internal numbers of sent messages
+}
+
+// carrierAPI describes the request and callback formats of a carrier API.
+type carrierAPI interface {
+	endpoint() string                                                // public API URL
+	request(c *HTTPCarrier, msg *SendMessage) (*http.Request, error) // send request
+	response(body []byte) (string, error)                            // message id from the send response
+	inbound(c *HTTPCarrier, r *http.Request) ([]Received, error)
+	status(c *HTTPCarrier, r *http.Request) ([]Status, error)
+	verify(c *HTTPCarrier, r *http.Request) error // callback signature check
+	authorize(c *HTTPCarrier, req *http.Request)  // sets the API credentials
+}
+
+// senderTypes lists the kinds of the source addresses accepted by the carrier
+// APIs. SMPP accepts all of them.
+var senderTypes = map[string][]phone.Type{
+	APITwilio:    {phone.International, phone.ShortCode, phone.Alphanumeric},
+	APITelnyx:    {phone.International, phone.ShortCode, phone.Alphanumeric},
+	APIBandwidth: {phone.International, phone.ShortCode},
+}
+
+// AcceptsSender reports whether the carrier API accepts the source addresses of
+// the kind. The empty API is SMPP.
+func AcceptsSender(api string, kind phone.Type) bool {
+	if api == "" {
+		return kind == phone.International || kind == phone.ShortCode || kind == phone.Alphanumeric
+	}
+	for _, accepted := range senderTypes[strings.ToLower(api)] {
+		if kind == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// carrierAPIs lists the supported APIs by name.
+var carrierAPIs = map[string]carrierAPI{
+	APITwilio:    twilioAPI{},
+	APITelnyx:    telnyxAPI{},
+	APIBandwidth: bandwidthAPI{},
+}
+
+// NewHTTPCarrier returns the carrier using the API with the name.
+func NewHTTPCarrier(name, api, username, password, endpoint string) (*HTTPCarrier, error) {
+	carrierAPI := carrierAPIs[strings.ToLower(api)]
+	if carrierAPI == nil {
+		return nil, fmt.Errorf("unsupported carrier API %q", api)
+	}
+	if endpoint == "" {
+		endpoint = carrierAPI.endpoint()
+	}
+	return &HTTPCarrier{
+		Name:     name,
+		API:      strings.ToLower(api),
+		Username: username,
+		Password: password,
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Logger:   logrus.NewEntry(logrus.StandardLogger()).WithField("carrier", name),
+		api:      carrierAPI,
+	}, nil
+}
+
+// Send implements the Carrier interface.
+func (c *HTTPCarrier) Send(msg *SendMessage) error {
+	logEntry := c.Logger.WithFields(logrus.Fields{
+		"from": msg.From,
+		"to":   msg.To,
+	})
+	req, err := c.api.request(c, msg)
+	if err != nil {
+		return err
+	}
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: carrierTimeout}
+	}
+	submitted := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s: %s", c.Name, resp.Status, bytes.TrimSpace(body))
+	}
+	id, err := c.api.response(body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.Name, err)
+	}
+	// the message has a single part: the carrier splits long messages itself
+	seq := atomic.AddUint32(&c.seq, 1)
+	msg.Seq = []uint32{seq}
+	logEntry.WithField("id", id).Info("SMS send response")
+	if c.Receive != nil {
+		c.Receive <- SendResponse{
+			ID:        id,
+			Seq:       seq,
+			Addr:      c.Name,
+			Status:    smpp.ESME_ROK,
+			Message:   msg,
+			Submitted: submitted,
+		}
+	}
+	return nil
+}
+
+// ParseInbound implements the Carrier interface.
+func (c *HTTPCarrier) ParseInbound(r *http.Request) ([]Received, error) {
+	return c.api.inbound(c, r)
+}
+
+// ParseStatus implements the Carrier interface.
+func (c *HTTPCarrier) ParseStatus(r *http.Request) ([]Status, error) {
+	return c.api.status(c, r)
+}
+
+// Verify checks the signature of the callback posted by the carrier.
+func (c *HTTPCarrier) Verify(r *http.Request) error {
+	return c.api.verify(c, r)
+}
+
+// ServeHTTP implements the http.Handler interface. It receives the callbacks
+// posted by the carrier and passes the incoming messages and receipts to the
+// receive channel.
+func (c *HTTPCarrier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logEntry := c.Logger.WithField("remote", r.RemoteAddr)
+	if err := c.Verify(r); err != nil {
+		logEntry.WithError(err).Warning("Carrier callback rejected")
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	received, err := c.ParseInbound(r)
+	if err != nil {
+		logEntry.WithError(err).Warning("Carrier callback error")
+		http.Error(w, "invalid callback", http.StatusBadRequest)
+		return
+	}
+	statuses, err := c.ParseStatus(r)
+	if err != nil {
+		logEntry.WithError(err).Warning("Carrier callback error")
+		http.Error(w, "invalid callback", http.StatusBadRequest)
+		return
+	}
+	for _, msg := range received {
+		logEntry.WithFields(logrus.Fields{
+			"from":  msg.From,
+			"to":    msg.To,
+			"media": len(msg.Media),
+		}).Info("SMS received")
+		if len(msg.Media) > 0 && c.Media != nil {
+			// downloads may take longer than the carrier waits for the response
+			go c.receive(msg)
+			continue
+		}
+		if c.Receive != nil {
+			c.Receive <- msg
+		}
+	}
+	for _, status := range statuses {
+		logEntry.WithField("id", status.ID).Infof("SMS status: %q", status.Stat)
+		if c.Receive != nil {
+			c.Receive <- status
+		}
+	}
+	if c.API == APITwilio { // an empty TwiML response, so nothing is sent back
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte("<Response></Response>"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// receive stores the media of the incoming message and passes the message with
+// the links to the stored copies to the receive channel. Media that can't be
+// stored keep the carrier URL.
+func (c *HTTPCarrier) receive(msg Received) {
+	media := make([]Media, len(msg.Media))
+	for i, m := range msg.Media {
+		media[i] = m
+		req, err := c.mediaRequest(m.URL)
+		if err == nil {
+			media[i], err = c.Media.Save(req)
+		}
+		if err != nil {
+			c.Logger.WithError(err).WithField("url", m.URL).Warning("MMS media store error")
+			media[i] = m
+		}
+	}
+	msg.Media = media
+	if c.Receive != nil {
+		c.Receive <- msg
+	}
+}
+
+// mediaRequest returns the request downloading the media. The API credentials
+// are sent only to the API host.
+func (c *HTTPCarrier) mediaRequest(mediaURL string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint, err := url.Parse(c.Endpoint); err == nil && endpoint.Host == req.URL.Host {
+		c.api.authorize(c, req)
+	}
+	return req, nil
+}
+
+// callbackURL returns the URL the carrier posted the request to.
+func (c *HTTPCarrier) callbackURL(r *http.Request) string {
+	if c.CallbackURL != "" {
+		return strings.TrimSuffix(c.CallbackURL, "/") + r.URL.RequestURI()
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+// account returns the account identifier used in the API URLs.
+func (c *HTTPCarrier) account() string {
+	if c.Account != "" {
+		return c.Account
+	}
+	return c.Username
+}
+
+// readBody returns the request body and restores it, so the request can be
+// parsed again.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// e164 returns the phone number with the leading plus sign used by REST APIs.
+// Short codes and alphanumeric sender IDs are used as they are.
+func e164(addr string, kind phone.Type) string {
+	if kind == "" {
+		kind = phone.Classify(addr)
+	}
+	if kind == phone.ShortCode || kind == phone.Alphanumeric || strings.HasPrefix(addr, "+") {
+		return addr
+	}
+	return "+" + addr
+}
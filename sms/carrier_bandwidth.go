@@ -0,0 +1,158 @@
+package sms
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// bandwidthAPI sends messages with the Bandwidth Messaging API v2. Incoming
+// messages and delivery updates are posted as JSON arrays of callbacks.
+type bandwidthAPI struct{}
+
+// bandwidthStates maps Bandwidth callback types to the receipt states.
+var bandwidthStates = map[string]string{
+	"message-sending":   "ENROUTE",
+	"message-delivered": "DELIVRD",
+	"message-failed":    "UNDELIV",
+}
+
+// bandwidthCallback describes the part of Bandwidth callbacks used by the gateway.
+type bandwidthCallback struct {
+	Type      string `json:"type"`
+	To        string `json:"to"`
+	ErrorCode int    `json:"errorCode"`
+	Message   struct {
+		ID    string   `json:"id"`
+		From  string   `json:"from"`
+		Text  string   `json:"text"`
+		Media []string `json:"media"`
+	} `json:"message"`
+}
+
+func (bandwidthAPI) endpoint() string { return "https://messaging.bandwidth.com" }
+
+func (bandwidthAPI) request(c *HTTPCarrier, msg *SendMessage) (*http.Request, error) {
+	var mediaURLs []string
+	for _, media := range msg.Media {
+		mediaURLs = append(mediaURLs, media.URL)
+	}
+	body, err := json.Marshal(struct {
+		From          string   `json:"from"`
+		To            []string `json:"to"`
+		Text          string   `json:"text"`
+		ApplicationID string   `json:"applicationId"`
+		Media         []string `json:"media,omitempty"`
+	}{e164(msg.From, msg.FromType), []string{e164(msg.To, "")}, msg.Text, c.Application, mediaURLs})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost,
+		c.Endpoint+"/api/v2/users/"+url.PathEscape(c.account())+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	bandwidthAPI{}.authorize(c, req)
+	return req, nil
+}
+
+func (bandwidthAPI) authorize(c *HTTPCarrier, req *http.Request) {
+	req.SetBasicAuth(c.Username, c.Password)
+}
+
+func (bandwidthAPI) response(body []byte) (string, error) {
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	if resp.ID == "" {
+		return "", errors.New("no message id in the response")
+	}
+	return resp.ID, nil
+}
+
+// callbacks returns the callbacks posted with the request.
+func (bandwidthAPI) callbacks(r *http.Request) ([]bandwidthCallback, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	var callbacks []bandwidthCallback
+	if err := json.Unmarshal(body, &callbacks); err != nil {
+		return nil, err
+	}
+	return callbacks, nil
+}
+
+func (api bandwidthAPI) inbound(c *HTTPCarrier, r *http.Request) ([]Received, error) {
+	callbacks, err := api.callbacks(r)
+	if err != nil {
+		return nil, err
+	}
+	var received []Received
+	for _, callback := range callbacks {
+		if callback.Type != "message-received" {
+			continue
+		}
+		var media []Media
+		for _, mediaURL := range callback.Message.Media {
+			media = append(media, Media{URL: mediaURL})
+		}
+		received = append(received, Received{
+			From:  callback.Message.From,
+			To:    callback.To,
+			Text:  callback.Message.Text,
+			Addr:  c.Name,
+			Media: media,
+		})
+	}
+	return received, nil
+}
+
+func (api bandwidthAPI) status(c *HTTPCarrier, r *http.Request) ([]Status, error) {
+	callbacks, err := api.callbacks(r)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []Status
+	for _, callback := range callbacks {
+		stat := bandwidthStates[callback.Type]
+		if stat == "" {
+			continue // not a delivery update
+		}
+		statuses = append(statuses, Status{
+			ID:   callback.Message.ID,
+			Sub:  1,
+			Stat: stat,
+			Err:  callback.ErrorCode,
+			Done: time.Now(),
+			Addr: c.Name,
+		})
+	}
+	return statuses, nil
+}
+
+// verify checks the basic authorization configured for the callbacks of the
+// application. Requests are rejected if the credentials are not configured.
+func (bandwidthAPI) verify(c *HTTPCarrier, r *http.Request) error {
+	if c.Secret == "" {
+		return errors.New("callback credentials not configured")
+	}
+	user, password, _ := strings.Cut(c.Secret, ":")
+	ruser, rpassword, ok := r.BasicAuth()
+	if !ok {
+		return errors.New("no authorization")
+	}
+	if subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(ruser+":"+rpassword)) != 1 {
+		return errors.New("invalid credentials")
+	}
+	return nil
+}
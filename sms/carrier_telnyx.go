@@ -0,0 +1,197 @@
+package sms
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const telnyxTolerance = time.Minute * 5 // maximum age of the signed webhook
+
+// telnyxAPI sends messages with the Telnyx Messaging API. Incoming messages and
+// delivery updates are posted as JSON events.
+type telnyxAPI struct{}
+
+// telnyxStates maps Telnyx recipient states to the receipt states.
+var telnyxStates = map[string]string{
+	"queued":               "ACCEPTD",
+	"sending":              "ENROUTE",
+	"sent":                 "ENROUTE",
+	"delivered":            "DELIVRD",
+	"sending_failed":       "REJECTD",
+	"delivery_failed":      "UNDELIV",
+	"delivery_unconfirmed": "UNKNOWN",
+}
+
+// telnyxEvent describes the part of Telnyx webhook events used by the gateway.
+type telnyxEvent struct {
+	Data struct {
+		EventType string `json:"event_type"`
+		Payload   struct {
+			ID   string `json:"id"`
+			Text string `json:"text"`
+			From struct {
+				PhoneNumber string `json:"phone_number"`
+			} `json:"from"`
+			To []struct {
+				PhoneNumber string `json:"phone_number"`
+				Status      string `json:"status"`
+			} `json:"to"`
+			Media []struct {
+				URL         string `json:"url"`
+				ContentType string `json:"content_type"`
+				Size        int64  `json:"size"`
+			} `json:"media"`
+			Errors []struct {
+				Code string `json:"code"`
+			} `json:"errors"`
+		} `json:"payload"`
+	} `json:"data"`
+}
+
+func (telnyxAPI) endpoint() string { return "https://api.telnyx.com" }
+
+func (telnyxAPI) request(c *HTTPCarrier, msg *SendMessage) (*http.Request, error) {
+	var mediaURLs []string
+	for _, media := range msg.Media {
+		mediaURLs = append(mediaURLs, media.URL)
+	}
+	body, err := json.Marshal(struct {
+		From      string   `json:"from"`
+		To        string   `json:"to"`
+		Text      string   `json:"text"`
+		Profile   string   `json:"messaging_profile_id,omitempty"`
+		MediaURLs []string `json:"media_urls,omitempty"`
+	}{e164(msg.From, msg.FromType), e164(msg.To, ""), msg.Text, c.Application, mediaURLs})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Endpoint+"/v2/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	telnyxAPI{}.authorize(c, req)
+	return req, nil
+}
+
+func (telnyxAPI) authorize(c *HTTPCarrier, req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+c.Password)
+}
+
+func (telnyxAPI) response(body []byte) (string, error) {
+	var resp struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	if resp.Data.ID == "" {
+		return "", errors.New("no message id in the response")
+	}
+	return resp.Data.ID, nil
+}
+
+// event returns the webhook event posted with the request.
+func (telnyxAPI) event(r *http.Request) (*telnyxEvent, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	event := new(telnyxEvent)
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+func (api telnyxAPI) inbound(c *HTTPCarrier, r *http.Request) ([]Received, error) {
+	event, err := api.event(r)
+	if err != nil || event.Data.EventType != "message.received" {
+		return nil, err
+	}
+	payload := event.Data.Payload
+	var media []Media
+	for _, m := range payload.Media {
+		media = append(media, Media{URL: m.URL, ContentType: m.ContentType, Size: m.Size})
+	}
+	var received []Received
+	for _, to := range payload.To {
+		received = append(received, Received{
+			From:  payload.From.PhoneNumber,
+			To:    to.PhoneNumber,
+			Text:  payload.Text,
+			Addr:  c.Name,
+			Media: media,
+		})
+	}
+	return received, nil
+}
+
+func (api telnyxAPI) status(c *HTTPCarrier, r *http.Request) ([]Status, error) {
+	event, err := api.event(r)
+	if err != nil || (event.Data.EventType != "message.sent" &&
+		event.Data.EventType != "message.finalized") {
+		return nil, err
+	}
+	payload := event.Data.Payload
+	var errorCode int
+	if len(payload.Errors) > 0 {
+		errorCode, _ = strconv.Atoi(payload.Errors[0].Code)
+	}
+	var statuses []Status
+	for _, to := range payload.To {
+		stat := telnyxStates[to.Status]
+		if stat == "" {
+			stat = "UNKNOWN"
+		}
+		statuses = append(statuses, Status{
+			ID:   payload.ID,
+			Sub:  1,
+			Stat: stat,
+			Err:  errorCode,
+			Done: time.Now(),
+			Addr: c.Name,
+		})
+	}
+	return statuses, nil
+}
+
+// verify checks the Ed25519 signature of the timestamp and body with the public
+// key of the account. Requests are rejected if the key is not configured.
+func (telnyxAPI) verify(c *HTTPCarrier, r *http.Request) error {
+	if c.Secret == "" {
+		return errors.New("public key not configured")
+	}
+	key, err := base64.StdEncoding.DecodeString(c.Secret)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get("Telnyx-Signature-Ed25519"))
+	if err != nil || len(signature) == 0 {
+		return errors.New("no signature")
+	}
+	timestamp := r.Header.Get("Telnyx-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("no timestamp")
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > telnyxTolerance || age < -telnyxTolerance {
+		return errors.New("timestamp is out of range")
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, append([]byte(timestamp+"|"), body...), signature) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package sms
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mxsms/phone"
+)
+
+func TestHTTPCarrierSend(t *testing.T) {
+	tests := []struct {
+		api      string
+		path     string
+		response string
+		id       string
+		check    func(r *http.Request, body []byte) bool
+	}{
+		{
+			api:      APITwilio,
+			path:     "/2010-04-01/Accounts/AC1/Messages.json",
+			response: `{"sid": "SM1", "status": "queued"}`,
+			id:       "SM1",
+			check: func(r *http.Request, body []byte) bool {
+				form, _ := url.ParseQuery(string(body))
+				user, pass, _ := r.BasicAuth()
+				return user == "AC1" && pass == "token" && form.Get("From") == "+14085551234" &&
+					form.Get("To") == "+14155550000" && form.Get("Body") == "test"
+			},
+		},
+		{
+			api:      APITelnyx,
+			path:     "/v2/messages",
+			response: `{"data": {"id": "40317f4a", "type": "SMS"}}`,
+			id:       "40317f4a",
+			check: func(r *http.Request, body []byte) bool {
+				var req map[string]string
+				json.Unmarshal(body, &req)
+				return r.Header.Get("Authorization") == "Bearer token" &&
+					req["from"] == "+14085551234" && req["to"] == "+14155550000" && req["text"] == "test"
+			},
+		},
+		{
+			api:      APIBandwidth,
+			path:     "/api/v2/users/AC1/messages",
+			response: `{"id": "1589228074636lm4k2je7j7jklbn2", "owner": "+14085551234"}`,
+			id:       "1589228074636lm4k2je7j7jklbn2",
+			check: func(r *http.Request, body []byte) bool {
+				var req struct {
+					From string   `json:"from"`
+					To   []string `json:"to"`
+					Text string   `json:"text"`
+				}
+				json.Unmarshal(body, &req)
+				user, pass, _ := r.BasicAuth()
+				return user == "AC1" && pass == "token" && req.From == "+14085551234" &&
+					len(req.To) == 1 && req.To[0] == "+14155550000" && req.Text == "test"
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.api, func(t *testing.T) {
+			stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.URL.Path != test.path || !test.check(r, body) {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"message": "bad request"}`))
+					return
+				}
+				w.Write([]byte(test.response))
+			}))
+			defer stub.Close()
+			carrier, err := NewHTTPCarrier("carrier", test.api, "AC1", "token", stub.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receive := make(chan interface{}, 1)
+			carrier.Receive = receive
+			msg := &SendMessage{From: "14085551234", To: "14155550000", Text: "test"}
+			if err := carrier.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+			resp := (<-receive).(SendResponse)
+			if resp.ID != test.id || resp.Message != msg || len(msg.Seq) != 1 || resp.Seq != msg.Seq[0] {
+				t.Errorf("unexpected response %+v", resp)
+			}
+			// API errors are returned with the response
+			msg.Text = "other"
+			if err := carrier.Send(msg); err == nil || !strings.Contains(err.Error(), "bad request") {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+	if _, err := NewHTTPCarrier("carrier", "unknown", "", "", ""); err == nil {
+		t.Error("unknown API accepted")
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	for _, test := range []struct {
+		addr string
+		kind phone.Type
+		want string
+	}{
+		{"14085551234", "", "+14085551234"},
+		{"22395", "", "22395"},
+		{"ACME", "", "ACME"},
+		{"12345678", phone.ShortCode, "12345678"}, // configured as the short code
+	} {
+		if addr := e164(test.addr, test.kind); addr != test.want {
+			t.Errorf("%q: %q", test.addr, addr)
+		}
+	}
+	if !AcceptsSender("", phone.Alphanumeric) || !AcceptsSender("Twilio", phone.Alphanumeric) ||
+		AcceptsSender(APIBandwidth, phone.Alphanumeric) || !AcceptsSender(APIBandwidth, phone.ShortCode) ||
+		AcceptsSender("", "") {
+		t.Error("unexpected accepted senders")
+	}
+}
+
+func TestHTTPCarrierParse(t *testing.T) {
+	tests := []struct {
+		api         string
+		contentType string
+		inbound     string
+		status      string
+		stat        string
+	}{
+		{
+			api:         APITwilio,
+			contentType: "application/x-www-form-urlencoded",
+			inbound:     "MessageSid=SM2&From=%2B14155550000&To=%2B14085551234&Body=hello",
+			status:      "MessageSid=SM1&MessageStatus=undelivered&ErrorCode=30003",
+			stat:        "UNDELIV",
+		},
+		{
+			api:         APITelnyx,
+			contentType: "application/json",
+			inbound: `{"data": {"event_type": "message.received", "payload": {"id": "m2", "text": "hello",
+				"from": {"phone_number": "+14155550000"}, "to": [{"phone_number": "+14085551234"}]}}}`,
+			status: `{"data": {"event_type": "message.finalized", "payload": {"id": "SM1",
+				"to": [{"phone_number": "+14155550000", "status": "delivery_failed"}],
+				"errors": [{"code": "30003"}]}}}`,
+			stat: "UNDELIV",
+		},
+		{
+			api:         APIBandwidth,
+			contentType: "application/json",
+			inbound: `[{"type": "message-received", "to": "+14085551234",
+				"message": {"id": "m2", "from": "+14155550000", "text": "hello"}}]`,
+			status: `[{"type": "message-failed", "to": "+14155550000", "errorCode": 30003,
+				"message": {"id": "SM1", "from": "+14085551234"}}]`,
+			stat: "UNDELIV",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.api, func(t *testing.T) {
+			carrier, err := NewHTTPCarrier("carrier", test.api, "AC1", "token", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := func(body string) *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+				r.Header.Set("Content-Type", test.contentType)
+				return r
+			}
+			r := request(test.inbound)
+			received, err := carrier.ParseInbound(r)
+			if err != nil || len(received) != 1 || received[0].Text != "hello" ||
+				received[0].From != "+14155550000" || received[0].To != "+14085551234" {
+				t.Fatalf("inbound: %v %+v", err, received)
+			}
+			if statuses, err := carrier.ParseStatus(r); err != nil || len(statuses) != 0 {
+				t.Errorf("status from inbound message: %v %+v", err, statuses)
+			}
+			r = request(test.status)
+			statuses, err := carrier.ParseStatus(r)
+			if err != nil || len(statuses) != 1 || statuses[0].ID != "SM1" ||
+				statuses[0].Stat != test.stat || statuses[0].Err != 30003 {
+				t.Fatalf("status: %v %+v", err, statuses)
+			}
+			if received, err := carrier.ParseInbound(r); err != nil || len(received) != 0 {
+				t.Errorf("inbound from status: %v %+v", err, received)
+			}
+		})
+	}
+}
+
+func TestHTTPCarrierCallback(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		api    string
+		secret string
+		body   string
+		sign   func(r *http.Request)
+	}{
+		{
+			api:  APITwilio,
+			body: "MessageSid=SM2&From=%2B14155550000&To=%2B14085551234&Body=hello",
+			sign: func(r *http.Request) {
+				form, _ := url.ParseQuery("MessageSid=SM2&From=%2B14155550000&To=%2B14085551234&Body=hello")
+				signature := twilioSignature("token", "https://sms.example.com/carriers/carrier", form)
+				r.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(signature))
+			},
+		},
+		{
+			api:    APITelnyx,
+			secret: base64.StdEncoding.EncodeToString(public),
+			body: `{"data": {"event_type": "message.received", "payload": {"id": "m2", "text": "hello",
+				"from": {"phone_number": "+14155550000"}, "to": [{"phone_number": "+14085551234"}]}}}`,
+			sign: func(r *http.Request) {
+				timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+				body, _ := readBody(r)
+				signature := ed25519.Sign(private, append([]byte(timestamp+"|"), body...))
+				r.Header.Set("Telnyx-Timestamp", timestamp)
+				r.Header.Set("Telnyx-Signature-Ed25519", base64.StdEncoding.EncodeToString(signature))
+			},
+		},
+		{
+			api:    APIBandwidth,
+			secret: "callback:secret",
+			body: `[{"type": "message-received", "to": "+14085551234",
+				"message": {"id": "m2", "from": "+14155550000", "text": "hello"}}]`,
+			sign: func(r *http.Request) {
+				r.SetBasicAuth("callback", "secret")
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.api, func(t *testing.T) {
+			carrier, err := NewHTTPCarrier("carrier", test.api, "AC1", "token", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			receive := make(chan interface{}, 1)
+			carrier.Receive = receive
+			carrier.Secret, carrier.CallbackURL = test.secret, "https://sms.example.com"
+			request := func(signed bool) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodPost, "/carriers/carrier", strings.NewReader(test.body))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if signed {
+					test.sign(r)
+				}
+				w := httptest.NewRecorder()
+				carrier.ServeHTTP(w, r)
+				return w
+			}
+			if w := request(false); w.Code != http.StatusForbidden {
+				t.Errorf("unsigned callback: %d", w.Code)
+			}
+			if w := request(true); w.Code != http.StatusOK {
+				t.Fatalf("signed callback: %d %s", w.Code, w.Body)
+			}
+			select {
+			case msg := <-receive:
+				if received, ok := msg.(Received); !ok || received.Text != "hello" || received.Addr != "carrier" {
+					t.Errorf("unexpected message %+v", msg)
+				}
+			default:
+				t.Error("message not received")
+			}
+			carrier.Secret, carrier.Password = "", "" // not configured: rejected
+			if w := request(true); w.Code != http.StatusForbidden {
+				t.Errorf("callback without the secret: %d", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package sms
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// twilioAPI sends messages with the Twilio Messages API. Incoming messages and
+// status callbacks are posted as forms.
+type twilioAPI struct{}
+
+// twilioStates maps Twilio message states to the receipt states.
+var twilioStates = map[string]string{
+	"accepted":    "ACCEPTD",
+	"queued":      "ACCEPTD",
+	"sending":     "ENROUTE",
+	"sent":        "ENROUTE",
+	"delivered":   "DELIVRD",
+	"read":        "DELIVRD",
+	"undelivered": "UNDELIV",
+	"failed":      "REJECTD",
+	"canceled":    "DELETED",
+}
+
+func (twilioAPI) endpoint() string { return "https://api.twilio.com" }
+
+func (twilioAPI) request(c *HTTPCarrier, msg *SendMessage) (*http.Request, error) {
+	form := url.Values{
+		"From": {e164(msg.From, msg.FromType)},
+		"To":   {e164(msg.To, "")},
+		"Body": {msg.Text},
+	}
+	for _, media := range msg.Media {
+		form.Add("MediaUrl", media.URL)
+	}
+	if c.Application != "" {
+		form.Set("MessagingServiceSid", c.Application)
+	}
+	req, err := http.NewRequest(http.MethodPost,
+		c.Endpoint+"/2010-04-01/Accounts/"+url.PathEscape(c.account())+"/Messages.json",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	twilioAPI{}.authorize(c, req)
+	return req, nil
+}
+
+func (twilioAPI) authorize(c *HTTPCarrier, req *http.Request) {
+	req.SetBasicAuth(c.Username, c.Password)
+}
+
+func (twilioAPI) response(body []byte) (string, error) {
+	var resp struct {
+		SID string `json:"sid"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	if resp.SID == "" {
+		return "", errors.New("no message sid in the response")
+	}
+	return resp.SID, nil
+}
+
+func (twilioAPI) inbound(c *HTTPCarrier, r *http.Request) ([]Received, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	// status callbacks have the message status, incoming messages don't
+	if r.PostForm.Get("MessageStatus") != "" || r.PostForm.Get("MessageSid") == "" {
+		return nil, nil
+	}
+	count, _ := strconv.Atoi(r.PostForm.Get("NumMedia"))
+	var media []Media
+	for i := 0; i < count; i++ {
+		media = append(media, Media{
+			URL:         r.PostForm.Get("MediaUrl" + strconv.Itoa(i)),
+			ContentType: r.PostForm.Get("MediaContentType" + strconv.Itoa(i)),
+		})
+	}
+	return []Received{{
+		From:  r.PostForm.Get("From"),
+		To:    r.PostForm.Get("To"),
+		Text:  r.PostForm.Get("Body"),
+		Addr:  c.Name,
+		Media: media,
+	}}, nil
+}
+
+func (twilioAPI) status(c *HTTPCarrier, r *http.Request) ([]Status, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	state := r.PostForm.Get("MessageStatus")
+	if state == "" {
+		return nil, nil
+	}
+	stat := twilioStates[state]
+	if stat == "" {
+		stat = "UNKNOWN"
+	}
+	errorCode, _ := strconv.Atoi(r.PostForm.Get("ErrorCode"))
+	return []Status{{
+		ID:   r.PostForm.Get("MessageSid"),
+		Sub:  1,
+		Stat: stat,
+		Err:  errorCode,
+		Done: time.Now(),
+		Addr: c.Name,
+	}}, nil
+}
+
+// verify checks the X-Twilio-Signature header: the HMAC-SHA1 of the callback URL
+// followed by the sorted form parameters, signed with the auth token. Requests
+// are rejected if the token is not configured.
+func (twilioAPI) verify(c *HTTPCarrier, r *http.Request) error {
+	if c.Password == "" {
+		return errors.New("auth token not configured")
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Twilio-Signature"))
+	if err != nil || len(signature) == 0 {
+		return errors.New("no signature")
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if !hmac.Equal(signature, twilioSignature(c.Password, c.callbackURL(r), r.PostForm)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// twilioSignature returns the signature of the request with the URL and form.
+func twilioSignature(token, callbackURL string, form url.Values) []byte {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(callbackURL))
+	for _, key := range keys {
+		for _, value := range form[key] {
+			mac.Write([]byte(key + value))
+		}
+	}
+	return mac.Sum(nil)
+}
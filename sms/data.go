@@ -1,29 +1,63 @@
 package sms
 
-import "time"
+import (
+	"time"
+
+	"mxsms/phone"
+	"mxsms/smpp"
+)
 
 // Received describes a delivered and parsed SMS message.
 // It includes only those fields that were of interest to me.
 type Received struct {
-	From string // from which number
-	To   string // to which number
-	Text string // message text (already decoded)
-	Addr string // SMPP server identifier
+	From  string  // from which number
+	To    string  // to which number
+	Text  string  // message text (already decoded)
+	Addr  string  // SMPP server identifier
+	Media []Media // MMS attachments, stored locally if the carrier has a media store
 }
 
 type SendMessage struct {
-	MXName string   // name of the MX server from the configuration
-	JID    string   // unique user identifier in MX
-	From   string   // from which number
-	To     string   // to which number
-	Text   string   // message text (already decoded)
-	Seq    []uint32 // internal numbers of sent messages
+	ID       string     // gateway message identifier, assigned when sent if empty
+	MXName   string     // name of the MX server from the configuration
+	JID      string     // unique user identifier in MX
+	From     string     // from which number
+	FromType phone.Type // kind of the source address, classified by the address if empty
+	To       string     // to which number
+	Text     string     // message text (already decoded)
+	Media    []Media    // MMS attachments, sent only by REST carriers
+	Seq      []uint32   // internal numbers of sent messages
+	Origin   *Submitted // ESME submission the message was created from, if any
+}
+
+// sender returns the kind of the source address.
+func (m *SendMessage) sender() phone.Type {
+	if m.FromType != "" {
+		return m.FromType
+	}
+	return phone.Classify(m.From)
 }
 
 type SendResponse struct {
-	ID   string // message identifier
-	Seq  uint32 // internal message number
-	Addr string // SMPP server identifier
+	ID        string         // message identifier
+	Seq       uint32         // internal message number
+	Addr      string         // SMPP server identifier
+	Status    smpp.CMDStatus // response status, ESME_ROK if the message was accepted
+	Message   *SendMessage   // sent message the response belongs to, if known
+	Submitted time.Time      // time the message part was submitted, if known
+}
+
+// Submitted describes a message submitted by an ESME client of the SMPP front end.
+// Long messages are reassembled before they are passed on.
+type Submitted struct {
+	Client  string              // system_id of the ESME
+	From    string              // from which number
+	To      string              // to which number
+	Text    string              // message text (already decoded)
+	IDs     []string            // message identifiers returned to the ESME, one per part
+	Receipt bool                // the ESME requested a delivery receipt
+	Session *smpp.ClientSession // session the message was submitted with
+	Time    time.Time           // time the message was submitted
 }
 
 type Status struct {
@@ -0,0 +1,249 @@
+package sms
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"mxsms/phone"
+	"mxsms/smpp"
+)
+
+const (
+	defaultRetryDelay = 30 * time.Second // default time to wait for deliver_sm_resp
+	defaultQueueTTL   = 24 * time.Hour   // default time undelivered messages are kept
+)
+
+// delivery describes an incoming message queued for delivery to an ESME client.
+type delivery struct {
+	client   string              // system_id of the ESME
+	msg      Received            // message to deliver
+	created  time.Time           // time the message was queued
+	next     time.Time           // time of the next attempt or of the response timeout
+	attempts int                 // number of delivery attempts
+	session  *smpp.ClientSession // session of the current attempt, nil if not sent
+	parts    int                 // number of parts sent in the current attempt
+	acked    int                 // number of parts confirmed in the current attempt
+	done     bool                // delivered or dropped
+}
+
+// waitKey identifies a deliver_sm waiting for the response.
+type waitKey struct {
+	session *smpp.ClientSession
+	seq     uint32
+}
+
+// Owner returns the system_id of the ESME account that owns the phone number,
+// or an empty string if the number is not delivered to ESME clients.
+func (s *Server) Owner(number string) string {
+	s.mu.Lock()
+	auth := s.auth
+	s.mu.Unlock()
+	if auth == nil {
+		return ""
+	}
+	owner, _ := auth.Owner(number)
+	return owner
+}
+
+// Deliver queues the incoming message for delivery to the ESME client. The message
+// is kept while the client is offline and resent until a deliver_sm_resp is received.
+// The queue is kept in memory only: messages still queued are lost on restart.
+func (s *Server) Deliver(client string, msg Received) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server == nil {
+		return errors.New("smpp server not started")
+	}
+	s.queue = append(s.queue, &delivery{
+		client:  client,
+		msg:     msg,
+		created: time.Now(),
+		next:    time.Now(),
+	})
+	select { // start delivery without waiting for the timer
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Queued returns the number of messages waiting for delivery to the client.
+func (s *Server) Queued(client string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int
+	for _, d := range s.queue {
+		if d.client == client && !d.done {
+			count++
+		}
+	}
+	return count
+}
+
+// delivering sends the queued messages to the clients until the server is stopped.
+func (s *Server) delivering(server *smpp.Server) {
+	ticker := time.NewTicker(s.retryDelay / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.wakeup:
+		case <-server.Done():
+			return
+		}
+		s.deliverQueued(server)
+	}
+}
+
+// outgoing describes the parts of a queued message built for the delivery
+// attempt, written to the session after the lock is released.
+type outgoing struct {
+	d        *delivery
+	pdus     []smpp.Pdu
+	logEntry *logrus.Entry
+}
+
+// deliverQueued makes an attempt to deliver every queued message that is due.
+// The messages are built with the lock held and written without it, each
+// session by its own goroutine, so a stalled client delays neither the
+// responses nor the deliveries to the other clients.
+func (s *Server) deliverQueued(server *smpp.Server) {
+	s.mu.Lock()
+	now := time.Now()
+	queue := s.queue[:0]
+	sends := make(map[*smpp.ClientSession][]outgoing)
+	for _, d := range s.queue {
+		if !d.done && now.Sub(d.created) > s.queueTTL {
+			s.Logger.WithFields(logrus.Fields{
+				"client":   d.client,
+				"from":     d.msg.From,
+				"to":       d.msg.To,
+				"attempts": d.attempts,
+			}).Warning("SMS delivery to client expired")
+			s.resetAttempt(d)
+			d.done = true
+		}
+		if d.done {
+			continue // remove from the queue
+		}
+		queue = append(queue, d)
+		if now.Before(d.next) {
+			continue // not yet time for the next attempt
+		}
+		if d.session != nil { // no response received in time
+			s.resetAttempt(d)
+		}
+		session := server.ReceiverSession(d.client)
+		if session == nil {
+			continue // the client is offline, keep the message in the queue
+		}
+		if out, ok := s.prepareDelivery(d, session); ok {
+			sends[session] = append(sends[session], out)
+		}
+	}
+	s.queue = queue
+	s.mu.Unlock()
+	for session, list := range sends {
+		go s.writeDeliveries(session, list)
+	}
+}
+
+// prepareDelivery builds all parts of the message for the session and waits for
+// their responses. It must be called with the lock held.
+func (s *Server) prepareDelivery(d *delivery, session *smpp.ClientSession) (outgoing, bool) {
+	d.attempts++
+	d.next = time.Now().Add(s.retryDelay)
+	logEntry := s.Logger.WithFields(logrus.Fields{
+		"client":  d.client,
+		"from":    d.msg.From,
+		"to":      d.msg.To,
+		"attempt": d.attempts,
+	})
+	code, parts := splitText(d.msg.Text)
+	sourceTON, sourceNPI := phone.Address(d.msg.From)
+	destTON, destNPI := phone.Address(d.msg.To)
+	params := smpp.Params{
+		smpp.SOURCE_ADDR_TON: sourceTON,
+		smpp.SOURCE_ADDR_NPI: sourceNPI,
+		smpp.DEST_ADDR_TON:   destTON,
+		smpp.DEST_ADDR_NPI:   destNPI,
+		smpp.DATA_CODING:     code,
+	}
+	if len(parts) > 1 {
+		params[smpp.ESM_CLASS] = 0x40 // parts start with UDH
+	}
+	d.session, d.parts, d.acked = session, len(parts), 0
+	out := outgoing{d: d, logEntry: logEntry}
+	for _, part := range parts {
+		pdu, err := session.Smpp.DeliverSm(d.msg.From, d.msg.To, part, params)
+		if err != nil {
+			logEntry.WithError(err).Error("SMS delivery to client error")
+			s.resetAttempt(d)
+			return outgoing{}, false
+		}
+		// waited for before the write: the response may come before it returns
+		s.waiting[waitKey{session, pdu.GetHeader().Sequence}] = d
+		out.pdus = append(out.pdus, pdu)
+	}
+	return out, true
+}
+
+// writeDeliveries writes the prepared messages to the session. A failed write
+// ends the attempt, the message is retried after the delay.
+func (s *Server) writeDeliveries(session *smpp.ClientSession, list []outgoing) {
+	for _, out := range list {
+		var err error
+		for _, pdu := range out.pdus {
+			if err = session.Write(pdu); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			out.logEntry.WithError(err).Error("SMS delivery to client error")
+			s.mu.Lock()
+			if out.d.session == session { // not reset by a timeout meanwhile
+				s.resetAttempt(out.d)
+			}
+			s.mu.Unlock()
+			continue
+		}
+		out.logEntry.WithField("parts", len(out.pdus)).Info("SMS delivered to client")
+	}
+}
+
+// resetAttempt forgets the responses expected for the current attempt. It must be
+// called with the lock held.
+func (s *Server) resetAttempt(d *delivery) {
+	for key, waiting := range s.waiting {
+		if waiting == d {
+			delete(s.waiting, key)
+		}
+	}
+	d.session = nil
+}
+
+// deliverSmResp handles the client response to a delivered message part.
+func (s *Server) deliverSmResp(session *smpp.ClientSession, seq uint32, status smpp.CMDStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := waitKey{session, seq}
+	d := s.waiting[key]
+	if d == nil {
+		return // a receipt or a response to an attempt that already timed out
+	}
+	delete(s.waiting, key)
+	if status != smpp.ESME_ROK { // the client can't take the message now, retry later
+		s.Logger.WithFields(logrus.Fields{
+			"client": d.client,
+			"from":   d.msg.From,
+			"to":     d.msg.To,
+		}).WithError(status).Warning("SMS delivery to client rejected")
+		s.resetAttempt(d)
+		d.next = time.Now().Add(s.retryDelay)
+		return
+	}
+	if d.acked++; d.acked >= d.parts {
+		d.done = true // will be removed from the queue
+	}
+}
@@ -0,0 +1,128 @@
+package sms
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultMediaSize = 5 << 20          // default maximum size of a media file
+	mediaTimeout     = time.Second * 60 // time allowed for the media download
+)
+
+// ErrMMSNotSupported is returned when a message with media is sent through a
+// carrier that can only send text.
+var ErrMMSNotSupported = errors.New("carrier doesn't support MMS")
+
+// ErrMediaTooLarge is returned when the media file exceeds the size limit.
+var ErrMediaTooLarge = errors.New("media file is too large")
+
+// Media describes a file attached to an MMS message.
+type Media struct {
+	URL         string `json:"url"`                   // where the file can be downloaded
+	ContentType string `json:"contentType,omitempty"` // MIME type, if known
+	Size        int64  `json:"size,omitempty"`        // size in bytes, if known
+}
+
+// MediaStore downloads the media of incoming MMS messages into a local
+// directory and serves the stored files, so they can be passed to MX chat as
+// links. The carrier URLs usually require the API credentials and expire.
+type MediaStore struct {
+	Dir     string       `yaml:"dir" json:"dir"`                             // directory the files are stored in
+	MaxSize int64        `yaml:"maxSize,omitempty" json:"maxSize,omitempty"` // maximum file size in bytes, 5 MB by default
+	BaseURL string       `yaml:"baseUrl" json:"baseUrl"`                     // public URL the stored files are served at
+	Client  *http.Client `yaml:"-" json:"-"`                                 // HTTP client, with the default timeout if nil
+}
+
+// Save downloads the media with the request and returns the stored copy. Files
+// larger than the limit are not stored.
+func (s *MediaStore) Save(req *http.Request) (Media, error) {
+	maxSize := s.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMediaSize
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: mediaTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Media{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Media{}, fmt.Errorf("media download: %s", resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return Media{}, ErrMediaTooLarge
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return Media{}, err
+	}
+	name := uuid.New().String() + mediaExtension(contentType)
+	filename := filepath.Join(s.Dir, name)
+	file, err := os.Create(filename)
+	if err != nil {
+		return Media{}, err
+	}
+	size, err := io.Copy(file, io.LimitReader(resp.Body, maxSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size > maxSize {
+		err = ErrMediaTooLarge
+	}
+	if err != nil {
+		os.Remove(filename)
+		return Media{}, err
+	}
+	return Media{
+		URL:         strings.TrimSuffix(s.BaseURL, "/") + "/" + name,
+		ContentType: contentType,
+		Size:        size,
+	}, nil
+}
+
+// ServeHTTP implements the http.Handler interface. It serves the stored files by
+// name; the names are random, so the files are not listed.
+func (s *MediaStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(s.Dir, name))
+}
+
+// mediaExtension returns the file name extension for the content type.
+func mediaExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType { // the first registered extension is not always the usual one
+	case "image/jpeg":
+		return ".jpg"
+	case "text/plain":
+		return ".txt"
+	}
+	if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package sms
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMediaStore(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		switch r.URL.Path {
+		case "/small.jpg":
+			w.Write([]byte("jpeg"))
+		case "/large.jpg":
+			w.Write([]byte(strings.Repeat("x", 100)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stub.Close()
+	store := &MediaStore{Dir: t.TempDir(), MaxSize: 10, BaseURL: "https://sms.example.com/media/"}
+	save := func(name string) (Media, error) {
+		req, _ := http.NewRequest(http.MethodGet, stub.URL+name, nil)
+		return store.Save(req)
+	}
+	media, err := save("/small.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(media.URL, "https://sms.example.com/media/") || path.Ext(media.URL) != ".jpg" ||
+		media.ContentType != "image/jpeg" || media.Size != 4 {
+		t.Errorf("unexpected media %+v", media)
+	}
+	if _, err := save("/large.jpg"); err != ErrMediaTooLarge {
+		t.Errorf("large media: %v", err)
+	}
+	if _, err := save("/missing.jpg"); err == nil {
+		t.Error("missing media stored")
+	}
+	if files, _ := os.ReadDir(store.Dir); len(files) != 1 {
+		t.Errorf("%d files stored", len(files))
+	}
+	// stored files are served by name
+	w := httptest.NewRecorder()
+	store.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/media/"+path.Base(media.URL), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "jpeg" {
+		t.Errorf("serve: %d %q", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	store.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/media/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("directory listing: %d", w.Code)
+	}
+}
+
+func TestHTTPCarrierMMS(t *testing.T) {
+	var sent url.Values
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "AC1" || pass != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/2010-04-01/Accounts/AC1/Messages.json":
+			body, _ := io.ReadAll(r.Body)
+			sent, _ = url.ParseQuery(string(body))
+			w.Write([]byte(`{"sid": "MM1"}`))
+		case "/2010-04-01/Accounts/AC1/Messages/MM2/Media/ME1":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stub.Close()
+	carrier, err := NewHTTPCarrier("carrier", APITwilio, "AC1", "token", stub.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := make(chan interface{}, 1)
+	carrier.Receive = receive
+	carrier.Media = &MediaStore{Dir: t.TempDir(), BaseURL: "https://sms.example.com/media"}
+	// outgoing media are passed to the carrier by URL
+	msg := &SendMessage{From: "14085551234", To: "14155550000", Text: "photo",
+		Media: []Media{{URL: "https://example.com/photo.jpg"}}}
+	if err := carrier.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	<-receive
+	if sent.Get("MediaUrl") != "https://example.com/photo.jpg" {
+		t.Errorf("media not sent: %v", sent)
+	}
+	if err := (SMPPCarrier{}).Send(msg); err != ErrMMSNotSupported {
+		t.Errorf("SMPP MMS: %v", err)
+	}
+	// incoming media are stored and replaced with the local links
+	form := url.Values{
+		"MessageSid":        {"MM2"},
+		"From":              {"+14155550000"},
+		"To":                {"+14085551234"},
+		"NumMedia":          {"1"},
+		"MediaUrl0":         {stub.URL + "/2010-04-01/Accounts/AC1/Messages/MM2/Media/ME1"},
+		"MediaContentType0": {"image/png"},
+	}
+	carrier.CallbackURL = "https://sms.example.com"
+	r := httptest.NewRequest(http.MethodPost, "/carriers/carrier", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(
+		twilioSignature("token", "https://sms.example.com/carriers/carrier", form)))
+	w := httptest.NewRecorder()
+	carrier.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	select {
+	case msg := <-receive:
+		received := msg.(Received)
+		if len(received.Media) != 1 || received.Media[0].Size != 3 ||
+			!strings.HasPrefix(received.Media[0].URL, "https://sms.example.com/media/") {
+			t.Errorf("unexpected media %+v", received.Media)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+	}
+}
+
+func TestHTTPCarrierParseMMS(t *testing.T) {
+	tests := []struct {
+		api  string
+		body string
+	}{
+		{
+			api: APITelnyx,
+			body: `{"data": {"event_type": "message.received", "payload": {"id": "m2", "text": "",
+				"from": {"phone_number": "+14155550000"}, "to": [{"phone_number": "+14085551234"}],
+				"media": [{"url": "https://media.example.com/1.png", "content_type": "image/png", "size": 3}]}}}`,
+		},
+		{
+			api: APIBandwidth,
+			body: `[{"type": "message-received", "to": "+14085551234",
+				"message": {"id": "m2", "from": "+14155550000", "media": ["https://media.example.com/1.png"]}}]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.api, func(t *testing.T) {
+			carrier, err := NewHTTPCarrier("carrier", test.api, "AC1", "token", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			received, err := carrier.ParseInbound(r)
+			if err != nil || len(received) != 1 || len(received[0].Media) != 1 ||
+				received[0].Media[0].URL != "https://media.example.com/1.png" {
+				t.Fatalf("inbound: %v %+v", err, received)
+			}
+		})
+	}
+}
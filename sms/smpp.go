@@ -4,30 +4,38 @@ import (
 	"errors"
 	"mxsms/smpp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"mxsms/conf"
+	"mxsms/health"
+	"mxsms/supervisor"
 	"mxsms/zabbix"
 )
 
-const MaxErrors = 10 // maximum allowable number of connection errors
-
 // SMPP describes a connection to the SMPP server.
 type SMPP struct {
-	Address         []string         // address and port of the SMPP server
-	SystemID        string           `yaml:"systemId"` // login for authorization
-	Password        string           // password for authorization
-	EnquireDuration string           `yaml:"enquireDuration,omitempty"` // interval for sending connection maintenance messages
-	ReconnectDelay  string           `yaml:"reconnectDelay,omitempty"`  // delay time between reconnecting to the server
-	MaxError        int              `yaml:"maxError,omitempty"`        // maximum allowable number of errors
-	MaxParts        uint8            `yaml:"maxParts,omitempty"`        // maximum number of SMS splits
-	Logger          *logrus.Entry    `yaml:"-"`                         // log output
-	Zabbix          *zabbix.Log      `yaml:"-"`
-	Receive         chan interface{} `yaml:"-"` // return channel from transceiver
-
-	send chan *SendMessage       // channel for sending SMS
-	trxs map[string]*Transceiver // list of connected SMPP transceivers
-	mu   sync.RWMutex
+	Address         []string               `yaml:"address" json:"address"`                                     // address and port of the SMPP server
+	SystemID        string                 `yaml:"systemId" json:"systemId"`                                   // login for authorization
+	Password        string                 `yaml:"password" json:"password"`                                   // password for authorization
+	EnquireDuration conf.Duration          `yaml:"enquireDuration,omitempty" json:"enquireDuration,omitempty"` // interval for sending connection maintenance messages
+	ReconnectDelay  conf.Duration          `yaml:"reconnectDelay,omitempty" json:"reconnectDelay,omitempty"`   // delay time between reconnecting to the server
+	MaxError        int                    `yaml:"maxError,omitempty" json:"maxError,omitempty"`               // maximum allowable number of errors
+	MaxParts        uint8                  `yaml:"maxParts,omitempty" json:"maxParts,omitempty"`               // maximum number of SMS splits
+	Names           map[string]string      `yaml:"names,omitempty" json:"names,omitempty"`                     // link names by address, for the metrics and Zabbix keys
+	Logger          *logrus.Entry          `yaml:"-" json:"-"`                                                 // log output
+	Zabbix          *zabbix.Log            `yaml:"-" json:"-"`                                                 // link state metrics
+	Receive         chan interface{}       `yaml:"-" json:"-"`                                                 // return channel from transceiver
+	Reconnect       *supervisor.Config     `yaml:"-" json:"-"`                                                 // reconnect settings shared with MX
+	Alert           func(supervisor.Alert) `yaml:"-" json:"-"`                                                 // circuit breaker alerts
+
+	send        chan *SendMessage                 // channel for sending SMS
+	queued      int32                             // messages waiting for a transceiver
+	trxs        map[string]*Transceiver           // list of connected SMPP transceivers
+	states      map[string]*health.State          // link states by address
+	supervisors map[string]*supervisor.Supervisor // link reconnects by address
+	mu          sync.RWMutex
 }
 
 // Connect establishes a connection with all SMPP addresses specified in the properties.
@@ -39,88 +47,157 @@ func (s *SMPP) Connect() {
 	s.send = make(chan *SendMessage)                       // channel for sending SMS
 	s.Receive = make(chan interface{})                     // channel for receiving SMS
 	s.trxs = make(map[string]*Transceiver, len(s.Address)) // list of established connections
+	s.states = make(map[string]*health.State, len(s.Address))
+	s.supervisors = make(map[string]*supervisor.Supervisor, len(s.Address))
 	if s.MaxParts > 0 {
 		MaxParts = int(s.MaxParts) // set the maximum allowable number of SMS parts
 	}
 	s.mu.Unlock()
+	// establish a connection with all specified server addresses
+	for _, addr := range s.Address {
+		s.start(addr)
+	}
+}
+
+// start starts the supervisor connecting to the SMPP server with the current
+// bind settings.
+func (s *SMPP) start(addr string) {
+	s.mu.Lock()
+	state := new(health.State)
+	link := &supervisor.Supervisor{
+		Name:   "smpp/" + s.linkName(addr),
+		Policy: s.Reconnect.Policy(time.Duration(s.ReconnectDelay), s.MaxError),
+		State:  state,
+		Logger: s.Logger.WithField("smpp", addr),
+		Alert:  s.Alert,
+	}
+	s.states[addr], s.supervisors[addr] = state, link
 	// form authorization parameters
 	bindParams := smpp.Params{
 		smpp.SYSTEM_TYPE: "SMPP",
 		smpp.SYSTEM_ID:   s.SystemID,
 		smpp.PASSWORD:    s.Password,
 	}
-	// establish a connection with all specified server addresses
-	for _, addr := range s.Address {
-		go func(addr string) {
-			logEntry := s.Logger.WithField("smpp", addr)
-			maxErrors := MaxErrors // set the maximum number of allowable errors
-			if s.MaxError > 0 {
-				maxErrors = s.MaxError
-			}
-			var lastErrorTime time.Time      // time when the last temporary error occurred
-			for i := 0; i < maxErrors; i++ { // restart the service automatically in case of connection errors
-				var key string
-				if addr == s.Address[0] {
-					key = "east.bw.sms.link"
-				} else {
-					key = "west.bw.sms.link"
-				}
-				// establish a connection with the SMPP server
-				enquireDuration, _ := time.ParseDuration(s.EnquireDuration)
-				trx, err := smpp.NewTransceiver(addr, enquireDuration, bindParams)
-				if err != nil {
-					s.Zabbix.Send(key, "0")
-					logEntry.WithError(err).Error("SMPP Connection error")
-					if time.Since(lastErrorTime) > time.Minute*30 {
-						i = 0 // reset error counter if errors were long ago
-					}
-					reconnectDelay, _ := time.ParseDuration(s.ReconnectDelay)
-
-					time.Sleep(reconnectDelay) // delay before next attempt
-					lastErrorTime = time.Now() // remember error time
-					continue                   // repeat once more
-				}
-				logEntry.Info("SMPP Connected")
-				go func() {
-					for {
-						s.Zabbix.Send(key, "1")
-						time.Sleep(time.Minute)
-					}
-				}()
-				transceiver := &Transceiver{
-					addr:        addr,
-					Transceiver: trx,
-					Logger:      logEntry,
-				}
-				s.mu.Lock()
-				s.trxs[addr] = transceiver
-				s.mu.Unlock()
-				// start processing messages for sending
-				go transceiver.sending(s.send)
-				// start receiving data from the server
-				err = transceiver.reading(s.Receive)
-				s.mu.Lock()
-				delete(s.trxs, addr) // remove from the list
-				s.mu.Unlock()
-				transceiver.Close() // close if not closed
-				if err != nil {
-					logEntry.WithError(err).Error("SMPP error")
-				} else {
-					break // planned stop
-				}
-				logEntry.Warning("SMPP Connection stopped")
+	enquire := time.Duration(s.EnquireDuration)
+	s.mu.Unlock()
+	go link.Run(func(up func()) error {
+		return s.connect(link, addr, bindParams, enquire, up)
+	})
+}
+
+// connect establishes the connection with the SMPP server and serves it until
+// it's lost. Bind rejections are reported as authorization failures.
+func (s *SMPP) connect(link *supervisor.Supervisor, addr string, bindParams smpp.Params,
+	enquire time.Duration, up func()) error {
+	logEntry := s.Logger.WithField("smpp", addr)
+	key := s.Zabbix.LinkKey(s.zabbixLink(addr))
+	trx, err := smpp.NewTransceiver(addr, enquire, bindParams)
+	if err != nil {
+		s.Zabbix.Set(key, "0")
+		logEntry.WithError(err).Error("SMPP Connection error")
+		if _, ok := err.(smpp.SmppBindAuthErr); ok {
+			return supervisor.AuthError(err)
+		}
+		return err
+	}
+	transceiver := &Transceiver{
+		addr:        addr,
+		Transceiver: trx,
+		Logger:      logEntry,
+		state:       link.State,
+	}
+	s.mu.Lock()
+	if s.trxs == nil || s.supervisors[addr] != link { // closed or replaced while connecting
+		s.mu.Unlock()
+		transceiver.Close()
+		return nil
+	}
+	s.trxs[addr] = transceiver
+	s.mu.Unlock()
+	logEntry.Info("SMPP Connected")
+	up()
+	s.Zabbix.Set(key, "1") // repeated while the link is up
+	s.Receive <- Link{Address: addr, Name: s.LinkName(addr), Up: true}
+	// start processing messages for sending
+	go transceiver.sending(s.send)
+	// start receiving data from the server
+	err = transceiver.reading(s.Receive)
+	s.mu.Lock()
+	if s.trxs[addr] == transceiver {
+		delete(s.trxs, addr) // remove from the list
+	}
+	s.mu.Unlock()
+	transceiver.Close() // close if not closed
+	s.Zabbix.Set(key, "0")
+	s.Receive <- Link{Address: addr, Name: s.LinkName(addr), Up: false}
+	if err != nil {
+		logEntry.WithError(err).Error("SMPP error")
+		logEntry.Warning("SMPP Connection stopped")
+	}
+	return err
+}
+
+// Update applies the reloaded settings to the running links. The links to the
+// removed or renamed servers are closed and the added ones are connected; all
+// of them are reconnected if the bind settings are changed. The messages
+// waiting for a link stay in the queue.
+func (s *SMPP) Update(next *SMPP) {
+	s.mu.Lock()
+	rebind := s.SystemID != next.SystemID || s.Password != next.Password ||
+		s.EnquireDuration != next.EnquireDuration
+	policy := next.Reconnect.Policy(time.Duration(next.ReconnectDelay), next.MaxError)
+	for addr, link := range s.supervisors {
+		if rebind || !contains(next.Address, addr) || s.linkName(addr) != next.linkName(addr) {
+			link.Stop()
+			if trx := s.trxs[addr]; trx != nil {
+				trx.Close()
 			}
-		}(addr)
+			delete(s.supervisors, addr)
+			delete(s.states, addr)
+			continue
+		}
+		link.SetPolicy(policy)
+	}
+	s.Address, s.SystemID, s.Password = next.Address, next.SystemID, next.Password
+	s.EnquireDuration, s.ReconnectDelay, s.MaxError = next.EnquireDuration, next.ReconnectDelay, next.MaxError
+	s.Names, s.Reconnect = next.Names, next.Reconnect
+	if next.MaxParts > 0 && next.MaxParts != s.MaxParts {
+		MaxParts = int(next.MaxParts)
+	}
+	s.MaxParts = next.MaxParts
+	var added []string
+	for _, addr := range s.Address {
+		if s.supervisors[addr] == nil {
+			added = append(added, addr)
+		}
+	}
+	s.mu.Unlock()
+	for _, addr := range added {
+		s.start(addr)
 	}
 }
 
+// contains reports whether the list contains the address.
+func contains(list []string, addr string) bool {
+	for _, item := range list {
+		if item == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops reconnecting and closes the connections.
 func (s *SMPP) Close() {
-	s.mu.RLock()
+	s.mu.Lock()
+	for _, supervisor := range s.supervisors {
+		supervisor.Stop()
+	}
 	for _, trx := range s.trxs {
 		trx.Close()
 	}
 	s.trxs = nil
-	s.mu.RUnlock()
+	s.mu.Unlock()
 }
 
 // Send sends an outgoing SMS for processing and sending to the server.
@@ -128,6 +205,90 @@ func (s *SMPP) Send(sms *SendMessage) error {
 	if s.send == nil {
 		return errors.New("smpp not initialized")
 	}
+	atomic.AddInt32(&s.queued, 1)
 	s.send <- sms
+	atomic.AddInt32(&s.queued, -1)
 	return nil
 }
+
+// Queued returns the number of messages waiting for a connected transceiver.
+func (s *SMPP) Queued() int {
+	return int(atomic.LoadInt32(&s.queued))
+}
+
+// LinkName returns the name of the link to the SMPP server from Names, or the
+// address if the name is not set.
+func (s *SMPP) LinkName(addr string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.linkName(addr)
+}
+
+// linkName returns the name of the link; the caller holds the lock.
+func (s *SMPP) linkName(addr string) string {
+	if name := s.Names[addr]; name != "" {
+		return name
+	}
+	return addr
+}
+
+// zabbixLink returns the link name used for the Zabbix key. Without a name in
+// Names the first address keeps the "east.bw" key and the others "west.bw", as
+// before the names were configurable.
+func (s *SMPP) zabbixLink(addr string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if name := s.Names[addr]; name != "" {
+		return name
+	}
+	if len(s.Address) > 0 && addr == s.Address[0] {
+		return "east.bw"
+	}
+	return "west.bw"
+}
+
+// Link describes the state of the connection to one of the SMPP servers. It is
+// also sent to the Receive channel when the connection is established or lost.
+type Link struct {
+	Address string `json:"address"`        // address and port of the SMPP server
+	Name    string `json:"name,omitempty"` // link name used in the metrics
+	Up      bool   `json:"up"`             // the connection is established and bound
+}
+
+// LinkStates returns the detailed state of the links to all configured SMPP
+// servers, for the health checks.
+func (s *SMPP) LinkStates() []health.Link {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	links := make([]health.Link, len(s.Address))
+	for i, addr := range s.Address {
+		links[i] = health.Link{Address: addr, Name: s.linkName(addr), Status: s.states[addr].Status()}
+	}
+	return links
+}
+
+// Supervisors returns the reconnect supervisors of the links to all
+// configured SMPP servers.
+func (s *SMPP) Supervisors() []*supervisor.Supervisor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	supervisors := make([]*supervisor.Supervisor, 0, len(s.supervisors))
+	for _, addr := range s.Address {
+		if supervisor := s.supervisors[addr]; supervisor != nil {
+			supervisors = append(supervisors, supervisor)
+		}
+	}
+	return supervisors
+}
+
+// Links returns the state of the connections to all configured SMPP servers.
+func (s *SMPP) Links() []Link {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	links := make([]Link, len(s.Address))
+	for i, addr := range s.Address {
+		_, up := s.trxs[addr]
+		links[i] = Link{Address: addr, Name: s.linkName(addr), Up: up}
+	}
+	return links
+}
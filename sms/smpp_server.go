@@ -1,156 +1,275 @@
 package sms
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"github.com/sirupsen/logrus"
-	"math/rand"
-	"mxsms/smpp" // replace this with the actual import path to your smpp package
+	"sync"
 	"time"
+
+	"github.com/sirupsen/logrus"
+	"mxsms/conf"
+	"mxsms/smpp"
 )
 
-func main() {
-	// Define a simple authentication handler
-	authHandler := func(systemID, password string) bool {
-		// Hard-coded authentication check
-		return (systemID == "client1" && password == "pass1") || (systemID == "client2" && password == "password2")
-	}
-
-	// Create the SMPP server
-	server := smpp.NewServer("0.0.0.0:2776", authHandler)
-
-	// Start the server
-	server.Start()
-	/*if err != nil {
-		log.Fatalf("Failed to start SMPP server: %v", err)
-	}*/
-	fmt.Println("SMPP server started on :2776")
-
-	// Start the inbound processing queue
-	go processIncomingMessages(server.IncomingChannel)
-
-	// Start the outbound processing queue
-	/*go processOutgoingMessages(server.OutgoingChannel, server)*/
-
-	// Example of sending a message to a specific client after 10 seconds
-	go func() {
-		time.Sleep(10 * time.Second) // Simulate delay before sending SMS
-		err := sendMessage(server, smpp.SMS{
-			From:    "Server",
-			To:      "client1",
-			Message: "Hello from the server!",
-		})
-		if err != nil {
-			logrus.Error(err)
-		}
-		fmt.Println("Queued SMS to client1 for sending")
-	}()
+// partsTimeout is the time after which incomplete long messages are dropped.
+const partsTimeout = 10 * time.Minute
+
+// Server describes the SMPP front end accepting messages from ESME clients,
+// such as the PBX or third-party applications. Incoming messages for the
+// clients are queued in memory and are lost if the gateway is restarted before
+// they are delivered.
+type Server struct {
+	Address     string         `yaml:"address" json:"address"`                             // address and port to listen on
+	Accounts    string         `yaml:"accounts,omitempty" json:"accounts,omitempty"`       // file with ESME accounts
+	AccountsDSN string         `yaml:"accountsDSN,omitempty" json:"accountsDSN,omitempty"` // database with the ESME accounts instead of the file
+	BindTimeout conf.Duration  `yaml:"bindTimeout,omitempty" json:"bindTimeout,omitempty"` // time allowed for a connection to bind
+	MaxBinds    int            `yaml:"maxBinds,omitempty" json:"maxBinds,omitempty"`       // maximum sessions per account
+	RetryDelay  conf.Duration  `yaml:"retryDelay,omitempty" json:"retryDelay,omitempty"`   // time to wait for deliver_sm_resp before retry
+	QueueTTL    conf.Duration  `yaml:"queueTTL,omitempty" json:"queueTTL,omitempty"`       // time undelivered messages are kept
+	Logger      *logrus.Entry  `yaml:"-" json:"-"`                                         // log output
+	Receive     chan Submitted `yaml:"-" json:"-"`                                         // messages submitted by clients
+
+	server     *smpp.Server
+	auth       accounts
+	parts      map[string]*submittedParts // parts of long messages waiting for the rest
+	retryDelay time.Duration
+	queueTTL   time.Duration
+	queue      []*delivery           // messages waiting for delivery to clients
+	waiting    map[waitKey]*delivery // delivered parts waiting for the response
+	wakeup     chan struct{}
+	mu         sync.Mutex
+}
 
-	// Run the server indefinitely (or add your own logic to stop it)
-	select {}
+// accounts is the store of the ESME accounts: the file or the database.
+type accounts interface {
+	smpp.Authenticator
+	smpp.NumberOwner
+	Close() error
+}
+
+// submittedParts collects the parts of a long message submitted by an ESME.
+type submittedParts struct {
+	sms      smpp.SMS // first received part
+	parts    [][]byte // message text by part number
+	ids      []string // message identifiers returned for the parts
+	received int      // number of received parts
+	time     time.Time
+}
+
+// Start starts accepting connections from ESME clients.
+func (s *Server) Start() error {
+	if s.Logger == nil { // initialize log support
+		s.Logger = logrus.NewEntry(logrus.StandardLogger())
+	}
+	s.Logger = s.Logger.WithField("smppServer", s.Address)
+	auth, err := s.openAccounts()
+	if err != nil {
+		return err
+	}
+	server := smpp.NewServer(s.Address, auth)
+	if s.BindTimeout > 0 {
+		server.BindTimeout = time.Duration(s.BindTimeout)
+	}
+	server.MaxBinds = s.MaxBinds
+	retryDelay, queueTTL := defaultRetryDelay, defaultQueueTTL
+	if s.RetryDelay > 0 {
+		retryDelay = time.Duration(s.RetryDelay)
+	}
+	if s.QueueTTL > 0 {
+		queueTTL = time.Duration(s.QueueTTL)
+	}
+	server.DeliverSmRespHandler = s.deliverSmResp
+	if err := server.Start(); err != nil {
+		auth.Close()
+		return err
+	}
+	if file, ok := auth.(*smpp.FileAuthenticator); ok {
+		file.Watch(time.Second * 10) // pick up account changes without restart
+	}
+	s.mu.Lock()
+	s.server = server
+	s.auth = auth
+	s.parts = make(map[string]*submittedParts)
+	s.Receive = make(chan Submitted)
+	s.retryDelay, s.queueTTL = retryDelay, queueTTL
+	s.waiting = make(map[waitKey]*delivery)
+	s.wakeup = make(chan struct{}, 1)
+	s.mu.Unlock()
+	s.Logger.WithField("addr", server.Addr().String()).Info("SMPP server started")
+	go s.receiving(server)
+	go s.delivering(server)
+	return nil
 }
 
-// Process incoming messages (Inbound Queue)
-func processIncomingMessages(incomingQueue <-chan smpp.SMS) {
-	for sms := range incomingQueue {
-		// Process the received SMS message
-		fmt.Printf("Received SMS from %s to %s: %s\n", sms.From, sms.To, sms.Message)
-		// Add custom processing logic here (e.g., saving to a database, triggering an action)
+// openAccounts opens the accounts database if it's set, the accounts file
+// otherwise.
+func (s *Server) openAccounts() (accounts, error) {
+	if s.AccountsDSN != "" {
+		return smpp.OpenSQLAuthenticator(s.AccountsDSN)
 	}
+	return smpp.NewFileAuthenticator(s.Accounts)
 }
 
-/*// Process outgoing messages (Outbound Queue)
-func processOutgoingMessages(outgoingQueue <-chan smpp.SMS, server *smpp.Server) {
-	for sms := range outgoingQueue {
-		// Process and send the SMS message
-		server.SendSMS(sms) // Utilize the sendSMS method in the Server struct to send the message
-		fmt.Printf("Sent SMS from %s to %s: %s\n", sms.From, sms.To, sms.Message)
-		// Add custom logic here (e.g., logging, notification of successful sending)
-	}
-}*/
-
-func sendMessage(s *smpp.Server, sms smpp.SMS) error {
-	session := s.Clients[sms.Client]
-
-	text := sms.Message
-	// determine the message encoding
-	var code int             // encoding number
-	for _, r := range text { // iterate through the text character by character
-		// if r > '\u007F' { // non-ASCII characters are used
-		// 	code = 3
-		// }
-		// for now, we'll leave only unicode encoding for all cases of extended characters
-		if r > '\u007F' { // non-ASCII characters are used
-			code = 8
-			break
-		}
+// Close stops the server and disconnects all clients.
+func (s *Server) Close() {
+	s.mu.Lock()
+	server, auth := s.server, s.auth
+	s.mu.Unlock()
+	if server == nil {
+		return
 	}
-	// convert the text to the required encoding
-	text = string(Encode(uint8(code), text))
-	// form parameters for sending the message
-	params := smpp.Params{
-		smpp.DEST_ADDR_TON:       1,
-		smpp.DEST_ADDR_NPI:       1,
-		smpp.DATA_CODING:         code, // encoding
-		smpp.REGISTERED_DELIVERY: 1,    // send delivery reports
-	}
-	// depending on the encoding, check for the maximum allowable length of a single message
-	var maxOneMessageLength, maxMultiplyMessageLength int
-	switch code {
-	case 0: // raw
-		maxOneMessageLength = 160
-		maxMultiplyMessageLength = 153
-	default:
-		maxOneMessageLength = 140
-		maxMultiplyMessageLength = 134
-	}
-	// check if the message fits into one
-	if len(text) <= maxOneMessageLength {
-		p, err := session.SubmitSm(sms.From, sms.To, text, params) // send as is
-		if err == nil {
-			//sms.Seq = []uint32{seq}
+	auth.Close()
+	server.Stop()
+	s.Logger.Info("SMPP server stopped")
+}
+
+// SMPP returns the underlying SMPP server.
+func (s *Server) SMPP() *smpp.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server
+}
+
+// receiving reassembles and decodes the messages submitted by clients.
+func (s *Server) receiving(server *smpp.Server) {
+	for {
+		select {
+		case sms := <-server.IncomingChannel:
+			msg, ok := s.reassemble(sms)
+			if !ok {
+				continue // waiting for the rest of the message
+			}
+			s.Logger.WithFields(logrus.Fields{
+				"client": msg.Client,
+				"from":   msg.From,
+				"to":     msg.To,
+				"parts":  len(msg.IDs),
+			}).Info("SMS submitted")
+			select {
+			case s.Receive <- msg:
+			case <-server.Done():
+				return
+			}
+		case <-server.Done():
+			return
 		}
-		if err := session.Write(p); err != nil {
-			return err
+	}
+}
+
+// reassemble returns the complete message once all of its parts were received.
+func (s *Server) reassemble(sms smpp.SMS) (Submitted, bool) {
+	text := []byte(sms.Message)
+	ref, total, part, body := parseUDH(sms.EsmClass, text)
+	if total <= 1 {
+		return submitted(sms, Decode(sms.DataCoding, body), []string{sms.MessageID}), true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, parts := range s.parts { // drop messages that will never be complete
+		if time.Since(parts.time) > partsTimeout {
+			delete(s.parts, key)
 		}
-		return err
 	}
-	// the message needs to be split into several
-	params[smpp.ESM_CLASS] = 0x40 // set a special type indicating that text concatenation is used
-	// calculate the number of necessary parts
-	count := (len(text) + maxMultiplyMessageLength - 1) / maxMultiplyMessageLength
-	if count > MaxParts {
-		count = MaxParts // set the maximum number of parts
-	}
-	// form the "header" of the UDH string of the SMS
-	// the last field stores the message counter, the penultimate - the quantity,
-	// and before it - a random identifier for the entire group of messages
-	udh := []byte{0x5, 0x0, 0x3, byte(rand.Intn(0xff) + 1), byte(count), 0x0}
-	// iterate through all parts and send them to the server
-	//sms.Seq = make([]uint32, 0, count) // initialize the list of identifiers
-	for i := 0; i < count; i++ {
-		udh[5] = byte(i + 1)                    // add the sequence number to the header
-		start := i * maxMultiplyMessageLength   // start of the text fragment
-		end := start + maxMultiplyMessageLength // end of the fragment
-		if end > len(text) {
-			end = len(text) // we're trying to get more than actually exists
+	key := fmt.Sprintf("%s/%s/%s/%d", sms.Client, sms.From, sms.To, ref)
+	parts := s.parts[key]
+	if parts == nil || len(parts.parts) != total {
+		parts = &submittedParts{sms: sms, parts: make([][]byte, total), time: time.Now()}
+		s.parts[key] = parts
+	}
+	if parts.parts[part-1] == nil {
+		parts.received++
+	}
+	parts.parts[part-1] = body
+	parts.ids = append(parts.ids, sms.MessageID)
+	if parts.received < total {
+		return Submitted{}, false
+	}
+	delete(s.parts, key)
+	text = bytes.Join(parts.parts, nil)
+	return submitted(parts.sms, Decode(parts.sms.DataCoding, text), parts.ids), true
+}
+
+// submitted returns the description of a complete message.
+func submitted(sms smpp.SMS, text string, ids []string) Submitted {
+	return Submitted{
+		Client:  sms.Client,
+		From:    sms.From,
+		To:      sms.To,
+		Text:    text,
+		IDs:     ids,
+		Receipt: sms.RegisteredDelivery&0x01 != 0,
+		Session: sms.Session,
+		Time:    time.Now(),
+	}
+}
+
+// parseUDH returns the concatenation info and the text without the user data header.
+// Both 8-bit and 16-bit reference numbers are supported. Messages without UDH are
+// returned as a single part.
+func parseUDH(esmClass uint8, text []byte) (ref, total, part int, body []byte) {
+	if esmClass&0x40 == 0 || len(text) == 0 || int(text[0])+1 > len(text) {
+		return 0, 1, 1, text
+	}
+	udh, body := text[1:text[0]+1], text[text[0]+1:]
+	for len(udh) >= 2 {
+		iei, l := udh[0], int(udh[1])
+		if len(udh) < l+2 {
+			break
 		}
-		// combine the header with a piece of text
-		msg := string(udh) + text[start:end]
-		// fmt.Println(">", msg, "[", len(msg), "]")
-		/*logEntry.WithFields(logrus.Fields{
-			"count":  i + 1,
-			"total":  count,
-			"length": len(msg),
-		}).Info("SMS send")*/
-
-		p, err := session.SubmitSm(sms.From, sms.To, msg, params) // send as is
-		if err == nil {
-			//sms.Seq = []uint32{seq}
+		data := udh[2 : l+2]
+		switch {
+		case iei == 0x00 && l == 3: // 8-bit reference number
+			ref, total, part = int(data[0]), int(data[1]), int(data[2])
+		case iei == 0x08 && l == 4: // 16-bit reference number
+			ref, total, part = int(data[0])<<8|int(data[1]), int(data[2]), int(data[3])
 		}
-		if err := session.Write(p); err != nil {
+		udh = udh[l+2:]
+	}
+	if total == 0 || part == 0 || part > total {
+		return 0, 1, 1, body
+	}
+	return ref, total, part, body
+}
+
+// SendReceipt sends a delivery receipt for every part of the submitted message to
+// the session it was submitted with or, if that one can't receive, to another
+// receiver session of the same client.
+func (s *Server) SendReceipt(msg Submitted, status Status) error {
+	server := s.SMPP()
+	if server == nil {
+		return errors.New("smpp server not started")
+	}
+	session := msg.Session
+	if session == nil || !session.State().CanReceive() {
+		session = server.ReceiverSession(msg.Client)
+	}
+	if session == nil {
+		return fmt.Errorf("no receiver session bound for %s", msg.Client)
+	}
+	params := smpp.Params{
+		smpp.ESM_CLASS:   0x04, // delivery receipt
+		smpp.DATA_CODING: 0,
+	}
+	text := []rune(msg.Text)
+	if len(text) > 20 {
+		text = text[:20]
+	}
+	done := status.Done
+	if done.IsZero() {
+		done = time.Now()
+	}
+	for _, id := range msg.IDs {
+		receipt := fmt.Sprintf("id:%s sub:001 dlvrd:%03d submit date:%s done date:%s stat:%s err:%03d text:%s",
+			id, status.Dlvrd, msg.Time.Format(statusTimeFormat), done.Format(statusTimeFormat),
+			status.Stat, status.Err, string(Encode(0, string(text))))
+		if _, err := session.DeliverSm(msg.To, msg.From, receipt, params); err != nil {
 			return err
 		}
-		//sms.Seq = append(sms.Seq, seq)
 	}
+	s.Logger.WithFields(logrus.Fields{
+		"client": msg.Client,
+		"to":     msg.To,
+	}).Infof("SMS receipt sent: %q", status.Stat)
 	return nil
 }
@@ -1,55 +1,218 @@
 package sms
 
 import (
-	"fmt"
-	"github.com/sirupsen/logrus"
-	"mxsms/smpp"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/sirupsen/logrus"
+	"mxsms/conf"
+	"mxsms/smpp"
 )
 
-func TestSmppServer(t *testing.T) {
-	// Define a simple authentication handler
-	authHandler := func(systemID, password string) bool {
-		// Hard-coded authentication check
-		return (systemID == "client1" && password == "pass1") || (systemID == "client2" && password == "pass2")
+func testSMPPServer(t *testing.T, server *Server) *Server {
+	accounts := filepath.Join(t.TempDir(), "accounts.yaml")
+	err := os.WriteFile(accounts, []byte("accounts:\n  - systemId: client1\n    password: pass1\n"+
+		"    numbers: [\"14155550000\"]\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
 	}
+	server.Address, server.Accounts = "127.0.0.1:0", accounts
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
 
-	// Create the SMPP server
-	server := smpp.NewServer("0.0.0.0:2776", authHandler)
-
-	// Start the server
-	server.Start()
-	/*if err != nil {
-		log.Fatalf("Failed to start SMPP server: %v", err)
-	}*/
-	fmt.Println("SMPP server started on :2776")
-
-	// Start the inbound processing queue
-	go processIncomingMessages(server.IncomingChannel)
+func TestSmppServer(t *testing.T) {
+	server := testSMPPServer(t, new(Server))
+	bindParams := smpp.Params{
+		smpp.SYSTEM_TYPE: "SMPP",
+		smpp.SYSTEM_ID:   "client1",
+		smpp.PASSWORD:    "pass1",
+	}
+	logEntry := logrus.NewEntry(logrus.StandardLogger())
+	trx, err := NewTransceiver(server.SMPP().Addr().String(), 0, bindParams, logEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trx.Close()
+	// the long message is split into parts with UDH by the transceiver
+	text := strings.Repeat("Сообщение из нескольких частей. ", 5)
+	sms := &SendMessage{From: "14085551234", To: "14155550000", Text: text}
+	if err := trx.Send(sms); err != nil {
+		t.Fatal(err)
+	}
+	for range sms.Seq {
+		pdu, err := trx.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pdu.GetHeader().Id != smpp.SUBMIT_SM_RESP || !pdu.Ok() {
+			t.Fatalf("unexpected response %s %v", pdu.GetHeader().Id.Error(), pdu.GetHeader().Status)
+		}
+	}
+	var msg Submitted
+	select {
+	case msg = <-server.Receive:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+	}
+	if msg.Text != text || msg.Client != "client1" || msg.From != sms.From || msg.To != sms.To {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if len(msg.IDs) != len(sms.Seq) || !msg.Receipt {
+		t.Errorf("expected %d ids with receipt: %v", len(sms.Seq), msg.IDs)
+	}
+	// receipts are relayed back to the session as DELIVER_SM
+	if err := server.SendReceipt(msg, Status{Stat: "DELIVRD", Dlvrd: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range msg.IDs {
+		pdu, err := trx.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		receipt := pdu.GetField(smpp.SHORT_MESSAGE).String()
+		if pdu.GetHeader().Id != smpp.DELIVER_SM || !strings.HasPrefix(receipt, "id:"+id+" ") ||
+			!strings.Contains(receipt, "stat:DELIVRD") {
+			t.Errorf("unexpected receipt %q", receipt)
+		}
+		if class := pdu.GetField(smpp.ESM_CLASS).Value().(uint8); class&0x04 == 0 {
+			t.Errorf("receipt esm_class %x", class)
+		}
+		trx.DeliverSmResp(pdu.GetHeader().Sequence, smpp.ESME_ROK)
+	}
+}
 
-	// Start the outbound processing queue
-	/*go processOutgoingMessages(server.OutgoingChannel, server)*/
+func TestSmppServerDeliver(t *testing.T) {
+	server := testSMPPServer(t, &Server{RetryDelay: conf.Duration(time.Millisecond * 200)})
+	if owner := server.Owner("14155550000"); owner != "client1" {
+		t.Fatalf("unexpected owner %q", owner)
+	}
+	// the message is kept in the queue while the client is offline
+	msg := Received{From: "14085551234", To: "14155550000", Text: "Привет"}
+	if err := server.Deliver("client1", msg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if queued := server.Queued("client1"); queued != 1 {
+		t.Fatalf("queued %d", queued)
+	}
+	bindParams := smpp.Params{
+		smpp.SYSTEM_TYPE: "SMPP",
+		smpp.SYSTEM_ID:   "client1",
+		smpp.PASSWORD:    "pass1",
+	}
+	logEntry := logrus.NewEntry(logrus.StandardLogger())
+	trx, err := NewTransceiver(server.SMPP().Addr().String(), 0, bindParams, logEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trx.Close()
+	// the message is delivered after bind and resent while there is no response
+	var seq uint32
+	for attempt := 0; attempt < 2; attempt++ {
+		pdu, err := trx.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pdu.GetHeader().Id != smpp.DELIVER_SM {
+			t.Fatalf("unexpected pdu %s", pdu.GetHeader().Id.Error())
+		}
+		coding := pdu.GetField(smpp.DATA_CODING).Value().(uint8)
+		text := Decode(coding, []byte(pdu.GetField(smpp.SHORT_MESSAGE).String()))
+		if text != msg.Text || pdu.GetField(smpp.SOURCE_ADDR).String() != msg.From ||
+			pdu.GetField(smpp.DESTINATION_ADDR).String() != msg.To {
+			t.Errorf("unexpected message %q", text)
+		}
+		seq = pdu.GetHeader().Sequence
+	}
+	if queued := server.Queued("client1"); queued != 1 {
+		t.Fatalf("queued %d before response", queued)
+	}
+	trx.DeliverSmResp(seq, smpp.ESME_ROK)
+	for start := time.Now(); server.Queued("client1") != 0; time.Sleep(time.Millisecond * 10) {
+		if time.Since(start) > time.Second*2 {
+			t.Fatal("message not removed from the queue")
+		}
+	}
+}
 
-	// Example of sending a message to a specific client after 10 seconds
-	go func(serv *smpp.Server) {
+func TestSMPPUpdate(t *testing.T) {
+	first := testSMPPServer(t, new(Server)).SMPP().Addr().String()
+	second := testSMPPServer(t, new(Server)).SMPP().Addr().String()
+	client := &SMPP{Address: []string{first}, SystemID: "client1", Password: "pass1"}
+	client.Connect()
+	defer client.Close()
+	links := make(chan Link, 10)
+	go func() {
+		for msg := range client.Receive {
+			if link, ok := msg.(Link); ok {
+				links <- link
+			}
+		}
+	}()
+	wait := func(addr string, up bool) {
+		t.Helper()
 		for {
-			time.Sleep(2 * time.Second) // Simulate delay before sending SMS
-			for s, _ := range serv.Clients {
-				err := sendMessage(serv, smpp.SMS{
-					From:    "+12508591501",
-					To:      "+17786538344",
-					Message: "Hello from the server!",
-					Client:  s,
-				})
-				logrus.Infof("Sending to %s", s)
-				if err != nil {
-					logrus.Error(err)
+			select {
+			case link := <-links:
+				if link.Address == addr && link.Up == up {
+					return
 				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("link %s up=%v not reported", addr, up)
 			}
 		}
-	}(server)
+	}
+	wait(first, true)
+	running := client.Supervisors()[0]
+	// the added link is connected, the unchanged one is kept
+	client.Update(&SMPP{Address: []string{first, second}, SystemID: "client1", Password: "pass1",
+		Names: map[string]string{second: "backup"}})
+	wait(second, true)
+	if supervisors := client.Supervisors(); len(supervisors) != 2 || supervisors[0] != running ||
+		supervisors[1].Name != "smpp/backup" {
+		t.Errorf("unexpected supervisors %v", supervisors)
+	}
+	// the removed link is closed
+	client.Update(&SMPP{Address: []string{second}, SystemID: "client1", Password: "pass1",
+		Names: map[string]string{second: "backup"}})
+	wait(first, false)
+	if links := client.Links(); len(links) != 1 || links[0].Name != "backup" || !links[0].Up {
+		t.Errorf("unexpected links %v", links)
+	}
+	// the changed bind settings reconnect the link
+	client.Update(&SMPP{Address: []string{second}, SystemID: "client1", Password: "pass1",
+		Names: map[string]string{second: "backup"}, EnquireDuration: conf.Duration(time.Minute)})
+	wait(second, false)
+	wait(second, true)
+}
+
+func TestZabbixLink(t *testing.T) {
+	s := &SMPP{Address: []string{"east:2775", "west:2775", "backup:2775"},
+		Names: map[string]string{"backup:2775": "backup"}}
+	for addr, want := range map[string]string{
+		"east:2775":   "east.bw",
+		"west:2775":   "west.bw",
+		"backup:2775": "backup",
+	} {
+		if name := s.zabbixLink(addr); name != want {
+			t.Errorf("%s: %q", addr, name)
+		}
+	}
+}
 
-	// Run the server indefinitely (or add your own logic to stop it)
-	select {}
+func TestParseUDH(t *testing.T) {
+	ref, total, part, body := parseUDH(0x40, []byte{0x06, 0x08, 0x04, 0x01, 0x02, 0x03, 0x02, 'a'})
+	if ref != 0x0102 || total != 3 || part != 2 || string(body) != "a" {
+		t.Errorf("16-bit reference: %d %d %d %q", ref, total, part, body)
+	}
+	if _, total, _, body := parseUDH(0x00, []byte("text")); total != 1 || string(body) != "text" {
+		t.Errorf("no UDH: %d %q", total, body)
+	}
 }
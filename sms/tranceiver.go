@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"mxsms/health"
+	"mxsms/phone"
 	"mxsms/smpp"
 )
 
@@ -17,11 +19,20 @@ var MaxParts = 8 // maximum number of parts into which a long message is split
 
 // Transceiver describes a connection to the SMPP server and allows working with it.
 type Transceiver struct {
-	addr              string        // SMPP server address
-	*smpp.Transceiver               // connection to the server
-	Logger            *logrus.Entry // log output
-	isClosed          bool          // flag for closed connection
-	mu                sync.Mutex    // lock for shared access
+	addr              string                 // SMPP server address
+	*smpp.Transceiver                        // connection to the server
+	Logger            *logrus.Entry          // log output
+	isClosed          bool                   // flag for closed connection
+	mu                sync.Mutex             // lock for shared access
+	pending           map[uint32]pendingPart // sent messages waiting for submit_sm_resp
+	pendingMu         sync.Mutex
+	state             *health.State // link state, for the health checks
+}
+
+// pendingPart describes a submitted message part waiting for submit_sm_resp.
+type pendingPart struct {
+	msg       *SendMessage // message the part belongs to
+	submitted time.Time    // time the part was submitted
 }
 
 // NewTransceiver establishes a connection with the SMPP server and returns it.
@@ -61,9 +72,56 @@ func (trx *Transceiver) Send(sms *SendMessage) error {
 		"to":   sms.To,
 	})
 	logEntry.Debugf("SMS send text: %q", sms.Text)
-	text := sms.Text
+	// the sequence numbers are registered while the lock is held, so responses
+	// can't be read before the message they belong to is known
+	trx.pendingMu.Lock()
+	defer trx.pendingMu.Unlock()
+	if trx.pending == nil {
+		trx.pending = make(map[uint32]pendingPart)
+	}
+	code, parts := splitText(sms.Text)
+	sourceTON, sourceNPI := sms.sender().SMPP()
+	destTON, destNPI := phone.Address(sms.To)
+	from := sms.From
+	if sourceTON == phone.TONAlphanumeric {
+		from = string(Encode(0, from)) // sender ID in the default alphabet
+	}
+	// form parameters for sending the message
+	params := smpp.Params{
+		smpp.SOURCE_ADDR_TON:     sourceTON,
+		smpp.SOURCE_ADDR_NPI:     sourceNPI,
+		smpp.DEST_ADDR_TON:       destTON,
+		smpp.DEST_ADDR_NPI:       destNPI,
+		smpp.DATA_CODING:         code, // encoding
+		smpp.REGISTERED_DELIVERY: 1,    // send delivery reports
+	}
+	logEntry = logEntry.WithField("code", code)
+	if len(parts) > 1 {
+		params[smpp.ESM_CLASS] = 0x40 // set a special type indicating that text concatenation is used
+	}
+	// iterate through all parts and send them to the server
+	sms.Seq = make([]uint32, 0, len(parts)) // initialize the list of identifiers
+	for i, msg := range parts {
+		logEntry.WithFields(logrus.Fields{
+			"count":  i + 1,
+			"total":  len(parts),
+			"length": len(msg),
+		}).Info("SMS send")
+		seq, err := trx.Transceiver.SubmitSm(from, sms.To, msg, params) // send
+		if err != nil {
+			return err // in case of an error, return information about it and break
+		}
+		sms.Seq = append(sms.Seq, seq)
+		trx.pending[seq] = pendingPart{msg: sms, submitted: time.Now()}
+	}
+	return nil
+}
+
+// splitText encodes the text and splits it into the parts of a long message if
+// it doesn't fit into one. Every part of a long message starts with UDH.
+// It returns the data coding used and the encoded parts.
+func splitText(text string) (code int, parts []string) {
 	// determine the message encoding
-	var code int             // encoding number
 	for _, r := range text { // iterate through the text character by character
 		// if r > '\u007F' { // non-ASCII characters are used
 		// 	code = 3
@@ -76,13 +134,6 @@ func (trx *Transceiver) Send(sms *SendMessage) error {
 	}
 	// convert the text to the required encoding
 	text = string(Encode(uint8(code), text))
-	// form parameters for sending the message
-	params := smpp.Params{
-		smpp.DEST_ADDR_TON:       1,
-		smpp.DEST_ADDR_NPI:       1,
-		smpp.DATA_CODING:         code, // encoding
-		smpp.REGISTERED_DELIVERY: 1,    // send delivery reports
-	}
 	// depending on the encoding, check for the maximum allowable length of a single message
 	var maxOneMessageLength, maxMultiplyMessageLength int
 	switch code {
@@ -93,18 +144,10 @@ func (trx *Transceiver) Send(sms *SendMessage) error {
 		maxOneMessageLength = 140
 		maxMultiplyMessageLength = 134
 	}
-	logEntry = logEntry.WithField("code", code)
 	// check if the message fits into one
 	if len(text) <= maxOneMessageLength {
-		logEntry.WithField("length", len(text)).Info("SMS send")
-		seq, err := trx.Transceiver.SubmitSm(sms.From, sms.To, text, params) // send as is
-		if err == nil {
-			sms.Seq = []uint32{seq}
-		}
-		return err
+		return code, []string{text} // send as is
 	}
-	// the message needs to be split into several
-	params[smpp.ESM_CLASS] = 0x40 // set a special type indicating that text concatenation is used
 	// calculate the number of necessary parts
 	count := (len(text) + maxMultiplyMessageLength - 1) / maxMultiplyMessageLength
 	if count > MaxParts {
@@ -114,8 +157,7 @@ func (trx *Transceiver) Send(sms *SendMessage) error {
 	// the last field stores the message counter, the penultimate - the quantity,
 	// and before it - a random identifier for the entire group of messages
 	udh := []byte{0x5, 0x0, 0x3, byte(rand.Intn(0xff) + 1), byte(count), 0x0}
-	// iterate through all parts and send them to the server
-	sms.Seq = make([]uint32, 0, count) // initialize the list of identifiers
+	parts = make([]string, 0, count)
 	for i := 0; i < count; i++ {
 		udh[5] = byte(i + 1)                    // add the sequence number to the header
 		start := i * maxMultiplyMessageLength   // start of the text fragment
@@ -124,20 +166,9 @@ func (trx *Transceiver) Send(sms *SendMessage) error {
 			end = len(text) // we're trying to get more than actually exists
 		}
 		// combine the header with a piece of text
-		msg := string(udh) + text[start:end]
-		// fmt.Println(">", msg, "[", len(msg), "]")
-		logEntry.WithFields(logrus.Fields{
-			"count":  i + 1,
-			"total":  count,
-			"length": len(msg),
-		}).Info("SMS send")
-		seq, err := trx.Transceiver.SubmitSm(sms.From, sms.To, msg, params) // send
-		if err != nil {
-			return err // in case of an error, return information about it and break
-		}
-		sms.Seq = append(sms.Seq, seq)
+		parts = append(parts, string(udh)+text[start:end])
 	}
-	return nil
+	return code, parts
 }
 
 // sending receives messages from the channel and sends them to the server
@@ -187,10 +218,17 @@ func (trx *Transceiver) reading(receive chan<- interface{}) (err error) {
 		case smpp.SUBMIT_SM_RESP: // message sent by us
 			seq := pdu.GetHeader().Sequence // internal number of the sent message
 			logEntry.WithField("seq", seq).Info("SMS send response")
+			trx.pendingMu.Lock()
+			part := trx.pending[seq]
+			delete(trx.pending, seq)
+			trx.pendingMu.Unlock()
 			receive <- SendResponse{
-				Addr: trx.addr, // server address
-				ID:   id,       // external unique message identifier
-				Seq:  seq,      // internal message number
+				Addr:      trx.addr, // server address
+				ID:        id,       // external unique message identifier
+				Seq:       seq,      // internal message number
+				Status:    pdu.GetHeader().Status,
+				Message:   part.msg,       // message the response belongs to
+				Submitted: part.submitted, // zero for unknown messages
 			}
 		case smpp.DELIVER_SM: // incoming message
 			var msg Received    // parsed message
@@ -260,8 +298,10 @@ func (trx *Transceiver) reading(receive chan<- interface{}) (err error) {
 				trx.Logger.WithError(err).Error("SMS DeliverSM Response Error")
 				// receive <- err
 			}
-		case smpp.ENQUIRE_LINK_RESP, smpp.ENQUIRE_LINK: // connection confirmation
-			continue // ignore
+		case smpp.ENQUIRE_LINK_RESP: // connection confirmation
+			trx.state.Keepalive()
+		case smpp.ENQUIRE_LINK:
+			continue // answered by the connection
 		default: // unhandled message type
 			logEntry.WithField("type", pdu.GetHeader().Id).Warning("SMS unsupported command type")
 		}
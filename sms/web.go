@@ -1 +1,600 @@
 package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"mxsms/smpp"
+	"mxsms/supervisor"
+)
+
+const (
+	webMessageTTL   = time.Hour * 72   // how long sent messages can be queried
+	webMaxBody      = 64 << 10         // maximum size of the request body
+	callbackTimeout = time.Second * 10 // time allowed for the callback request
+)
+
+// Message states reported by the HTTP API.
+const (
+	WebAccepted  = "accepted"  // passed to the SMPP connection
+	WebSent      = "sent"      // accepted by the SMPP server
+	WebDelivered = "delivered" // delivered to the phone
+	WebFailed    = "failed"    // rejected or not delivered
+)
+
+// WebGateway sends the messages accepted by the HTTP API.
+type WebGateway interface {
+	// SendMessage sends the message. A smpp.CMDStatus error is reported to the
+	// client with its code.
+	SendMessage(msg *SendMessage) error
+	// Links returns the state of the SMPP connections.
+	Links() []Link
+	// Connections returns the reconnect supervisors of the MX and SMPP
+	// connections.
+	Connections() []*supervisor.Supervisor
+}
+
+// Web describes the HTTP API allowing CRM systems and scripts to send messages
+// and check their status without going through MX:
+//
+//	POST /messages        send a message: {"from", "to", "text", "callback"}
+//	GET  /messages/{id}   message status and parts
+//	GET  /links           state of the SMPP connections
+//	GET  /log             search of the message log, if the log is configured
+//	GET  /log/{id}        logged message with its parts and status history
+//	POST /carriers/{name} incoming messages and receipts of REST carriers
+//	GET  /media/{name}    stored media of incoming MMS messages
+//	GET  /admin/connections              MX and SMPP circuit breakers
+//	POST /admin/connections/{name}/reset reconnect at once, such as mx/main
+//
+// Carrier callbacks are checked with the carrier signature. Media files have
+// random names and are served without authorization. Other requests are
+// authorized with an API key in the X-API-Key header or as a bearer token. The
+// log and admin requests are allowed only for the clients listed in admins, as
+// the log holds the messages of all clients and MX users.
+//
+// Repeating POST /messages with the same Idempotency-Key header returns the
+// message sent by the first request. Status callbacks are not posted to
+// loopback, private or link-local addresses unless the host is listed in
+// callbackHosts, and redirects are not followed. Errors are returned as JSON
+// with the SMPP status code: {"error": "Invalid Dest Addr", "status": 11}.
+type Web struct {
+	Address       string                  `yaml:"address" json:"address"`                                 // address and port to listen on
+	APIKeys       map[string]string       `yaml:"apiKeys" json:"apiKeys"`                                 // API key -> client name
+	Admins        []string                `yaml:"admins,omitempty" json:"admins,omitempty"`               // clients allowed to use the log and admin API
+	CallbackHosts []string                `yaml:"callbackHosts,omitempty" json:"callbackHosts,omitempty"` // internal hosts the callbacks may be posted to
+	Logger        *logrus.Entry           `yaml:"-" json:"-"`                                             // log output
+	Gateway       WebGateway              `yaml:"-" json:"-"`                                             // sends the messages
+	Carriers      map[string]http.Handler `yaml:"-" json:"-"`                                             // callback handlers by carrier name
+	Media         http.Handler            `yaml:"-" json:"-"`                                             // serves the stored MMS media, if set
+	Log           http.Handler            `yaml:"-" json:"-"`                                             // serves the message log queries, if set
+
+	server   *http.Server
+	listener net.Listener
+	messages map[string]*WebMessage       // messages by identifier
+	keys     map[string]*WebMessage       // messages by client and idempotency key
+	sent     map[*SendMessage]*WebMessage // messages waiting for submit responses
+	receipts map[string]*WebMessage       // messages by SMPP message id, waiting for receipts
+	mu       sync.Mutex
+}
+
+// WebMessage describes a message sent with the HTTP API.
+type WebMessage struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Text     string    `json:"text"`
+	Callback string    `json:"callback,omitempty"` // URL notified about status changes
+	Status   string    `json:"status"`             // accepted, sent, delivered or failed
+	Parts    []WebPart `json:"parts,omitempty"`    // known after the SMPP server responded
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+
+	client string       // API client that sent the message
+	key    string       // idempotency key
+	msg    *SendMessage // message passed to the gateway
+}
+
+// WebPart describes the state of a message part.
+type WebPart struct {
+	ID     string `json:"id,omitempty"`   // message identifier assigned by the SMPP server
+	Status string `json:"status"`         // accepted, sent, delivered or failed
+	Stat   string `json:"stat,omitempty"` // state from the delivery receipt
+	Err    int    `json:"err,omitempty"`  // SMPP status or receipt error code
+}
+
+// webRequest describes the body of POST /messages.
+type webRequest struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Text     string `json:"text"`
+	Callback string `json:"callback,omitempty"`
+}
+
+// webError describes the error returned to the client.
+type webError struct {
+	Error  string         `json:"error"`
+	Status smpp.CMDStatus `json:"status"`
+}
+
+// Start starts serving the HTTP API.
+func (w *Web) Start() error {
+	if w.Logger == nil { // initialize log support
+		w.Logger = logrus.NewEntry(logrus.StandardLogger())
+	}
+	w.Logger = w.Logger.WithField("web", w.Address)
+	if w.Gateway == nil {
+		return errors.New("web gateway not set")
+	}
+	listener, err := net.Listen("tcp", w.Address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: w, ReadHeaderTimeout: time.Second * 10}
+	w.mu.Lock()
+	w.server, w.listener = server, listener
+	w.messages = make(map[string]*WebMessage)
+	w.keys = make(map[string]*WebMessage)
+	w.sent = make(map[*SendMessage]*WebMessage)
+	w.receipts = make(map[string]*WebMessage)
+	w.mu.Unlock()
+	w.Logger.WithField("addr", listener.Addr().String()).Info("Web API started")
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			w.Logger.WithError(err).Error("Web API error")
+		}
+	}()
+	return nil
+}
+
+// Close stops the HTTP API.
+func (w *Web) Close() {
+	w.mu.Lock()
+	server := w.server
+	w.mu.Unlock()
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	server.Shutdown(ctx)
+	w.Logger.Info("Web API stopped")
+}
+
+// Addr returns the address the API is listening on.
+func (w *Web) Addr() net.Addr {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.listener == nil {
+		return nil
+	}
+	return w.listener.Addr()
+}
+
+// SetCarriers replaces the callback handlers of the carriers after the
+// configuration reload.
+func (w *Web) SetCarriers(carriers map[string]http.Handler) {
+	w.mu.Lock()
+	w.Carriers = carriers
+	w.mu.Unlock()
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (w *Web) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/carriers/") {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/carriers/"), "/")
+		w.mu.Lock()
+		handler := w.Carriers[name]
+		w.mu.Unlock()
+		if handler != nil {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+		writeWebError(rw, http.StatusNotFound, smpp.ESME_RINVCMDID, "not found")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/media/") && w.Media != nil {
+		w.Media.ServeHTTP(rw, r)
+		return
+	}
+	client := w.client(r)
+	if client == "" {
+		writeWebError(rw, http.StatusUnauthorized, smpp.ESME_RINVPASWD, "invalid API key")
+		return
+	}
+	switch {
+	case r.URL.Path == "/messages" && r.Method == http.MethodPost:
+		w.send(rw, r, client)
+	case strings.HasPrefix(r.URL.Path, "/messages/") && r.Method == http.MethodGet:
+		w.message(rw, client, strings.TrimPrefix(r.URL.Path, "/messages/"))
+	case r.URL.Path == "/links" && r.Method == http.MethodGet:
+		writeJSON(rw, http.StatusOK, map[string][]Link{"links": w.Gateway.Links()})
+	case (r.URL.Path == "/log" || strings.HasPrefix(r.URL.Path, "/log/")) && w.Log != nil:
+		if !includes(w.Admins, client) {
+			writeWebError(rw, http.StatusForbidden, smpp.ESME_RINVSYSID, "log access denied")
+			return
+		}
+		w.Log.ServeHTTP(rw, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		if !includes(w.Admins, client) {
+			writeWebError(rw, http.StatusForbidden, smpp.ESME_RINVSYSID, "admin access denied")
+			return
+		}
+		w.admin(rw, r)
+	case r.URL.Path == "/messages" || strings.HasPrefix(r.URL.Path, "/messages/") ||
+		r.URL.Path == "/links":
+		writeWebError(rw, http.StatusMethodNotAllowed, smpp.ESME_RINVCMDID, "method not allowed")
+	default:
+		writeWebError(rw, http.StatusNotFound, smpp.ESME_RINVCMDID, "not found")
+	}
+}
+
+// admin handles the admin API requests.
+func (w *Web) admin(rw http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/connections")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		connections := w.Gateway.Connections()
+		infos := make([]supervisor.Info, len(connections))
+		for i, connection := range connections {
+			infos[i] = connection.Info()
+		}
+		writeJSON(rw, http.StatusOK, map[string][]supervisor.Info{"connections": infos})
+	case strings.HasPrefix(path, "/") && strings.HasSuffix(path, "/reset") && r.Method == http.MethodPost:
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/reset")
+		for _, connection := range w.Gateway.Connections() {
+			if connection.Name == name {
+				connection.Reset()
+				w.Logger.WithField("connection", name).Info("Connection reset by the admin API")
+				writeJSON(rw, http.StatusOK, connection.Info())
+				return
+			}
+		}
+		writeWebError(rw, http.StatusNotFound, smpp.ESME_RINVCMDID, "unknown connection")
+	default:
+		writeWebError(rw, http.StatusNotFound, smpp.ESME_RINVCMDID, "not found")
+	}
+}
+
+// client returns the name of the client the request API key belongs to, or an
+// empty string if the key is unknown.
+func (w *Web) client(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return ""
+	}
+	name, ok := w.APIKeys[key]
+	if !ok {
+		return ""
+	}
+	if name == "" {
+		name = "api"
+	}
+	return name
+}
+
+// send handles POST /messages.
+func (w *Web) send(rw http.ResponseWriter, r *http.Request, client string) {
+	var req webRequest
+	if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, webMaxBody)).Decode(&req); err != nil {
+		writeWebError(rw, http.StatusBadRequest, smpp.ESME_RINVCMDLEN, "invalid request: "+err.Error())
+		return
+	}
+	req.From, req.To = strings.TrimPrefix(req.From, "+"), strings.TrimPrefix(req.To, "+")
+	switch {
+	case req.From == "":
+		writeWebError(rw, http.StatusBadRequest, smpp.ESME_RINVSRCADR, "from phone is empty")
+		return
+	case req.To == "":
+		writeWebError(rw, http.StatusBadRequest, smpp.ESME_RINVDSTADR, "to phone is empty")
+		return
+	case req.Text == "":
+		writeWebError(rw, http.StatusBadRequest, smpp.ESME_RINVMSGLEN, "text is empty")
+		return
+	}
+	if req.Callback != "" {
+		u, err := url.Parse(req.Callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			writeWebError(rw, http.StatusBadRequest, smpp.ESME_RINVOPTPARAMVAL, "invalid callback URL")
+			return
+		}
+		if ip := net.ParseIP(u.Hostname()); (ip != nil && internalIP(ip) || u.Hostname() == "localhost") &&
+			!includes(w.CallbackHosts, u.Hostname()) { // names are checked again when resolved
+			writeWebError(rw, http.StatusBadRequest, smpp.ESME_RINVOPTPARAMVAL, "callback URL host not allowed")
+			return
+		}
+	}
+	now := time.Now()
+	m := &WebMessage{
+		ID:       uuid.New().String(),
+		From:     req.From,
+		To:       req.To,
+		Text:     req.Text,
+		Callback: req.Callback,
+		Status:   WebAccepted,
+		Created:  now,
+		Updated:  now,
+		client:   client,
+	}
+	m.msg = &SendMessage{ID: m.ID, From: m.From, To: m.To, Text: m.Text}
+	// the key is reserved before sending, so concurrent retries don't send twice
+	w.mu.Lock()
+	w.purge()
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		m.key = client + "\x00" + key
+		if prev := w.keys[m.key]; prev != nil {
+			same := prev.From == m.From && prev.To == m.To && prev.Text == m.Text
+			resp := prev.view()
+			w.mu.Unlock()
+			if !same {
+				writeWebError(rw, http.StatusConflict, smpp.ESME_RSUBMITFAIL,
+					"idempotency key was used for another message")
+				return
+			}
+			writeJSON(rw, http.StatusOK, resp)
+			return
+		}
+		w.keys[m.key] = m
+	}
+	w.messages[m.ID] = m
+	w.sent[m.msg] = m
+	w.mu.Unlock()
+
+	logEntry := w.Logger.WithFields(logrus.Fields{
+		"client": client,
+		"id":     m.ID,
+		"from":   m.From,
+		"to":     m.To,
+	})
+	if err := w.Gateway.SendMessage(m.msg); err != nil {
+		w.mu.Lock()
+		w.remove(m)
+		w.mu.Unlock()
+		logEntry.WithError(err).Error("Web SMS send error")
+		status, ok := err.(smpp.CMDStatus)
+		if !ok {
+			status = smpp.ESME_RSUBMITFAIL
+		}
+		writeWebError(rw, webHTTPStatus(status), status, err.Error())
+		return
+	}
+	logEntry.Info("Web SMS send")
+	w.mu.Lock()
+	resp := m.view()
+	w.mu.Unlock()
+	rw.Header().Set("Location", "/messages/"+m.ID)
+	writeJSON(rw, http.StatusCreated, resp)
+}
+
+// message handles GET /messages/{id}. Messages of other clients are not found.
+func (w *Web) message(rw http.ResponseWriter, client, id string) {
+	w.mu.Lock()
+	m := w.messages[id]
+	var resp WebMessage
+	if m != nil {
+		resp = m.view()
+	}
+	w.mu.Unlock()
+	if m == nil || m.client != client {
+		writeWebError(rw, http.StatusNotFound, smpp.ESME_RINVMSGID, "message not found")
+		return
+	}
+	writeJSON(rw, http.StatusOK, resp)
+}
+
+// Response updates the message parts with the response of the SMPP server.
+func (w *Web) Response(resp SendResponse) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m := w.sent[resp.Message]
+	if m == nil {
+		return // not sent with the API
+	}
+	if m.Parts == nil {
+		m.Parts = make([]WebPart, len(resp.Message.Seq))
+		for i := range m.Parts {
+			m.Parts[i].Status = WebAccepted
+		}
+	}
+	part := -1
+	for i, seq := range resp.Message.Seq {
+		if seq == resp.Seq {
+			part = i
+		}
+	}
+	if part < 0 {
+		return
+	}
+	if resp.Status != smpp.ESME_ROK {
+		m.Parts[part] = WebPart{Status: WebFailed, Err: int(resp.Status)}
+	} else {
+		m.Parts[part] = WebPart{ID: resp.ID, Status: WebSent}
+		w.receipts[resp.ID] = m
+	}
+	var responses int
+	for _, p := range m.Parts {
+		if p.Status != WebAccepted {
+			responses++
+		}
+	}
+	if responses == len(m.Parts) {
+		delete(w.sent, resp.Message) // all parts are known
+	}
+	w.update(m)
+}
+
+// Status updates the message part with the delivery receipt.
+func (w *Web) Status(status Status) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m := w.receipts[status.ID]
+	if m == nil {
+		return // not sent with the API
+	}
+	for i, p := range m.Parts {
+		if p.ID != status.ID {
+			continue
+		}
+		m.Parts[i].Stat, m.Parts[i].Err = status.Stat, status.Err
+		switch status.Stat {
+		case "DELIVRD":
+			m.Parts[i].Status = WebDelivered
+		case "EXPIRED", "DELETED", "UNDELIV", "UNKNOWN", "REJECTD":
+			m.Parts[i].Status = WebFailed
+		default:
+			continue // intermediate state, wait for the final one
+		}
+		delete(w.receipts, status.ID)
+	}
+	w.update(m)
+}
+
+// update sets the message status from the state of its parts and notifies the
+// callback URL if it changed. It must be called with the lock held.
+func (w *Web) update(m *WebMessage) {
+	status := WebDelivered
+	for _, p := range m.Parts {
+		switch {
+		case p.Status == WebFailed:
+			status = WebFailed
+		case status == WebFailed:
+		case p.Status == WebAccepted:
+			status = WebAccepted
+		case p.Status == WebSent && status != WebAccepted:
+			status = WebSent
+		}
+	}
+	if len(m.Parts) == 0 || status == m.Status {
+		return
+	}
+	m.Status, m.Updated = status, time.Now()
+	if m.Callback != "" {
+		go w.callback(m.Callback, m.view())
+	}
+}
+
+// callback posts the message state to the callback URL.
+func (w *Web) callback(target string, m WebMessage) {
+	logEntry := w.Logger.WithFields(logrus.Fields{
+		"id":       m.ID,
+		"callback": target,
+	})
+	data, err := json.Marshal(m)
+	if err != nil {
+		logEntry.WithError(err).Error("Web callback error")
+		return
+	}
+	resp, err := w.callbackClient(target).Post(target, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logEntry.WithError(err).Warning("Web callback error")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logEntry.WithField("status", resp.StatusCode).Warning("Web callback rejected")
+	}
+}
+
+// callbackClient returns the client posting to the callback URL. It connects
+// to the internal addresses only if the host is listed in CallbackHosts, and
+// doesn't follow redirects, so API clients can't reach the internal services.
+func (w *Web) callbackClient(target string) *http.Client {
+	host := ""
+	if u, err := url.Parse(target); err == nil {
+		host = u.Hostname()
+	}
+	allowed := includes(w.CallbackHosts, host)
+	dialer := &net.Dialer{
+		Timeout: callbackTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			ip, _, _ := net.SplitHostPort(address)
+			if !allowed && internalIP(net.ParseIP(ip)) {
+				return fmt.Errorf("callback to the internal address %s not allowed", ip)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   callbackTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext}, // no proxy: it would bypass the check
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// internalIP reports whether the address is a loopback, private, link-local or
+// unspecified one. Unparsed addresses are reported as internal.
+func internalIP(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// remove forgets the message. It must be called with the lock held.
+func (w *Web) remove(m *WebMessage) {
+	delete(w.messages, m.ID)
+	delete(w.sent, m.msg)
+	if m.key != "" {
+		delete(w.keys, m.key)
+	}
+	for _, p := range m.Parts {
+		if p.ID != "" {
+			delete(w.receipts, p.ID)
+		}
+	}
+}
+
+// purge removes expired messages. It must be called with the lock held.
+func (w *Web) purge() {
+	for _, m := range w.messages {
+		if time.Since(m.Created) > webMessageTTL {
+			w.remove(m)
+		}
+	}
+}
+
+// view returns a copy of the message safe to use without the lock.
+func (m *WebMessage) view() WebMessage {
+	v := *m
+	v.Parts = append([]WebPart(nil), m.Parts...)
+	return v
+}
+
+// webHTTPStatus returns the HTTP status for the SMPP status returned by the gateway.
+func webHTTPStatus(status smpp.CMDStatus) int {
+	switch status {
+	case smpp.ESME_RINVSRCADR, smpp.ESME_RINVDSTADR, smpp.ESME_RINVMSGLEN:
+		return http.StatusBadRequest
+	case smpp.ESME_RTHROTTLED, smpp.ESME_RMSGQFUL:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// writeWebError writes the error with the SMPP status code.
+func writeWebError(rw http.ResponseWriter, code int, status smpp.CMDStatus, msg string) {
+	writeJSON(rw, code, webError{Error: msg, Status: status})
+}
+
+// writeJSON writes the value as a JSON response.
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
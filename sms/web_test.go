@@ -0,0 +1,263 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mxsms/smpp"
+	"mxsms/supervisor"
+)
+
+// testGateway records the messages sent with the API.
+type testGateway struct {
+	sent        []*SendMessage
+	err         error
+	connections []*supervisor.Supervisor
+	mu          sync.Mutex
+}
+
+func (g *testGateway) SendMessage(msg *SendMessage) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		return g.err
+	}
+	msg.Seq = []uint32{uint32(len(g.sent)*2 + 1), uint32(len(g.sent)*2 + 2)}
+	g.sent = append(g.sent, msg)
+	return nil
+}
+
+func (g *testGateway) Links() []Link {
+	return []Link{{Address: "127.0.0.1:2775", Up: true}}
+}
+
+func (g *testGateway) Connections() []*supervisor.Supervisor {
+	return g.connections
+}
+
+func testWeb(t *testing.T) (*Web, *testGateway) {
+	gateway := new(testGateway)
+	web := &Web{
+		Address: "127.0.0.1:0",
+		APIKeys: map[string]string{"key1": "crm", "key2": "scripts"},
+		Gateway: gateway,
+	}
+	if err := web.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(web.Close)
+	return web, gateway
+}
+
+func testWebRequest(t *testing.T, web *Web, method, path, key string, body interface{},
+	header http.Header) (int, map[string]interface{}) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, "http://"+web.Addr().String()+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, result
+}
+
+func TestWebSend(t *testing.T) {
+	web, gateway := testWeb(t)
+	if code, resp := testWebRequest(t, web, "GET", "/links", "wrong", nil, nil); code != 401 ||
+		resp["status"] != float64(smpp.ESME_RINVPASWD) {
+		t.Fatalf("unauthorized: %d %v", code, resp)
+	}
+	// carrier callbacks don't need the API key
+	web.Carriers = map[string]http.Handler{"twilio": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"carrier": "twilio"})
+	})}
+	if code, resp := testWebRequest(t, web, "POST", "/carriers/twilio", "", nil, nil); code != 200 ||
+		resp["carrier"] != "twilio" {
+		t.Fatalf("carrier callback: %d %v", code, resp)
+	}
+	code, resp := testWebRequest(t, web, "GET", "/links", "key1", nil, nil)
+	if links, _ := resp["links"].([]interface{}); code != 200 || len(links) != 1 {
+		t.Fatalf("links: %d %v", code, resp)
+	}
+	// log queries need the API key of an admin
+	web.Admins = []string{"scripts"}
+	web.Log = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"number": r.URL.Query().Get("number")})
+	})
+	if code, _ := testWebRequest(t, web, "GET", "/log?number=1", "", nil, nil); code != 401 {
+		t.Fatalf("unauthorized log: %d", code)
+	}
+	if code, _ := testWebRequest(t, web, "GET", "/log?number=1", "key1", nil, nil); code != 403 {
+		t.Fatalf("log by crm: %d", code)
+	}
+	if code, resp := testWebRequest(t, web, "GET", "/log?number=1", "key2", nil, nil); code != 200 ||
+		resp["number"] != "1" {
+		t.Fatalf("log: %d %v", code, resp)
+	}
+	code, resp = testWebRequest(t, web, "POST", "/messages", "key1",
+		webRequest{From: "14085551234", Text: "test"}, nil)
+	if code != 400 || resp["status"] != float64(smpp.ESME_RINVDSTADR) {
+		t.Fatalf("no destination: %d %v", code, resp)
+	}
+	// the same idempotency key returns the same message
+	header := http.Header{"Idempotency-Key": {"order-1"}}
+	msg := webRequest{From: "+14085551234", To: "14155550000", Text: "test"}
+	code, resp = testWebRequest(t, web, "POST", "/messages", "key1", msg, header)
+	if code != 201 || resp["status"] != WebAccepted || resp["from"] != "14085551234" {
+		t.Fatalf("send: %d %v", code, resp)
+	}
+	id := resp["id"]
+	code, resp = testWebRequest(t, web, "POST", "/messages", "key1", msg, header)
+	if code != 200 || resp["id"] != id || len(gateway.sent) != 1 || gateway.sent[0].ID != id {
+		t.Fatalf("repeated send: %d %v", code, resp)
+	}
+	msg.Text = "other"
+	if code, resp = testWebRequest(t, web, "POST", "/messages", "key1", msg, header); code != 409 {
+		t.Fatalf("idempotency conflict: %d %v", code, resp)
+	}
+	// messages of other clients are not visible
+	if code, _ = testWebRequest(t, web, "GET", "/messages/"+id.(string), "key2", nil, nil); code != 404 {
+		t.Fatalf("other client message: %d", code)
+	}
+	// gateway errors are returned with the SMPP status
+	gateway.mu.Lock()
+	gateway.err = smpp.ESME_RINVSRCADR
+	gateway.mu.Unlock()
+	code, resp = testWebRequest(t, web, "POST", "/messages", "key1", msg, nil)
+	if code != 400 || resp["status"] != float64(smpp.ESME_RINVSRCADR) {
+		t.Fatalf("gateway status: %d %v", code, resp)
+	}
+	gateway.mu.Lock()
+	gateway.err = errors.New("no SMPP connection")
+	gateway.mu.Unlock()
+	code, resp = testWebRequest(t, web, "POST", "/messages", "key1", msg, nil)
+	if code != 503 || resp["status"] != float64(smpp.ESME_RSUBMITFAIL) {
+		t.Fatalf("gateway error: %d %v", code, resp)
+	}
+}
+
+func TestWebStatus(t *testing.T) {
+	web, gateway := testWeb(t)
+	callbacks := make(chan WebMessage, 10)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m WebMessage
+		json.NewDecoder(r.Body).Decode(&m)
+		callbacks <- m
+	}))
+	defer callback.Close()
+	msg := webRequest{From: "14085551234", To: "14155550000", Text: "test", Callback: callback.URL}
+	code, resp := testWebRequest(t, web, "POST", "/messages", "key1", msg, nil)
+	if code != 400 || resp["status"] != float64(smpp.ESME_RINVOPTPARAMVAL) {
+		t.Fatalf("loopback callback: %d %v", code, resp)
+	}
+	web.CallbackHosts = []string{"127.0.0.1"}
+	code, resp = testWebRequest(t, web, "POST", "/messages", "key1", msg, nil)
+	if code != 201 {
+		t.Fatalf("send: %d %v", code, resp)
+	}
+	id := resp["id"].(string)
+	sent := gateway.sent[0]
+	web.Response(SendResponse{ID: "100", Seq: sent.Seq[0], Message: sent})
+	web.Response(SendResponse{ID: "101", Seq: sent.Seq[1], Message: sent})
+	web.Status(Status{ID: "100", Stat: "DELIVRD"})
+	web.Status(Status{ID: "101", Stat: "DELIVRD"})
+	code, resp = testWebRequest(t, web, "GET", "/messages/"+id, "key1", nil, nil)
+	parts, _ := resp["parts"].([]interface{})
+	if code != 200 || resp["status"] != WebDelivered || len(parts) != 2 {
+		t.Fatalf("status: %d %v", code, resp)
+	}
+	// callbacks are posted concurrently, so they can arrive in any order
+	notified := make(map[string]bool)
+	for len(notified) < 2 {
+		select {
+		case m := <-callbacks:
+			if m.ID != id {
+				t.Errorf("callback for %q", m.ID)
+			}
+			notified[m.Status] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("callbacks: %v", notified)
+		}
+	}
+	if !notified[WebSent] || !notified[WebDelivered] {
+		t.Errorf("callbacks: %v", notified)
+	}
+	// a failed part fails the message
+	testWebRequest(t, web, "POST", "/messages", "key1", msg, nil)
+	sent = gateway.sent[1]
+	web.Response(SendResponse{ID: "102", Seq: sent.Seq[0], Message: sent})
+	web.Response(SendResponse{Seq: sent.Seq[1], Message: sent, Status: smpp.ESME_RINVDSTADR})
+	web.mu.Lock()
+	waiting, m := web.sent[sent], web.receipts["102"]
+	web.mu.Unlock()
+	if waiting != nil {
+		t.Error("message is still waiting for responses")
+	}
+	code, resp = testWebRequest(t, web, "GET", "/messages/"+m.ID, "key1", nil, nil)
+	if code != 200 || resp["status"] != WebFailed {
+		t.Errorf("failed part: %d %v", code, resp)
+	}
+}
+
+func TestWebCallbackClient(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	web := new(Web)
+	// host names resolved to the internal addresses are rejected when connecting
+	url := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	if _, err := web.callbackClient(url).Post(url, "application/json", nil); err == nil {
+		t.Error("callback to localhost posted")
+	}
+	web.CallbackHosts = []string{"localhost"}
+	if resp, err := web.callbackClient(url).Post(url, "application/json", nil); err != nil {
+		t.Errorf("allowed callback: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestWebAdmin(t *testing.T) {
+	web, gateway := testWeb(t)
+	web.Admins = []string{"scripts"}
+	gateway.connections = []*supervisor.Supervisor{{Name: "mx/main"}, {Name: "smpp/east"}}
+	if code, _ := testWebRequest(t, web, http.MethodGet, "/admin/connections", "key1", nil, nil); code != http.StatusForbidden {
+		t.Errorf("admin by crm: %d", code)
+	}
+	code, resp := testWebRequest(t, web, http.MethodGet, "/admin/connections", "key2", nil, nil)
+	if connections, _ := resp["connections"].([]interface{}); code != http.StatusOK || len(connections) != 2 {
+		t.Errorf("connections: %d %v", code, resp)
+	}
+	code, resp = testWebRequest(t, web, http.MethodPost, "/admin/connections/smpp/east/reset", "key2", nil, nil)
+	if code != http.StatusOK || resp["name"] != "smpp/east" || resp["breaker"] != supervisor.Closed {
+		t.Errorf("reset: %d %v", code, resp)
+	}
+	if code, _ := testWebRequest(t, web, http.MethodPost, "/admin/connections/smpp/west/reset", "key2", nil, nil); code != http.StatusNotFound {
+		t.Errorf("unknown reset: %d", code)
+	}
+}
@@ -0,0 +1,450 @@
+package sms
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"mxsms/conf"
+)
+
+// Event types posted to webhooks.
+const (
+	EventReceived = "sms.received" // incoming message
+	EventStatus   = "sms.status"   // delivery receipt
+	EventLinkUp   = "link.up"      // SMPP connection established
+	EventLinkDown = "link.down"    // SMPP connection lost
+	EventAlert    = "link.alert"   // MX or SMPP circuit breaker opened or closed
+)
+
+const (
+	defaultWebhookAttempts = 10               // default number of delivery attempts
+	defaultWebhookDelay    = time.Second * 10 // default delay before the first retry
+	maxWebhookDelay        = time.Hour        // maximum delay between retries
+	webhookTimeout         = time.Second * 10 // time allowed for the webhook request
+	webhookCompact         = 1000             // queue file records written before it's compacted
+)
+
+// Webhook describes an endpoint subscribed to gateway events. Empty filters
+// match everything. Link events are not related to phone numbers, so they are
+// only filtered by type.
+type Webhook struct {
+	URL    string   `yaml:"url" json:"url"`                           // endpoint the events are posted to
+	Secret string   `yaml:"secret,omitempty" json:"secret,omitempty"` // key of the HMAC-SHA256 signature
+	Events []string `yaml:"events,omitempty" json:"events,omitempty"` // event types
+	DIDs   []string `yaml:"dids,omitempty" json:"dids,omitempty"`     // gateway phone numbers
+	MX     []string `yaml:"mx,omitempty" json:"mx,omitempty"`         // MX server names
+}
+
+// Event describes a gateway event posted to webhooks as JSON. The body is signed
+// with the webhook secret; the signature is sent in the X-Signature header as
+// "sha256=" followed by the hex encoded HMAC-SHA256 of the body.
+type Event struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	DID  string          `json:"did,omitempty"` // gateway phone number the event is about
+	MX   string          `json:"mx,omitempty"`  // MX server the number belongs to
+	Data json.RawMessage `json:"data"`
+}
+
+// Webhooks posts gateway events to the subscribed endpoints. Each endpoint is
+// posted to by its own goroutine, so a slow one doesn't delay the others. Failed
+// deliveries are retried with exponential backoff; the retry queue is kept in a
+// file, so it survives restarts. The changes of the queue are appended to the
+// file, which is rewritten only when it grows much larger than the queue.
+type Webhooks struct {
+	Hooks       []*Webhook    `yaml:"hooks" json:"hooks"`
+	QueueFile   string        `yaml:"queueFile,omitempty" json:"queueFile,omitempty"`     // file keeping undelivered events
+	MaxAttempts int           `yaml:"maxAttempts,omitempty" json:"maxAttempts,omitempty"` // delivery attempts before the event is dropped
+	RetryDelay  conf.Duration `yaml:"retryDelay,omitempty" json:"retryDelay,omitempty"`   // delay before the first retry, doubled after each one
+	Logger      *logrus.Entry `yaml:"-" json:"-"`                                         // log output
+
+	retryDelay time.Duration
+	client     *http.Client
+	queue      []*webhookDelivery // events waiting for delivery
+	busy       map[string]bool    // endpoints being posted to
+	file       *os.File           // queue file open for appending
+	records    int                // records appended since the file was compacted
+	wakeup     chan struct{}
+	done       chan struct{}
+	stopped    chan struct{} // closed when delivering is finished
+	mu         sync.Mutex
+}
+
+// webhookDelivery describes the delivery of an event to the endpoint.
+type webhookDelivery struct {
+	URL      string    `json:"url"`
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"` // failed attempts
+	Next     time.Time `json:"next"`     // time of the next attempt
+}
+
+// queueRecord is a line of the queue file: the queued event, the next attempt
+// of its delivery or the end of the delivery.
+type queueRecord struct {
+	URL      string    `json:"url"`
+	ID       string    `json:"id"`              // event identifier
+	Event    *Event    `json:"event,omitempty"` // set when the event is queued
+	Attempts int       `json:"attempts,omitempty"`
+	Next     time.Time `json:"next"`
+	Done     bool      `json:"done,omitempty"` // delivered or dropped
+}
+
+// Start loads the retry queue and starts delivering events.
+func (w *Webhooks) Start() error {
+	if w.Logger == nil { // initialize log support
+		w.Logger = logrus.NewEntry(logrus.StandardLogger())
+	}
+	retryDelay := defaultWebhookDelay
+	if w.RetryDelay > 0 {
+		retryDelay = time.Duration(w.RetryDelay)
+	}
+	if w.MaxAttempts <= 0 {
+		w.MaxAttempts = defaultWebhookAttempts
+	}
+	queue, err := loadQueue(w.QueueFile)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, d := range queue { // events for removed endpoints are dropped
+		if w.hook(d.URL) != nil {
+			w.queue = append(w.queue, d)
+		}
+	}
+	if err := w.compact(); err != nil {
+		return err
+	}
+	w.retryDelay = retryDelay
+	w.client = &http.Client{Timeout: webhookTimeout}
+	w.busy = make(map[string]bool)
+	w.wakeup = make(chan struct{}, 1)
+	w.done = make(chan struct{})
+	w.stopped = make(chan struct{})
+	go w.delivering(w.done, w.stopped)
+	return nil
+}
+
+// loadQueue reads the queue file: the records of the queue changes.
+func loadQueue(name string) ([]*webhookDelivery, error) {
+	if name == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	var queue []*webhookDelivery
+	queued := make(map[[2]string]*webhookDelivery)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		var r queueRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		key := [2]string{r.URL, r.ID}
+		switch d := queued[key]; {
+		case r.Event != nil:
+			d = &webhookDelivery{URL: r.URL, Event: *r.Event, Attempts: r.Attempts, Next: r.Next}
+			queued[key] = d
+			queue = append(queue, d)
+		case d == nil: // the event was dropped before
+		case r.Done:
+			delete(queued, key)
+		default:
+			d.Attempts, d.Next = r.Attempts, r.Next
+		}
+	}
+	list := queue[:0]
+	for _, d := range queue { // keep the events not done, in the order queued
+		if queued[[2]string{d.URL, d.Event.ID}] == d {
+			list = append(list, d)
+		}
+	}
+	return list, nil
+}
+
+// Close stops delivering events and waits for the current deliveries to finish.
+// Undelivered events stay in the queue file.
+func (w *Webhooks) Close() {
+	w.mu.Lock()
+	done, stopped := w.done, w.stopped
+	w.done = nil
+	w.mu.Unlock()
+	if done == nil {
+		return
+	}
+	close(done)
+	<-stopped
+	w.mu.Lock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	w.mu.Unlock()
+}
+
+// Publish queues the event for all endpoints subscribed to it. The data is
+// encoded as JSON.
+func (w *Webhooks) Publish(eventType, did, mx string, data interface{}) {
+	if w == nil {
+		return
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		w.Logger.WithError(err).Error("Webhook event error")
+		return
+	}
+	event := Event{
+		ID:   uuid.New().String(),
+		Type: eventType,
+		Time: time.Now(),
+		DID:  did,
+		MX:   mx,
+		Data: raw,
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var records []queueRecord
+	for _, hook := range w.Hooks {
+		if hook.match(event) {
+			w.queue = append(w.queue, &webhookDelivery{URL: hook.URL, Event: event, Next: event.Time})
+			records = append(records, queueRecord{URL: hook.URL, ID: event.ID, Event: &event, Next: event.Time})
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+	w.save(records...)
+	select { // deliver without waiting for the timer
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// match reports whether the endpoint is subscribed to the event.
+func (h *Webhook) match(event Event) bool {
+	if len(h.Events) > 0 && !includes(h.Events, event.Type) {
+		return false
+	}
+	if event.Type == EventLinkUp || event.Type == EventLinkDown || event.Type == EventAlert {
+		return true
+	}
+	if len(h.DIDs) > 0 && !includes(h.DIDs, event.DID) {
+		return false
+	}
+	return len(h.MX) == 0 || includes(h.MX, event.MX)
+}
+
+// includes reports whether the list contains the value.
+func includes(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hook returns the endpoint with the URL. It must be called with the lock held.
+func (w *Webhooks) hook(url string) *Webhook {
+	for _, hook := range w.Hooks {
+		if hook.URL == url {
+			return hook
+		}
+	}
+	return nil
+}
+
+// delivering posts the queued events until the webhooks are closed. The due
+// events of each endpoint are posted in order by a goroutine of the endpoint;
+// endpoints still busy with the previous events are skipped until they finish.
+func (w *Webhooks) delivering(done, stopped chan struct{}) {
+	var wg sync.WaitGroup
+	defer close(stopped)
+	defer wg.Wait()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.wakeup:
+		case <-done:
+			return
+		}
+		w.mu.Lock()
+		due := make(map[string][]*webhookDelivery)
+		now := time.Now()
+		for _, d := range w.queue {
+			if !now.Before(d.Next) && !w.busy[d.URL] {
+				due[d.URL] = append(due[d.URL], d)
+			}
+		}
+		for url := range due {
+			w.busy[url] = true
+		}
+		w.mu.Unlock()
+		for url, list := range due {
+			wg.Add(1)
+			go func(url string, list []*webhookDelivery) {
+				defer wg.Done()
+			posting:
+				for _, d := range list {
+					select {
+					case <-done:
+						break posting
+					default:
+					}
+					w.deliver(d)
+				}
+				w.mu.Lock()
+				delete(w.busy, url)
+				w.mu.Unlock()
+				select { // pick up the events queued meanwhile
+				case w.wakeup <- struct{}{}:
+				default:
+				}
+			}(url, list)
+		}
+	}
+}
+
+// deliver posts the event to the endpoint and removes it from the queue or
+// schedules the next attempt.
+func (w *Webhooks) deliver(d *webhookDelivery) {
+	w.mu.Lock()
+	hook := w.hook(d.URL)
+	w.mu.Unlock()
+	logEntry := w.Logger.WithFields(logrus.Fields{
+		"webhook": d.URL,
+		"event":   d.Event.Type,
+		"id":      d.Event.ID,
+	})
+	var err error
+	if hook != nil {
+		err = w.post(hook, d.Event)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		d.Attempts++
+		if d.Attempts < w.MaxAttempts {
+			delay := w.retryDelay << (d.Attempts - 1)
+			if delay > maxWebhookDelay || delay <= 0 {
+				delay = maxWebhookDelay
+			}
+			d.Next = time.Now().Add(delay)
+			logEntry.WithError(err).WithField("retry", delay).Warning("Webhook error")
+			w.save(queueRecord{URL: d.URL, ID: d.Event.ID, Attempts: d.Attempts, Next: d.Next})
+			return
+		}
+		logEntry.WithError(err).Error("Webhook event dropped")
+	}
+	for i, queued := range w.queue {
+		if queued == d {
+			w.queue = append(w.queue[:i], w.queue[i+1:]...)
+			break
+		}
+	}
+	w.save(queueRecord{URL: d.URL, ID: d.Event.ID, Done: true})
+}
+
+// post sends the signed event to the endpoint.
+func (w *Webhooks) post(hook *Webhook, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", event.Type)
+	req.Header.Set("X-Event-ID", event.ID)
+	if hook.Secret != "" {
+		req.Header.Set("X-Signature", "sha256="+Signature(hook.Secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Signature returns the hex encoded HMAC-SHA256 of the body with the secret.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// save appends the records of the queue changes to the file, and compacts it
+// once it holds many more records than the queue. It must be called with the
+// lock held.
+func (w *Webhooks) save(records ...queueRecord) {
+	if w.file == nil {
+		return
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, r := range records {
+		encoder.Encode(r)
+	}
+	_, err := w.file.Write(buf.Bytes()) // the records of a change are written at once
+	if w.records += len(records); err == nil && w.records > webhookCompact+2*len(w.queue) {
+		err = w.compact()
+	}
+	if err != nil {
+		w.Logger.WithError(err).Error("Webhook queue save error")
+	}
+}
+
+// compact replaces the queue file with the records of the queued events and
+// opens it for appending. It must be called with the lock held.
+func (w *Webhooks) compact() error {
+	if w.QueueFile == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, d := range w.queue {
+		event := d.Event
+		encoder.Encode(queueRecord{URL: d.URL, ID: event.ID, Event: &event, Attempts: d.Attempts, Next: d.Next})
+	}
+	// the file is replaced at once, so a crash doesn't leave it half written
+	tmp := w.QueueFile + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.QueueFile); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.QueueFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file, w.records = file, 0
+	return nil
+}
@@ -0,0 +1,178 @@
+package sms
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mxsms/conf"
+)
+
+// testEndpoint returns a webhook endpoint passing the received events to the
+// channel. The first failures requests are answered with an error.
+func testEndpoint(t *testing.T, secret string, failures int32) (*httptest.Server, chan Event) {
+	events := make(chan Event, 10)
+	var requests int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if secret != "" && r.Header.Get("X-Signature") != "sha256="+Signature(secret, body) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Signature"))
+		}
+		if atomic.AddInt32(&requests, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	t.Cleanup(endpoint.Close)
+	return endpoint, events
+}
+
+func TestWebhooks(t *testing.T) {
+	endpoint, events := testEndpoint(t, "secret", 1)
+	webhooks := &Webhooks{
+		Hooks: []*Webhook{
+			{URL: endpoint.URL, Secret: "secret", DIDs: []string{"14155550000"}},
+			{URL: endpoint.URL + "/status", Secret: "secret", Events: []string{EventStatus}},
+		},
+		RetryDelay: conf.Duration(time.Millisecond * 10),
+	}
+	if err := webhooks.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer webhooks.Close()
+	// the message to another number is filtered out by both endpoints; the first
+	// request fails and is retried
+	webhooks.Publish(EventReceived, "14085551234", "", Received{Text: "other"})
+	webhooks.Publish(EventReceived, "14155550000", "mx1", Received{Text: "hello"})
+	select {
+	case event := <-events:
+		if event.Type != EventReceived || event.DID != "14155550000" || event.MX != "mx1" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("event not delivered")
+	}
+	webhooks.Publish(EventStatus, "14085551234", "", Status{Stat: "DELIVRD"})
+	select {
+	case event := <-events:
+		if event.Type != EventStatus {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("status event not delivered")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestWebhooksQueue(t *testing.T) {
+	queueFile := filepath.Join(t.TempDir(), "webhooks.json")
+	endpoint, events := testEndpoint(t, "", 1)
+	webhooks := &Webhooks{
+		Hooks:      []*Webhook{{URL: endpoint.URL}},
+		QueueFile:  queueFile,
+		RetryDelay: conf.Duration(time.Hour),
+	}
+	if err := webhooks.Start(); err != nil {
+		t.Fatal(err)
+	}
+	webhooks.Publish(EventLinkDown, "", "", Link{Address: "127.0.0.1:2775"})
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		webhooks.mu.Lock()
+		attempts := webhooks.queue[0].Attempts
+		webhooks.mu.Unlock()
+		if attempts > 0 {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("event not posted")
+		}
+	}
+	webhooks.Close()
+	if data, err := os.ReadFile(queueFile); err != nil || len(data) == 0 {
+		t.Fatalf("queue not saved: %v", err)
+	}
+	// the queue is loaded after restart and delivered once the endpoint is up
+	webhooks = &Webhooks{
+		Hooks:     []*Webhook{{URL: endpoint.URL}},
+		QueueFile: queueFile,
+	}
+	if err := webhooks.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer webhooks.Close()
+	webhooks.mu.Lock()
+	webhooks.queue[0].Next = time.Now() // don't wait for the retry delay
+	webhooks.mu.Unlock()
+	select {
+	case event := <-events:
+		if event.Type != EventLinkDown {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("queued event not delivered")
+	}
+}
+
+func TestWebhooksSlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	endpoint, events := testEndpoint(t, "", 0)
+	webhooks := &Webhooks{Hooks: []*Webhook{{URL: slow.URL}, {URL: endpoint.URL}}}
+	if err := webhooks.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer webhooks.Close()
+	defer close(release) // the slow request ends before closing
+	// the endpoint gets the events while the slow one is still posted to
+	for i := 0; i < 2; i++ {
+		webhooks.Publish(EventLinkUp, "", "", Link{Address: "127.0.0.1:2775"})
+		select {
+		case <-events:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+}
+
+func TestLoadQueue(t *testing.T) {
+	dir := t.TempDir()
+	records := filepath.Join(dir, "records.json")
+	os.WriteFile(records, []byte(`{"url":"a","id":"1","event":{"id":"1","type":"link.up"},"next":"2024-01-01T00:00:00Z"}
+{"url":"b","id":"1","event":{"id":"1","type":"link.up"},"next":"2024-01-01T00:00:00Z"}
+{"url":"a","id":"1","attempts":2,"next":"2024-01-02T00:00:00Z"}
+{"url":"b","id":"1","done":true,"next":"0001-01-01T00:00:00Z"}
+`), 0600)
+	queue, err := loadQueue(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].URL != "a" || queue[0].Attempts != 2 || queue[0].Next.Day() != 2 {
+		t.Errorf("unexpected queue %+v", queue)
+	}
+	if queue, err := loadQueue(filepath.Join(dir, "missing.json")); err != nil || len(queue) != 0 {
+		t.Errorf("queue of the missing file %+v: %v", queue, err)
+	}
+	array := filepath.Join(dir, "array.json")
+	os.WriteFile(array, []byte(`[{"url":"a","event":{"id":"1","type":"link.up"},"attempts":1}]`), 0600)
+	if _, err := loadQueue(array); err == nil {
+		t.Error("JSON array accepted as the queue records")
+	}
+}
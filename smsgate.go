@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"mxsms/conf"
+	"mxsms/health"
+	"mxsms/phone"
+	"mxsms/smpp"
 	"mxsms/sms"
+	"mxsms/sqlog"
+	"mxsms/supervisor"
 	"mxsms/zabbix"
 )
 
@@ -20,81 +32,481 @@ type SMSTemplates struct {
 	Delivered string `yaml:",omitempty" json:"delivered,omitempty"`      // delivered
 	Error     string `yaml:",omitempty" json:"error,omitempty"`          // sending or delivery error
 	Incoming  string `yaml:",omitempty" json:"incoming,omitempty"`       // incoming
+	Group     string `yaml:",omitempty" json:"group,omitempty"`          // sent to several recipients, with the results by recipient
 }
 
+// SMSCarrier describes a carrier the outgoing phone numbers are assigned to in
+// PhoneInfo.From. Messages from numbers of carriers without a REST API go over
+// SMPP.
 type SMSCarrier struct {
-	Name     string `json:"name,omitempty"`
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
-	Endpoint string `json:"endpoint,omitempty"`
+	Name        string `json:"name,omitempty"`
+	API         string `yaml:"api,omitempty" json:"api,omitempty"` // twilio, telnyx, bandwidth or empty for SMPP
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	Account     string `yaml:"account,omitempty" json:"account,omitempty"`         // account identifier, if differs from the user name
+	Application string `yaml:"application,omitempty" json:"application,omitempty"` // application or messaging profile identifier
+	Secret      string `yaml:"secret,omitempty" json:"secret,omitempty"`           // key checking the callback signatures
+	CallbackURL string `yaml:"callbackUrl,omitempty" json:"callbackUrl,omitempty"` // public URL of the web API, for the callback signatures
+	Endpoint    string `json:"endpoint,omitempty"`
 }
 
 // SMSGate describes the configuration for sending SMS.
 type SMSGate struct {
-	SMPP      *sms.SMPP    // SMPP connection
-	Carriers  []SMSCarrier `json:"carriers"`
-	Responses SMSTemplates `yaml:"messageTemplates" json:"responses"` // list of response templates
-	MYSQL     string       `yaml:"mySqlLog" json:"mysql,omitempty"`   // initialization of connection to the log
-	Zabbix    *zabbix.Log  `yaml:"zabbix" json:"zabbix,omitempty"`
-	counter   uint32       // counter of sent messages
-	history   History      // history of sent messages
+	SMPP      *sms.SMPP              `yaml:"smpp" json:"smpp"`                                 // SMPP connection
+	Server    *sms.Server            `yaml:"smppServer,omitempty" json:"smppServer,omitempty"` // SMPP front end for ESME clients
+	Web       *sms.Web               `yaml:"web,omitempty" json:"web,omitempty"`               // HTTP API for sending messages
+	Webhooks  *sms.Webhooks          `yaml:"webhooks,omitempty" json:"webhooks,omitempty"`     // subscriptions to gateway events
+	Media     *sms.MediaStore        `yaml:"media,omitempty" json:"media,omitempty"`           // local copies of MMS media
+	Carriers  []SMSCarrier           `yaml:"carriers,omitempty" json:"carriers,omitempty"`
+	Responses SMSTemplates           `yaml:"messageTemplates" json:"messageTemplates"`     // list of response templates
+	MYSQL     string                 `yaml:"mySqlLog,omitempty" json:"mySqlLog,omitempty"` // message log database: MySQL DSN, postgres:// or sqlite://
+	Zabbix    *zabbix.Log            `yaml:"zabbix,omitempty" json:"zabbix,omitempty"`
+	Metrics   *Metrics               `yaml:"metrics,omitempty" json:"metrics,omitempty"`     // Prometheus metrics endpoint
+	Health    *HealthConfig          `yaml:"health,omitempty" json:"health,omitempty"`       // health checks and readiness policy
+	History   *HistoryConfig         `yaml:"history,omitempty" json:"history,omitempty"`     // history store, in memory if not set
+	Reconnect *supervisor.Config     `yaml:"reconnect,omitempty" json:"reconnect,omitempty"` // reconnect settings of the MX and SMPP connections
+	counter   uint32                 // counter of sent messages
+	history   *History               // history of sent messages
+	numbers   *NumberAllocator       // allocation of the outgoing numbers
+	carriers  map[string]sms.Carrier // REST carriers by name
+	started   []byte                 // settings the gateway was started with, see restartSettings
+	mu        sync.RWMutex           // guards the settings replaced by the reload
+
+	receipts   map[string]*receipt           // SMPP message id -> receipt for the ESME
+	pending    map[*sms.SendMessage]*receipt // ESME messages waiting for submit responses
+	sent       map[string]sentMessage        // SMPP message id -> sent message, for receipt events
+	purged     time.Time                     // last time expired receipts were removed
+	receiptsMu sync.Mutex
+}
+
+// OpenHistory opens the history of sent messages. The pairings of the gateway
+// used before the configuration reload are moved to the new history, so replies
+// are still routed to the users that texted the numbers. The usage of the
+// outgoing numbers is kept too.
+func (s *SMSGate) OpenHistory(previous *SMSGate) error {
+	if previous != nil && previous.numbers != nil {
+		s.numbers = previous.numbers
+	}
+	if previous != nil && previous.history != nil && reflect.DeepEqual(s.History, previous.History) {
+		s.history = previous.history // the same store
+		return nil
+	}
+	history, err := OpenHistory(s.History, s.MYSQL)
+	if err != nil {
+		return err
+	}
+	if previous != nil && previous.history != nil {
+		if err := history.Migrate(previous.history); err != nil {
+			llog.WithError(err).Error("History migration error")
+		}
+	}
+	s.history = history
+	return nil
 }
 
 func (s *SMSGate) Connect() {
+	s.started = s.restartSettings()
+	if s.history == nil { // history not opened: kept in memory
+		s.history = new(History)
+	}
+	if s.numbers == nil {
+		s.numbers = new(NumberAllocator)
+	}
+	if s.Webhooks != nil { // post events to the subscribed endpoints
+		if err := s.Webhooks.Start(); err != nil {
+			llog.WithError(err).Error("Webhooks start error")
+			s.Webhooks = nil
+		}
+	}
+	if s.Metrics != nil { // collected even if they can't be served
+		if err := s.Metrics.Start(s.SMPP); err != nil {
+			llog.WithError(err).Error("Metrics start error")
+		}
+	}
+	checks := health.Handler(s.healthReport)
+	if s.Health != nil && s.Health.Address != "" {
+		if err := s.Health.Start(checks); err != nil {
+			llog.WithError(err).Error("Health server start error")
+		}
+	} else { // served with the metrics
+		s.Metrics.Handle("/healthz", checks)
+		s.Metrics.Handle("/readyz", checks)
+	}
+	s.SMPP.Reconnect, s.SMPP.Alert = s.Reconnect, s.alert
 	s.SMPP.Connect() // establish connection with SMPP servers
+	s.carriers = s.newCarriers(s.Carriers)
 	go func() {
 		for msg := range s.SMPP.Receive {
 			// s.Logger.Debugln("Received:", msg)
 			switch msg := msg.(type) {
 			case sms.Received: // incoming SMS
+				s.Metrics.Received(msg)
 				s.Receive(msg) // process incoming message
+			case sms.SendResponse: // message accepted by the SMPP server
+				s.Metrics.Submitted(msg)
+				if msg.Message != nil {
+					sglogDB.Part(msg.Message.ID, msg.ID, msg.Addr, int(msg.Status))
+				}
+				s.trackSent(msg)
+				s.history.chatResponse(msg)
+				s.sendResponse(msg)
+				if s.Web != nil {
+					s.Web.Response(msg)
+				}
+			case sms.Status: // delivery receipt
+				s.Metrics.Receipt(msg)
+				sglogDB.Status(msg.ID, msg.Addr, msg.Stat, msg.Err)
+				s.status(msg)
+				s.history.chatStatus(msg)
+				s.publishStatus(msg)
+				if s.Web != nil {
+					s.Web.Status(msg)
+				}
+			case sms.Link: // SMPP connection established or lost
+				s.Metrics.Link(msg)
+				s.publishLink(msg)
 			}
 		}
 	}()
+	if s.Server != nil { // accept messages from ESME clients
+		if err := s.Server.Start(); err != nil {
+			llog.WithError(err).Error("SMPP server start error")
+		} else {
+			go s.submitting()
+		}
+	}
+	if s.Web != nil { // accept messages from the HTTP API and carrier callbacks
+		s.Web.Gateway = s
+		s.Web.Carriers = carrierHandlers(s.carriers)
+		if s.Media != nil {
+			s.Web.Media = s.Media
+		}
+		if sglogDB != nil {
+			s.Web.Log = sglogDB
+		}
+		if err := s.Web.Start(); err != nil {
+			llog.WithError(err).Error("Web API start error")
+		}
+	}
+}
+
+// newCarriers returns the REST carriers by name. Carriers without API are
+// served over SMPP.
+func (s *SMSGate) newCarriers(list []SMSCarrier) map[string]sms.Carrier {
+	carriers := make(map[string]sms.Carrier)
+	for _, c := range list {
+		if c.API == "" {
+			continue // sent over SMPP
+		}
+		carrier, err := sms.NewHTTPCarrier(c.Name, c.API, c.Username, c.Password, c.Endpoint)
+		if err != nil {
+			llog.WithError(err).WithField("carrier", c.Name).Error("Carrier init error")
+			continue
+		}
+		carrier.Account, carrier.Application = c.Account, c.Application
+		carrier.Secret, carrier.CallbackURL = c.Secret, c.CallbackURL
+		// responses, incoming messages and receipts are handled as SMPP ones
+		carrier.Receive = s.SMPP.Receive
+		carrier.Media = s.Media
+		carriers[c.Name] = carrier
+	}
+	return carriers
+}
+
+// carrierHandlers returns the callback handlers of the carriers for the web API.
+func carrierHandlers(carriers map[string]sms.Carrier) map[string]http.Handler {
+	handlers := make(map[string]http.Handler, len(carriers))
+	for name, carrier := range carriers {
+		if handler, ok := carrier.(http.Handler); ok {
+			handlers[name] = handler
+		}
+	}
+	return handlers
+}
+
+// restartSettings returns the encoded settings that can't be replaced in place:
+// the gateway is restarted if the reload changes them.
+func (s *SMSGate) restartSettings() []byte {
+	data, _ := conf.Marshal(conf.YAML, &SMSGate{
+		Server:   s.Server,
+		Web:      s.Web,
+		Webhooks: s.Webhooks,
+		Media:    s.Media,
+		MYSQL:    s.MYSQL,
+		Zabbix:   s.Zabbix,
+		Metrics:  s.Metrics,
+		Health:   s.Health,
+		History:  s.History,
+	})
+	return data
+}
+
+// reload replaces the templates, the carriers and the reconnect settings with
+// the reloaded ones, and updates the SMPP links. It returns false and changes
+// nothing if the other settings are changed.
+func (s *SMSGate) reload(next *SMSGate) bool {
+	if s == nil || next == nil || next.SMPP == nil || !bytes.Equal(s.started, next.restartSettings()) {
+		return false
+	}
+	carriers := s.newCarriers(next.Carriers)
+	s.mu.Lock()
+	s.Responses, s.Reconnect = next.Responses, next.Reconnect
+	s.Carriers, s.carriers = next.Carriers, carriers
+	s.mu.Unlock()
+	next.SMPP.Reconnect = next.Reconnect
+	s.SMPP.Update(next.SMPP)
+	if s.Web != nil {
+		s.Web.SetCarriers(carrierHandlers(carriers))
+	}
+	return true
+}
+
+// templates returns the message templates.
+func (s *SMSGate) templates() SMSTemplates {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Responses
+}
+
+// reconnect returns the reconnect settings of the MX and SMPP connections.
+func (s *SMSGate) reconnect() *supervisor.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Reconnect
 }
 
 func (s *SMSGate) Close() {
+	if s.Web != nil {
+		s.Web.Close() // stop accepting API requests
+	}
+	if s.Server != nil {
+		s.Server.Close() // stop accepting ESME clients
+	}
 	s.SMPP.Close() // stop connection with SMPP
+	if s.Webhooks != nil {
+		s.Webhooks.Close() // undelivered events stay in the queue file
+	}
+	s.Metrics.Close()
+	s.Health.Close()
 }
 
 func (s *SMSGate) Send(mxName, jid string, msgID int64, to, msg string) (err error) {
-	from := s.history.GetFrom(config.MX[mxName].From, to, jid) // get the best outgoing number
-	if from == "" {
-		return errors.New("from phone is empty")
-	}
+	return s.SendMMS(mxName, jid, msgID, to, msg, nil)
+}
+
+// SendMMS sends the message with the media attachments. Without media it is sent
+// as SMS.
+func (s *SMSGate) SendMMS(mxName, jid string, msgID int64, to, msg string, media []sms.Media) (err error) {
 	if to == "" {
 		return errors.New("to phone is empty")
 	}
-	phoneType := int64(11 - len(from))
-	smsMessage := &sms.SendMessage{From: from, To: to, Text: msg}
-	if err = s.SMPP.Send(smsMessage); err != nil { // send SMS
-		//zabbixLog.Send("gw.smsc.error", err.Error())
-		sglogDB.Insert(mxName, from, to, msg, false, phoneType, msgID, 0)
+	mx := config.server(mxName)
+	if mx == nil {
+		return errors.New("unknown MX server")
+	}
+	var allocation Allocation
+	if from := s.history.Session(mxName, jid).From; from != "" { // chosen with /from
+		allocation, err = s.numbers.Choose(mx, from)
+	} else {
+		allocation, err = s.numbers.Allocate(mx, s.history, to, jid) // get the best outgoing number
+	}
+	if err != nil {
+		return err
+	}
+	from := allocation.From
+	mx.Logger.WithFields(logrus.Fields{
+		"jid":    jid,
+		"from":   from,
+		"to":     to,
+		"policy": allocation.Policy,
+		"sticky": allocation.Sticky,
+	}).Debug("Phone number allocated")
+	smsMessage := &sms.SendMessage{ID: uuid.New().String(), MXName: mxName, JID: jid, From: from, To: to, Text: msg, Media: media}
+	s.history.chatSent(smsMessage) // before sending: the carrier may respond before Send returns
+	if err = s.send(smsMessage, msgID); err != nil {
+		s.history.chatFailed(smsMessage)
 		return err
 	}
-	sglogDB.Insert(mxName, from, to, msg, false, phoneType, msgID, 1)
 	s.history.Add(mxName, jid, from, to) // add information about phone connection to history
 	return nil
 }
 
+// send passes the message to the carrier of the source number and logs it.
+func (s *SMSGate) send(msg *sms.SendMessage, msgID int64) error {
+	if msg.ID == "" {
+		msg.ID = uuid.New().String()
+	}
+	// logged before sending: the carrier may respond before Send returns
+	sglogDB.Insert(&sqlog.Message{
+		ID:        msg.ID,
+		Direction: sqlog.Outbound,
+		MX:        msg.MXName,
+		JID:       msg.JID,
+		From:      msg.From,
+		To:        msg.To,
+		Text:      msg.Text,
+		Status:    sqlog.StatusAccepted,
+		Carrier:   carrierName(msg.From),
+		PID:       msgID,
+	})
+	if msg.FromType == "" {
+		msg.FromType = senderType(msg.From)
+	}
+	if err := s.carrier(msg.From).Send(msg); err != nil { // send SMS
+		//zabbixLog.Send("gw.smsc.error", err.Error())
+		sglogDB.SetStatus(msg.ID, sqlog.StatusFailed)
+		return err
+	}
+	if s.numbers != nil {
+		s.numbers.Sent(msg.From) // counted against the daily cap
+	}
+	s.Metrics.Sent(msg)
+	return nil
+}
+
+// SendMessage sends a message from the HTTP API. The source address must be one
+// of the configured outgoing phone numbers.
+func (s *SMSGate) SendMessage(msg *sms.SendMessage) error {
+	if msg.MXName = mxByPhone(msg.From); msg.MXName == "" {
+		return smpp.ESME_RINVSRCADR
+	}
+	to, err := config.server(msg.MXName).parse(msg.To)
+	if err != nil { // the API takes the international numbers without the plus
+		if to, err = phone.Parse("+"+msg.To, ""); err != nil {
+			return smpp.ESME_RINVDSTADR
+		}
+	}
+	msg.To = to.String()
+	if _, ok := s.carrier(msg.From).(sms.SMPPCarrier); ok {
+		var up bool
+		for _, link := range s.SMPP.Links() {
+			up = up || link.Up
+		}
+		if !up { // the message would wait for the connection
+			return errors.New("no SMPP connection")
+		}
+	}
+	return s.send(msg, 0)
+}
+
+// Links returns the state of the SMPP connections.
+func (s *SMSGate) Links() []sms.Link {
+	return s.SMPP.Links()
+}
+
+// Connections returns the reconnect supervisors of the MX and SMPP connections,
+// sorted by name.
+func (s *SMSGate) Connections() []*supervisor.Supervisor {
+	connections := s.SMPP.Supervisors()
+	for _, mx := range config.servers() {
+		if mx.conn.supervisor != nil {
+			connections = append(connections, mx.conn.supervisor)
+		}
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].Name < connections[j].Name })
+	return connections
+}
+
+// carrier returns the carrier assigned to the outgoing phone number. Numbers of
+// carriers without a REST API are served over SMPP.
+func (s *SMSGate) carrier(phone string) sms.Carrier {
+	s.mu.RLock()
+	carriers := s.carriers
+	s.mu.RUnlock()
+	for _, mx := range config.servers() {
+		if carrier := carriers[mx.From[phone]]; carrier != nil {
+			return carrier
+		}
+	}
+	return sms.SMPPCarrier{SMPP: s.SMPP}
+}
+
+// carrierName returns the name of the carrier the phone number is assigned to.
+func carrierName(phone string) string {
+	for _, mx := range config.servers() {
+		if name, ok := mx.From[phone]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// senderType returns the kind of the outgoing number configured for the MX
+// server it belongs to.
+func senderType(from string) phone.Type {
+	for _, mx := range config.servers() {
+		if _, ok := mx.From[from]; ok {
+			return mx.senderType(from)
+		}
+	}
+	return ""
+}
+
+// mxByPhone returns the name of the MX server the phone number belongs to.
+func mxByPhone(phone string) string {
+	for name, mx := range config.servers() {
+		if _, ok := mx.From[phone]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// normalizeReceived returns the numbers of the incoming message as the gateway
+// keeps them. The numbers in the national format are parsed with the region of
+// the MX server the destination number belongs to.
+func normalizeReceived(from, to string) (string, string) {
+	for _, mx := range config.servers() {
+		region := mx.region()
+		number := phone.Normalize(to, region)
+		if _, ok := mx.From[number]; ok {
+			return phone.Normalize(from, region), number
+		}
+	}
+	return phone.Normalize(from, ""), phone.Normalize(to, "")
+}
+
 // Receive processes incoming messages
 func (s *SMSGate) Receive(msg sms.Received) {
-	incoming := s.Responses.Incoming
+	incoming := s.templates().Incoming
 	if incoming == "" {
 		incoming = "%s: %s"
 	}
-	// remove plus signs
-	if msg.From[0] == '+' {
-		msg.From = msg.From[1:]
-	}
-	if msg.To[0] == '+' {
-		msg.To = msg.To[1:]
+	msg.From, msg.To = normalizeReceived(msg.From, msg.To)
+	s.publishReceived(msg)
+	msg.Text = mediaText(msg)
+	if s.Server != nil { // numbers owned by ESME clients bypass MX routing
+		if client := s.Server.Owner(msg.To); client != "" {
+			logEntry := llog.WithFields(logrus.Fields{
+				"from":   msg.From,
+				"to":     msg.To,
+				"client": client,
+			})
+			if err := s.Server.Deliver(client, msg); err != nil {
+				logEntry.WithError(err).Error("SMS delivery to client error")
+				return
+			}
+			logEntry.Info("SMS queued for client")
+			return
+		}
 	}
-	phoneType := int64(11 - len(msg.From))
 	mxName, jid := s.history.Get(msg.To, msg.From)
-	sglogDB.Insert(mxName, msg.From, msg.To, msg.Text, true, phoneType, 0, 2)
+	logMsg := &sqlog.Message{
+		ID:        uuid.New().String(),
+		Direction: sqlog.Inbound,
+		MX:        mxName,
+		JID:       jid,
+		From:      msg.From,
+		To:        msg.To,
+		Text:      msg.Text,
+		Parts:     1,
+		Status:    sqlog.StatusReceived,
+		Link:      msg.Addr,
+		Carrier:   carrierName(msg.To),
+	}
+	defer sglogDB.Insert(logMsg)   // with the user the message is routed to
 	if mxName == "" || jid == "" { // no suitable user found in history to whom this is addressed
-		for name, mx := range config.MX { // iterate through all MX server settings
+		for name, mx := range config.servers() { // iterate through all MX server settings
 			for from, _ := range mx.From { // iterate through all their phones
 				if msg.To == from { // found a matching number
 					mxName = name
@@ -114,21 +526,26 @@ func (s *SMSGate) Receive(msg sms.Received) {
 		return
 	}
 next:
-	mx := config.MX[mxName]
+	logMsg.MX, logMsg.JID = mxName, jid
+	mx := config.server(mxName)
 	if mx == nil {
 		return
 	}
-	for mx.handler == nil {
-		llog.Debug("MX Handler not initialised... Waiting...")
-		time.Sleep(time.Second)
-	}
-	mx.client.Send(mx.handler.getMessage(
-		jid, incoming, msg.From, msg.Text))
-	mx.Logger.WithFields(logrus.Fields{
+	logEntry := mx.Logger.WithFields(logrus.Fields{
 		"jid":  jid,
 		"from": msg.From,
 		"to":   msg.To,
-	}).Info("SMS incoming")
+	})
+	// the messages wait for the login to the MX server
+	switch sent, err := mx.conn.deliver(s.getMessage(jid, incoming, msg.From, msg.Text)); {
+	case err != nil:
+		logEntry.WithError(err).Error("SMS incoming delivery error")
+	case !sent:
+		logEntry.Warning("SMS incoming kept until the MX login")
+	default:
+		logEntry.Info("SMS incoming")
+	}
+	s.history.chatReceived(mxName, jid, msg) // replied to with /r
 	// check for spam
 	for _, from := range mx.From {
 		if msg.To == from {
@@ -138,6 +555,19 @@ next:
 	return
 }
 
+// mediaText returns the message text followed by the links to its media, so MMS
+// can be read in MX chat and by ESME clients.
+func mediaText(msg sms.Received) string {
+	text := msg.Text
+	for _, media := range msg.Media {
+		if text != "" {
+			text += "\n"
+		}
+		text += media.URL
+	}
+	return text
+}
+
 // getMessage returns a formed command to send a confirmation message
 // based on the template text. If the template text is empty, the message is not sent
 func (s *SMSGate) getMessage(to, tmpl string, items ...interface{}) *sendMessage {
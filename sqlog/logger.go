@@ -1,37 +1,311 @@
+// Package sqlog keeps the log of the sent and received messages in a MySQL,
+// PostgreSQL or embedded SQLite database. Writes are queued and executed in
+// batches by a background goroutine, so they don't block sending; the schema is
+// created and upgraded by the migrations on connect.
 package sqlog
 
 import (
 	"database/sql"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
 )
 
+const (
+	queueSize  = 10000       // writes waiting for the database
+	batchSize  = 100         // writes executed in one transaction
+	batchDelay = time.Second // how long writes wait for the batch to fill
+)
+
+// Message directions.
+const (
+	Inbound  = "in"
+	Outbound = "out"
+)
+
+// Message states. Receipt states are kept in the status history as received.
+const (
+	StatusAccepted  = "accepted"  // passed to the carrier
+	StatusSent      = "sent"      // accepted by the carrier
+	StatusDelivered = "delivered" // delivered to the phone
+	StatusFailed    = "failed"    // not sent or not delivered
+	StatusReceived  = "received"  // incoming message
+)
+
+// finalStates maps the receipt states to the message states.
+var finalStates = map[string]string{
+	"DELIVRD": StatusDelivered,
+	"EXPIRED": StatusFailed,
+	"DELETED": StatusFailed,
+	"UNDELIV": StatusFailed,
+	"REJECTD": StatusFailed,
+}
+
+// Message describes a logged message.
+type Message struct {
+	ID        string    `json:"id"`        // gateway message identifier
+	Direction string    `json:"direction"` // in or out
+	MX        string    `json:"mx,omitempty"`
+	JID       string    `json:"jid,omitempty"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Text      string    `json:"text"`
+	Parts     int       `json:"parts"`
+	Status    string    `json:"status"`
+	Link      string    `json:"link,omitempty"`    // SMPP server address or carrier name
+	Carrier   string    `json:"carrier,omitempty"` // carrier of the outgoing number
+	PID       int64     `json:"pid,omitempty"`     // MX message identifier
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+
+	SMPPIDs []string       `json:"smppIds,omitempty"` // message identifiers assigned by the carrier
+	History []StatusChange `json:"history,omitempty"` // status changes
+}
+
+// StatusChange describes a message status change.
+type StatusChange struct {
+	SMPPID string    `json:"smppId,omitempty"`
+	Status string    `json:"status"`
+	Err    int       `json:"err,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Log is the message log.
+type Log interface {
+	// Insert logs the message.
+	Insert(msg *Message)
+	// Part logs the identifier the carrier assigned to a message part.
+	Part(id, smppID, link string, err int)
+	// Status logs the delivery receipt for the message part.
+	Status(smppID, link, stat string, err int)
+	// SetStatus changes the status of the message.
+	SetStatus(id, status string)
+	// Find returns the messages matching the query.
+	Find(query Query) ([]Message, error)
+	// Message returns the message with its parts and status history.
+	Message(id string) (*Message, error)
+	// ServeHTTP serves the queries of the HTTP API.
+	http.Handler
+	// Close writes the queued messages and closes the log.
+	Close() error
+}
+
+var _ Log = (*DB)(nil)
+
+// DB is the message log in an SQL database. A nil DB discards the writes.
 type DB struct {
-	db *sql.DB
+	Logger *logrus.Entry // log output
+
+	db      *sql.DB
+	dialect Dialect
+	queue   chan op
+	done    chan struct{}
+	once    sync.Once
+}
+
+// op describes a queued write. Ops with the flushed channel only signal that the
+// writes queued before them are done.
+type op struct {
+	query   string
+	args    []interface{}
+	flushed chan struct{}
 }
 
-func Connect(url string) (*DB, error) {
-	db, err := sql.Open("mysql", url) //"/mxsms?charset=utf8")
+// Connect connects to the database selected by the DSN scheme, upgrades the
+// schema and starts writing. See Open for the DSN formats.
+func Connect(dsn string) (*DB, error) {
+	db, dialect, err := Open(dsn)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Ping()
-	if err != nil {
+	if err = migrate(db, dialect); err != nil {
+		db.Close()
 		return nil, err
 	}
-	return &DB{db: db}, nil
+	log := &DB{
+		Logger:  logrus.NewEntry(logrus.StandardLogger()).WithField("log", dialect.Driver()),
+		db:      db,
+		dialect: dialect,
+		queue:   make(chan op, queueSize),
+		done:    make(chan struct{}),
+	}
+	go log.writing()
+	return log, nil
 }
 
+// Close writes the queued messages and closes the database.
 func (db *DB) Close() error {
+	if db == nil {
+		return nil
+	}
+	db.once.Do(func() { close(db.queue) })
+	<-db.done
 	return db.db.Close()
 }
 
-func (db *DB) Insert(mx, in, out, text string, inbound bool, phoneType, pid int64, delivered int) error {
-	// todo fix this?
-	/*stmt, err := db.db.Prepare(`INSERT log SET mx=?,calling=?,called=?,inbound=?,text=?,pid=?,delivered=?,type=?`)
+// Flush waits until the queued writes are done.
+func (db *DB) Flush() {
+	if db == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	db.queue <- op{flushed: flushed}
+	<-flushed
+}
+
+// Insert logs the message. Empty identifier, status and times are filled in.
+func (db *DB) Insert(msg *Message) {
+	if db == nil {
+		return
+	}
+	now := time.Now().UTC()
+	if msg.Created.IsZero() {
+		msg.Created = now
+	}
+	if msg.Updated.IsZero() {
+		msg.Updated = msg.Created
+	}
+	db.write(`INSERT INTO messages (message_id, direction, mx, jid, calling, called, text, parts,
+		status, link, carrier, pid, created, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.ID, msg.Direction, msg.MX, msg.JID, msg.From, msg.To, msg.Text, msg.Parts,
+		msg.Status, msg.Link, msg.Carrier, msg.PID, msg.Created.UTC(), msg.Updated.UTC())
+	db.write(`INSERT INTO message_status (message_id, status, time) VALUES (?, ?, ?)`,
+		msg.ID, msg.Status, msg.Created.UTC())
+}
+
+// Part logs the identifier the carrier assigned to a message part. Rejected
+// parts fail the message.
+func (db *DB) Part(id, smppID, link string, err int) {
+	if db == nil {
+		return
+	}
+	now := time.Now().UTC()
+	status := StatusSent
+	if err != 0 {
+		status = StatusFailed
+	}
+	db.write(`INSERT INTO message_parts (smpp_id, message_id, link) VALUES (?, ?, ?)`, smppID, id, link)
+	db.write(`UPDATE messages SET parts = parts + 1, link = ?, updated = ?,
+		status = CASE WHEN status = ? THEN status ELSE ? END WHERE message_id = ?`,
+		link, now, StatusFailed, status, id)
+	db.write(`INSERT INTO message_status (message_id, smpp_id, link, status, err, time)
+		VALUES (?, ?, ?, ?, ?, ?)`, id, smppID, link, status, err, now)
+}
+
+// Status logs the delivery receipt for the message part with the identifier
+// assigned by the carrier. Receipts of unknown parts are ignored.
+func (db *DB) Status(smppID, link, stat string, err int) {
+	if db == nil {
+		return
+	}
+	now := time.Now().UTC()
+	db.write(`INSERT INTO message_status (message_id, smpp_id, link, status, err, time)
+		SELECT message_id, smpp_id, link, ?, ?, ? FROM message_parts WHERE smpp_id = ? AND link = ?`,
+		stat, err, now, smppID, link)
+	if status := finalStates[stat]; status != "" {
+		db.write(`UPDATE messages SET status = ?, updated = ? WHERE message_id IN
+			(SELECT message_id FROM message_parts WHERE smpp_id = ? AND link = ?)`,
+			status, now, smppID, link)
+	}
+}
+
+// SetStatus changes the status of the message.
+func (db *DB) SetStatus(id, status string) {
+	if db == nil {
+		return
+	}
+	now := time.Now().UTC()
+	db.write(`UPDATE messages SET status = ?, updated = ? WHERE message_id = ?`, status, now, id)
+	db.write(`INSERT INTO message_status (message_id, status, time) VALUES (?, ?, ?)`, id, status, now)
+}
+
+// write queues the statement. Writes are dropped if the database can't keep up,
+// so sending is never blocked.
+func (db *DB) write(query string, args ...interface{}) {
+	select {
+	case db.queue <- op{query: db.dialect.Rebind(query), args: db.args(args)}:
+	default:
+		db.Logger.Warning("SQL log queue is full: write dropped")
+	}
+}
+
+// writing executes the queued writes in batches until the queue is closed.
+func (db *DB) writing() {
+	defer close(db.done)
+	timer := time.NewTimer(batchDelay)
+	defer timer.Stop()
+	var batch []op
+	for {
+		select {
+		case o, ok := <-db.queue:
+			if !ok {
+				db.execute(batch)
+				return
+			}
+			if o.flushed != nil {
+				db.execute(batch)
+				batch = batch[:0]
+				close(o.flushed)
+				continue
+			}
+			batch = append(batch, o)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-timer.C:
+			timer.Reset(batchDelay)
+		}
+		db.execute(batch)
+		batch = batch[:0]
+	}
+}
+
+// execute runs the batch in a transaction. If the transaction fails, the writes
+// are repeated one by one, so a single bad write doesn't lose the others.
+func (db *DB) execute(batch []op) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := db.transaction(batch); err == nil {
+		return
+	}
+	for _, o := range batch {
+		if _, err := db.db.Exec(o.query, o.args...); err != nil {
+			db.Logger.WithError(err).WithField("query", firstLine(o.query)).Error("SQL log write error")
+		}
+	}
+}
+
+// args returns the arguments with the times in the database format.
+func (db *DB) args(args []interface{}) []interface{} {
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			args[i] = db.dialect.Time(t)
+		}
+	}
+	return args
+}
+
+// transaction runs the writes in a transaction.
+func (db *DB) transaction(batch []op) error {
+	tx, err := db.db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(mx, in, out, inbound, text, pid, delivered, phoneType)*/
-	return nil
+	defer tx.Rollback()
+	for _, o := range batch {
+		if _, err := tx.Exec(o.query, o.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// firstLine returns the first line of the query for the log.
+func firstLine(query string) string {
+	line, _, _ := strings.Cut(query, "\n")
+	return line
 }
@@ -1,15 +1,174 @@
 package sqlog
 
-import "testing"
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLog returns the log in a temporary SQLite database.
+func testLog(t *testing.T) *DB {
+	db, err := Connect("sqlite://" + filepath.Join(t.TempDir(), "log.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
 
 func TestLog(t *testing.T) {
-	db, err := Connect("root@/mxsms?charset=utf8")
+	db := testLog(t)
+	id := "test-" + time.Now().Format("150405.000000")
+	db.Insert(&Message{ID: id, Direction: Outbound, MX: "mx", JID: "jid", From: "14085551234",
+		To: "14155550000", Text: "text", Status: StatusAccepted, PID: 2345})
+	db.Part(id, id+"-1", "smpp", 0)
+	db.Status(id+"-1", "smpp", "DELIVRD", 0)
+	db.Status("unknown-1", "smpp", "DELIVRD", 0) // not logged without the part
+	db.Flush()
+	var orphans int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM message_status WHERE message_id = ''`).Scan(&orphans); err != nil || orphans != 0 {
+		t.Errorf("%d receipts without the message: %v", orphans, err)
+	}
+	msg, err := db.Message(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Status != StatusDelivered || msg.Parts != 1 || len(msg.SMPPIDs) != 1 || len(msg.History) != 3 ||
+		msg.History[2].Status != "DELIVRD" || time.Since(msg.Created) > time.Minute {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if _, err := db.Message("unknown"); err != ErrNotFound {
+		t.Errorf("unknown message: %v", err)
+	}
+	db.Insert(&Message{ID: "in-1", Direction: Inbound, From: "14155550000", To: "14085551234",
+		Text: "reply", Status: StatusReceived, Created: time.Now().Add(-time.Hour * 48)})
+	db.Flush()
+	tests := []struct {
+		query Query
+		ids   []string
+	}{
+		{Query{Number: "14155550000"}, []string{id, "in-1"}},
+		{Query{Number: "14155550000", JID: "jid", Status: StatusDelivered}, []string{id}},
+		{Query{Direction: Inbound}, []string{"in-1"}},
+		{Query{Since: time.Now().Add(-time.Hour)}, []string{id}},
+		{Query{Until: time.Now().Add(-time.Hour)}, []string{"in-1"}},
+		{Query{Limit: 1}, []string{id}},
+		{Query{Number: "14155550001"}, nil},
+	}
+	for _, test := range tests {
+		messages, err := db.Find(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+			t.Errorf("find %+v: %v", test.query, ids)
+		}
+	}
+}
+
+func TestLogHTTP(t *testing.T) {
+	db := testLog(t)
+	db.Insert(&Message{ID: "m1", Direction: Outbound, From: "14085551234", To: "14155550000",
+		Text: "text", Status: StatusAccepted})
+	db.Flush()
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		db.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, w.Body.String()
+	}
+	if code, body := get("/log?number=%2B14155550000"); code != 200 || !strings.Contains(body, `"id":"m1"`) {
+		t.Errorf("find: %d %s", code, body)
+	}
+	if code, body := get("/log/m1"); code != 200 || !strings.Contains(body, `"history"`) {
+		t.Errorf("message: %d %s", code, body)
+	}
+	if code, _ := get("/log/m2"); code != 404 {
+		t.Errorf("unknown message: %d", code)
+	}
+	if code, _ := get("/log?since=yesterday"); code != 400 {
+		t.Errorf("invalid query: %d", code)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dsns := []string{
+		"root@tcp(127.0.0.1:1)/mxsms?charset=utf8",
+		"mysql://root@tcp(127.0.0.1:1)/mxsms",
+		"postgres://root@127.0.0.1:1/mxsms?sslmode=disable",
+	}
+	for _, dsn := range dsns {
+		// no server is listening: the driver of the scheme fails to connect
+		if _, _, err := Open(dsn); err == nil || !strings.Contains(err.Error(), "connect") &&
+			!strings.Contains(err.Error(), "dial") {
+			t.Errorf("%s: %v", dsn, err)
+		}
+	}
+	db, dialect, err := Open("sqlite::memory:")
+	if err != nil || dialect.Driver() != "sqlite" {
+		t.Fatalf("sqlite: %v", err)
+	}
+	db.Close()
+	if query := (postgresDialect{}).Rebind("a = ? AND b = ?"); query != "a = $1 AND b = $2" {
+		t.Errorf("rebind: %s", query)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	// the versions mean the same schema on every database
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d has version %d", i+1, m.version)
+		}
+		for _, dialect := range []Dialect{mysqlDialect{}, postgresDialect{}, sqliteDialect{}} {
+			for _, statement := range m.statements {
+				if schema := dialect.Schema(statement); strings.Contains(schema, "{{") {
+					t.Errorf("%s: migration %d template left: %s", dialect.Driver(), m.version, schema)
+				}
+			}
+		}
+	}
+	db, dialect, err := Open("sqlite::memory:")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
-	err = db.Insert("mx", "in", "out", "text", true, 3, 2345, 2)
+	if err := migrate(db, dialect); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, dialect); err != nil { // applied once
+		t.Fatal(err)
+	}
+	var version int
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil ||
+		version != len(migrations) {
+		t.Errorf("schema version %d: %v", version, err)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	query, err := ParseQuery(url.Values{
+		"number": {"+14155550000"},
+		"since":  {"2024-08-01"},
+		"until":  {"2024-08-02T12:00:00Z"},
+		"limit":  {"10"},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if query.Number != "14155550000" || query.Limit != 10 ||
+		!query.Since.Equal(time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)) ||
+		!query.Until.Equal(time.Date(2024, 8, 2, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected query %+v", query)
+	}
+	if _, err := ParseQuery(url.Values{"since": {"yesterday"}}); err == nil {
+		t.Error("invalid date accepted")
+	}
 }
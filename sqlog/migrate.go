@@ -0,0 +1,110 @@
+package sqlog
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration describes a schema version: the statements are executed one by one
+// in the listed order. The {{id}}, {{time}} and {{options}} templates are
+// replaced with the types and options of the database dialect.
+type migration struct {
+	version    int
+	statements []string
+}
+
+// migrations lists the schema versions in order. Applied migrations must not
+// be changed: add a new version instead.
+var migrations = []migration{
+	{1, []string{
+		`CREATE TABLE messages (
+			id {{id}},
+			message_id VARCHAR(64) NOT NULL,
+			direction VARCHAR(8) NOT NULL,
+			mx VARCHAR(128) NOT NULL DEFAULT '',
+			jid VARCHAR(128) NOT NULL DEFAULT '',
+			calling VARCHAR(32) NOT NULL,
+			called VARCHAR(32) NOT NULL,
+			text TEXT NOT NULL,
+			parts INT NOT NULL DEFAULT 0,
+			status VARCHAR(16) NOT NULL,
+			link VARCHAR(128) NOT NULL DEFAULT '',
+			carrier VARCHAR(64) NOT NULL DEFAULT '',
+			pid BIGINT NOT NULL DEFAULT 0,
+			created {{time}} NOT NULL,
+			updated {{time}} NOT NULL
+		){{options}}`,
+		`CREATE UNIQUE INDEX messages_message_id ON messages (message_id)`,
+		`CREATE INDEX messages_calling ON messages (calling, created)`,
+		`CREATE INDEX messages_called ON messages (called, created)`,
+		`CREATE INDEX messages_jid ON messages (jid, created)`,
+		`CREATE INDEX messages_created ON messages (created)`,
+		`CREATE TABLE message_parts (
+			smpp_id VARCHAR(64) NOT NULL,
+			message_id VARCHAR(64) NOT NULL,
+			link VARCHAR(128) NOT NULL DEFAULT '',
+			PRIMARY KEY (smpp_id, link)
+		){{options}}`,
+		`CREATE INDEX message_parts_message_id ON message_parts (message_id)`,
+		`CREATE TABLE message_status (
+			id {{id}},
+			message_id VARCHAR(64) NOT NULL,
+			smpp_id VARCHAR(64) NOT NULL DEFAULT '',
+			status VARCHAR(16) NOT NULL,
+			err INT NOT NULL DEFAULT 0,
+			time {{time}} NOT NULL
+		){{options}}`,
+		`CREATE INDEX message_status_message_id ON message_status (message_id)`,
+	}},
+	// the link of the message part the status is logged for
+	{2, []string{
+		`ALTER TABLE message_status ADD COLUMN link VARCHAR(128) NOT NULL DEFAULT ''`,
+		`CREATE INDEX message_status_smpp_id ON message_status (smpp_id, link)`,
+	}},
+}
+
+// migrate brings the schema to the latest version. The applied versions are
+// recorded in the schema_migrations table.
+func migrate(db *sql.DB, dialect Dialect) error {
+	_, err := db.Exec(dialect.Schema(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT NOT NULL,
+		applied {{time}} NOT NULL,
+		PRIMARY KEY (version)
+	)`))
+	if err != nil {
+		return err
+	}
+	var current sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if int64(m.version) <= current.Int64 {
+			continue
+		}
+		if err := apply(db, dialect, m); err != nil {
+			return fmt.Errorf("migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// apply executes the migration statements and records the version.
+func apply(db *sql.DB, dialect Dialect, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range m.statements {
+		if _, err := tx.Exec(dialect.Schema(statement)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(dialect.Rebind(`INSERT INTO schema_migrations (version, applied) VALUES (?, ?)`),
+		m.version, dialect.Time(time.Now())); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
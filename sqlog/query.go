@@ -0,0 +1,236 @@
+package sqlog
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLimit = 100  // messages returned by default
+	maxLimit     = 1000 // maximum messages returned at once
+)
+
+// ErrNotFound is returned for unknown messages.
+var ErrNotFound = errors.New("message not found")
+
+// Query describes the search of the logged messages. Empty fields don't
+// restrict the search. Messages are returned newest first.
+type Query struct {
+	Number    string    // source or destination phone number
+	JID       string    // MX user
+	MX        string    // MX server name
+	Direction string    // in or out
+	Status    string    // message status
+	Since     time.Time // created at or after
+	Until     time.Time // created before
+	Limit     int       // maximum number of messages, 100 by default
+}
+
+// ParseQuery returns the query with the parameters: number, jid, mx,
+// direction, status, since, until and limit. Dates are in the 2006-01-02 or
+// RFC 3339 format.
+func ParseQuery(values url.Values) (Query, error) {
+	query := Query{
+		Number:    strings.TrimPrefix(values.Get("number"), "+"),
+		JID:       values.Get("jid"),
+		MX:        values.Get("mx"),
+		Direction: values.Get("direction"),
+		Status:    values.Get("status"),
+	}
+	var err error
+	if query.Since, err = parseDate(values.Get("since")); err != nil {
+		return query, fmt.Errorf("since: %w", err)
+	}
+	if query.Until, err = parseDate(values.Get("until")); err != nil {
+		return query, fmt.Errorf("until: %w", err)
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return query, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+	return query, nil
+}
+
+// parseDate parses the date or time. Empty string returns the zero time.
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// Find returns the messages matching the query, without the parts and history.
+func (db *DB) Find(query Query) ([]Message, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(condition string, values ...interface{}) {
+		where = append(where, condition)
+		args = append(args, values...)
+	}
+	if query.Number != "" {
+		add("(calling = ? OR called = ?)", query.Number, query.Number)
+	}
+	if query.JID != "" {
+		add("jid = ?", query.JID)
+	}
+	if query.MX != "" {
+		add("mx = ?", query.MX)
+	}
+	if query.Direction != "" {
+		add("direction = ?", query.Direction)
+	}
+	if query.Status != "" {
+		add("status = ?", query.Status)
+	}
+	if !query.Since.IsZero() {
+		add("created >= ?", query.Since)
+	}
+	if !query.Until.IsZero() {
+		add("created < ?", query.Until)
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	statement := messageSelect
+	if len(where) > 0 {
+		statement += " WHERE " + strings.Join(where, " AND ")
+	}
+	statement += " ORDER BY created DESC, id DESC LIMIT " + strconv.Itoa(limit)
+	rows, err := db.db.Query(db.dialect.Rebind(statement), db.args(args)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *msg)
+	}
+	return messages, rows.Err()
+}
+
+// Message returns the message with its parts and status history.
+func (db *DB) Message(id string) (*Message, error) {
+	msg, err := scanMessage(db.db.QueryRow(db.dialect.Rebind(messageSelect+" WHERE message_id = ?"), id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.db.Query(db.dialect.Rebind(
+		`SELECT smpp_id FROM message_parts WHERE message_id = ? ORDER BY smpp_id`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var smppID string
+		if err := rows.Scan(&smppID); err != nil {
+			return nil, err
+		}
+		msg.SMPPIDs = append(msg.SMPPIDs, smppID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = db.db.Query(db.dialect.Rebind(`SELECT smpp_id, status, err, time FROM message_status
+		WHERE message_id = ? ORDER BY time, id`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change StatusChange
+		if err := rows.Scan(&change.SMPPID, &change.Status, &change.Err, &change.Time); err != nil {
+			return nil, err
+		}
+		msg.History = append(msg.History, change)
+	}
+	return msg, rows.Err()
+}
+
+// messageSelect selects the message columns read by scanMessage.
+const messageSelect = `SELECT message_id, direction, mx, jid, calling, called, text, parts,
+	status, link, carrier, pid, created, updated FROM messages`
+
+// scanMessage reads the message selected with messageSelect.
+func scanMessage(row interface{ Scan(...interface{}) error }) (*Message, error) {
+	msg := new(Message)
+	err := row.Scan(&msg.ID, &msg.Direction, &msg.MX, &msg.JID, &msg.From, &msg.To, &msg.Text,
+		&msg.Parts, &msg.Status, &msg.Link, &msg.Carrier, &msg.PID, &msg.Created, &msg.Updated)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ServeHTTP implements the http.Handler interface for the API:
+//
+//	GET /log?number=&jid=&mx=&direction=&status=&since=&until=&limit=
+//	GET /log/{id}
+//
+// The requests must be authorized by the caller.
+func (db *DB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/log"), "/"); id != "" {
+		msg, err := db.Message(id)
+		switch {
+		case err == ErrNotFound:
+			writeError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			db.Logger.WithError(err).Error("SQL log query error")
+			writeError(w, http.StatusInternalServerError, "log query error")
+		default:
+			writeJSON(w, http.StatusOK, msg)
+		}
+		return
+	}
+	query, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	messages, err := db.Find(query)
+	if err != nil {
+		db.Logger.WithError(err).Error("SQL log query error")
+		writeError(w, http.StatusInternalServerError, "log query error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]Message{"messages": messages})
+}
+
+// writeError writes the error as JSON.
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// writeJSON writes the value as JSON with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
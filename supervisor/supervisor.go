@@ -0,0 +1,347 @@
+// Package supervisor keeps the gateway connections running. A failed connection
+// is retried with exponential backoff and jitter. Authorization failures and
+// too many failures in a row open the circuit breaker: the connection is only
+// retried after the open delay, or after a manual reset.
+package supervisor
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"mxsms/conf"
+	"mxsms/health"
+)
+
+// Circuit breaker states.
+const (
+	Closed   = "closed"    // reconnecting with the backoff
+	Open     = "open"      // waiting for the open delay or a reset
+	HalfOpen = "half-open" // trying to reconnect after the open delay
+)
+
+// Defaults of the reconnect policy.
+const (
+	DefaultDelay     = time.Second * 5
+	DefaultMaxDelay  = time.Minute * 5
+	DefaultThreshold = 10
+	DefaultOpenDelay = time.Minute * 10
+)
+
+// authError marks the authorization failures.
+type authError struct {
+	err error
+}
+
+func (e *authError) Error() string { return e.err.Error() }
+func (e *authError) Unwrap() error { return e.err }
+
+// AuthError marks the error as an authorization failure. Repeating the same
+// credentials doesn't help, so it opens the circuit breaker at once.
+func AuthError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &authError{err: err}
+}
+
+// IsAuth reports whether the error is an authorization failure.
+func IsAuth(err error) bool {
+	var auth *authError
+	return errors.As(err, &auth)
+}
+
+// Config describes the reconnect settings shared by the MX and SMPP
+// connections. The first delay and the failure threshold are set for each
+// connection by its reconnectDelay and maxError.
+type Config struct {
+	MaxDelay  conf.Duration `yaml:"maxDelay,omitempty" json:"maxDelay,omitempty"`   // maximum delay between reconnects
+	OpenDelay conf.Duration `yaml:"openDelay,omitempty" json:"openDelay,omitempty"` // wait of the open circuit breaker
+}
+
+// Policy returns the reconnect policy with the first delay and the failure
+// threshold of the connection. Unset values are replaced with the defaults.
+func (c *Config) Policy(delay time.Duration, threshold int) Policy {
+	p := Policy{Delay: delay, Threshold: threshold}
+	if c != nil {
+		p.MaxDelay, p.OpenDelay = time.Duration(c.MaxDelay), time.Duration(c.OpenDelay)
+	}
+	return p
+}
+
+// Policy describes how a connection is reconnected.
+type Policy struct {
+	Delay     time.Duration // delay after the first failure, doubled after each one
+	MaxDelay  time.Duration // maximum delay between reconnects
+	Threshold int           // failures in a row opening the circuit breaker
+	OpenDelay time.Duration // wait of the open circuit breaker
+}
+
+// withDefaults returns the policy with the unset values replaced with the
+// defaults.
+func (p Policy) withDefaults() Policy {
+	if p.Delay <= 0 {
+		p.Delay = DefaultDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultMaxDelay
+	}
+	if p.MaxDelay < p.Delay {
+		p.MaxDelay = p.Delay
+	}
+	if p.Threshold <= 0 {
+		p.Threshold = DefaultThreshold
+	}
+	if p.OpenDelay <= 0 {
+		p.OpenDelay = DefaultOpenDelay
+	}
+	return p
+}
+
+// backoff returns the delay after the number of failures in a row: the first
+// delay doubled after each failure up to the maximum, half of it randomized.
+func (p Policy) backoff(failures int) time.Duration {
+	delay := p.MaxDelay
+	if failures <= 32 {
+		if d := p.Delay << (failures - 1); d > 0 && d < p.MaxDelay {
+			delay = d
+		}
+	}
+	return jitter(delay)
+}
+
+// jitter returns the delay with the random second half, so connections failed
+// at the same time don't reconnect together.
+func jitter(delay time.Duration) time.Duration {
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// Alert describes the change of the circuit breaker: opened after the failures
+// or closed after the connection is restored.
+type Alert struct {
+	Name     string `json:"name"`            // connection name
+	Breaker  string `json:"breaker"`         // open or closed
+	Auth     bool   `json:"auth,omitempty"`  // opened by an authorization failure
+	Failures int    `json:"failures"`        // failures in a row
+	Error    string `json:"error,omitempty"` // last error
+}
+
+// Info describes the state of a supervised connection.
+type Info struct {
+	Name      string     `json:"name"`
+	Breaker   string     `json:"breaker"`             // circuit breaker state
+	Failures  int        `json:"failures"`            // failures in a row
+	Auth      bool       `json:"auth,omitempty"`      // the last error is an authorization failure
+	LastError string     `json:"lastError,omitempty"` // error of the last failure
+	Retry     *time.Time `json:"retry,omitempty"`     // time of the next attempt while waiting
+}
+
+// Supervisor runs a connection and reconnects it after the failures. It's safe
+// for concurrent use; the nil Supervisor does nothing.
+type Supervisor struct {
+	Name   string        // connection name used in the alerts
+	Policy Policy        // reconnect policy, replaced with SetPolicy once running
+	State  *health.State // connection state, for the health checks
+	Logger *logrus.Entry // log output
+	Alert  func(Alert)   // called when the circuit breaker opens or closes
+
+	breaker  string
+	failures int
+	lastErr  error
+	retry    time.Time     // time of the next attempt while waiting
+	reset    chan struct{} // wakes up the waiting connection
+	stop     chan struct{} // closed by Stop
+	once     sync.Once
+	mu       sync.Mutex
+}
+
+// init initializes the channels.
+func (s *Supervisor) init() {
+	s.once.Do(func() {
+		s.reset = make(chan struct{}, 1)
+		s.stop = make(chan struct{})
+		if s.Logger == nil {
+			s.Logger = logrus.NewEntry(logrus.StandardLogger())
+		}
+	})
+}
+
+// Run connects and reconnects until the connection stops without an error or
+// the supervisor is stopped. The connect function must call up when the
+// connection is established and authorized, and return when it's lost.
+func (s *Supervisor) Run(connect func(up func()) error) {
+	s.init()
+	defer s.State.Set(health.Stopped, nil)
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		s.State.Set(health.Connecting, nil)
+		err := connect(s.up)
+		if err == nil {
+			return // planned stop
+		}
+		s.State.Set(health.Down, err)
+		if !s.wait(s.failed(err)) {
+			return
+		}
+	}
+}
+
+// up closes the circuit breaker after the connection is established.
+func (s *Supervisor) up() {
+	s.State.Set(health.Up, nil)
+	s.mu.Lock()
+	alert := s.breaker != Closed && s.breaker != ""
+	failures := s.failures
+	s.breaker, s.failures = Closed, 0
+	s.mu.Unlock()
+	if alert {
+		s.Logger.WithField("failures", failures).Info("Connection restored")
+		s.alert(Alert{Name: s.Name, Breaker: Closed, Failures: failures})
+	}
+}
+
+// failed counts the failure and returns the delay before the next attempt.
+func (s *Supervisor) failed(err error) time.Duration {
+	auth := IsAuth(err)
+	s.mu.Lock()
+	policy := s.Policy.withDefaults()
+	s.failures++
+	s.lastErr = err
+	failures, previous := s.failures, s.breaker
+	open := auth || previous == HalfOpen || failures >= policy.Threshold
+	if open {
+		s.breaker = Open
+	} else {
+		s.breaker = Closed
+	}
+	s.mu.Unlock()
+	if !open {
+		delay := policy.backoff(failures)
+		s.Logger.WithField("delay", delay.Round(time.Millisecond)).Info("Reconnecting after the delay")
+		return delay
+	}
+	logEntry := s.Logger.WithError(err).WithFields(logrus.Fields{
+		"failures": failures,
+		"auth":     auth,
+		"delay":    policy.OpenDelay,
+	})
+	if previous == HalfOpen {
+		logEntry.Warning("Connection breaker still open")
+	} else {
+		logEntry.Error("Connection breaker open")
+		s.alert(Alert{Name: s.Name, Breaker: Open, Auth: auth, Failures: failures, Error: err.Error()})
+	}
+	return jitter(policy.OpenDelay)
+}
+
+// wait waits for the delay or the reset. It returns false if the supervisor is
+// stopped.
+func (s *Supervisor) wait(delay time.Duration) bool {
+	s.mu.Lock()
+	s.retry = time.Now().Add(delay)
+	s.mu.Unlock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.reset:
+	case <-s.stop:
+		return false
+	}
+	s.mu.Lock()
+	if s.breaker == Open {
+		s.breaker = HalfOpen // one trial attempt
+	}
+	s.retry = time.Time{}
+	s.mu.Unlock()
+	return true
+}
+
+// alert calls the alert hook, if set.
+func (s *Supervisor) alert(a Alert) {
+	if s.Alert != nil {
+		s.Alert(a)
+	}
+}
+
+// Reset clears the failures and reconnects at once if the connection is
+// waiting. The open circuit breaker is half-opened: it's closed if the
+// connection is restored and opened again if it fails.
+func (s *Supervisor) Reset() {
+	if s == nil {
+		return
+	}
+	s.init()
+	s.mu.Lock()
+	waiting := !s.retry.IsZero()
+	if s.breaker == Open {
+		s.breaker = HalfOpen
+	}
+	s.failures = 0
+	s.mu.Unlock()
+	s.Logger.Info("Connection reset")
+	if waiting {
+		select {
+		case s.reset <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetPolicy replaces the reconnect policy, such as after the configuration
+// reload. It's used from the next failure.
+func (s *Supervisor) SetPolicy(policy Policy) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Policy = policy
+	s.mu.Unlock()
+}
+
+// Stop stops reconnecting. The running connection must be closed by the
+// caller.
+func (s *Supervisor) Stop() {
+	if s == nil {
+		return
+	}
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
+
+// Info returns the state of the connection.
+func (s *Supervisor) Info() Info {
+	if s == nil {
+		return Info{Breaker: Closed}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := Info{Name: s.Name, Breaker: s.breaker, Failures: s.failures}
+	if info.Breaker == "" {
+		info.Breaker = Closed
+	}
+	if s.lastErr != nil {
+		info.LastError, info.Auth = s.lastErr.Error(), IsAuth(s.lastErr)
+	}
+	if !s.retry.IsZero() {
+		retry := s.retry
+		info.Retry = &retry
+	}
+	return info
+}
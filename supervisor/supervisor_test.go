@@ -0,0 +1,104 @@
+package supervisor
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"mxsms/conf"
+	"mxsms/health"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{Delay: time.Second, MaxDelay: time.Second * 10}.withDefaults()
+	for _, test := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, time.Second * 2},
+		{4, time.Second * 8},
+		{5, time.Second * 10},
+		{100, time.Second * 10},
+	} {
+		for i := 0; i < 10; i++ {
+			if delay := p.backoff(test.failures); delay < test.max/2 || delay >= test.max {
+				t.Errorf("%d failures: %v", test.failures, delay)
+			}
+		}
+	}
+	if p := (*Config)(nil).Policy(0, 0).withDefaults(); p.Delay != DefaultDelay || p.Threshold != DefaultThreshold {
+		t.Errorf("default policy %+v", p)
+	}
+	p = (&Config{MaxDelay: conf.Duration(time.Minute), OpenDelay: conf.Duration(time.Hour)}).Policy(time.Second*30, 5)
+	if p.Delay != time.Second*30 || p.MaxDelay != time.Minute || p.Threshold != 5 || p.OpenDelay != time.Hour {
+		t.Errorf("policy %+v", p)
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	alerts := make(chan Alert, 10)
+	s := &Supervisor{
+		Name:   "smpp/east",
+		Policy: Policy{Delay: time.Millisecond, Threshold: 3, OpenDelay: time.Hour},
+		State:  new(health.State),
+		Alert:  func(a Alert) { alerts <- a },
+	}
+	results := make(chan error)
+	attempts := make(chan func())
+	done := make(chan struct{})
+	go func() {
+		s.Run(func(up func()) error {
+			attempts <- up
+			return <-results
+		})
+		close(done)
+	}()
+	// network failures are retried with the backoff until the threshold
+	for i := 0; i < 3; i++ {
+		<-attempts
+		results <- io.EOF
+	}
+	a := <-alerts
+	if a.Breaker != Open || a.Auth || a.Failures != 3 || a.Error != "EOF" {
+		t.Errorf("open alert %+v", a)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if info := s.Info(); info.Breaker != Open || info.Retry == nil || info.LastError != "EOF" {
+		t.Errorf("open info %+v", info)
+	}
+	// the reset half-opens the breaker and closes it after the connection
+	s.Reset()
+	up := <-attempts
+	up()
+	if a := <-alerts; a.Breaker != Closed || a.Failures != 0 {
+		t.Errorf("closed alert %+v", a)
+	}
+	if status := s.State.Status(); status.State != health.Up {
+		t.Errorf("state %+v", status)
+	}
+	// an authorization failure opens the breaker at once
+	results <- AuthError(errors.New("Bind auth failed"))
+	if a := <-alerts; a.Breaker != Open || !a.Auth || a.Failures != 1 {
+		t.Errorf("auth alert %+v", a)
+	}
+	s.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("not stopped")
+	}
+	if status := s.State.Status(); status.State != health.Stopped {
+		t.Errorf("stopped state %+v", status)
+	}
+	if info := s.Info(); !info.Auth || info.Failures != 1 {
+		t.Errorf("auth info %+v", info)
+	}
+	var nilSupervisor *Supervisor
+	nilSupervisor.Reset()
+	nilSupervisor.Stop()
+	if info := nilSupervisor.Info(); info.Breaker != Closed {
+		t.Errorf("nil info %+v", info)
+	}
+}
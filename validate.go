@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mxsms/conf"
+	"mxsms/health"
+	"mxsms/phone"
+	"mxsms/sms"
+)
+
+var (
+	// gatewayPhoneRE matches the gateway phone numbers: short codes and
+	// international numbers without the plus.
+	gatewayPhoneRE = regexp.MustCompile(`^[0-9]{3,15}$`)
+	shortCodeRE    = regexp.MustCompile(`^[0-9]{3,8}$`)
+	digitsRE       = regexp.MustCompile(`^[0-9]+$`)
+	groupNameRE    = regexp.MustCompile(`^[\w.-]+$`) // as written after @ in the chat
+	// senderTypes lists the kinds of the From numbers that can be configured.
+	senderTypes = []string{string(phone.International), string(phone.ShortCode), string(phone.Alphanumeric)}
+)
+
+// Validate checks the configuration and returns all errors found with the
+// paths of the invalid values.
+func (c *Config) Validate() error {
+	var errs conf.Errors
+	carriers := make(map[string]string) // APIs of the configured carriers by name
+	if c.SMSGate != nil {
+		for _, carrier := range c.SMSGate.Carriers {
+			carriers[carrier.Name] = carrier.API
+		}
+	}
+	if len(c.MX) == 0 {
+		errs.Addf("mx", "no MX servers configured")
+	}
+	owners := make(map[string]string) // MX server names by phone number
+	for _, name := range sortedKeys(c.MX) {
+		path := "mx." + name
+		if c.MX[name] == nil {
+			errs.Addf(path, "empty server settings")
+			continue
+		}
+		c.MX[name].validate(&errs, path, carriers)
+		for phone := range c.MX[name].From {
+			if owner, ok := owners[phone]; ok {
+				errs.Addf(path+".phones.from."+phone, "number already used by mx.%s", owner)
+			}
+			owners[phone] = name
+		}
+	}
+	if c.SMSGate == nil {
+		errs.Addf("smsgate", "required")
+	} else {
+		c.SMSGate.validate(&errs, "smsgate")
+	}
+	return errs.Err()
+}
+
+// validate checks the MX server settings.
+func (mx *MX) validate(errs *conf.Errors, path string, carriers map[string]string) {
+	if mx.Addr.Host == "" {
+		errs.Addf(path+".server.host", "required")
+	}
+	if mx.Addr.Port <= 0 || mx.Addr.Port > 65535 {
+		errs.Addf(path+".server.port", "invalid port %d", mx.Addr.Port)
+	}
+	checkDuration(errs, path+".server.timeout", mx.Addr.Timeout)
+	checkDuration(errs, path+".server.reconnectDelay", mx.Addr.ReconnectDelay)
+	if mx.Addr.MaxError < 0 {
+		errs.Addf(path+".server.maxError", "negative")
+	}
+	if mx.Login.User == "" {
+		errs.Addf(path+".login.user", "required")
+	}
+	path += ".phones"
+	if mx.Prefix != "" && !digitsRE.MatchString(mx.Prefix) {
+		errs.Addf(path+".defaultPrefix", "not a number: %q", mx.Prefix)
+	}
+	if len(mx.From) == 0 {
+		errs.Addf(path+".from", "no phone numbers")
+	}
+	if mx.Region != "" && phone.Lookup(mx.Region) == nil {
+		errs.Addf(path+".region", "unknown region %q: ISO 3166-1 alpha-2 code expected", mx.Region)
+	}
+	for _, number := range sortedKeys(mx.Types) {
+		if kind := mx.Types[number]; !includes(senderTypes, string(kind)) {
+			errs.Addf(path+".types."+number, "unknown type %q: one of %s expected", kind, strings.Join(senderTypes, ", "))
+		}
+		if _, ok := mx.From[number]; !ok {
+			errs.Addf(path+".types."+number, "not one of the phone numbers")
+		}
+	}
+	for _, number := range sortedKeys(mx.From) {
+		kind := mx.Types[number]
+		if !includes(senderTypes, string(kind)) { // unknown types are reported above
+			kind = phone.Classify(number)
+		}
+		switch kind {
+		case phone.International:
+			if !gatewayPhoneRE.MatchString(number) {
+				errs.Addf(path+".from."+number, "invalid phone number: 3 to 15 digits without the plus expected")
+			} else if n, err := phone.Parse("+"+number, ""); err != nil || n.OutOfPlan() {
+				errs.Addf(path+".from."+number, "invalid international number")
+			}
+		case phone.ShortCode:
+			if !shortCodeRE.MatchString(number) {
+				errs.Addf(path+".from."+number, "invalid short code: 3 to 8 digits expected")
+			}
+		case phone.Alphanumeric:
+			if !phone.IsAlphanumeric(number) {
+				errs.Addf(path+".from."+number, "invalid sender ID: up to 11 letters, digits and spaces expected")
+			}
+		default:
+			errs.Addf(path+".from."+number, "invalid phone number: 3 to 15 digits without the plus expected")
+			continue
+		}
+		carrier := mx.From[number]
+		api, ok := carriers[carrier]
+		switch {
+		case carrier != "" && !ok:
+			errs.Addf(path+".from."+number, "unknown carrier %q", carrier)
+		case !sms.AcceptsSender(api, kind):
+			errs.Addf(path+".from."+number, "%s sender not accepted by the carrier %q", kind, carrier)
+		}
+	}
+	pool := mx.Pool
+	switch pool.Policy {
+	case "", PolicyLeastRecent, PolicyRoundRobin, PolicyHash, PolicyDedicated:
+	default:
+		errs.Addf(path+".pool.policy", "unknown policy %q", pool.Policy)
+	}
+	if pool.Sticky < 0 {
+		errs.Addf(path+".pool.sticky", "negative duration")
+	}
+	if pool.DailyCap < 0 {
+		errs.Addf(path+".pool.dailyCap", "negative")
+	}
+	for _, phone := range sortedKeys(pool.Caps) {
+		if _, ok := mx.From[phone]; !ok {
+			errs.Addf(path+".pool.caps."+phone, "not one of the phone numbers")
+		}
+	}
+	for _, jid := range sortedKeys(pool.Dedicated) {
+		if _, ok := mx.From[pool.Dedicated[jid]]; !ok {
+			errs.Addf(path+".pool.dedicated."+jid, "%q is not one of the phone numbers", pool.Dedicated[jid])
+		}
+	}
+	for _, name := range sortedKeys(mx.Groups) {
+		groupPath := path + ".groups." + name
+		if !groupNameRE.MatchString(name) {
+			errs.Addf(groupPath, "invalid group name: letters, digits, dots, dashes and underscores expected")
+		}
+		if len(mx.Groups[name]) == 0 {
+			errs.Addf(groupPath, "no phone numbers")
+		}
+		for i, number := range mx.Groups[name] {
+			if _, err := mx.parse(number); err != nil {
+				errs.Addf(fmt.Sprintf("%s[%d]", groupPath, i), "invalid phone number %q", number)
+			}
+		}
+	}
+}
+
+// validate checks the gateway settings.
+func (s *SMSGate) validate(errs *conf.Errors, path string) {
+	if smpp := s.SMPP; smpp == nil {
+		errs.Addf(path+".smpp", "required")
+	} else {
+		if len(smpp.Address) == 0 {
+			errs.Addf(path+".smpp.address", "required")
+		}
+		for i, addr := range smpp.Address {
+			checkAddress(errs, fmt.Sprintf("%s.smpp.address[%d]", path, i), addr, false)
+		}
+		if smpp.SystemID == "" {
+			errs.Addf(path+".smpp.systemId", "required")
+		}
+		checkPositive(errs, path+".smpp.enquireDuration", smpp.EnquireDuration)
+		checkPositive(errs, path+".smpp.reconnectDelay", smpp.ReconnectDelay)
+		if smpp.MaxError < 0 {
+			errs.Addf(path+".smpp.maxError", "negative")
+		}
+		for _, addr := range sortedKeys(smpp.Names) {
+			if !includes(smpp.Address, addr) {
+				errs.Addf(path+".smpp.names."+addr, "not one of the addresses")
+			}
+		}
+	}
+	if server := s.Server; server != nil {
+		checkAddress(errs, path+".smppServer.address", server.Address, true)
+		if server.Accounts == "" && server.AccountsDSN == "" {
+			errs.Addf(path+".smppServer.accounts", "required: the accounts file or accountsDSN")
+		} else if server.Accounts != "" && server.AccountsDSN != "" {
+			errs.Addf(path+".smppServer.accountsDSN", "the accounts file is set too: one of them expected")
+		}
+		checkPositive(errs, path+".smppServer.bindTimeout", server.BindTimeout)
+		checkPositive(errs, path+".smppServer.retryDelay", server.RetryDelay)
+		checkPositive(errs, path+".smppServer.queueTTL", server.QueueTTL)
+	}
+	if web := s.Web; web != nil {
+		checkAddress(errs, path+".web.address", web.Address, true)
+		if len(web.APIKeys) == 0 {
+			errs.Addf(path+".web.apiKeys", "no API keys")
+		}
+		clients := make(map[string]bool, len(web.APIKeys))
+		for _, client := range web.APIKeys {
+			if client == "" {
+				client = "api"
+			}
+			clients[client] = true
+		}
+		for i, admin := range web.Admins {
+			if !clients[admin] {
+				errs.Addf(fmt.Sprintf("%s.web.admins[%d]", path, i), "unknown client %q", admin)
+			}
+		}
+	}
+	if webhooks := s.Webhooks; webhooks != nil {
+		for i, hook := range webhooks.Hooks {
+			hookPath := fmt.Sprintf("%s.webhooks.hooks[%d]", path, i)
+			checkURL(errs, hookPath+".url", hook.URL)
+			for j, event := range hook.Events {
+				switch event {
+				case sms.EventReceived, sms.EventStatus, sms.EventLinkUp, sms.EventLinkDown, sms.EventAlert:
+				default:
+					errs.Addf(fmt.Sprintf("%s.events[%d]", hookPath, j), "unknown event %q", event)
+				}
+			}
+		}
+		checkPositive(errs, path+".webhooks.retryDelay", webhooks.RetryDelay)
+	}
+	if media := s.Media; media != nil {
+		if media.Dir == "" {
+			errs.Addf(path+".media.dir", "required")
+		}
+		checkURL(errs, path+".media.baseUrl", media.BaseURL)
+	}
+	names := make(map[string]bool, len(s.Carriers))
+	for i, carrier := range s.Carriers {
+		carrierPath := fmt.Sprintf("%s.carriers[%d]", path, i)
+		if carrier.Name == "" {
+			errs.Addf(carrierPath+".name", "required")
+		} else if names[carrier.Name] {
+			errs.Addf(carrierPath+".name", "duplicate carrier %q", carrier.Name)
+		}
+		names[carrier.Name] = true
+		if carrier.API != "" {
+			if _, err := sms.NewHTTPCarrier(carrier.Name, carrier.API, carrier.Username, carrier.Password, carrier.Endpoint); err != nil {
+				errs.Add(carrierPath+".api", err)
+			}
+		}
+		// callbacks without the signature key are rejected
+		switch strings.ToLower(carrier.API) {
+		case sms.APITwilio:
+			if carrier.Password == "" {
+				errs.Addf(carrierPath+".password", "required: the auth token checks the callback signatures")
+			}
+		case sms.APITelnyx, sms.APIBandwidth:
+			if carrier.Secret == "" {
+				errs.Addf(carrierPath+".secret", "required: the callbacks are checked with it")
+			}
+		}
+	}
+	for _, t := range []struct {
+		name string
+		tmpl string
+		args int // values passed to the template
+	}{
+		{"noPhone", s.Responses.NoPhone, 0},
+		{"incorrect", s.Responses.Incorrect, 1}, // phone number
+		{"accepted", s.Responses.Accepted, 1},   // phone number
+		{"delivered", s.Responses.Delivered, 1}, // phone number
+		{"error", s.Responses.Error, 1},         // error text
+		{"incoming", s.Responses.Incoming, 2},   // sender phone number and text
+		{"group", s.Responses.Group, 3},         // sent and all recipients and the results
+	} {
+		if t.tmpl != "" { // not sent if empty
+			errs.Add(path+".messageTemplates."+t.name, checkTemplate(t.tmpl, t.args))
+		}
+	}
+	if z := s.Zabbix; z != nil {
+		if z.Server == "" {
+			errs.Addf(path+".zabbix.server", "required")
+		}
+		if z.Host == "" {
+			errs.Addf(path+".zabbix.host", "required")
+		}
+	}
+	if s.Metrics != nil {
+		checkAddress(errs, path+".metrics.address", s.Metrics.Address, true)
+	}
+	if h := s.Health; h != nil {
+		if h.Address != "" {
+			checkAddress(errs, path+".health.address", h.Address, true)
+		}
+		if !health.ValidPolicy(h.Ready.SMPP) {
+			errs.Addf(path+".health.ready.smpp", "unknown policy %q: use any, all or none", h.Ready.SMPP)
+		}
+		if !health.ValidPolicy(h.Ready.MX) {
+			errs.Addf(path+".health.ready.mx", "unknown policy %q: use any, all or none", h.Ready.MX)
+		}
+	}
+	if h := s.History; h != nil {
+		switch h.Store {
+		case "", "memory", "sql":
+		case "file":
+			if h.File == "" {
+				errs.Addf(path+".history.file", "required for the file store")
+			}
+		default:
+			errs.Addf(path+".history.store", "unknown store %q: use memory, file or sql", h.Store)
+		}
+		checkPositive(errs, path+".history.ttl", h.TTL)
+	}
+	if r := s.Reconnect; r != nil {
+		checkPositive(errs, path+".reconnect.maxDelay", r.MaxDelay)
+		checkPositive(errs, path+".reconnect.openDelay", r.OpenDelay)
+	}
+}
+
+// checkAddress checks the host and port. The host may be omitted for the
+// addresses to listen on.
+func checkAddress(errs *conf.Errors, path, addr string, listen bool) {
+	if addr == "" {
+		errs.Addf(path, "required")
+		return
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.Addf(path, "invalid address %q: host:port expected", addr)
+		return
+	}
+	if host == "" && !listen {
+		errs.Addf(path, "no host in %q", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 || (n == 0 && !listen) {
+		errs.Addf(path, "invalid port in %q", addr)
+	}
+}
+
+// checkURL checks the HTTP URL.
+func checkURL(errs *conf.Errors, path, value string) {
+	if value == "" {
+		errs.Addf(path, "required")
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.Addf(path, "invalid URL %q: http or https expected", value)
+	}
+}
+
+// checkDuration checks the duration written as a string.
+func checkDuration(errs *conf.Errors, path, value string) {
+	if value == "" {
+		return
+	}
+	if d, err := time.ParseDuration(value); err != nil {
+		errs.Add(path, err)
+	} else if d < 0 {
+		errs.Addf(path, "negative duration")
+	}
+}
+
+// checkPositive checks that the duration isn't negative.
+func checkPositive(errs *conf.Errors, path string, d conf.Duration) {
+	if d < 0 {
+		errs.Addf(path, "negative duration")
+	}
+}
+
+// checkTemplate checks that the message template uses the number of values
+// passed to it, as strings.
+func checkTemplate(tmpl string, args int) error {
+	used := make([]bool, args)
+	next := 0 // next argument
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(tmpl) && (tmpl[i] == '+' || tmpl[i] == '-' || tmpl[i] == '#' || tmpl[i] == ' ' || tmpl[i] == '0') {
+			i++ // flags
+		}
+		for i < len(tmpl) && (tmpl[i] >= '0' && tmpl[i] <= '9' || tmpl[i] == '.') {
+			i++ // width and precision
+		}
+		if i < len(tmpl) && tmpl[i] == '[' { // explicit argument index
+			end := strings.IndexByte(tmpl[i:], ']')
+			if end < 0 {
+				return errors.New("unclosed argument index")
+			}
+			n, err := strconv.Atoi(tmpl[i+1 : i+end])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid argument index %q", tmpl[i:i+end+1])
+			}
+			next, i = n-1, i+end+1
+		}
+		if i == len(tmpl) {
+			return errors.New("template ends with %")
+		}
+		switch verb := tmpl[i]; verb {
+		case '%':
+			continue
+		case 's', 'q', 'v':
+		default:
+			return fmt.Errorf("unsupported verb %%%c: use %%s, %%q or %%v", verb)
+		}
+		if next >= args {
+			return fmt.Errorf("too many verbs: %d values are passed", args)
+		}
+		used[next] = true
+		next++
+	}
+	for i, ok := range used {
+		if !ok {
+			return fmt.Errorf("value %d is not used: %d values are passed", i+1, args)
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the map in order, so the errors are reported
+// in the same order every time.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// includes reports whether the list contains the value.
+func includes(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
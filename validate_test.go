@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"mxsms/conf"
+)
+
+func TestConfigValidate(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+mx:
+  main:
+    server:
+      host: mx.example.com
+      port: 7778
+      reconnectDelay: 30
+    login:
+      user: smsgate
+    phones:
+      region: XX
+      from:
+        "14085551234": twilio
+        "+14085551235": ""
+        "10005551234": ""
+        "ACME": bw
+        "12345678": ""
+      types:
+        "12345678": shortCode
+        "14085551234": landline
+      pool:
+        policy: newest
+      groups:
+        sales: ["+14085551234", "0"]
+        "all staff": []
+smsgate:
+  carriers:
+    - name: bw
+      api: bandwidth
+  smpp:
+    address: [smpp.example.com, "10.0.0.1:2775"]
+    systemId: gw
+  web:
+    address: ":8080"
+    apiKeys: {key1: crm}
+    admins: [ops]
+  messageTemplates:
+    incorrect: "Invalid phone number: %d"
+    accepted: "SMS sent"
+    incoming: "%[2]s from %[1]q"
+  health:
+    ready:
+      smpp: most
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Validate()
+	var errs conf.Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, want := range []string{
+		`mx.main.server.reconnectDelay: time: missing unit in duration "30"`,
+		`mx.main.phones.region: unknown region "XX"`,
+		`mx.main.phones.from.+14085551235: invalid phone number`,
+		`mx.main.phones.from.10005551234: invalid international number`,
+		`mx.main.phones.types.14085551234: unknown type "landline"`,
+		`mx.main.phones.from.ACME: alphanumeric sender not accepted by the carrier "bw"`,
+		`mx.main.phones.from.14085551234: unknown carrier "twilio"`,
+		`mx.main.phones.pool.policy: unknown policy "newest"`,
+		`mx.main.phones.groups.sales[1]: invalid phone number "0"`,
+		`mx.main.phones.groups.all staff: invalid group name`,
+		`mx.main.phones.groups.all staff: no phone numbers`,
+		`smsgate.carriers[0].secret: required`,
+		`smsgate.smpp.address[0]: invalid address "smpp.example.com"`,
+		`smsgate.web.admins[0]: unknown client "ops"`,
+		`smsgate.messageTemplates.incorrect: unsupported verb %d`,
+		`smsgate.messageTemplates.accepted: value 1 is not used`,
+		`smsgate.health.ready.smpp: unknown policy "most"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if len(errs) != 17 {
+		t.Errorf("%d errors:\n%v", len(errs), err)
+	}
+	if err := (&Config{}).Validate(); err == nil || !strings.Contains(err.Error(), "smsgate: required") {
+		t.Errorf("empty config: %v", err)
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	for _, test := range []struct {
+		tmpl string
+		args int
+		ok   bool
+	}{
+		{"SMS from %q\n%s", 2, true},
+		{"%[2]s: %[1]s", 2, true},
+		{"100%% sent to %v", 1, true},
+		{"sent to %-20s", 1, true},
+		{"no phone", 0, true},
+		{"sent to %s", 0, false},
+		{"%s %s", 1, false},
+		{"error %", 1, false},
+		{"%[3]s", 2, false},
+		{"%[x]s", 1, false},
+	} {
+		if err := checkTemplate(test.tmpl, test.args); (err == nil) != test.ok {
+			t.Errorf("%q: %v", test.tmpl, err)
+		}
+	}
+}
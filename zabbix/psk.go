@@ -0,0 +1,237 @@
+//go:build cgo
+
+package zabbix
+
+/*
+#cgo LDFLAGS: -lssl -lcrypto
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/err.h>
+#include <openssl/ssl.h>
+
+// psk is the identity and the key of the connection, kept as the SSL app data.
+typedef struct {
+	char *identity;
+	unsigned char *key;
+	unsigned int len;
+} psk;
+
+static unsigned int psk_client(SSL *ssl, const char *hint, char *identity,
+		unsigned int max_identity, unsigned char *key, unsigned int max_key) {
+	psk *p = SSL_get_app_data(ssl);
+	if (p == NULL || strlen(p->identity) >= max_identity || p->len > max_key) {
+		return 0;
+	}
+	strcpy(identity, p->identity);
+	memcpy(key, p->key, p->len);
+	return p->len;
+}
+
+static unsigned int psk_server(SSL *ssl, const char *identity, unsigned char *key,
+		unsigned int max_key) {
+	psk *p = SSL_get_app_data(ssl);
+	if (p == NULL || identity == NULL || strcmp(identity, p->identity) != 0 || p->len > max_key) {
+		return 0;
+	}
+	memcpy(key, p->key, p->len);
+	return p->len;
+}
+
+// psk_new returns the TLS 1.2+ PSK connection reading and writing memory BIOs.
+static SSL *psk_new(int server, psk *p) {
+	SSL_CTX *ctx = SSL_CTX_new(server ? TLS_server_method() : TLS_client_method());
+	if (ctx == NULL) {
+		return NULL;
+	}
+	SSL_CTX_set_min_proto_version(ctx, TLS1_2_VERSION);
+	SSL_CTX_set_cipher_list(ctx, "PSK");
+	if (server) {
+		SSL_CTX_set_psk_server_callback(ctx, psk_server);
+	} else {
+		SSL_CTX_set_psk_client_callback(ctx, psk_client);
+	}
+	SSL *ssl = SSL_new(ctx);
+	SSL_CTX_free(ctx); // kept by the connection
+	if (ssl == NULL) {
+		return NULL;
+	}
+	SSL_set_app_data(ssl, p);
+	SSL_set_bio(ssl, BIO_new(BIO_s_mem()), BIO_new(BIO_s_mem()));
+	if (server) {
+		SSL_set_accept_state(ssl);
+	} else {
+		SSL_set_connect_state(ssl);
+	}
+	return ssl;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unsafe"
+)
+
+// pskConn is the TLS-PSK connection to the Zabbix server, the one Zabbix
+// configures with TLSConnect=psk. The TLS is done by OpenSSL over memory
+// buffers; the records are read from and written to the network connection.
+type pskConn struct {
+	net.Conn
+	ssl  *C.SSL
+	psk  *C.psk
+	buf  []byte // records read from the network
+	once sync.Once
+}
+
+// dialPSK runs the client handshake with the identity and the key on the
+// connection.
+func dialPSK(conn net.Conn, identity string, psk []byte) (net.Conn, error) {
+	return newPSKConn(conn, identity, psk, false)
+}
+
+// newPSKConn runs the client or the server handshake on the connection. The
+// connection is closed if the handshake fails.
+func newPSKConn(conn net.Conn, identity string, psk []byte, server bool) (*pskConn, error) {
+	if len(psk) == 0 {
+		conn.Close()
+		return nil, errors.New("empty PSK")
+	}
+	p := (*C.psk)(C.calloc(1, C.sizeof_psk))
+	p.identity = C.CString(identity)
+	p.key = (*C.uchar)(C.CBytes(psk))
+	p.len = C.uint(len(psk))
+	c := &pskConn{Conn: conn, psk: p, buf: make([]byte, 16*1024)}
+	var mode C.int
+	if server {
+		mode = 1
+	}
+	if c.ssl = C.psk_new(mode, p); c.ssl == nil {
+		c.Close()
+		return nil, sslError("TLS-PSK setup")
+	}
+	if err := c.handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake runs the handshake until it's complete.
+func (c *pskConn) handshake() error {
+	for {
+		r := C.SSL_do_handshake(c.ssl)
+		if err := c.flush(); err != nil {
+			return err
+		}
+		if r == 1 {
+			return nil
+		}
+		if C.SSL_get_error(c.ssl, r) != C.SSL_ERROR_WANT_READ {
+			return sslError("TLS-PSK handshake")
+		}
+		if err := c.fill(); err != nil {
+			if err == io.EOF {
+				err = errors.New("TLS-PSK handshake: connection closed by the peer")
+			}
+			return err
+		}
+	}
+}
+
+// Read returns the decrypted data. It returns io.EOF when the peer closes the
+// connection.
+func (c *pskConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		n := C.SSL_read(c.ssl, unsafe.Pointer(&p[0]), C.int(len(p)))
+		if n > 0 {
+			return int(n), nil
+		}
+		switch C.SSL_get_error(c.ssl, n) {
+		case C.SSL_ERROR_WANT_READ:
+			if err := c.flush(); err != nil {
+				return 0, err
+			}
+			if err := c.fill(); err != nil {
+				return 0, err
+			}
+		case C.SSL_ERROR_ZERO_RETURN:
+			return 0, io.EOF
+		default:
+			return 0, sslError("TLS-PSK read")
+		}
+	}
+}
+
+// Write encrypts the data and writes the records to the network.
+func (c *pskConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if C.SSL_write(c.ssl, unsafe.Pointer(&p[0]), C.int(len(p))) <= 0 {
+		return 0, sslError("TLS-PSK write")
+	}
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends the close notification and closes the connection.
+func (c *pskConn) Close() error {
+	c.once.Do(func() {
+		if c.ssl != nil {
+			C.SSL_shutdown(c.ssl)
+			c.flush()
+			C.SSL_free(c.ssl)
+		}
+		C.free(unsafe.Pointer(c.psk.identity))
+		C.free(unsafe.Pointer(c.psk.key))
+		C.free(unsafe.Pointer(c.psk))
+	})
+	return c.Conn.Close()
+}
+
+// flush writes the records OpenSSL produced to the network.
+func (c *pskConn) flush() error {
+	out := C.SSL_get_wbio(c.ssl)
+	for C.BIO_ctrl_pending(out) > 0 {
+		n := C.BIO_read(out, unsafe.Pointer(&c.buf[0]), C.int(len(c.buf)))
+		if n <= 0 {
+			break
+		}
+		if _, err := c.Conn.Write(c.buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill passes the records read from the network to OpenSSL.
+func (c *pskConn) fill() error {
+	n, err := c.Conn.Read(c.buf)
+	if n > 0 {
+		C.BIO_write(C.SSL_get_rbio(c.ssl), unsafe.Pointer(&c.buf[0]), C.int(n))
+		return nil
+	}
+	return err
+}
+
+// sslError returns the OpenSSL error queued for the operation and clears the
+// queue.
+func sslError(op string) error {
+	code := C.ERR_get_error()
+	C.ERR_clear_error()
+	if code == 0 {
+		return errors.New(op + " failed")
+	}
+	var buf [256]C.char
+	C.ERR_error_string_n(code, &buf[0], C.size_t(len(buf)))
+	return fmt.Errorf("%s: %s", op, C.GoString(&buf[0]))
+}
@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package zabbix
+
+import (
+	"errors"
+	"net"
+)
+
+// errNoPSK is returned for TLS-PSK connections by the builds without OpenSSL.
+var errNoPSK = errors.New("TLS-PSK requires the build with cgo and OpenSSL")
+
+// dialPSK fails: TLS-PSK is done by OpenSSL, which needs cgo.
+func dialPSK(conn net.Conn, identity string, psk []byte) (net.Conn, error) {
+	conn.Close()
+	return nil, errNoPSK
+}
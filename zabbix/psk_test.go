@@ -0,0 +1,39 @@
+//go:build cgo
+
+package zabbix
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogPSK(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	tr := newTrapper(t, func(conn net.Conn) (net.Conn, error) {
+		return newPSKConn(conn, "gw1", psk, true)
+	})
+	name := filepath.Join(t.TempDir(), "zabbix.psk")
+	if err := os.WriteFile(name, []byte("30313233343536373839616263646566\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	z := &Log{Server: tr.Addr().String(), Host: "gw", PSKIdentity: "gw1", PSKFile: name}
+	z.Send("gw.sms.sent", "1")
+	z.Close()
+	if req := tr.request(t); len(req.Data) != 1 || req.Data[0].Key != "gw.sms.sent" {
+		t.Errorf("unexpected request %+v", req)
+	}
+	// an invalid key or identity fails the handshake
+	z = &Log{Server: tr.Addr().String(), PSKIdentity: "gw1", psk: []byte("fedcba9876543210")}
+	if _, err := z.send([]Item{{Key: "key"}}); err == nil {
+		t.Error("invalid PSK accepted")
+	}
+	z = &Log{Server: tr.Addr().String(), PSKIdentity: "gw2", psk: psk}
+	if _, err := z.send([]Item{{Key: "key"}}); err == nil {
+		t.Error("unknown identity accepted")
+	}
+	if _, err := readPSK(name + ".missing"); err == nil {
+		t.Error("missing PSK file accepted")
+	}
+}
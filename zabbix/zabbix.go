@@ -1,16 +1,338 @@
+// Package zabbix sends the gateway metrics to the Zabbix server or proxy with
+// the sender protocol, as zabbix_sender does. Values are queued and sent in
+// batches by a background goroutine, so sending never blocks the caller.
 package zabbix
 
-import "os/exec"
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPort = "10051"          // Zabbix trapper port
+	queueSize   = 1000             // values waiting for sending
+	batchSize   = 250              // values sent in one request
+	batchDelay  = time.Second      // how long values wait for the batch to fill
+	timeout     = time.Second * 10 // connection and exchange timeout
+	maxResponse = 1 << 20          // maximum size of the server response
+
+	defaultLinkFormat = "%s.sms.link" // key of the link state items
+)
+
+// resendInterval is the interval of repeating the values of Set, so the
+// nodata() triggers of the items stay quiet while the state doesn't change.
+var resendInterval = time.Minute
+
+// header starts the sender protocol packets.
+var header = []byte("ZBXD\x01")
+
+// Item is a value of the trapper item.
+type Item struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+}
+
+// Log sends the values to the Zabbix trapper items of the host. A nil Log
+// discards the values.
 type Log struct {
-	Server string
-	Host   string // имя сервера
+	Server      string        `yaml:"server" json:"server"`                               // server or proxy address, port 10051 by default
+	Host        string        `yaml:"host" json:"host"`                                   // host name in Zabbix
+	PSKIdentity string        `yaml:"pskIdentity,omitempty" json:"pskIdentity,omitempty"` // TLS-PSK identity, TLS is not used if empty
+	PSKFile     string        `yaml:"pskFile,omitempty" json:"pskFile,omitempty"`         // file with the hex-encoded pre-shared key
+	LinkFormat  string        `yaml:"linkKey,omitempty" json:"linkKey,omitempty"`         // key of the link state items, %s is the link name
+	Logger      *logrus.Entry `yaml:"-" json:"-"`                                         // log output
+
+	queue  chan op
+	done   chan struct{}
+	psk    []byte
+	closed bool
+	mu     sync.Mutex
+}
+
+// op describes a queued value. Ops with the flushed channel only signal that
+// the values queued before them are sent.
+type op struct {
+	item    Item
+	repeat  bool // the value is repeated periodically
+	flushed chan struct{}
+}
+
+// LinkKey returns the key of the link state item: LinkFormat with the link
+// name, "%s.sms.link" by default.
+func (z *Log) LinkKey(link string) string {
+	format := defaultLinkFormat
+	if z != nil && z.LinkFormat != "" {
+		format = z.LinkFormat
+	}
+	return fmt.Sprintf(format, link)
+}
+
+// Send queues the value of the item. The values are dropped if the server
+// can't keep up.
+func (z *Log) Send(key, value string) {
+	if z == nil {
+		return
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.enqueue(key, value, false)
+}
+
+// Set queues the value of the item and repeats it every minute until it's
+// changed or the Log is closed. It's used for states, such as the link state.
+func (z *Log) Set(key, value string) {
+	if z == nil {
+		return
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.enqueue(key, value, true)
+}
+
+// Flush waits until the queued values are sent.
+func (z *Log) Flush() {
+	if z == nil {
+		return
+	}
+	z.mu.Lock()
+	if !z.start() {
+		z.mu.Unlock()
+		return
+	}
+	flushed := make(chan struct{})
+	z.queue <- op{flushed: flushed}
+	z.mu.Unlock()
+	<-flushed
+}
+
+// Close sends the queued values and stops sending. Later values are discarded.
+func (z *Log) Close() {
+	if z == nil {
+		return
+	}
+	z.mu.Lock()
+	if z.closed || z.queue == nil {
+		z.closed = true
+		z.mu.Unlock()
+		return
+	}
+	z.closed = true
+	close(z.queue)
+	z.mu.Unlock()
+	<-z.done
+}
+
+// enqueue queues the value without blocking. It's called with the mutex locked.
+func (z *Log) enqueue(key, value string, repeat bool) {
+	if !z.start() {
+		return
+	}
+	item := Item{Host: z.Host, Key: key, Value: value, Clock: time.Now().Unix()}
+	select {
+	case z.queue <- op{item: item, repeat: repeat}:
+	default:
+		z.Logger.WithField("key", key).Warning("Zabbix queue is full: value dropped")
+	}
+}
+
+// start starts sending on the first use and reports whether the Log is open.
+// It's called with the mutex locked.
+func (z *Log) start() bool {
+	if z.closed {
+		return false
+	}
+	if z.queue != nil {
+		return true
+	}
+	if z.Logger == nil {
+		z.Logger = logrus.NewEntry(logrus.StandardLogger())
+	}
+	z.Logger = z.Logger.WithField("zabbix", z.Server)
+	if z.PSKFile != "" {
+		psk, err := readPSK(z.PSKFile)
+		if err != nil { // values are rejected by the server without TLS anyway
+			z.Logger.WithError(err).Error("Zabbix PSK error")
+		}
+		z.psk = psk
+	}
+	z.queue = make(chan op, queueSize)
+	z.done = make(chan struct{})
+	go z.sending()
+	return true
+}
+
+// sending sends the queued values in batches until the queue is closed.
+func (z *Log) sending() {
+	defer close(z.done)
+	timer := time.NewTimer(batchDelay)
+	defer timer.Stop()
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+	var batch []Item
+	values := make(map[string]string) // values repeated periodically
+	for {
+		select {
+		case o, ok := <-z.queue:
+			if !ok {
+				z.sendBatch(batch)
+				return
+			}
+			if o.flushed != nil {
+				z.sendBatch(batch)
+				batch = batch[:0]
+				close(o.flushed)
+				continue
+			}
+			if o.repeat {
+				values[o.item.Key] = o.item.Value
+			}
+			batch = append(batch, o.item)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			now := time.Now().Unix()
+			for key, value := range values {
+				batch = append(batch, Item{Host: z.Host, Key: key, Value: value, Clock: now})
+			}
+		case <-timer.C:
+			timer.Reset(batchDelay)
+		}
+		z.sendBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+// sendBatch sends the values and logs the errors. The values are not resent:
+// the next values of the items replace them.
+func (z *Log) sendBatch(batch []Item) {
+	if len(batch) == 0 {
+		return
+	}
+	info, err := z.send(batch)
+	if err != nil {
+		z.Logger.WithError(err).WithField("values", len(batch)).Error("Zabbix send error")
+		return
+	}
+	var processed, failed, total int
+	if _, err := fmt.Sscanf(info, "processed: %d; failed: %d; total: %d", &processed, &failed, &total); err == nil &&
+		failed > 0 { // unknown host or keys, or the items are not trappers
+		z.Logger.WithField("info", info).Warning("Zabbix values rejected")
+	}
+}
+
+// response is the reply of the server to the sender data.
+type response struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// send sends the values in one request and returns the processing info
+// of the server: "processed: 2; failed: 0; total: 2; seconds spent: 0.000040".
+func (z *Log) send(items []Item) (string, error) {
+	conn, err := z.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	data, err := json.Marshal(struct {
+		Request string `json:"request"`
+		Data    []Item `json:"data"`
+		Clock   int64  `json:"clock"`
+	}{"sender data", items, time.Now().Unix()})
+	if err != nil {
+		return "", err
+	}
+	if _, err = conn.Write(packet(data)); err != nil {
+		return "", err
+	}
+	if data, err = readPacket(conn); err != nil {
+		return "", err
+	}
+	var resp response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", err
+	}
+	if resp.Response != "success" {
+		return "", fmt.Errorf("zabbix response %q: %s", resp.Response, resp.Info)
+	}
+	return resp.Info, nil
+}
+
+// dial connects to the server, with TLS-PSK if the identity is set. TLS-PSK is
+// done by OpenSSL, so it needs the build with cgo.
+func (z *Log) dial() (net.Conn, error) {
+	addr := z.Server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil || z.PSKIdentity == "" {
+		return conn, err
+	}
+	if len(z.psk) == 0 {
+		conn.Close()
+		return nil, errors.New("zabbix PSK is not set")
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	return dialPSK(conn, z.PSKIdentity, z.psk)
+}
+
+// readPSK reads the hex-encoded key of at least 128 bits, as Zabbix requires.
+func readPSK(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	psk, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PSK: %w", err)
+	}
+	if len(psk) < 16 {
+		return nil, errors.New("PSK is shorter than 128 bits")
+	}
+	return psk, nil
+}
+
+// packet returns the data with the protocol header and length.
+func packet(data []byte) []byte {
+	p := make([]byte, len(header)+8, len(header)+8+len(data))
+	copy(p, header)
+	binary.LittleEndian.PutUint64(p[len(header):], uint64(len(data)))
+	return append(p, data...)
 }
 
-func (z Log) Send(key, value string) error {
-	return exec.Command("zabbix_sender",
-		"-z", z.Server,
-		"-s", z.Host,
-		"-k", key,
-		"-o", value).Run()
+// readPacket reads the data of the packet.
+func readPacket(r io.Reader) ([]byte, error) {
+	head := make([]byte, len(header)+8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:len(header)], header) {
+		return nil, fmt.Errorf("invalid zabbix header %q", head[:len(header)])
+	}
+	size := binary.LittleEndian.Uint64(head[len(header):])
+	if size > maxResponse {
+		return nil, fmt.Errorf("zabbix packet too large: %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
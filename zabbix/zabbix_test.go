@@ -0,0 +1,131 @@
+package zabbix
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// request is the sender data received by the trapper.
+type request struct {
+	Request string `json:"request"`
+	Data    []Item `json:"data"`
+}
+
+// trapper is a fake Zabbix trapper. It replies with the failed values of the
+// unknown keys and passes the requests to the channel.
+type trapper struct {
+	net.Listener
+	requests chan request
+	wrap     func(net.Conn) (net.Conn, error) // handshake of the connections if set
+}
+
+func newTrapper(t *testing.T, wrap func(net.Conn) (net.Conn, error)) *trapper {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &trapper{Listener: ln, requests: make(chan request, 10), wrap: wrap}
+	t.Cleanup(func() { ln.Close() })
+	go tr.serve(t)
+	return tr
+}
+
+func (tr *trapper) serve(t *testing.T) {
+	for {
+		conn, err := tr.Accept()
+		if err != nil {
+			return
+		}
+		if tr.wrap != nil {
+			if conn, err = tr.wrap(conn); err != nil {
+				t.Log("handshake:", err)
+				continue
+			}
+		}
+		data, err := readPacket(conn)
+		if err != nil {
+			t.Log("read:", err)
+			conn.Close()
+			continue
+		}
+		var req request
+		json.Unmarshal(data, &req)
+		failed := 0
+		for _, item := range req.Data {
+			if item.Key == "unknown" {
+				failed++
+			}
+		}
+		info := "processed: 0; failed: 0; total: 0; seconds spent: 0.000040"
+		if failed > 0 {
+			info = "processed: 0; failed: 1; total: 1; seconds spent: 0.000040"
+		}
+		resp, _ := json.Marshal(response{Response: "success", Info: info})
+		conn.Write(packet(resp))
+		conn.Close()
+		tr.requests <- req
+	}
+}
+
+func (tr *trapper) request(t *testing.T) request {
+	t.Helper()
+	select {
+	case req := <-tr.requests:
+		return req
+	case <-time.After(time.Second * 5):
+		t.Fatal("no request")
+		return request{}
+	}
+}
+
+func TestLog(t *testing.T) {
+	tr := newTrapper(t, nil)
+	z := &Log{Server: tr.Addr().String(), Host: "gw"}
+	z.Send("gw.sms.sent", "1")
+	z.Set("link", "1")
+	z.Send("unknown", "x") // rejected values are only logged
+	z.Flush()
+	req := tr.request(t)
+	if req.Request != "sender data" || len(req.Data) != 3 || req.Data[0].Host != "gw" ||
+		req.Data[1].Key != "link" || req.Data[1].Value != "1" || time.Since(time.Unix(req.Data[2].Clock, 0)) > time.Minute {
+		t.Errorf("unexpected request %+v", req)
+	}
+	z.Close()
+	z.Send("gw.sms.sent", "2") // discarded after close
+	z.Close()
+	select {
+	case req := <-tr.requests:
+		t.Errorf("request after close: %+v", req)
+	case <-time.After(batchDelay * 2):
+	}
+	var nilLog *Log
+	nilLog.Send("key", "value")
+	nilLog.Close()
+	if key := nilLog.LinkKey("east"); key != "east.sms.link" {
+		t.Errorf("default link key: %s", key)
+	}
+	if key := (&Log{LinkFormat: "gw.%s.bound"}).LinkKey("east"); key != "gw.east.bound" {
+		t.Errorf("link key: %s", key)
+	}
+}
+
+func TestLogRepeat(t *testing.T) {
+	interval := resendInterval
+	resendInterval = time.Millisecond * 100
+	defer func() { resendInterval = interval }()
+	tr := newTrapper(t, nil)
+	z := &Log{Server: tr.Addr().String(), Host: "gw"}
+	defer z.Close()
+	z.Set("link", "1")
+	z.Set("link", "0")
+	z.Flush()
+	if req := tr.request(t); len(req.Data) != 2 {
+		t.Errorf("unexpected request %+v", req)
+	}
+	// the last state is repeated
+	if req := tr.request(t); len(req.Data) != 1 || req.Data[0].Key != "link" || req.Data[0].Value != "0" {
+		t.Errorf("unexpected repeat %+v", req)
+	}
+}